@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/sir-wiggles/chat/api/postgres"
+	"github.com/sir-wiggles/chat/api/structs"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+
+	// maxPasswordLength is as long as bcrypt goes, anything longer would be silently ignored
+	maxPasswordLength = 72
+)
+
+var (
+	usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{2,31}$`)
+
+	bcryptCost = bcrypt.DefaultCost
+
+	// dummyPasswordHash is compared against when the username doesn't exist so that signing in
+	// takes as long whether it does or not
+	dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcryptCost)
+
+	ErrInvalidUsername = errors.New("username must be 3 to 32 letters, digits, dots, dashes or underscores")
+	ErrInvalidPassword = fmt.Errorf("password must be %d to %d characters", minPasswordLength, maxPasswordLength)
+)
+
+// LocalAuthRequest is the body of register and authenticate.  Name is the display name of a new
+// account, it defaults to the username.
+type LocalAuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Name     string `json:"name,omitempty"`
+}
+
+// validate normalizes the username and checks both it and the password are acceptable
+func (req *LocalAuthRequest) validate() error {
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+	req.Name = strings.TrimSpace(req.Name)
+
+	if !usernamePattern.MatchString(req.Username) {
+		return ErrInvalidUsername
+	} else if len(req.Password) < minPasswordLength || len(req.Password) > maxPasswordLength {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// Register creates a local account and signs it in
+func (c Authentication) Register(w http.ResponseWriter, r *http.Request) {
+	var (
+		req = LocalAuthRequest{}
+		ip  = "ip:" + clientIP(r)
+	)
+
+	if !c.allow(w, ip) {
+		return
+	}
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithJSON(w, http.StatusBadRequest, err)
+		return
+	} else if err := req.validate(); err != nil {
+		RespondWithJSON(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" {
+		req.Name = req.Username
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptCost)
+	if err != nil {
+		RespondWithJSON(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	id, err := gocql.RandomUUID()
+	if err != nil {
+		RespondWithJSON(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	profile := &Profile{Provider: "local", ID: req.Username, Name: req.Name}
+	user := structs.NewUser(id.String(), profile.Name, profile.Picture)
+	user.GID = profile.GID()
+
+	// the username is claimed before the user is stored so a registration that fails doesn't
+	// leave a user behind without an account
+	switch err := c.postgres.CreateLocalUser(user, req.Username, hash); err {
+	case nil:
+	case postgres.ErrUsernameTaken:
+		// failed registrations count against the ip so usernames can't be enumerated quickly
+		c.limiter.Fail(ip)
+		RespondWithJSON(w, http.StatusConflict, err)
+		return
+	default:
+		RespondWithJSON(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := c.db.CreateUser(user); err != nil {
+		RespondWithJSON(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.signIn(w, http.StatusCreated, user)
+}
+
+// allow responds with 429 if too many attempts have failed for any of the keys
+func (c Authentication) allow(w http.ResponseWriter, keys ...string) bool {
+	ok, retry := c.limiter.Allow(keys...)
+	if !ok {
+		tooManyAttempts(w, retry)
+	}
+	return ok
+}
+
+func tooManyAttempts(w http.ResponseWriter, retry time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retry.Seconds()))))
+	RespondWithJSON(w, http.StatusTooManyRequests, (&tooManyAttemptsError{retry}).Error())
+}
+
+// clientIP is the ip the request came from without the port.  Requests relayed by a trusted proxy,
+// such as the load balancer in front of the nodes, came from the last address in X-Forwarded-For
+// that isn't a trusted proxy itself.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(host); i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		host = ip
+	}
+	return host
+}
+
+// isTrustedProxy reports whether the ip is one of the trustedProxies
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, proxies := range trustedProxies {
+		if parsed != nil && proxies.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
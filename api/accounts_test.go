@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sir-wiggles/chat/api/cassandra"
+	"github.com/sir-wiggles/chat/api/postgres"
+	"github.com/sir-wiggles/chat/api/structs"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testAccounts returns an Authentication backed by an in memory table of local accounts
+func testAccounts() *Authentication {
+	var (
+		accounts = map[string][]byte{}
+		tokens   = testTokens()
+	)
+
+	tokens.CreateRefreshTokenFn = func(*postgres.RefreshToken) error {
+		return nil
+	}
+	tokens.CreateLocalUserFn = func(user *structs.User, username string, hash []byte) error {
+		if _, ok := accounts[username]; ok {
+			return postgres.ErrUsernameTaken
+		}
+		accounts[username] = hash
+		return nil
+	}
+	tokens.GetLocalUserFn = func(username string) (*structs.User, []byte, error) {
+		hash, ok := accounts[username]
+		if !ok {
+			return nil, nil, postgres.ErrUserNotFound
+		}
+		return testUser, hash, nil
+	}
+
+	var (
+		limiter   = newAttemptLimiter(3, time.Minute)
+		providers = NewProviders("", nil)
+	)
+	providers.Register("local", &localProvider{postgres: tokens, limiter: limiter})
+
+	return &Authentication{
+		postgres:  tokens,
+		providers: providers,
+		limiter:   limiter,
+		db: &cassandra.MockCassandra{
+			GetUserFn: func(gid, name, picture string) (*structs.User, error) {
+				if gid != "local:alice" {
+					return nil, postgres.ErrUserNotFound
+				}
+				return testUser, nil
+			},
+			CreateUserFn: func(user *structs.User) error {
+				if _, ok := accounts[strings.TrimPrefix(user.GID, "local:")]; !ok {
+					return fmt.Errorf("%s was stored before their account", user.GID)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+func postJSON(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	handler(w, r)
+	return w
+}
+
+var ttRegister = []struct {
+	name   string
+	body   string
+	status int
+}{
+	{
+		name:   "registered",
+		body:   `{"username": " Alice ", "password": "correct horse"}`,
+		status: http.StatusCreated,
+	},
+	{
+		name:   "taken",
+		body:   `{"username": "alice", "password": "battery staple"}`,
+		status: http.StatusConflict,
+	},
+	{
+		name:   "short username",
+		body:   `{"username": "al", "password": "correct horse"}`,
+		status: http.StatusBadRequest,
+	},
+	{
+		name:   "invalid username",
+		body:   `{"username": "alice smith", "password": "correct horse"}`,
+		status: http.StatusBadRequest,
+	},
+	{
+		name:   "short password",
+		body:   `{"username": "alice", "password": "hunter2"}`,
+		status: http.StatusBadRequest,
+	},
+	{
+		name:   "long password",
+		body:   `{"username": "alice", "password": "` + strings.Repeat("x", maxPasswordLength+1) + `"}`,
+		status: http.StatusBadRequest,
+	},
+	{
+		name:   "not json",
+		body:   `alice:correct horse`,
+		status: http.StatusBadRequest,
+	},
+}
+
+func TestRegister(t *testing.T) {
+	defer testJWTConfig()()
+	defer func(cost int) { bcryptCost = cost }(bcryptCost)
+	bcryptCost = bcrypt.MinCost
+
+	auth := testAccounts()
+	db := auth.db.(*cassandra.MockCassandra)
+	for _, tt := range ttRegister {
+		t.Run(tt.name, func(t *testing.T) {
+			db.CreateUserInvoked = false
+			w := postJSON(auth.Register, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d got %d %s", tt.status, w.Code, w.Body)
+			}
+			// only a registration that claimed its username stores a user
+			if db.CreateUserInvoked != (tt.status == http.StatusCreated) {
+				t.Fatalf("expected the user to be stored only if the account was created")
+			}
+		})
+	}
+
+	// the registered account can sign in and the password isn't stored as is
+	_, hash, _ := auth.postgres.GetLocalUser("alice")
+	if strings.Contains(string(hash), "correct horse") {
+		t.Fatal("expected the password to be hashed")
+	}
+	if w := postJSON(auth.signInWith("local"), `{"username": "alice", "password": "correct horse"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	defer testJWTConfig()()
+	defer func(cost int) { bcryptCost = cost }(bcryptCost)
+	bcryptCost = bcrypt.MinCost
+
+	auth := testAccounts()
+	postJSON(auth.Register, `{"username": "alice", "password": "correct horse"}`)
+
+	w := postJSON(auth.signInWith("local"), `{"username": "ALICE", "password": "correct horse"}`)
+	authResponse(t, w)
+
+	if w := postJSON(auth.signInWith("local"), `{"username": "bob", "password": "correct horse"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected an unknown user to get 401 got %d", w.Code)
+	}
+
+	// the limiter allows 3 failures per ip, bob's failure above was the first
+	for i := 0; i < 2; i++ {
+		if w := postJSON(auth.signInWith("local"), `{"username": "alice", "password": "wrong"}`); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected a wrong password to get 401 got %d", w.Code)
+		}
+	}
+
+	// even the right password is refused until the window passes
+	w = postJSON(auth.signInWith("local"), `{"username": "alice", "password": "correct horse"}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 got %d", w.Code)
+	} else if w.Header().Get("Retry-After") == "" {
+		t.Fatal("expected a Retry-After header")
+	}
+}
+
+func TestAttemptLimiter(t *testing.T) {
+	l := newAttemptLimiter(2, 50*time.Millisecond)
+
+	l.Fail("ip:1", "user:alice")
+	l.Fail("user:alice")
+	if ok, _ := l.Allow("ip:1"); !ok {
+		t.Fatal("expected ip:1 to be allowed with one failure")
+	}
+	if ok, retry := l.Allow("ip:1", "user:alice"); ok || retry <= 0 || retry > 50*time.Millisecond {
+		t.Fatalf("expected user:alice to be limited got %t %s", ok, retry)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := l.Allow("ip:1", "user:alice"); !ok {
+		t.Fatal("expected the failures to have left the window")
+	}
+
+	l.Fail("user:alice")
+	l.Fail("user:alice")
+	l.Reset("user:alice")
+	if ok, _ := l.Allow("user:alice"); !ok {
+		t.Fatal("expected a reset to forget the failures")
+	}
+
+	// keys that aren't tried again are forgotten once they leave the window
+	for i := 0; i < 100; i++ {
+		l.Fail(fmt.Sprintf("user:guess%d", i))
+	}
+	time.Sleep(60 * time.Millisecond)
+	l.Allow("ip:2")
+	if n := len(l.failures); n != 0 {
+		t.Fatalf("expected every key to have been swept got %d", n)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(proxies []*net.IPNet) { trustedProxies = proxies }(trustedProxies)
+	trustedProxies, _ = parseCIDRs("10.0.0.0/8, 192.168.1.1")
+
+	var tt = []struct {
+		name      string
+		remote    string
+		forwarded []string
+		ip        string
+	}{
+		{"uses the remote address", "203.0.113.7:4000", nil, "203.0.113.7"},
+		{"ignores the header from an untrusted peer", "203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"believes a trusted proxy", "10.1.2.3:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"skips the trusted proxies in the chain", "10.1.2.3:4000", []string{"1.1.1.1, 198.51.100.1", "192.168.1.1"}, "198.51.100.1"},
+		{"stops at an invalid address", "10.1.2.3:4000", []string{"198.51.100.1, nonsense"}, "10.1.2.3"},
+		{"falls back to the proxy without the header", "10.1.2.3:4000", nil, "10.1.2.3"},
+	}
+
+	for _, tt := range tt {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if ip := clientIP(r); ip != tt.ip {
+				t.Fatalf("expected %s got %s", tt.ip, ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Package auth issues and verifies the access tokens shared by the api and api2 services.  A
+// token is a jwt whose subject is the id of the user it was issued to.  Once a request has been
+// authenticated the claims of its token are carried in the request context.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gocql/gocql"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+// SigningMethod is the only method tokens are signed with, tokens signed any other way are
+// rejected
+var SigningMethod = jwt.SigningMethodHS256
+
+var (
+	ErrNoToken       = errors.New("request has no token")
+	ErrSigningMethod = errors.New("token is not signed with " + SigningMethod.Alg())
+	ErrClaims        = errors.New("token is missing the jti, iat, nbf or exp claims")
+	ErrIssuer        = errors.New("token has the wrong issuer")
+	ErrAudience      = errors.New("token has the wrong audience")
+	ErrSubject       = errors.New("token subject is not a user id")
+)
+
+// Claims are the claims of the tokens issued by the api.  The subject is the id of the user the
+// token was issued to.
+type Claims struct {
+	jwt.StandardClaims
+	User structs.User `json:"user"`
+}
+
+// Valid checks the time based claims, that the claims every token is issued with are there and
+// that the subject is the user's id.  The issuer and audience are checked by Config.Parse.
+func (c Claims) Valid() error {
+	if err := c.StandardClaims.Valid(); err != nil {
+		return err
+	}
+
+	if c.Id == "" || c.IssuedAt == 0 || c.NotBefore == 0 || c.ExpiresAt == 0 {
+		return ErrClaims
+	} else if _, err := gocql.ParseUUID(c.Subject); err != nil || c.Subject != c.User.ID {
+		return ErrSubject
+	}
+	return nil
+}
+
+// Config is what tokens are signed with and who they're issued by and for
+type Config struct {
+	Key      []byte
+	Issuer   string
+	Audience string
+
+	// ExpiresIn is how long an issued token is good for
+	ExpiresIn time.Duration
+}
+
+// Issue signs a token for the user.  Each token has a random jti so it can be revoked on its own.
+func (c *Config) Issue(user *structs.User) (string, error) {
+	jti, err := gocql.RandomUUID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := Claims{
+		jwt.StandardClaims{
+			Id:        jti.String(),
+			Subject:   user.ID,
+			Issuer:    c.Issuer,
+			Audience:  c.Audience,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(c.ExpiresIn).Unix(),
+		},
+		*user,
+	}
+
+	return jwt.NewWithClaims(SigningMethod, claims).SignedString(c.Key)
+}
+
+// Parse verifies the token string returning its claims
+func (c *Config) Parse(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != SigningMethod.Alg() {
+			return nil, ErrSigningMethod
+		}
+		return c.Key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !claims.VerifyIssuer(c.Issuer, true) {
+		return nil, ErrIssuer
+	} else if !claims.VerifyAudience(c.Audience, true) {
+		return nil, ErrAudience
+	}
+	return claims, nil
+}
+
+// FromRequest returns the token of the request.  Websockets can't set headers so the token query
+// param is looked at first, then the bearer token of the Authorization header.
+func FromRequest(r *http.Request) (string, error) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token, nil
+	}
+
+	header := r.Header.Get("Authorization")
+	if len(header) <= len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return "", ErrNoToken
+	}
+	return header[len("Bearer "):], nil
+}
+
+type ContextKey string
+
+const (
+	ContextName    ContextKey = "name"
+	ContextPicture ContextKey = "picture"
+	ContextUID     ContextKey = "uid"
+	ContextClaims  ContextKey = "claims"
+)
+
+// NewContext returns a copy of the context carrying the claims and the user they were issued to
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	ctx = context.WithValue(ctx, ContextName, claims.User.Name)
+	ctx = context.WithValue(ctx, ContextPicture, claims.User.Avatar)
+	ctx = context.WithValue(ctx, ContextUID, claims.Subject)
+	return context.WithValue(ctx, ContextClaims, claims)
+}
+
+// FromContext returns the claims the request carrying the context was authenticated with
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(ContextClaims).(*Claims)
+	return claims, ok
+}
+
+// UserID returns the id of the authenticated user, it's empty if the request wasn't authenticated
+func UserID(ctx context.Context) string {
+	uid, _ := ctx.Value(ContextUID).(string)
+	return uid
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+var (
+	testUser   = structs.NewUser("2b5c9d4e-7a61-4f0e-9f0a-2a3b8c1d0e4f", "alice", "alice.png")
+	testConfig = &Config{Key: []byte("secret"), Issuer: "chat.test", Audience: "chat", ExpiresIn: time.Hour}
+)
+
+func TestIssueAndParse(t *testing.T) {
+	token, err := testConfig.Issue(testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := testConfig.Parse(token)
+	if err != nil {
+		t.Fatal(err)
+	} else if claims.Subject != testUser.ID || claims.User != *testUser || claims.Id == "" {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+
+	var (
+		otherIssuer   = *testConfig
+		otherAudience = *testConfig
+		otherKey      = *testConfig
+	)
+	otherIssuer.Issuer = "chatter"
+	otherAudience.Audience = "someone-else"
+	otherKey.Key = []byte("guessed")
+
+	if _, err := otherIssuer.Parse(token); err != ErrIssuer {
+		t.Fatalf("expected %s got %v", ErrIssuer, err)
+	}
+	if _, err := otherAudience.Parse(token); err != ErrAudience {
+		t.Fatalf("expected %s got %v", ErrAudience, err)
+	}
+	if _, err := otherKey.Parse(token); err == nil {
+		t.Fatal("expected a token signed with another key to be rejected")
+	}
+}
+
+var ttFromRequest = []struct {
+	name   string
+	target string
+	header string
+	token  string
+	err    error
+}{
+	{
+		name:   "query",
+		target: "/ws?token=abc",
+		token:  "abc",
+	},
+	{
+		name:   "bearer",
+		target: "/",
+		header: "Bearer abc",
+		token:  "abc",
+	},
+	{
+		name:   "query before header",
+		target: "/ws?token=abc",
+		header: "Bearer def",
+		token:  "abc",
+	},
+	{
+		name:   "missing",
+		target: "/",
+		err:    ErrNoToken,
+	},
+	{
+		name:   "empty bearer",
+		target: "/",
+		header: "Bearer ",
+		err:    ErrNoToken,
+	},
+	{
+		name:   "basic",
+		target: "/",
+		header: "Basic YWxpY2U6aHVudGVyMg==",
+		err:    ErrNoToken,
+	},
+}
+
+func TestFromRequest(t *testing.T) {
+	for _, tt := range ttFromRequest {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+
+			token, err := FromRequest(r)
+			if err != tt.err || token != tt.token {
+				t.Fatalf("expected %q %v got %q %v", tt.token, tt.err, token, err)
+			}
+		})
+	}
+}
+
+func TestContext(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if UserID(r.Context()) != "" {
+		t.Fatal("expected no user id before authenticating")
+	}
+
+	claims := &Claims{User: *testUser}
+	claims.Subject = testUser.ID
+
+	ctx := NewContext(r.Context(), claims)
+	if UserID(ctx) != testUser.ID || ctx.Value(ContextName) != testUser.Name {
+		t.Fatalf("expected %s in the context", testUser.ID)
+	}
+	if got, ok := FromContext(ctx); !ok || got != claims {
+		t.Fatal("expected the claims in the context")
+	}
+}
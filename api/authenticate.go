@@ -1,49 +1,53 @@
 package main
 
 import (
-	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
-	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+	"github.com/sir-wiggles/chat/api/auth"
 	"github.com/sir-wiggles/chat/api/cassandra"
 	"github.com/sir-wiggles/chat/api/postgres"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
+	"github.com/sir-wiggles/chat/api/structs"
 )
 
 type Authentication struct {
-	db      cassandra.Controller
-	handler http.HandlerFunc
-	google  *oauth2.Config
+	db        cassandra.Controller
+	postgres  postgres.Controller
+	providers *Providers
+	limiter   *attemptLimiter
+	handler   http.HandlerFunc
 }
 
-func NewAuthenticationController(db cassandra.Controller) *Authentication {
-	googleConfig := &oauth2.Config{
-		ClientID:     googleClientID,
-		ClientSecret: googleClientSecret,
-		RedirectURL:  "postmessage",
-		Scopes: []string{
-			"profile",
-			"email",
-			"https://www.googleapis.com/auth/userinfo.profile",
-		},
-		Endpoint: google.Endpoint,
-	}
+// NewAuthenticationController returns the controller for signing in with the providers.  The
+// local provider is registered with the providers as local accounts are kept in postgres.
+func NewAuthenticationController(db cassandra.Controller, pg postgres.Controller, providers *Providers) *Authentication {
+	limiter := newAttemptLimiter(maxFailedLogins, failedLoginWindow)
+	providers.Register("local", &localProvider{postgres: pg, limiter: limiter})
 
 	return &Authentication{
-		db:     db,
-		google: googleConfig,
+		db:        db,
+		postgres:  pg,
+		providers: providers,
+		limiter:   limiter,
 	}
 }
 
 func (c Authentication) SetHandler(handler http.HandlerFunc) *Authentication {
 	return &Authentication{
-		db:      c.db,
-		google:  c.google,
-		handler: handler,
+		db:        c.db,
+		postgres:  c.postgres,
+		providers: c.providers,
+		limiter:   c.limiter,
+		handler:   handler,
 	}
 }
 
@@ -51,118 +55,224 @@ func (c Authentication) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c.handler(w, r)
 }
 
-type customJWTClaims struct {
-	jwt.StandardClaims
-	UserModel postgres.UserModel `json:"user"`
-}
+var ErrTokenRevoked = errors.New("token has been revoked")
 
-type GoogleAuthRequest struct {
-	Code        string `json:"code"`
-	RedirectURI string `json:"redirectURI"`
+// jwtConfig is the config tokens are issued and verified with
+func jwtConfig() *auth.Config {
+	return &auth.Config{
+		Key:       []byte(secretSigningKey),
+		Issuer:    jwtIssuer,
+		Audience:  jwtAudience,
+		ExpiresIn: time.Duration(jwtExpiresAt) * time.Minute,
+	}
 }
 
 type AuthResponse struct {
-	Token     string              `json:"token"`
-	UserModel *postgres.UserModel `json:"user"`
+	Token        string        `json:"token"`
+	RefreshToken string        `json:"refreshToken"`
+	User         *structs.User `json:"user"`
 }
 
-func (c Authentication) Google(w http.ResponseWriter, r *http.Request) {
+// RefreshRequest is the body of both refresh and logout
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
 
-	// Exchange code for token
-	var gar = GoogleAuthRequest{}
+// newRefreshToken returns a random refresh token for the user along with how it's stored.  The
+// token starts a new family unless it's going to replace a rotated token.
+func newRefreshToken(userID string) (string, *postgres.RefreshToken, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
 
-	defer r.Body.Close()
-	if err := json.NewDecoder(r.Body).Decode(&gar); err != nil {
+	id, err := gocql.RandomUUID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	return token, &postgres.RefreshToken{
+		ID:        id.String(),
+		Family:    id.String(),
+		UserID:    userID,
+		Hash:      hashRefreshToken(token),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	}, nil
+}
+
+func hashRefreshToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// signIn responds with a new access token and a refresh token that starts a new family
+func (c Authentication) signIn(w http.ResponseWriter, status int, user *structs.User) {
+	accessToken, err := jwtConfig().Issue(user)
+	if err != nil {
 		RespondWithJSON(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	token, err := c.google.Exchange(oauth2.NoContext, gar.Code)
+	refreshToken, stored, err := newRefreshToken(user.ID)
 	if err != nil {
-		RespondWithJSON(w, http.StatusUnauthorized, err)
+		RespondWithJSON(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := c.postgres.CreateRefreshToken(stored); err != nil {
+		RespondWithJSON(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	RespondWithJSON(w, status, AuthResponse{Token: accessToken, RefreshToken: refreshToken, User: user})
+}
+
+// Refresh rotates a refresh token, responding with a new access token and the refresh token to use
+// next time.  Each refresh token can only be used once.
+func (c Authentication) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req = RefreshRequest{}
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		RespondWithJSON(w, http.StatusBadRequest, "invalid refresh token")
 		return
 	}
 
-	resp, err := http.Get(fmt.Sprintf("%s?access_token=%s", googleUserInfoURL, token.AccessToken))
+	refreshToken, next, err := newRefreshToken("")
 	if err != nil {
 		RespondWithJSON(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	// Register the user in the system
-	var gui = postgres.UserModel{}
+	current, err := c.postgres.RotateRefreshToken(hashRefreshToken(req.RefreshToken), next)
+	switch err {
+	case nil:
+	case postgres.ErrRefreshTokenInvalid, postgres.ErrRefreshTokenExpired, postgres.ErrRefreshTokenReused:
+		RespondWithJSON(w, http.StatusUnauthorized, err)
+		return
+	default:
+		RespondWithJSON(w, http.StatusInternalServerError, err)
+		return
+	}
 
-	defer resp.Body.Close()
-	if err := json.NewDecoder(resp.Body).Decode(&gui); err != nil {
+	user, err := c.db.GetUserByID(current.UserID)
+	if err != nil {
 		RespondWithJSON(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	user, err := c.db.GetUser(gui.GID, gui.Name, gui.Picture)
+	accessToken, err := jwtConfig().Issue(user)
 	if err != nil {
 		RespondWithJSON(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	// Create a token for auth
-	claims := customJWTClaims{
-		jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(time.Hour * 24).Unix(),
-			Issuer:    "chatter",
-		},
-		gui,
+	RespondWithJSON(w, http.StatusOK, AuthResponse{Token: accessToken, RefreshToken: refreshToken, User: user})
+}
+
+// Logout revokes the access token the request was made with along with the family of the
+// refresh token in the body, if one is given
+func (c Authentication) Logout(w http.ResponseWriter, r *http.Request) {
+	var (
+		claims, _ = auth.FromContext(r.Context())
+		req       = RefreshRequest{}
+	)
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		RespondWithJSON(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.RefreshToken != "" {
+		if err := c.postgres.RevokeRefreshToken(hashRefreshToken(req.RefreshToken), claims.Subject); err != nil {
+			RespondWithJSON(w, http.StatusInternalServerError, err)
+			return
+		}
 	}
 
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	jwtTokenString, err := jwtToken.SignedString([]byte(secretSigningKey))
-	if err != nil {
+	if err := c.postgres.RevokeToken(claims.Id, time.Unix(claims.ExpiresAt, 0)); err != nil {
 		RespondWithJSON(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	authResponse := AuthResponse{Token: jwtTokenString}
-	RespondWithJSON(w, http.StatusOK, authResponse)
+	RespondWithJSON(w, http.StatusOK, "logged out")
+}
 
+// SignIn signs the user in with the provider named in the route
+func (c Authentication) SignIn(w http.ResponseWriter, r *http.Request) {
+	c.signInWith(mux.Vars(r)["provider"])(w, r)
 }
 
-type ContextKey string
+// signInWith returns a handler that signs the user in with the named provider.  The user's
+// profile is mapped into a user of our own the first time they sign in.  Failed attempts are
+// limited per ip across every provider.
+func (c Authentication) signInWith(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := c.providers.Get(name)
+		if !ok {
+			RespondWithJSON(w, http.StatusNotFound, fmt.Sprintf("no identity provider named %q", name))
+			return
+		}
+
+		ip := "ip:" + clientIP(r)
+		if !c.allow(w, ip) {
+			return
+		}
 
-const (
-	ContextName    ContextKey = "name"
-	ContextPicture ContextKey = "picture"
-	ContextGID     ContextKey = "gid"
-)
+		profile, err := provider.Authenticate(r)
+		if err != nil {
+			var (
+				credentials *credentialError
+				attempts    *tooManyAttemptsError
+			)
+			switch {
+			case errors.As(err, &attempts):
+				tooManyAttempts(w, attempts.retry)
+			case errors.As(err, &credentials):
+				c.limiter.Fail(ip)
+				RespondWithJSON(w, http.StatusUnauthorized, err)
+			default:
+				RespondWithJSON(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		user, err := c.db.GetUser(profile.GID(), profile.Name, profile.Picture)
+		if err != nil {
+			RespondWithJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		user.Email = profile.Email
+
+		c.signIn(w, http.StatusOK, user)
+	}
+}
 
 func (c *Authentication) Middleware(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		tokenString := r.URL.Query().Get("token")
-		if len(tokenString) == 0 {
-			tokenString = r.Header.Get("Authorization")
-			if len(tokenString) <= 7 {
-				RespondWithJSON(w, http.StatusBadRequest, "invalid token")
-				return
-			}
-			tokenString = tokenString[7:]
+		tokenString, err := auth.FromRequest(r)
+		if err != nil {
+			RespondWithJSON(w, http.StatusBadRequest, "invalid token")
+			return
 		}
 
-		token, err := jwt.ParseWithClaims(tokenString, &customJWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(secretSigningKey), nil
-		})
+		claims, err := jwtConfig().Parse(tokenString)
 		if err != nil {
-			RespondWithJSON(w, http.StatusForbidden, err)
+			RespondWithJSON(w, http.StatusForbidden, err.Error())
 			return
 		}
 
-		if _, ok := token.Claims.(*customJWTClaims); !ok && !token.Valid {
-			RespondWithJSON(w, http.StatusForbidden, "invalid claims")
+		revoked, err := c.postgres.IsTokenRevoked(claims.Id)
+		if err != nil {
+			RespondWithJSON(w, http.StatusInternalServerError, err)
+			return
+		} else if revoked {
+			RespondWithJSON(w, http.StatusForbidden, ErrTokenRevoked.Error())
 			return
 		}
 
-		claims := token.Claims.(*customJWTClaims)
-		fmt.Println("Claims", claims.UserModel)
-		r = r.WithContext(context.WithValue(r.Context(), ContextName, claims.UserModel.Name))
-		r = r.WithContext(context.WithValue(r.Context(), ContextPicture, claims.UserModel.Picture))
-		r = r.WithContext(context.WithValue(r.Context(), ContextGID, claims.UserModel.GID))
-
-		handler.ServeHTTP(w, r)
+		handler.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), claims)))
 	})
 }
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/sir-wiggles/chat/api/auth"
+	"github.com/sir-wiggles/chat/api/cassandra"
+	"github.com/sir-wiggles/chat/api/postgres"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+var (
+	testUser   = structs.NewUser("2b5c9d4e-7a61-4f0e-9f0a-2a3b8c1d0e4f", "alice", "")
+	revokedJTI = "5d7e1a0c-3f5b-4b8e-8a52-0c6f3d2e9b71"
+)
+
+// testJWTConfig sets the jwt config for a test returning a func that restores it
+func testJWTConfig() func() {
+	key, iss, aud, exp := secretSigningKey, jwtIssuer, jwtAudience, jwtExpiresAt
+	secretSigningKey, jwtIssuer, jwtAudience, jwtExpiresAt = "secret", "chat.test", "chat", 60
+
+	return func() {
+		secretSigningKey, jwtIssuer, jwtAudience, jwtExpiresAt = key, iss, aud, exp
+	}
+}
+
+// testTokens is a token store with nothing revoked but revokedJTI
+func testTokens() *postgres.MockPostgres {
+	return &postgres.MockPostgres{
+		IsTokenRevokedFn: func(jti string) (bool, error) {
+			return jti == revokedJTI, nil
+		},
+	}
+}
+
+// testClaims are valid claims for testUser, tweak is applied before they're returned
+func testClaims(tweak func(*auth.Claims)) *auth.Claims {
+	now := time.Now()
+	claims := &auth.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        "0e6b8f3a-9c2d-4e71-b5a4-7f1d2c3b4a59",
+			Subject:   testUser.ID,
+			Issuer:    jwtIssuer,
+			Audience:  jwtAudience,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(time.Hour).Unix(),
+		},
+		User: *testUser,
+	}
+	if tweak != nil {
+		tweak(claims)
+	}
+	return claims
+}
+
+var ttMiddleware = []struct {
+	name   string
+	method jwt.SigningMethod
+	key    interface{}
+	tweak  func(*auth.Claims)
+	status int
+}{
+	{
+		name:   "valid",
+		status: http.StatusOK,
+	},
+	{
+		name:   "expired",
+		tweak:  func(c *auth.Claims) { c.ExpiresAt = time.Now().Add(-time.Minute).Unix() },
+		status: http.StatusForbidden,
+	},
+	{
+		name:   "not yet valid",
+		tweak:  func(c *auth.Claims) { c.NotBefore = time.Now().Add(time.Hour).Unix() },
+		status: http.StatusForbidden,
+	},
+	{
+		name:   "missing iat",
+		tweak:  func(c *auth.Claims) { c.IssuedAt = 0 },
+		status: http.StatusForbidden,
+	},
+	{
+		name:   "missing jti",
+		tweak:  func(c *auth.Claims) { c.Id = "" },
+		status: http.StatusForbidden,
+	},
+	{
+		name:   "revoked",
+		tweak:  func(c *auth.Claims) { c.Id = revokedJTI },
+		status: http.StatusForbidden,
+	},
+	{
+		name:   "wrong issuer",
+		tweak:  func(c *auth.Claims) { c.Issuer = "chatter" },
+		status: http.StatusForbidden,
+	},
+	{
+		name:   "wrong audience",
+		tweak:  func(c *auth.Claims) { c.Audience = "someone-else" },
+		status: http.StatusForbidden,
+	},
+	{
+		name:   "google id as subject",
+		tweak:  func(c *auth.Claims) { c.Subject = "104518374627384920101" },
+		status: http.StatusForbidden,
+	},
+	{
+		name:   "wrong key",
+		key:    []byte("guessed"),
+		status: http.StatusForbidden,
+	},
+	{
+		name:   "other hmac algorithm",
+		method: jwt.SigningMethodHS512,
+		status: http.StatusForbidden,
+	},
+	{
+		name:   "unsigned",
+		method: jwt.SigningMethodNone,
+		key:    jwt.UnsafeAllowNoneSignatureType,
+		status: http.StatusForbidden,
+	},
+}
+
+func TestMiddleware(t *testing.T) {
+	defer testJWTConfig()()
+
+	var (
+		c       = &Authentication{postgres: testTokens()}
+		uid     string
+		handler = c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			uid = auth.UserID(r.Context())
+		}))
+	)
+
+	// a token from issueToken is accepted
+	token, err := jwtConfig().Issue(testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/api/health?token="+token, nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if uid != testUser.ID {
+		t.Fatalf("expected the user id %s in the context got %q", testUser.ID, uid)
+	}
+
+	for _, tt := range ttMiddleware {
+		t.Run(tt.name, func(t *testing.T) {
+			uid = ""
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/api/health", nil)
+			var (
+				method = tt.method
+				key    = tt.key
+			)
+			if method == nil {
+				method = auth.SigningMethod
+			}
+			if key == nil {
+				key = []byte(secretSigningKey)
+			}
+
+			token, err := jwt.NewWithClaims(method, testClaims(tt.tweak)).SignedString(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Authorization", "Bearer "+token)
+
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d got %d %s", tt.status, w.Code, w.Body)
+			}
+			if tt.status == http.StatusOK && uid != testUser.ID {
+				t.Fatalf("expected the user id %s in the context got %q", testUser.ID, uid)
+			}
+		})
+	}
+}
+
+// authResponse decodes the response of an auth endpoint
+func authResponse(t *testing.T, w *httptest.ResponseRecorder) *AuthResponse {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d %s", w.Code, w.Body)
+	}
+
+	resp := &AuthResponse{}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Token == "" || resp.RefreshToken == "" || resp.User == nil || resp.User.ID != testUser.ID {
+		t.Fatalf("incomplete auth response %+v", resp)
+	}
+	return resp
+}
+
+var ttRefresh = []struct {
+	name   string
+	body   string
+	err    error
+	status int
+}{
+	{
+		name:   "rotated",
+		body:   `{"refreshToken": "current"}`,
+		status: http.StatusOK,
+	},
+	{
+		name:   "missing token",
+		body:   `{}`,
+		status: http.StatusBadRequest,
+	},
+	{
+		name:   "unknown token",
+		body:   `{"refreshToken": "made-up"}`,
+		err:    postgres.ErrRefreshTokenInvalid,
+		status: http.StatusUnauthorized,
+	},
+	{
+		name:   "expired token",
+		body:   `{"refreshToken": "current"}`,
+		err:    postgres.ErrRefreshTokenExpired,
+		status: http.StatusUnauthorized,
+	},
+	{
+		name:   "reused token",
+		body:   `{"refreshToken": "current"}`,
+		err:    postgres.ErrRefreshTokenReused,
+		status: http.StatusUnauthorized,
+	},
+}
+
+func TestRefresh(t *testing.T) {
+	defer testJWTConfig()()
+
+	for _, tt := range ttRefresh {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				next   *postgres.RefreshToken
+				tokens = testTokens()
+				auth   = &Authentication{
+					postgres: tokens,
+					db: &cassandra.MockCassandra{
+						GetUserByIDFn: func(uid string) (*structs.User, error) {
+							return testUser, nil
+						},
+					},
+				}
+			)
+			tokens.RotateRefreshTokenFn = func(hash []byte, n *postgres.RefreshToken) (*postgres.RefreshToken, error) {
+				if !bytes.Equal(hash, hashRefreshToken("current")) {
+					return nil, postgres.ErrRefreshTokenInvalid
+				} else if tt.err != nil {
+					return nil, tt.err
+				}
+				next = n
+				return &postgres.RefreshToken{UserID: testUser.ID}, nil
+			}
+
+			w := httptest.NewRecorder()
+			auth.Refresh(w, httptest.NewRequest("POST", "/auth/refresh", strings.NewReader(tt.body)))
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d got %d %s", tt.status, w.Code, w.Body)
+			} else if w.Code != http.StatusOK {
+				return
+			}
+
+			// the new refresh token is the one that was stored in place of the current one
+			resp := authResponse(t, w)
+			if next == nil || !bytes.Equal(next.Hash, hashRefreshToken(resp.RefreshToken)) {
+				t.Fatal("expected the returned refresh token to be the one stored")
+			}
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	defer testJWTConfig()()
+
+	var (
+		revoked       = map[string]bool{}
+		revokedFamily []byte
+		tokens        = &postgres.MockPostgres{
+			CreateRefreshTokenFn: func(*postgres.RefreshToken) error {
+				return nil
+			},
+			RevokeRefreshTokenFn: func(hash []byte, uid string) error {
+				if uid == testUser.ID {
+					revokedFamily = hash
+				}
+				return nil
+			},
+			RevokeTokenFn: func(jti string, expiresAt time.Time) error {
+				revoked[jti] = true
+				return nil
+			},
+			IsTokenRevokedFn: func(jti string) (bool, error) {
+				return revoked[jti], nil
+			},
+		}
+		auth    = &Authentication{postgres: tokens}
+		logout  = auth.Middleware(auth.SetHandler(auth.Logout))
+		request = func(handler http.Handler, token, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/auth/logout", strings.NewReader(body))
+			r.Header.Set("Authorization", "Bearer "+token)
+			handler.ServeHTTP(w, r)
+			return w
+		}
+	)
+
+	w := httptest.NewRecorder()
+	auth.signIn(w, http.StatusOK, testUser)
+	resp := authResponse(t, w)
+
+	body := fmt.Sprintf(`{"refreshToken": %q}`, resp.RefreshToken)
+	if w := request(logout, resp.Token, body); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d %s", w.Code, w.Body)
+	}
+	if !bytes.Equal(revokedFamily, hashRefreshToken(resp.RefreshToken)) {
+		t.Fatal("expected the refresh token to be revoked")
+	}
+
+	// the access token can't be used once logged out even though it hasn't expired
+	if w := request(logout, resp.Token, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403 got %d %s", w.Code, w.Body)
+	}
+}
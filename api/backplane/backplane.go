@@ -0,0 +1,59 @@
+// Package backplane carries broadcasts between the api nodes so that a message posted on one node
+// reaches the clients connected to every other node.
+//
+// Each node subscribes to the channels its clients are in and publishes what it broadcasts.  A
+// published message is delivered to every subscription of the channel, including those of the node
+// that published it, so a node delivers to its own clients only when the message comes back off
+// the backplane.
+package backplane
+
+import (
+	"errors"
+	"net/url"
+)
+
+// ErrClosed is returned when using a backplane that has been closed
+var ErrClosed = errors.New("backplane: closed")
+
+// Handler is called with the data of every message published to a subscribed channel.  Handlers
+// of a subscription are called one at a time in the order the messages were published.
+type Handler func(channel string, data []byte)
+
+// Backplane is a publish/subscribe bus keyed by channel
+type Backplane interface {
+	// Publish sends the data to every subscription of the channel
+	Publish(channel string, data []byte) error
+
+	// Subscribe calls the handler with every message published to the channel until the
+	// subscription is cancelled
+	Subscribe(channel string, handler Handler) (Subscription, error)
+
+	// Close cancels every subscription and releases the backplane's connections
+	Close() error
+}
+
+// Subscription is a handler's interest in a channel
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// Open returns the backplane for the url.  An empty url or memory:// gives an in-memory backplane
+// that only reaches a single node, redis://host:port gives one shared through a redis server.
+func Open(rawurl string) (Backplane, error) {
+	if rawurl == "" {
+		return NewMemory(), nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "memory":
+		return NewMemory(), nil
+	case "redis", "rediss":
+		return NewRedis(rawurl)
+	}
+	return nil, errors.New("backplane: unsupported scheme " + u.Scheme)
+}
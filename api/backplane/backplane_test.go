@@ -0,0 +1,103 @@
+package backplane
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// received collects what a handler was called with
+type received chan string
+
+func (r received) handler(channel string, data []byte) {
+	r <- fmt.Sprintf("%s:%s", channel, data)
+}
+
+func (r received) expect(t *testing.T, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-r:
+			if got != w {
+				t.Fatalf("expected %q got %q", w, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %q got nothing", w)
+		}
+	}
+
+	select {
+	case got := <-r:
+		t.Fatalf("expected nothing more got %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// testFanOut publishes through the first node and checks that every node subscribed to the
+// channel receives the messages in order.  ready is called once the subscriptions are made and
+// should wait until they're in effect.
+func testFanOut(t *testing.T, nodes []Backplane, ready func(channel string, n int)) {
+	var (
+		general = make([]received, len(nodes))
+		random  = make(received, 8)
+		subs    = make([]Subscription, len(nodes))
+		err     error
+	)
+
+	for i, node := range nodes {
+		general[i] = make(received, 8)
+		if subs[i], err = node.Subscribe("general", general[i].handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := nodes[len(nodes)-1].Subscribe("random", random.handler); err != nil {
+		t.Fatal(err)
+	}
+	ready("general", len(nodes))
+	ready("random", 1)
+
+	for _, text := range []string{"one", "two", "three"} {
+		if err := nodes[0].Publish("general", []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range general {
+		r.expect(t, "general:one", "general:two", "general:three")
+	}
+	random.expect(t)
+
+	// the last node leaving the channel stops hearing it, everyone else still does
+	last := len(nodes) - 1
+	if err := subs[last].Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := subs[last].Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	ready("general", last)
+
+	if err := nodes[last].Publish("general", []byte("four")); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range general[:last] {
+		r.expect(t, "general:four")
+	}
+	general[last].expect(t)
+}
+
+func TestOpen(t *testing.T) {
+	for _, url := range []string{"", "memory://"} {
+		b, err := Open(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := b.(*Memory); !ok {
+			t.Fatalf("expected %q to open a memory backplane got %T", url, b)
+		}
+		b.Close()
+	}
+
+	if _, err := Open("carrier-pigeon://coop"); err == nil {
+		t.Fatal("expected an unsupported scheme to fail")
+	}
+}
@@ -0,0 +1,123 @@
+package backplane
+
+import (
+	"sync"
+)
+
+// Memory is a backplane that lives in a single process.  It's what a single node runs on and lets
+// tests stand several nodes up on one bus.
+//
+// Published messages are queued and handed to the handlers from a separate goroutine so a handler
+// may block without blocking the publisher.
+type Memory struct {
+	mu            sync.Mutex
+	ready         *sync.Cond
+	queue         []*message
+	subscriptions map[string]map[*memorySubscription]bool
+	closed        bool
+}
+
+type message struct {
+	channel string
+	data    []byte
+}
+
+type memorySubscription struct {
+	memory  *Memory
+	channel string
+	handler Handler
+}
+
+// NewMemory returns an empty in-memory backplane and starts its delivery loop
+func NewMemory() *Memory {
+	m := &Memory{
+		subscriptions: make(map[string]map[*memorySubscription]bool),
+	}
+	m.ready = sync.NewCond(&m.mu)
+
+	go m.start()
+	return m
+}
+
+// Publish queues the data for every subscription of the channel
+func (m *Memory) Publish(channel string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	m.queue = append(m.queue, &message{channel: channel, data: data})
+	m.ready.Signal()
+	return nil
+}
+
+// Subscribe calls the handler with every message published to the channel from now on
+func (m *Memory) Subscribe(channel string, handler Handler) (Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	s := &memorySubscription{memory: m, channel: channel, handler: handler}
+	if m.subscriptions[channel] == nil {
+		m.subscriptions[channel] = make(map[*memorySubscription]bool)
+	}
+	m.subscriptions[channel][s] = true
+	return s, nil
+}
+
+// Close cancels every subscription, messages still queued are discarded
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	m.queue = nil
+	m.subscriptions = make(map[string]map[*memorySubscription]bool)
+	m.ready.Signal()
+	return nil
+}
+
+func (m *Memory) start() {
+	for {
+		m.mu.Lock()
+		for len(m.queue) == 0 && !m.closed {
+			m.ready.Wait()
+		}
+		if m.closed {
+			m.mu.Unlock()
+			return
+		}
+
+		msg := m.queue[0]
+		m.queue[0] = nil
+		m.queue = m.queue[1:]
+
+		handlers := make([]Handler, 0, len(m.subscriptions[msg.channel]))
+		for s := range m.subscriptions[msg.channel] {
+			handlers = append(handlers, s.handler)
+		}
+		m.mu.Unlock()
+
+		for _, handler := range handlers {
+			handler(msg.channel, msg.data)
+		}
+	}
+}
+
+// Unsubscribe stops the handler being called, unsubscribing more than once is a no-op
+func (s *memorySubscription) Unsubscribe() error {
+	m := s.memory
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.subscriptions[s.channel], s)
+	if len(m.subscriptions[s.channel]) == 0 {
+		delete(m.subscriptions, s.channel)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package backplane
+
+import (
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	// nodes sharing a memory backplane each subscribe with their own handler
+	testFanOut(t, []Backplane{m, m, m}, func(string, int) {})
+}
+
+func TestMemoryBlockingHandler(t *testing.T) {
+	var (
+		m       = NewMemory()
+		r       = make(received)
+		release = make(chan bool)
+	)
+	defer m.Close()
+
+	m.Subscribe("general", func(channel string, data []byte) {
+		<-release
+		r.handler(channel, data)
+	})
+
+	// publishing never waits on a handler
+	for _, text := range []string{"one", "two", "three"} {
+		if err := m.Publish("general", []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(release)
+	r.expect(t, "general:one", "general:two", "general:three")
+
+	m.Close()
+	if err := m.Publish("general", nil); err != ErrClosed {
+		t.Fatalf("expected ErrClosed got %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package backplane
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisReconnectWait is how long to wait before redialing after the subscription connection drops
+var redisReconnectWait = time.Second
+
+// Redis is a backplane shared through the publish/subscribe commands of a redis server.  Every
+// node subscribes on a single connection and publishes through a pool.
+//
+// When the subscription connection drops it's redialed and every channel resubscribed.  Messages
+// published in the meantime are lost, clients catch up on them by reconnecting with last_seen.
+type Redis struct {
+	url  string
+	pool *redis.Pool
+
+	mu            sync.Mutex
+	conn          *redis.PubSubConn
+	subscriptions map[string]map[*redisSubscription]bool
+	closed        bool
+}
+
+type redisSubscription struct {
+	redis   *Redis
+	channel string
+	handler Handler
+}
+
+// NewRedis connects to the redis server at the url and starts receiving messages
+func NewRedis(url string) (*Redis, error) {
+	r := &Redis{
+		url: url,
+		pool: &redis.Pool{
+			MaxIdle:     8,
+			IdleTimeout: 5 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.DialURL(url)
+			},
+		},
+		subscriptions: make(map[string]map[*redisSubscription]bool),
+	}
+
+	conn, err := redis.DialURL(url)
+	if err != nil {
+		return nil, err
+	}
+	r.conn = &redis.PubSubConn{Conn: conn}
+
+	go r.start(r.conn)
+	return r, nil
+}
+
+// Publish sends the data to every node subscribed to the channel
+func (r *Redis) Publish(channel string, data []byte) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PUBLISH", channel, data)
+	return err
+}
+
+// Subscribe calls the handler with every message published to the channel.  The node only
+// subscribes to the channel on the server for its first handler.
+func (r *Redis) Subscribe(channel string, handler Handler) (Subscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, ErrClosed
+	}
+
+	s := &redisSubscription{redis: r, channel: channel, handler: handler}
+	if r.subscriptions[channel] == nil {
+		r.subscriptions[channel] = make(map[*redisSubscription]bool)
+		if r.conn != nil {
+			if err := r.conn.Subscribe(channel); err != nil {
+				delete(r.subscriptions, channel)
+				return nil, err
+			}
+		}
+	}
+	r.subscriptions[channel][s] = true
+	return s, nil
+}
+
+// Close cancels every subscription and closes the connections to the server
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.subscriptions = make(map[string]map[*redisSubscription]bool)
+
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+	return r.pool.Close()
+}
+
+// start receives on the subscription connection, redialing it whenever it drops
+func (r *Redis) start(conn *redis.PubSubConn) {
+	for {
+		err := r.receive(conn)
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return
+		}
+		r.conn = nil
+		r.mu.Unlock()
+
+		log.Printf("backplane: lost redis subscription connection: %s", err)
+		conn.Close()
+
+		for conn = r.redial(); conn == nil; conn = r.redial() {
+			if r.isClosed() {
+				return
+			}
+			time.Sleep(redisReconnectWait)
+		}
+		if r.isClosed() {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// receive hands messages to the handlers of their channel until the connection fails
+func (r *Redis) receive(conn *redis.PubSubConn) error {
+	for {
+		switch v := conn.Receive().(type) {
+		case redis.Message:
+			for _, handler := range r.handlers(v.Channel) {
+				handler(v.Channel, v.Data)
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+// redial connects a new subscription connection and resubscribes every channel.  Nil is returned
+// if the server can't be reached.
+func (r *Redis) redial() *redis.PubSubConn {
+	c, err := redis.DialURL(r.url)
+	if err != nil {
+		log.Printf("backplane: redialing redis: %s", err)
+		return nil
+	}
+	conn := &redis.PubSubConn{Conn: c}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return conn
+	}
+
+	channels := make([]interface{}, 0, len(r.subscriptions))
+	for channel := range r.subscriptions {
+		channels = append(channels, channel)
+	}
+	if len(channels) > 0 {
+		if err := conn.Subscribe(channels...); err != nil {
+			log.Printf("backplane: resubscribing to redis: %s", err)
+			conn.Close()
+			return nil
+		}
+	}
+
+	r.conn = conn
+	return conn
+}
+
+func (r *Redis) handlers(channel string) []Handler {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	handlers := make([]Handler, 0, len(r.subscriptions[channel]))
+	for s := range r.subscriptions[channel] {
+		handlers = append(handlers, s.handler)
+	}
+	return handlers
+}
+
+func (r *Redis) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// Unsubscribe stops the handler being called.  The node unsubscribes from the channel on the
+// server once its last handler is gone.  Unsubscribing more than once is a no-op.
+func (s *redisSubscription) Unsubscribe() error {
+	r := s.redis
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.subscriptions[s.channel][s] {
+		return nil
+	}
+
+	delete(r.subscriptions[s.channel], s)
+	if len(r.subscriptions[s.channel]) > 0 {
+		return nil
+	}
+
+	delete(r.subscriptions, s.channel)
+	if r.conn != nil {
+		return r.conn.Unsubscribe(s.channel)
+	}
+	return nil
+}
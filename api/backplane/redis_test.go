@@ -0,0 +1,85 @@
+package backplane
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// subscribed returns a ready func that waits until the server has n subscribers to the channel
+func subscribed(t *testing.T, server *miniredis.Miniredis) func(string, int) {
+	return func(channel string, n int) {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			if server.PubSubNumSub(channel)[channel] == n {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("expected %d subscribers to %s got %d", n, channel, server.PubSubNumSub(channel)[channel])
+	}
+}
+
+func TestRedis(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	a, err := NewRedis("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	b, err := NewRedis("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// a subscribes twice but only holds one subscription on the server
+	ready := subscribed(t, server)
+	testFanOut(t, []Backplane{a, a, b}, func(channel string, n int) {
+		if channel == "general" && n > 1 {
+			n--
+		}
+		ready(channel, n)
+	})
+}
+
+func TestRedisReconnect(t *testing.T) {
+	defer func(wait time.Duration) { redisReconnectWait = wait }(redisReconnectWait)
+	redisReconnectWait = 10 * time.Millisecond
+
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	r, err := NewRedis("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	received := make(received, 8)
+	r.Subscribe("general", received.handler)
+
+	ready := subscribed(t, server)
+	ready("general", 1)
+
+	// restarting the server drops the subscription, it's restored once the server is back
+	server.Close()
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	ready("general", 1)
+
+	if err := r.Publish("general", []byte("back")); err != nil {
+		t.Fatal(err)
+	}
+	received.expect(t, "general:back")
+}
@@ -0,0 +1,57 @@
+// Package blob stores files such as message attachments outside of the databases.  Blobs are
+// written once under a key and read back whole, there's no listing or partial update.
+package blob
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned when reading or deleting a blob that doesn't exist
+	ErrNotFound = errors.New("blob: not found")
+
+	// ErrInvalidKey is returned for keys that aren't clean relative slash separated paths
+	ErrInvalidKey = errors.New("blob: invalid key")
+)
+
+// Store keeps blobs under keys like "channel/attachment"
+type Store interface {
+	// Put writes everything read from r under the key replacing any blob already there, it
+	// returns the number of bytes written
+	Put(key string, r io.Reader) (int64, error)
+
+	// Get opens the blob under the key, the caller must close it
+	Get(key string) (io.ReadCloser, error)
+
+	// Delete removes the blob under the key
+	Delete(key string) error
+}
+
+// Open returns the store for the url.  An empty url gives one in the "attachments" directory of
+// the working directory, file:///path gives one in that directory.
+func Open(rawurl string) (Store, error) {
+	if rawurl == "" {
+		return NewFilesystem("attachments")
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		return NewFilesystem(u.Path)
+	}
+	return nil, errors.New("blob: unsupported scheme " + u.Scheme)
+}
+
+// validKey reports whether the key is a clean relative path that can't escape the store
+func validKey(key string) bool {
+	return key != "" && key != "." && key == path.Clean(key) && !path.IsAbs(key) &&
+		key != ".." && !strings.HasPrefix(key, "../") && !strings.Contains(key, "\\")
+}
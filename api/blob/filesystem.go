@@ -0,0 +1,85 @@
+package blob
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Filesystem is a store that keeps each blob in a file under a directory
+type Filesystem struct {
+	dir string
+}
+
+// NewFilesystem returns a store keeping blobs under the directory, creating it if needed
+func NewFilesystem(dir string) (*Filesystem, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &Filesystem{dir: dir}, nil
+}
+
+// path is the file the blob under the key is kept in
+func (f *Filesystem) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(f.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob to a temporary file that's renamed into place once it's complete so that
+// readers never see part of a blob
+func (f *Filesystem) Put(key string, r io.Reader) (int64, error) {
+	name, err := f.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0750); err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".upload-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return n, err
+	}
+	if err := tmp.Close(); err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp.Name(), name)
+}
+
+// Get opens the file of the blob
+func (f *Filesystem) Get(key string) (io.ReadCloser, error) {
+	name, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+// Delete removes the file of the blob
+func (f *Filesystem) Delete(key string) error {
+	name, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(name)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
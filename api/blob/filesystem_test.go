@@ -0,0 +1,98 @@
+package blob
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilesystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFilesystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"first", "second"} {
+		n, err := store.Put("general/a1", strings.NewReader(text))
+		if err != nil || n != int64(len(text)) {
+			t.Fatalf("expected %d bytes written got %d %v", len(text), n, err)
+		}
+	}
+
+	r, err := store.Get("general/a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "second" {
+		t.Fatalf("expected the blob to be replaced got %q", data)
+	}
+
+	// nothing is left behind but the blob
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "general"))
+	if len(files) != 1 {
+		t.Fatalf("expected one file got %d", len(files))
+	}
+
+	if err := store.Delete("general/a1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("general/a1"); err != ErrNotFound {
+		t.Fatalf("expected %v got %v", ErrNotFound, err)
+	}
+	if err := store.Delete("general/a1"); err != ErrNotFound {
+		t.Fatalf("expected %v got %v", ErrNotFound, err)
+	}
+}
+
+func TestFilesystemKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, _ := NewFilesystem(filepath.Join(dir, "store"))
+
+	for _, key := range []string{"", "/etc/passwd", "../secret", "general/../../secret", "general//a1", `general\a1`, "."} {
+		if _, err := store.Put(key, strings.NewReader("x")); err != ErrInvalidKey {
+			t.Fatalf("%q: expected %v got %v", key, ErrInvalidKey, err)
+		}
+		if _, err := store.Get(key); err != ErrInvalidKey {
+			t.Fatalf("%q: expected %v got %v", key, ErrInvalidKey, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "secret")); !os.IsNotExist(err) {
+		t.Fatal("expected nothing to be written outside of the store")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs, ok := store.(*Filesystem); !ok || fs.dir != dir {
+		t.Fatalf("expected a filesystem store in %s got %+v", dir, store)
+	}
+
+	if _, err := Open("s3://bucket"); err == nil {
+		t.Fatal("expected an unsupported scheme to fail")
+	}
+}
@@ -1,15 +1,75 @@
 package cassandra
 
 import (
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/gocql/gocql"
+	"github.com/sir-wiggles/chat/api/markdown"
 	"github.com/sir-wiggles/chat/api/structs"
 )
 
 type Controller interface {
-	LogMessage(string, string, string) error
+	LogMessage(string, string, string, string) (*structs.Message, error)
+	LogReply(string, string, string, string, string) (*structs.Message, *structs.Thread, error)
+	Attachable(string, string, []string) ([]*structs.Attachment, error)
+	Attach(string, string, []*structs.Attachment) error
+	SetPreviews(string, string, []*structs.Preview) error
+	MarkRead(string, string, string) (bool, error)
+	GetMessagesSince(string, string, int) ([]*structs.Message, error)
 	GetUser(string, string, string) (*structs.User, error)
+	CreateUser(*structs.User) error
+	GetUserByID(string) (*structs.User, error)
+	GetUsersInChannel(string) ([]*structs.User, error)
+	Contacts(string) (map[string]bool, error)
+	ChannelRoles(string) (map[string]structs.Role, error)
+	Authorize(string, string, structs.Action) (structs.Role, error)
+}
+
+var (
+	// ErrNotPermitted is returned when the user's role in a channel doesn't permit what they tried
+	ErrNotPermitted = errors.New("not permitted in the channel")
+
+	// ErrMessageNotFound is returned when a message isn't in the channel
+	ErrMessageNotFound = errors.New("message not found in the channel")
+
+	// ErrParentNotFound is returned when replying to a message that isn't in the channel
+	ErrParentNotFound = errors.New("the message replied to is not in the channel")
+
+	// ErrAttachmentNotFound is returned when an attachment isn't in the channel
+	ErrAttachmentNotFound = errors.New("attachment not found in the channel")
+
+	// ErrInvalidAttachment is returned when sending an attachment that isn't in the channel, was
+	// uploaded by someone else or was already sent
+	ErrInvalidAttachment = errors.New("attachments must be uploaded to the channel by the sender and not sent yet")
+)
+
+const (
+	// MaxUnread is the most unread messages counted in a channel
+	MaxUnread = 100
+
+	// pendingBucket is the partition of the attachments that haven't been sent.  They're all in
+	// the one partition so the oldest can be found without scanning every channel.
+	pendingBucket = 0
+)
+
+// revise marks the message as edited or deleted from its edited_at and deleted_at columns and
+// sets its HTML from the html column
+func revise(message *structs.Message, html string, editedAt, deletedAt time.Time) {
+	if !deletedAt.IsZero() {
+		message.Text = []string{}
+		message.HTML = ""
+		message.Deleted = true
+		return
+	} else if !editedAt.IsZero() {
+		message.EditedAt = &editedAt
+	}
+
+	// messages stored before they were rendered are rendered as they're read
+	if message.HTML = html; html == "" {
+		message.HTML = markdown.Render(strings.Join(message.Text, "\n"))
+	}
 }
 
 type Cassandra struct {
@@ -25,42 +85,913 @@ func New(urls []string) (*Cassandra, error) {
 	return &Cassandra{session}, err
 }
 
-func (c *Cassandra) LogMessage(cid, oid, body string) error {
-	query := `INSERT INTO
-		messages (channel, id, owner, body)
-	VALUES (?, ?, ?, ?)`
-	return c.Query(query, cid, gocql.TimeUUID(), oid, body).Exec()
+// LogMessage stores the message along with its body rendered as html returning it with the
+// TimeUUID it was stored under.  Only the ID of the author is set.
+func (c *Cassandra) LogMessage(cid, oid, body, html string) (*structs.Message, error) {
+	var (
+		query = `INSERT INTO
+		messages (channel, id, owner, body, html)
+	VALUES (?, ?, ?, ?, ?)`
+		id = gocql.TimeUUID()
+	)
+
+	if err := c.Query(query, cid, id, oid, body, html).Exec(); err != nil {
+		return nil, err
+	}
+
+	message := structs.NewMessage(cid, structs.NewUser(oid, "", ""), body, id.Time())
+	message.ID = id.String()
+	message.HTML = html
+	return message, nil
+}
+
+// LogReply stores a reply to the message parent of the channel returning the reply along with the
+// summary of the thread it's now in.  Replying to a reply is replying to the message it replied
+// to.  The body is stored along with it rendered as html.  ErrParentNotFound is returned if parent
+// isn't a message of the channel.
+func (c *Cassandra) LogReply(cid, parent, oid, body, html string) (*structs.Message, *structs.Thread, error) {
+	root, err := c.threadRoot(cid, parent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the reply is in the channel as well as the thread.  last_reply is written at the time of the
+	// reply so the latest reply wins whatever order the writes land in.
+	var (
+		id    = gocql.TimeUUID()
+		batch = c.NewBatch(gocql.LoggedBatch)
+	)
+	batch.Query(`INSERT INTO messages (channel, id, owner, body, html, parent_id) VALUES (?, ?, ?, ?, ?, ?)`,
+		cid, id, oid, body, html, root)
+	batch.Query(`INSERT INTO message_threads (channel, parent, id, owner, body, html) VALUES (?, ?, ?, ?, ?, ?)`,
+		cid, root, id, oid, body, html)
+	batch.Query(`UPDATE messages USING TIMESTAMP ? SET last_reply = ? WHERE channel = ? AND id = ?`,
+		id.Time().UnixNano()/int64(time.Microsecond), id, cid, root)
+
+	if err := c.ExecuteBatch(batch); err != nil {
+		return nil, nil, err
+	}
+
+	// counters can't be batched with other writes
+	var replies int64
+	err = c.Query(`UPDATE message_replies SET replies = replies + 1 WHERE channel = ? AND parent = ?`,
+		cid, root).Exec()
+	if err == nil {
+		err = c.Query(`SELECT replies FROM message_replies WHERE channel = ? AND parent = ?`,
+			cid, root).Scan(&replies)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	message := structs.NewMessage(cid, structs.NewUser(oid, "", ""), body, id.Time())
+	message.ID = id.String()
+	message.Parent = root.String()
+	message.HTML = html
+
+	thread := &structs.Thread{Parent: root.String(), Replies: int(replies), LastReply: id.Time()}
+	return message, thread, nil
+}
+
+// threadRoot returns the id of the message a reply to parent is in the thread of
+func (c *Cassandra) threadRoot(cid, parent string) (gocql.UUID, error) {
+	id, err := gocql.ParseUUID(parent)
+	if err != nil {
+		return gocql.UUID{}, ErrParentNotFound
+	}
+
+	var grandparent gocql.UUID
+	err = c.Query(`SELECT parent_id FROM messages WHERE channel = ? AND id = ?`, cid, id).Scan(&grandparent)
+	if err == gocql.ErrNotFound {
+		return gocql.UUID{}, ErrParentNotFound
+	} else if err != nil {
+		return gocql.UUID{}, err
+	}
+
+	if grandparent != (gocql.UUID{}) {
+		return grandparent, nil
+	}
+	return id, nil
+}
+
+// GetMessage returns the message of the channel along with the summary of its thread.  Only the ID
+// of the author is set.  ErrMessageNotFound is returned if it isn't a message of the channel.
+func (c *Cassandra) GetMessage(cid, mid string) (*structs.Message, error) {
+	id, err := gocql.ParseUUID(mid)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+
+	var (
+		query = `SELECT owner, body, html, parent_id, last_reply, edited_at, deleted_at FROM messages
+		WHERE channel = ? AND id = ?`
+		owner     string
+		body      string
+		html      string
+		parent    gocql.UUID
+		lastReply gocql.UUID
+		editedAt  time.Time
+		deletedAt time.Time
+	)
+	err = c.Query(query, cid, id).Scan(&owner, &body, &html, &parent, &lastReply, &editedAt, &deletedAt)
+	if err == gocql.ErrNotFound {
+		return nil, ErrMessageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	message := structs.NewMessage(cid, structs.NewUser(owner, "", ""), body, id.Time())
+	message.ID = id.String()
+	if parent != (gocql.UUID{}) {
+		message.Parent = parent.String()
+	}
+	revise(message, html, editedAt, deletedAt)
+
+	if lastReply != (gocql.UUID{}) {
+		replies, err := c.ReplyCounts(cid, []gocql.UUID{id})
+		if err != nil {
+			return nil, err
+		}
+		message.Thread = &structs.Thread{Parent: message.ID, Replies: replies[id], LastReply: lastReply.Time()}
+	}
+	if err := c.addReactions(cid, message); err != nil {
+		return nil, err
+	}
+	if err := c.addAttachments(cid, message); err != nil {
+		return nil, err
+	}
+	if err := c.addPreviews(cid, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// GetThread returns up to limit replies to the message parent of the channel that were stored
+// after the reply with the id after, oldest first.  An empty after starts from the first reply.
+// Only the ID of the authors is set.
+func (c *Cassandra) GetThread(cid, parent, after string, limit int) ([]*structs.Message, error) {
+	root, err := gocql.ParseUUID(parent)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+
+	var iter *gocql.Iter
+	if after == "" {
+		iter = c.Query(`
+			SELECT id, owner, body, html, edited_at, deleted_at FROM message_threads
+			WHERE channel = ? AND parent = ?
+			ORDER BY id ASC LIMIT ?`,
+			cid, root, limit,
+		).Iter()
+	} else {
+		since, err := gocql.ParseUUID(after)
+		if err != nil {
+			return nil, err
+		}
+		iter = c.Query(`
+			SELECT id, owner, body, html, edited_at, deleted_at FROM message_threads
+			WHERE channel = ? AND parent = ? AND id > ?
+			ORDER BY id ASC LIMIT ?`,
+			cid, root, since, limit,
+		).Iter()
+	}
+
+	var (
+		messages  = []*structs.Message{}
+		id        gocql.UUID
+		owner     string
+		body      string
+		html      string
+		editedAt  time.Time
+		deletedAt time.Time
+	)
+	for iter.Scan(&id, &owner, &body, &html, &editedAt, &deletedAt) {
+		message := structs.NewMessage(cid, structs.NewUser(owner, "", ""), body, id.Time())
+		message.ID = id.String()
+		message.Parent = parent
+		revise(message, html, editedAt, deletedAt)
+		messages = append(messages, message)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	if err := c.addReactions(cid, messages...); err != nil {
+		return nil, err
+	}
+	if err := c.addAttachments(cid, messages...); err != nil {
+		return nil, err
+	}
+	return messages, c.addPreviews(cid, messages...)
+}
+
+// EditMessage replaces the body of the message of the channel and the html it's rendered as,
+// keeping the body it replaces in its history.  The message is returned after the edit,
+// ErrMessageNotFound if it isn't in the channel or has been deleted.
+func (c *Cassandra) EditMessage(cid, mid, editor, body, html string) (*structs.Message, error) {
+	message, err := c.GetMessage(cid, mid)
+	if err != nil {
+		return nil, err
+	} else if message.Deleted {
+		return nil, ErrMessageNotFound
+	}
+
+	var (
+		id, _ = gocql.ParseUUID(message.ID)
+		now   = time.Now().UTC()
+		batch = c.NewBatch(gocql.LoggedBatch)
+	)
+	batch.Query(`INSERT INTO message_edits (channel, message, edited_at, editor, body) VALUES (?, ?, ?, ?, ?)`,
+		cid, id, now, editor, message.Text[0])
+	batch.Query(`UPDATE messages SET body = ?, html = ?, edited_at = ? WHERE channel = ? AND id = ?`,
+		body, html, now, cid, id)
+	if message.Parent != "" {
+		batch.Query(`UPDATE message_threads SET body = ?, html = ?, edited_at = ? WHERE channel = ? AND parent = ? AND id = ?`,
+			body, html, now, cid, message.Parent, id)
+	}
+
+	if err := c.ExecuteBatch(batch); err != nil {
+		return nil, err
+	}
+
+	message.Text = []string{body}
+	message.HTML = html
+	message.EditedAt = &now
+	return message, nil
+}
+
+// DeleteMessage replaces the message of the channel with a tombstone, its body, history,
+// reactions, attachments and previews are dropped.  Replies to the message are kept.  The
+// tombstone is returned, ErrMessageNotFound if the message isn't in the channel or has already
+// been deleted.
+func (c *Cassandra) DeleteMessage(cid, mid string) (*structs.Message, error) {
+	message, err := c.GetMessage(cid, mid)
+	if err != nil {
+		return nil, err
+	} else if message.Deleted {
+		return nil, ErrMessageNotFound
+	}
+
+	var (
+		id, _ = gocql.ParseUUID(message.ID)
+		now   = time.Now().UTC()
+		batch = c.NewBatch(gocql.LoggedBatch)
+	)
+	batch.Query(`DELETE FROM message_edits WHERE channel = ? AND message = ?`, cid, id)
+	batch.Query(`DELETE FROM message_reactions WHERE channel = ? AND message = ?`, cid, id)
+	batch.Query(`DELETE FROM message_attachments WHERE channel = ? AND message = ?`, cid, id)
+	batch.Query(`DELETE FROM message_previews WHERE channel = ? AND message = ?`, cid, id)
+	for _, attachment := range message.Attachments {
+		batch.Query(`DELETE FROM attachments WHERE channel = ? AND id = ?`, cid, attachment.ID)
+	}
+	batch.Query(`UPDATE messages SET body = null, html = null, edited_at = null, deleted_at = ? WHERE channel = ? AND id = ?`,
+		now, cid, id)
+	if message.Parent != "" {
+		batch.Query(`
+			UPDATE message_threads SET body = null, html = null, edited_at = null, deleted_at = ?
+			WHERE channel = ? AND parent = ? AND id = ?`,
+			now, cid, message.Parent, id)
+	}
+
+	if err := c.ExecuteBatch(batch); err != nil {
+		return nil, err
+	}
+
+	revise(message, "", time.Time{}, now)
+	message.EditedAt = nil
+	message.Reactions = nil
+	message.Attachments = nil
+	message.Previews = nil
+	return message, nil
+}
+
+// GetEdits returns the previous versions of the message of the channel, most recent first
+func (c *Cassandra) GetEdits(cid, mid string) ([]*structs.Edit, error) {
+	id, err := gocql.ParseUUID(mid)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+
+	var (
+		query = `SELECT edited_at, editor, body FROM message_edits WHERE channel = ? AND message = ?
+		ORDER BY edited_at DESC`
+		edits = []*structs.Edit{}
+		edit  = &structs.Edit{}
+	)
+	iter := c.Query(query, cid, id).Iter()
+
+	for iter.Scan(&edit.EditedAt, &edit.Editor, &edit.Text) {
+		edits = append(edits, edit)
+		edit = &structs.Edit{}
+	}
+	return edits, iter.Close()
+}
+
+// ReplyCounts returns the number of replies to each of the messages of the channel that have been
+// replied to
+func (c *Cassandra) ReplyCounts(cid string, parents []gocql.UUID) (map[gocql.UUID]int, error) {
+	var counts = make(map[gocql.UUID]int, len(parents))
+	if len(parents) == 0 {
+		return counts, nil
+	}
+
+	var (
+		query   = `SELECT parent, replies FROM message_replies WHERE channel = ? AND parent IN ?`
+		parent  gocql.UUID
+		replies int64
+	)
+	iter := c.Query(query, cid, parents).Iter()
+
+	for iter.Scan(&parent, &replies) {
+		counts[parent] = int(replies)
+	}
+	return counts, iter.Close()
+}
+
+// AddReaction reacts to the message of the channel with the emoji on behalf of the user and
+// returns the message's reactions.  ErrMessageNotFound is returned if the message isn't in the
+// channel or has been deleted.
+func (c *Cassandra) AddReaction(cid, mid, uid, emoji string) (*structs.Reactions, error) {
+	return c.react(cid, mid, `UPDATE message_reactions SET users = users + ?
+		WHERE channel = ? AND message = ? AND emoji = ?`, uid, emoji)
+}
+
+// RemoveReaction takes back the user's reaction to the message of the channel with the emoji and
+// returns the message's reactions.  ErrMessageNotFound is returned if the message isn't in the
+// channel or has been deleted.
+func (c *Cassandra) RemoveReaction(cid, mid, uid, emoji string) (*structs.Reactions, error) {
+	return c.react(cid, mid, `UPDATE message_reactions SET users = users - ?
+		WHERE channel = ? AND message = ? AND emoji = ?`, uid, emoji)
+}
+
+// react changes the reactions of the message with the update, which is given the user as a set
+// followed by the channel, message and emoji
+func (c *Cassandra) react(cid, mid, update, uid, emoji string) (*structs.Reactions, error) {
+	id, err := gocql.ParseUUID(mid)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+
+	var deletedAt time.Time
+	err = c.Query(`SELECT deleted_at FROM messages WHERE channel = ? AND id = ?`, cid, id).Scan(&deletedAt)
+	if err == gocql.ErrNotFound || err == nil && !deletedAt.IsZero() {
+		return nil, ErrMessageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := c.Query(update, []string{uid}, cid, id, emoji).Exec(); err != nil {
+		return nil, err
+	}
+
+	reactions, err := c.Reactions(cid, []gocql.UUID{id})
+	if err != nil {
+		return nil, err
+	}
+
+	var r = &structs.Reactions{Message: id.String(), Reactions: reactions[id]}
+	if r.Reactions == nil {
+		r.Reactions = []*structs.Reaction{}
+	}
+	return r, nil
+}
+
+// Reactions returns the reactions to each of the messages of the channel that have been reacted
+// to, ordered by emoji
+func (c *Cassandra) Reactions(cid string, messages []gocql.UUID) (map[gocql.UUID][]*structs.Reaction, error) {
+	var reactions = make(map[gocql.UUID][]*structs.Reaction, len(messages))
+	if len(messages) == 0 {
+		return reactions, nil
+	}
+
+	var (
+		query   = `SELECT message, emoji, users FROM message_reactions WHERE channel = ? AND message IN ?`
+		message gocql.UUID
+		emoji   string
+		users   []string
+	)
+	iter := c.Query(query, cid, messages).Iter()
+
+	for iter.Scan(&message, &emoji, &users) {
+		if len(users) == 0 {
+			continue
+		}
+		reactions[message] = append(reactions[message], &structs.Reaction{Emoji: emoji, Count: len(users), Users: users})
+		users = nil
+	}
+	return reactions, iter.Close()
+}
+
+// addReactions fills in the reactions to the messages of the channel.  Deleted messages have none.
+func (c *Cassandra) addReactions(cid string, messages ...*structs.Message) error {
+	var ids = make([]gocql.UUID, 0, len(messages))
+	for _, message := range messages {
+		if id, err := gocql.ParseUUID(message.ID); err == nil && !message.Deleted {
+			ids = append(ids, id)
+		}
+	}
+
+	reactions, err := c.Reactions(cid, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		if id, err := gocql.ParseUUID(message.ID); err == nil && !message.Deleted {
+			message.Reactions = reactions[id]
+		}
+	}
+	return nil
+}
+
+// CreateAttachment stores the metadata of an attachment uploaded to its channel under its ID,
+// which must be a TimeUUID.  The file itself is kept in a blob store.
+func (c *Cassandra) CreateAttachment(a *structs.Attachment) error {
+	id, err := gocql.ParseUUID(a.ID)
+	if err != nil {
+		return err
+	}
+	a.Time = id.Time()
+
+	batch := c.NewBatch(gocql.LoggedBatch)
+	batch.Query(`
+		INSERT INTO attachments (channel, id, uploader, name, type, size, width, height, thumbnail)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.Channel, id, a.Uploader, a.Name, a.Type, a.Size, a.Width, a.Height, a.Thumbnail)
+	batch.Query(`
+		INSERT INTO pending_attachments (bucket, id, channel, thumbnail) VALUES (?, ?, ?, ?)`,
+		pendingBucket, id, a.Channel, a.Thumbnail)
+	return c.ExecuteBatch(batch)
+}
+
+// GetAttachment returns the metadata of an attachment of the channel, ErrAttachmentNotFound if it
+// isn't in the channel
+func (c *Cassandra) GetAttachment(cid, aid string) (*structs.Attachment, error) {
+	id, err := gocql.ParseUUID(aid)
+	if err != nil {
+		return nil, ErrAttachmentNotFound
+	}
+
+	var (
+		a       = &structs.Attachment{ID: id.String(), Channel: cid, Time: id.Time()}
+		message gocql.UUID
+	)
+	err = c.Query(`
+		SELECT uploader, name, type, size, width, height, thumbnail, message FROM attachments
+		WHERE channel = ? AND id = ?`,
+		cid, id,
+	).Scan(&a.Uploader, &a.Name, &a.Type, &a.Size, &a.Width, &a.Height, &a.Thumbnail, &message)
+	if err == gocql.ErrNotFound {
+		return nil, ErrAttachmentNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if message != (gocql.UUID{}) {
+		a.Message = message.String()
+	}
+	return a, nil
+}
+
+// Attachable returns the attachments of the channel with the ids if the user can send them.
+// ErrInvalidAttachment is returned if one isn't in the channel, was uploaded by someone else, was
+// already sent or is listed twice.
+func (c *Cassandra) Attachable(cid, uid string, ids []string) ([]*structs.Attachment, error) {
+	var (
+		attachments = make([]*structs.Attachment, 0, len(ids))
+		seen        = make(map[string]bool, len(ids))
+	)
+	for _, aid := range ids {
+		a, err := c.GetAttachment(cid, aid)
+		if err == ErrAttachmentNotFound {
+			return nil, ErrInvalidAttachment
+		} else if err != nil {
+			return nil, err
+		}
+		if a.Uploader != uid || a.Message != "" || seen[a.ID] {
+			return nil, ErrInvalidAttachment
+		}
+		seen[a.ID] = true
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+// Attach marks the attachments as sent with the message of the channel so they're listed with it.
+// ErrInvalidAttachment is returned if one of them was sent with another message or swept since
+// Attachable checked it, checking the uploader as well keeps a swept attachment from coming back.
+func (c *Cassandra) Attach(cid, mid string, attachments []*structs.Attachment) error {
+	message, err := gocql.ParseUUID(mid)
+	if err != nil {
+		return ErrMessageNotFound
+	}
+
+	var (
+		ids  = make([]gocql.UUID, 0, len(attachments))
+		sent = c.NewBatch(gocql.LoggedBatch)
+	)
+	for _, a := range attachments {
+		id, err := gocql.ParseUUID(a.ID)
+		if err != nil {
+			return ErrInvalidAttachment
+		}
+		ids = append(ids, id)
+		sent.Query(`
+			UPDATE attachments SET message = ? WHERE channel = ? AND id = ?
+			IF uploader = ? AND message = null`,
+			message, cid, id, a.Uploader)
+	}
+
+	// the attachments are all in the channel's partition so they're claimed at once or not at all
+	applied, iter, err := c.MapExecuteBatchCAS(sent, map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if !applied {
+		return ErrInvalidAttachment
+	}
+
+	batch := c.NewBatch(gocql.LoggedBatch)
+	for i, a := range attachments {
+		batch.Query(`
+			INSERT INTO message_attachments
+				(channel, message, id, uploader, name, type, size, width, height, thumbnail)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			cid, message, ids[i], a.Uploader, a.Name, a.Type, a.Size, a.Width, a.Height, a.Thumbnail)
+		batch.Query(`DELETE FROM pending_attachments WHERE bucket = ? AND id = ?`, pendingBucket, ids[i])
+	}
+	if err := c.ExecuteBatch(batch); err != nil {
+		return err
+	}
+
+	for _, a := range attachments {
+		a.Message = mid
+	}
+	return nil
+}
+
+// PendingAttachments returns up to limit attachments uploaded before the time that haven't been
+// sent, oldest first.  Only their ID, Channel, Time and Thumbnail are set.
+func (c *Cassandra) PendingAttachments(before time.Time, limit int) ([]*structs.Attachment, error) {
+	var (
+		query = `SELECT id, channel, thumbnail FROM pending_attachments
+		WHERE bucket = ? AND id < maxTimeuuid(?) LIMIT ?`
+		attachments = []*structs.Attachment{}
+		id          gocql.UUID
+		a           = &structs.Attachment{}
+	)
+	iter := c.Query(query, pendingBucket, before, limit).Iter()
+
+	for iter.Scan(&id, &a.Channel, &a.Thumbnail) {
+		a.ID, a.Time = id.String(), id.Time()
+		attachments = append(attachments, a)
+		a = &structs.Attachment{}
+	}
+	return attachments, iter.Close()
+}
+
+// DropPending drops the pending attachment unless it was sent in the meantime, in which case it's
+// only no longer pending.  It reports whether it was dropped, its files are then the caller's to
+// remove.
+func (c *Cassandra) DropPending(a *structs.Attachment) (bool, error) {
+	id, err := gocql.ParseUUID(a.ID)
+	if err != nil {
+		return false, ErrAttachmentNotFound
+	}
+
+	dropped, err := c.Query(`DELETE FROM attachments WHERE channel = ? AND id = ? IF message = null`,
+		a.Channel, id,
+	).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, err
+	}
+
+	return dropped, c.Query(`DELETE FROM pending_attachments WHERE bucket = ? AND id = ?`,
+		pendingBucket, id,
+	).Exec()
+}
+
+// Attachments returns the attachments of each of the messages of the channel that have any, in
+// the order they were uploaded
+func (c *Cassandra) Attachments(cid string, messages []gocql.UUID) (map[gocql.UUID][]*structs.Attachment, error) {
+	var attachments = make(map[gocql.UUID][]*structs.Attachment, len(messages))
+	if len(messages) == 0 {
+		return attachments, nil
+	}
+
+	var (
+		query = `SELECT message, id, uploader, name, type, size, width, height, thumbnail
+		FROM message_attachments WHERE channel = ? AND message IN ?`
+		message gocql.UUID
+		id      gocql.UUID
+		a       = &structs.Attachment{}
+	)
+	iter := c.Query(query, cid, messages).Iter()
+
+	for iter.Scan(&message, &id, &a.Uploader, &a.Name, &a.Type, &a.Size, &a.Width, &a.Height, &a.Thumbnail) {
+		a.ID, a.Channel, a.Message, a.Time = id.String(), cid, message.String(), id.Time()
+		attachments[message] = append(attachments[message], a)
+		a = &structs.Attachment{}
+	}
+	return attachments, iter.Close()
+}
+
+// addAttachments fills in the attachments of the messages of the channel.  Deleted messages have
+// none.
+func (c *Cassandra) addAttachments(cid string, messages ...*structs.Message) error {
+	var ids = make([]gocql.UUID, 0, len(messages))
+	for _, message := range messages {
+		if id, err := gocql.ParseUUID(message.ID); err == nil && !message.Deleted {
+			ids = append(ids, id)
+		}
+	}
+
+	attachments, err := c.Attachments(cid, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		if id, err := gocql.ParseUUID(message.ID); err == nil && !message.Deleted {
+			message.Attachments = attachments[id]
+		}
+	}
+	return nil
+}
+
+// SetPreviews stores the previews of the links in the message of the channel in the order the
+// links appear in it
+func (c *Cassandra) SetPreviews(cid, mid string, previews []*structs.Preview) error {
+	message, err := gocql.ParseUUID(mid)
+	if err != nil {
+		return ErrMessageNotFound
+	}
+
+	batch := c.NewBatch(gocql.LoggedBatch)
+	for i, p := range previews {
+		batch.Query(`
+			INSERT INTO message_previews
+				(channel, message, position, url, title, description, image, site_name)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			cid, message, i, p.URL, p.Title, p.Description, p.Image, p.SiteName)
+	}
+	return c.ExecuteBatch(batch)
+}
+
+// Previews returns the previews of the links in each of the messages of the channel that have
+// any, in the order the links appear
+func (c *Cassandra) Previews(cid string, messages []gocql.UUID) (map[gocql.UUID][]*structs.Preview, error) {
+	var previews = make(map[gocql.UUID][]*structs.Preview, len(messages))
+	if len(messages) == 0 {
+		return previews, nil
+	}
+
+	var (
+		query = `SELECT message, url, title, description, image, site_name
+		FROM message_previews WHERE channel = ? AND message IN ?`
+		message gocql.UUID
+		p       = &structs.Preview{}
+	)
+	iter := c.Query(query, cid, messages).Iter()
+
+	for iter.Scan(&message, &p.URL, &p.Title, &p.Description, &p.Image, &p.SiteName) {
+		previews[message] = append(previews[message], p)
+		p = &structs.Preview{}
+	}
+	return previews, iter.Close()
+}
+
+// addPreviews fills in the previews of the links in the messages of the channel.  Deleted
+// messages have none.
+func (c *Cassandra) addPreviews(cid string, messages ...*structs.Message) error {
+	var ids = make([]gocql.UUID, 0, len(messages))
+	for _, message := range messages {
+		if id, err := gocql.ParseUUID(message.ID); err == nil && !message.Deleted {
+			ids = append(ids, id)
+		}
+	}
+
+	previews, err := c.Previews(cid, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		if id, err := gocql.ParseUUID(message.ID); err == nil && !message.Deleted {
+			message.Previews = previews[id]
+		}
+	}
+	return nil
+}
+
+// MarkRead moves the user's read cursor in the channel up to the message.  Cursors only move
+// forward, false is returned if the user had already read the message.  ErrMessageNotFound is
+// returned if the message isn't in the channel.
+func (c *Cassandra) MarkRead(cid, uid, mid string) (bool, error) {
+	id, err := gocql.ParseUUID(mid)
+	if err != nil {
+		return false, ErrMessageNotFound
+	}
+
+	err = c.Query(`SELECT id FROM messages WHERE channel = ? AND id = ?`, cid, id).Scan(&id)
+	if err == gocql.ErrNotFound {
+		return false, ErrMessageNotFound
+	} else if err != nil {
+		return false, err
+	}
+
+	var current gocql.UUID
+	err = c.Query(`SELECT message FROM channel_reads WHERE channel = ? AND user = ?`, cid, uid).Scan(&current)
+	if err != nil && err != gocql.ErrNotFound {
+		return false, err
+	} else if current.Timestamp() >= id.Timestamp() {
+		return false, nil
+	}
+
+	// the cursor is written at the time of the message so the latest message wins whatever order
+	// the writes land in
+	err = c.Query(`UPDATE channel_reads USING TIMESTAMP ? SET message = ? WHERE channel = ? AND user = ?`,
+		id.Time().UnixNano()/int64(time.Microsecond), id, cid, uid).Exec()
+	return err == nil, err
+}
+
+// ReadCursors returns the id of the last message each user has read in the channel keyed by user.
+// Users that never read the channel aren't included.
+func (c *Cassandra) ReadCursors(cid string) (map[string]string, error) {
+	var (
+		cursors = make(map[string]string)
+		user    string
+		message gocql.UUID
+	)
+	iter := c.Query(`SELECT user, message FROM channel_reads WHERE channel = ?`, cid).Iter()
+
+	for iter.Scan(&user, &message) {
+		cursors[user] = message.String()
+	}
+	return cursors, iter.Close()
 }
 
+// Unread returns how much of each of the channels the user hasn't read keyed by channel
+func (c *Cassandra) Unread(uid string, cids []string) (map[string]*structs.Unread, error) {
+	var unread = make(map[string]*structs.Unread, len(cids))
+	if len(cids) == 0 {
+		return unread, nil
+	}
+
+	var (
+		cursors = make(map[string]gocql.UUID, len(cids))
+		channel string
+		message gocql.UUID
+	)
+	iter := c.Query(`SELECT channel, message FROM channel_reads WHERE channel IN ? AND user = ?`, cids, uid).Iter()
+	for iter.Scan(&channel, &message) {
+		cursors[channel] = message
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	for _, cid := range cids {
+		var (
+			u       = &structs.Unread{}
+			deleted time.Time
+			iter    *gocql.Iter
+		)
+		if cursor, ok := cursors[cid]; ok {
+			u.LastRead = cursor.String()
+			iter = c.Query(`SELECT deleted_at FROM messages WHERE channel = ? AND id > ? LIMIT ?`,
+				cid, cursor, MaxUnread).Iter()
+		} else {
+			iter = c.Query(`SELECT deleted_at FROM messages WHERE channel = ? LIMIT ?`, cid, MaxUnread).Iter()
+		}
+
+		for iter.Scan(&deleted) {
+			if deleted.IsZero() {
+				u.Count++
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+		unread[cid] = u
+	}
+	return unread, nil
+}
+
+// GetMessagesSince returns up to limit messages of the channel that were stored after the message
+// with the id since, oldest first.  Only the ID of the authors is set.
+func (c *Cassandra) GetMessagesSince(cid, since string, limit int) ([]*structs.Message, error) {
+	after, err := gocql.ParseUUID(since)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		query = `SELECT id, owner, body, html, parent_id, edited_at, deleted_at FROM messages
+		WHERE channel = ? AND id > ? ORDER BY id ASC LIMIT ?`
+		messages  = []*structs.Message{}
+		id        gocql.UUID
+		owner     string
+		body      string
+		html      string
+		parent    gocql.UUID
+		editedAt  time.Time
+		deletedAt time.Time
+	)
+	iter := c.Query(query, cid, after, limit).Iter()
+
+	for iter.Scan(&id, &owner, &body, &html, &parent, &editedAt, &deletedAt) {
+		message := structs.NewMessage(cid, structs.NewUser(owner, "", ""), body, id.Time())
+		message.ID = id.String()
+		if parent != (gocql.UUID{}) {
+			message.Parent = parent.String()
+		}
+		revise(message, html, editedAt, deletedAt)
+		messages = append(messages, message)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	if err := c.addReactions(cid, messages...); err != nil {
+		return nil, err
+	}
+	if err := c.addAttachments(cid, messages...); err != nil {
+		return nil, err
+	}
+	return messages, c.addPreviews(cid, messages...)
+}
+
+// GetMessages returns the last limit messages of the channel, newest first, along with their
+// reactions, attachments and previews.  Only the ID of the authors is set.
 func (c *Cassandra) GetMessages(cid string, limit int) ([]*structs.Message, error) {
 	var (
-		query     = `SELECT totimestamp(id), owner, body FROM messages WHERE channel = ? LIMIT ?`
+		query = `SELECT id, owner, body, html, parent_id, edited_at, deleted_at FROM messages
+		WHERE channel = ? ORDER BY id DESC LIMIT ?`
 		messages  = []*structs.Message{}
-		timestamp time.Time
+		id        gocql.UUID
 		owner     string
 		body      string
+		html      string
+		parent    gocql.UUID
+		editedAt  time.Time
+		deletedAt time.Time
 	)
 	iter := c.Query(query, cid, limit).Iter()
 
-	for iter.Scan(&timestamp, &owner, &body) {
-		messages = append(messages, structs.NewMessage(cid, owner, body, timestamp))
+	for iter.Scan(&id, &owner, &body, &html, &parent, &editedAt, &deletedAt) {
+		message := structs.NewMessage(cid, structs.NewUser(owner, "", ""), body, id.Time())
+		message.ID = id.String()
+		if parent != (gocql.UUID{}) {
+			message.Parent = parent.String()
+		}
+		revise(message, html, editedAt, deletedAt)
+		messages = append(messages, message)
 	}
-	return messages, iter.Close()
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	if err := c.addReactions(cid, messages...); err != nil {
+		return nil, err
+	}
+	if err := c.addAttachments(cid, messages...); err != nil {
+		return nil, err
+	}
+	return messages, c.addPreviews(cid, messages...)
 }
 
-func (c *Cassandra) IsUserPermitted(cid, mid string) (bool, error) {
+// ChannelRoles returns the role of everyone in the channel keyed by user id.  A channel that
+// doesn't exist has no one in it.
+func (c *Cassandra) ChannelRoles(cid string) (map[string]structs.Role, error) {
 	var (
-		query  = `SELECT COUNT(1) FROM channels WHERE id = ? AND members CONTAINS ?;`
-		result int
-		valid  bool
+		query    = `SELECT owner, members, roles FROM channels WHERE id = ?`
+		owner    string
+		members  []string
+		assigned map[string]string
 	)
-	iter := c.Query(query, cid, mid).Iter()
-	iter.Scan(&result)
-	err := iter.Close()
-	if result == 1 {
-		valid = true
+
+	err := c.Query(query, cid).Scan(&owner, &members, &assigned)
+	if err == gocql.ErrNotFound {
+		return map[string]structs.Role{}, nil
+	} else if err != nil {
+		return nil, err
 	}
-	return valid, err
+	return structs.MemberRoles(owner, members, assigned), nil
+}
+
+// Authorize returns the role of the user in the channel.  ErrNotPermitted is returned along with
+// the role if it doesn't permit the action.
+func (c *Cassandra) Authorize(cid, uid string, action structs.Action) (structs.Role, error) {
+	roles, err := c.ChannelRoles(cid)
+	if err != nil {
+		return structs.RoleNone, err
+	}
+
+	role := roles[uid]
+	if !role.Permits(action) {
+		return role, ErrNotPermitted
+	}
+	return role, nil
 }
 
 func (c *Cassandra) RemoveUserFromChannel(cid, oid, mid string) (bool, error) {
@@ -99,6 +1030,31 @@ func (c *Cassandra) DeleteChannel(cid, oid string) (bool, error) {
 	return valid, err
 }
 
+// CreateUser stores the user under their GID with the id they already have, replacing any user
+// stored under it.  It's for users whose account was claimed elsewhere first, such as local
+// accounts, GetUser creates the users of every other provider.
+func (c *Cassandra) CreateUser(user *structs.User) error {
+	return c.Query(
+		`INSERT INTO users (gid, id, name, picture) VALUES (?, ?, ?, ?)`,
+		user.GID, user.ID, user.Name, user.Avatar,
+	).Exec()
+}
+
+// GetUserByID looks up a user by their uuid rather than their google id
+func (c *Cassandra) GetUserByID(uid string) (*structs.User, error) {
+	var (
+		id      string
+		name    string
+		picture string
+	)
+
+	err := c.Query(`SELECT id, name, picture FROM users WHERE id = ?`, uid).Scan(&id, &name, &picture)
+	if err != nil {
+		return nil, err
+	}
+	return structs.NewUser(id, name, picture), nil
+}
+
 func (c *Cassandra) GetUsersInChannel(cid string) ([]*structs.User, error) {
 	var (
 		memberQuery = `SELECT members FROM channels WHERE id = ?`
@@ -110,22 +1066,36 @@ func (c *Cassandra) GetUsersInChannel(cid string) ([]*structs.User, error) {
 		picture     string
 	)
 
-	iter := c.Query(memberQuery, cid).Iter()
-	for iter.Scan(&uuid) {
-		uuids = append(uuids, uuid)
-	}
-
-	if err := iter.Close(); err != nil {
+	if err := c.Query(memberQuery, cid).Scan(&uuids); err != nil {
 		return nil, err
 	}
 
-	iter = c.Query(nameQuery, uuids).Iter()
+	iter := c.Query(nameQuery, uuids).Iter()
 	for iter.Scan(&uuid, &name, &picture) {
 		users = append(users, structs.NewUser(uuid, name, picture))
 	}
 	return users, iter.Close()
 }
 
+// Contacts returns the ids of everyone who shares a channel with the user, the user included
+func (c *Cassandra) Contacts(uid string) (map[string]bool, error) {
+	var (
+		query    = `SELECT owner, members FROM channels WHERE members CONTAINS ?`
+		owner    string
+		members  []string
+		contacts = map[string]bool{uid: true}
+	)
+
+	iter := c.Query(query, uid).Iter()
+	for iter.Scan(&owner, &members) {
+		contacts[owner] = true
+		for _, member := range members {
+			contacts[member] = true
+		}
+	}
+	return contacts, iter.Close()
+}
+
 func (c *Cassandra) GetUser(gid, name, picture string) (*structs.User, error) {
 
 	var (
@@ -139,16 +1109,37 @@ func (c *Cassandra) GetUser(gid, name, picture string) (*structs.User, error) {
 	if iter.NumRows() == 1 {
 		iter.Scan(&id, &name, &picture)
 		user = structs.NewUser(id, name, picture)
+		user.GID = gid
 		return user, iter.Close()
 	}
 
-	err := c.Query(
-		`INSERT INTO users (gid, id, name, picture) VALUES (?, uuid(), ?, ?) IF NOT EXISTS`,
+	uuid, err := gocql.RandomUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	// the id is generated here rather than by cassandra so the caller gets it back.  If the
+	// insert loses a race with another sign in of the same user the stored id wins.
+	existing := make(map[string]interface{})
+	applied, err := c.Query(
+		`INSERT INTO users (gid, id, name, picture) VALUES (?, ?, ?, ?) IF NOT EXISTS`,
 		gid,
+		uuid,
 		name,
 		picture,
-	).Exec()
+	).MapScanCAS(existing)
+	if err != nil {
+		return nil, err
+	}
 
-	return structs.NewUser(id, name, picture), err
+	id = uuid.String()
+	if !applied {
+		if stored, ok := existing["id"].(gocql.UUID); ok {
+			id = stored.String()
+		}
+	}
 
+	user = structs.NewUser(id, name, picture)
+	user.GID = gid
+	return user, nil
 }
@@ -0,0 +1,120 @@
+package cassandra
+
+import (
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+// MockCassandra is a Controller where each method calls the matching Fn field
+type MockCassandra struct {
+	LogMessageFn      func(string, string, string, string) (*structs.Message, error)
+	LogMessageInvoked bool
+
+	LogReplyFn      func(string, string, string, string, string) (*structs.Message, *structs.Thread, error)
+	LogReplyInvoked bool
+
+	AttachableFn      func(string, string, []string) ([]*structs.Attachment, error)
+	AttachableInvoked bool
+
+	AttachFn      func(string, string, []*structs.Attachment) error
+	AttachInvoked bool
+
+	SetPreviewsFn      func(string, string, []*structs.Preview) error
+	SetPreviewsInvoked bool
+
+	MarkReadFn      func(string, string, string) (bool, error)
+	MarkReadInvoked bool
+
+	GetMessagesSinceFn      func(string, string, int) ([]*structs.Message, error)
+	GetMessagesSinceInvoked bool
+
+	GetUserFn      func(string, string, string) (*structs.User, error)
+	GetUserInvoked bool
+
+	CreateUserFn      func(*structs.User) error
+	CreateUserInvoked bool
+
+	GetUserByIDFn      func(string) (*structs.User, error)
+	GetUserByIDInvoked bool
+
+	GetUsersInChannelFn      func(string) ([]*structs.User, error)
+	GetUsersInChannelInvoked bool
+
+	ContactsFn      func(string) (map[string]bool, error)
+	ContactsInvoked bool
+
+	ChannelRolesFn      func(string) (map[string]structs.Role, error)
+	ChannelRolesInvoked bool
+
+	AuthorizeFn      func(string, string, structs.Action) (structs.Role, error)
+	AuthorizeInvoked bool
+}
+
+func (m *MockCassandra) LogMessage(cid, oid, body, html string) (*structs.Message, error) {
+	m.LogMessageInvoked = true
+	return m.LogMessageFn(cid, oid, body, html)
+}
+
+func (m *MockCassandra) LogReply(cid, parent, oid, body, html string) (*structs.Message, *structs.Thread, error) {
+	m.LogReplyInvoked = true
+	return m.LogReplyFn(cid, parent, oid, body, html)
+}
+
+func (m *MockCassandra) Attachable(cid, uid string, ids []string) ([]*structs.Attachment, error) {
+	m.AttachableInvoked = true
+	return m.AttachableFn(cid, uid, ids)
+}
+
+func (m *MockCassandra) Attach(cid, mid string, attachments []*structs.Attachment) error {
+	m.AttachInvoked = true
+	return m.AttachFn(cid, mid, attachments)
+}
+
+func (m *MockCassandra) SetPreviews(cid, mid string, previews []*structs.Preview) error {
+	m.SetPreviewsInvoked = true
+	return m.SetPreviewsFn(cid, mid, previews)
+}
+
+func (m *MockCassandra) MarkRead(cid, uid, mid string) (bool, error) {
+	m.MarkReadInvoked = true
+	return m.MarkReadFn(cid, uid, mid)
+}
+
+func (m *MockCassandra) GetMessagesSince(cid, since string, limit int) ([]*structs.Message, error) {
+	m.GetMessagesSinceInvoked = true
+	return m.GetMessagesSinceFn(cid, since, limit)
+}
+
+func (m *MockCassandra) GetUser(gid, name, picture string) (*structs.User, error) {
+	m.GetUserInvoked = true
+	return m.GetUserFn(gid, name, picture)
+}
+
+func (m *MockCassandra) CreateUser(user *structs.User) error {
+	m.CreateUserInvoked = true
+	return m.CreateUserFn(user)
+}
+
+func (m *MockCassandra) GetUserByID(uid string) (*structs.User, error) {
+	m.GetUserByIDInvoked = true
+	return m.GetUserByIDFn(uid)
+}
+
+func (m *MockCassandra) GetUsersInChannel(cid string) ([]*structs.User, error) {
+	m.GetUsersInChannelInvoked = true
+	return m.GetUsersInChannelFn(cid)
+}
+
+func (m *MockCassandra) Contacts(uid string) (map[string]bool, error) {
+	m.ContactsInvoked = true
+	return m.ContactsFn(uid)
+}
+
+func (m *MockCassandra) ChannelRoles(cid string) (map[string]structs.Role, error) {
+	m.ChannelRolesInvoked = true
+	return m.ChannelRolesFn(cid)
+}
+
+func (m *MockCassandra) Authorize(cid, uid string, action structs.Action) (structs.Role, error) {
+	m.AuthorizeInvoked = true
+	return m.AuthorizeFn(cid, uid, action)
+}
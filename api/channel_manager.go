@@ -1,33 +1,91 @@
 package main
 
-import (
-	"log"
-	"net/http"
-)
-
 type clientID string
 type channelID string
 
+// ChannelManager is the routing table of which clients are subscribed to which channels.  It's
+// owned by the ClientManager loop and isn't safe for concurrent use.
 type ChannelManager struct {
 	Clients  map[clientID]*Client
 	Channels map[channelID]map[clientID]*Client
 }
 
-func (c ChannelManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// NewChannelManager returns an empty routing table
+func NewChannelManager() *ChannelManager {
+	return &ChannelManager{
+		Clients:  make(map[clientID]*Client),
+		Channels: make(map[channelID]map[clientID]*Client),
+	}
+}
+
+// Add tracks the client without subscribing it to any channel
+func (c *ChannelManager) Add(client *Client) {
+	c.Clients[client.id] = client
+}
+
+// Remove unsubscribes the client from every channel and stops tracking it.  The channels the
+// client was subscribed to are returned.
+func (c *ChannelManager) Remove(client *Client) []channelID {
+	delete(c.Clients, client.id)
+
+	channels := make([]channelID, 0, 2)
+	for cid, clients := range c.Channels {
+		if _, ok := clients[client.id]; ok {
+			c.Unsubscribe(cid, client)
+			channels = append(channels, cid)
+		}
+	}
+	return channels
+}
+
+// Subscribe adds the client to the channel returning false if it was already subscribed
+func (c *ChannelManager) Subscribe(cid channelID, client *Client) bool {
+	clients, ok := c.Channels[cid]
+	if !ok {
+		clients = make(map[clientID]*Client)
+		c.Channels[cid] = clients
+	}
+
+	if _, ok := clients[client.id]; ok {
+		return false
+	}
+	clients[client.id] = client
+	return true
+}
+
+// Unsubscribe removes the client from the channel returning false if it wasn't subscribed
+func (c *ChannelManager) Unsubscribe(cid channelID, client *Client) bool {
+	clients, ok := c.Channels[cid]
+	if !ok {
+		return false
+	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("Upgrade error", err)
-		return
+	if _, ok := clients[client.id]; !ok {
+		return false
 	}
 
-	var (
-		name    = r.Context().Value(ContextName).(string)
-		picture = r.Context().Value(ContextPicture).(string)
-		gid     = r.Context().Value(ContextGID).(string)
-		client  = NewClient(conn, gid, name, picture)
-	)
+	delete(clients, client.id)
+	if len(clients) == 0 {
+		delete(c.Channels, cid)
+	}
+	return true
+}
 
-	c.Clients[clientID(gid)] = client
+// ChannelsOf returns the channels any client of the user is subscribed to
+func (c *ChannelManager) ChannelsOf(user string) []channelID {
+	channels := make([]channelID, 0, 2)
+	for cid, clients := range c.Channels {
+		for _, client := range clients {
+			if client.user.ID == user {
+				channels = append(channels, cid)
+				break
+			}
+		}
+	}
+	return channels
+}
 
+// Subscribers returns the clients subscribed to the channel
+func (c *ChannelManager) Subscribers(cid channelID) map[clientID]*Client {
+	return c.Channels[cid]
 }
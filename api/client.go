@@ -1,32 +1,106 @@
 package main
 
 import (
+	"expvar"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
 	"github.com/gorilla/websocket"
+	"github.com/sir-wiggles/chat/api/markdown"
+	"github.com/sir-wiggles/chat/api/protocol"
 	"github.com/sir-wiggles/chat/api/structs"
 )
 
+// reapedConnections counts the connections closed because the peer stopped answering pings or
+// stopped reading what was written to it
+var reapedConnections = expvar.NewInt("reaped_connections")
+
+// frame is an envelope received from a client.  If the envelope could not be decoded err is set.
+type frame struct {
+	*protocol.Envelope
+	client *Client
+	err    error
+
+	// html is the text of a send frame rendered from markdown
+	html string
+}
+
+// render renders the text of a send frame.  Frames are rendered as they're read so the manager
+// loop doesn't spend its time on it.
+func (f *frame) render() {
+	send := &protocol.Send{}
+	if err := f.Unmarshal(send); err == nil {
+		f.html = markdown.Render(send.Text)
+	}
+}
+
+// replay is how far replaying the messages a client missed in a channel has got.  They're replayed
+// a page at a time, the next page once the client has acked the last.
+type replay struct {
+	channel string
+
+	// after is the id of the last message replayed
+	after string
+
+	// sent is how many messages of the channel have been replayed
+	sent int
+
+	// seq is the seq of the last frame of the page being replayed
+	seq uint64
+
+	// authors are the members of the channel keyed by id
+	authors map[string]*structs.User
+
+	// fetching is set while the next page is fetched outside the manager loop
+	fetching bool
+}
+
 //Client is created for every websocket connection to the server
 type Client struct {
-	id      string
-	name    string
-	picture string
+	id      clientID
+	user    *structs.User
 	manager *ClientManager
-	send    chan *structs.Message
+	send    chan *protocol.Envelope
 	socket  *websocket.Conn
+
+	// posts are the frames waiting on the database to be handled, see ClientManager.post
+	posts chan *frame
+
+	// seq is the seq of the last frame queued for the client
+	seq uint64
+
+	// unacked are the frames queued for the client that it hasn't acked yet, oldest first
+	unacked []*protocol.Envelope
+
+	// lastSeen is the id of the last message the client saw on a previous connection.  Messages
+	// after it are replayed when the client joins a channel.
+	lastSeen string
+
+	// replays are the channels whose missed messages are being replayed to the client in the
+	// order it joined them, only the first is being replayed
+	replays []*replay
+
+	reaped sync.Once
 }
 
 // NewClient returns a new client with the given manager and socket connection
-func NewClient(socket *websocket.Conn, id, name, picture string) *Client {
+func NewClient(manager *ClientManager, socket *websocket.Conn, user *structs.User, lastSeen string) *Client {
 	client := &Client{
-		id:      id,
-		name:    name,
-		picture: picture,
-		send:    make(chan *structs.Message),
-		socket:  socket,
+		id:       clientID(gocql.TimeUUID().String()),
+		user:     user,
+		manager:  manager,
+		send:     make(chan *protocol.Envelope, clientSendBufferSize),
+		socket:   socket,
+		posts:    make(chan *frame, clientPostBufferSize),
+		lastSeen: lastSeen,
 	}
 
 	go client.read()
 	go client.write()
+	go client.post()
 
 	return client
 }
@@ -37,30 +111,129 @@ func (client *Client) read() {
 		client.socket.Close()
 	}()
 
+	client.socket.SetReadLimit(maxMessageSize)
+	client.socket.SetReadDeadline(time.Now().Add(pongWait))
+	client.socket.SetPongHandler(func(string) error {
+		return client.socket.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
 	for {
 		_, data, err := client.socket.ReadMessage()
 		//log.Printf("r %s %s\n", client.name, data)
 		if err != nil {
+			if isTimeout(err) {
+				client.reap(err)
+			}
 			break
 		}
-		client.manager.broadcast <- structs.NewMessage(string(data))
+
+		envelope, err := protocol.Decode(data)
+		if err != nil {
+			log.Printf("invalid frame from %s: %s", client.user.ID, err)
+		}
+
+		f := &frame{Envelope: envelope, client: client, err: err}
+		if err == nil && envelope.Type == protocol.TypeSend {
+			f.render()
+		}
+		client.manager.incoming <- f
 	}
 }
 
 func (client *Client) write() {
+	ticker := time.NewTicker(pingPeriod)
 	defer func() {
+		ticker.Stop()
 		client.socket.Close()
 	}()
 
 	for {
 		select {
-		case message, ok := <-client.send:
-			//log.Printf("w %s %s\n", client.id, message)
+		case envelope, ok := <-client.send:
+			//log.Printf("w %s %s\n", client.id, envelope)
+			client.socket.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				client.socket.WriteMessage(websocket.CloseMessage, []byte{})
+				// the client may have been dropped for falling behind, let it know it can
+				// reconnect and catch up from the last message it saw
+				client.socket.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "reconnect with last_seen"))
+				return
+			}
+
+			data, err := protocol.Encode(envelope)
+			if err != nil {
+				log.Printf("encoding %s frame for %s: %s", envelope.Type, client.user.ID, err)
+				continue
+			}
+			if err := client.socket.WriteMessage(websocket.TextMessage, data); err != nil {
+				if isTimeout(err) {
+					client.reap(err)
+				}
+				return
+			}
+
+		case <-ticker.C:
+			client.socket.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := client.socket.WriteMessage(websocket.PingMessage, nil); err != nil {
+				if isTimeout(err) {
+					client.reap(err)
+				}
 				return
 			}
-			client.socket.WriteJSON(message)
 		}
 	}
 }
+
+// post hands the manager the frames waiting on the database one at a time in the order they were
+// read.  It runs outside the manager loop so a slow query only holds up this client, it stops once
+// the manager drops the client.
+func (client *Client) post() {
+	for f := range client.posts {
+		client.manager.post(f)
+	}
+}
+
+// reap closes a connection that has gone quiet.  Closing the socket ends the read loop which
+// unregisters the client.  A client is only counted as reaped once.
+func (client *Client) reap(err error) {
+	client.reaped.Do(func() {
+		log.Printf("reaping stale connection %s: %s", client.id, err)
+		reapedConnections.Add(1)
+		client.socket.Close()
+	})
+}
+
+// isTimeout reports whether err is from a read or write deadline passing
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// queue numbers the envelope and queues it to be written to the socket.  False is returned if the
+// client has too many unacked frames or its send buffer is full.
+func (client *Client) queue(envelope *protocol.Envelope) bool {
+	if len(client.unacked) >= maxUnackedFrames {
+		return false
+	}
+
+	numbered := *envelope
+	numbered.Seq = client.seq + 1
+
+	select {
+	case client.send <- &numbered:
+		client.seq++
+		client.unacked = append(client.unacked, &numbered)
+		return true
+	default:
+		return false
+	}
+}
+
+// acknowledge forgets every unacked frame up to and including seq
+func (client *Client) acknowledge(seq uint64) {
+	i := 0
+	for i < len(client.unacked) && client.unacked[i].Seq <= seq {
+		i++
+	}
+	client.unacked = client.unacked[i:]
+}
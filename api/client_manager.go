@@ -1,32 +1,131 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/gocql/gocql"
 	"github.com/gorilla/websocket"
+	"github.com/sir-wiggles/chat/api/auth"
+	"github.com/sir-wiggles/chat/api/backplane"
 	"github.com/sir-wiggles/chat/api/cassandra"
+	"github.com/sir-wiggles/chat/api/presence"
+	"github.com/sir-wiggles/chat/api/protocol"
+	"github.com/sir-wiggles/chat/api/search"
 	"github.com/sir-wiggles/chat/api/structs"
+	"github.com/sir-wiggles/chat/api/unfurl"
 )
 
-// ClientManager manages all clients on the server
+// delivery is what's published to the backplane for a channel.  Ignore is the client, on
+// whichever node it's connected to, that the envelope isn't delivered to.
+type delivery struct {
+	Envelope *protocol.Envelope `json:"envelope"`
+	Ignore   clientID           `json:"ignore,omitempty"`
+}
+
+// presenceChannel is the backplane channel the nodes share presence on.  Channel ids are uuids so
+// it can't collide with one.
+const presenceChannel = "_presence"
+
+// membershipChannel is the backplane channel removals from channels are published on, the nodes
+// stop sending a channel to the clients of the users removed from it
+const membershipChannel = "_membership"
+
+// revocation is what's published to the backplane when users are removed from a channel
+type revocation struct {
+	Channel string   `json:"channel"`
+	Users   []string `json:"users"`
+}
+
+// ErrInvalidPresenceUsers is returned when asking for the presence of no users or too many
+var ErrInvalidPresenceUsers = errors.New("users must list 1 to 100 comma separated user ids")
+
+// maxPresenceUsers is the most users whose presence can be asked for at once
+const maxPresenceUsers = 100
+
+// presenceUpdate is what's published to the backplane about the users connected to a node.  A
+// full update lists every user connected to the node, otherwise only those whose status changed.
+type presenceUpdate struct {
+	Node  string                     `json:"node"`
+	Users map[string]presence.Status `json:"users"`
+	Full  bool                       `json:"full,omitempty"`
+}
+
+// ClientManager manages all clients on the server.  Broadcasts go through the backplane so
+// they reach the clients connected to every node, not just this one.
 type ClientManager struct {
-	cassandra   cassandra.Controller
+	cassandra cassandra.Controller
+	backplane backplane.Backplane
+	index     search.Index
+	unfurler  *unfurl.Fetcher
+
+	// unfurls holds a token for every message whose links are being unfurled
+	unfurls     chan struct{}
 	connections map[*Client]bool
-	broadcast   chan *structs.Message
+	channels    *ChannelManager
+	incoming    chan *frame
+	broadcast   chan *delivery
 	register    chan *Client
 	unregister  chan *Client
+
+	// answers are what's left to do in the loop once the database has answered for a frame
+	answers chan func()
+
+	// revocations are the users removed from channels, whichever service removed them
+	revocations chan *revocation
+
+	// subscriptions are the backplane channels this node is subscribed to, one for every channel
+	// with a local subscriber
+	subscriptions map[channelID]backplane.Subscription
+
+	// node identifies this node to the others when sharing presence
+	node string
+
+	// presence is the status of every user, whichever node they're connected to
+	presence *presence.Tracker
+
+	// typing is when each client typing in a channel stops unless it says it's still typing
+	typing        map[channelID]map[*Client]time.Time
+	typingTimeout time.Duration
 }
 
-// NewClientManager creates a new ClientManager and starts the manager loop
-func NewClientManager(cass cassandra.Controller) *ClientManager {
+// NewClientManager creates a new ClientManager and starts the manager loop.  Messages are added to
+// the search index as they're logged and the links in them are unfurled by the fetcher, a nil
+// fetcher leaves them be.
+func NewClientManager(cass cassandra.Controller, bp backplane.Backplane, index search.Index, fetcher *unfurl.Fetcher) *ClientManager {
 	manager := &ClientManager{
-		cassandra:   cass,
-		connections: make(map[*Client]bool),
-		broadcast:   make(chan *structs.Message, broadcastChannelBufferSize),
-		register:    make(chan *Client, registerChannelBufferSize),
-		unregister:  make(chan *Client, unregisterChannelBufferSize),
+		cassandra:     cass,
+		backplane:     bp,
+		index:         index,
+		unfurler:      fetcher,
+		unfurls:       make(chan struct{}, maxUnfurls),
+		connections:   make(map[*Client]bool),
+		channels:      NewChannelManager(),
+		incoming:      make(chan *frame, incomingChannelBufferSize),
+		broadcast:     make(chan *delivery, broadcastChannelBufferSize),
+		register:      make(chan *Client, registerChannelBufferSize),
+		unregister:    make(chan *Client, unregisterChannelBufferSize),
+		answers:       make(chan func(), answerChannelBufferSize),
+		revocations:   make(chan *revocation, revocationChannelBufferSize),
+		subscriptions: make(map[channelID]backplane.Subscription),
+		node:          gocql.TimeUUID().String(),
+		presence:      presence.NewTracker(3 * presenceHeartbeat),
+		typing:        make(map[channelID]map[*Client]time.Time),
+		typingTimeout: typingTimeout,
+	}
+
+	if _, err := bp.Subscribe(presenceChannel, manager.merge); err != nil {
+		log.Printf("subscribing to presence: %s", err)
+	}
+	if _, err := bp.Subscribe(membershipChannel, manager.revoked); err != nil {
+		log.Printf("subscribing to membership: %s", err)
 	}
 
 	go manager.start()
@@ -34,57 +133,814 @@ func NewClientManager(cass cassandra.Controller) *ClientManager {
 }
 
 // Start will start the socket listening loop
-func (manager ClientManager) start() {
+func (manager *ClientManager) start() {
+	var (
+		heartbeat = time.NewTicker(presenceHeartbeat)
+		sweep     = time.NewTicker(manager.typingTimeout / 2)
+	)
+
 	for {
 		select {
 
-		// Client joining
+		// Client connecting, it won't receive anything until it joins a channel
 		case client := <-manager.register:
 			//log.Printf("+ %s\n", client.id)
 			manager.connections[client] = true
-			message := structs.NewSystemMessage(fmt.Sprintf("%s has joined the conversation", client.name))
-			manager.send(message, client)
+			manager.channels.Add(client)
 
-		// Client leaving
+			message := structs.NewInitializeMessage(client.user, fmt.Sprintf("Welcome %s", client.user.Name))
+			if envelope, err := protocol.New(protocol.TypeInitialize, "", message); err == nil {
+				manager.reply(client, envelope)
+			}
+			manager.setPresence(client, presence.Online)
+
+		// Client disconnecting
 		case client := <-manager.unregister:
 			if _, ok := manager.connections[client]; ok {
 				//log.Printf("- %s\n", client.id)
-				delete(manager.connections, client)
-				message := structs.NewSystemMessage(fmt.Sprintf("%s has left the conversation", client.name))
-				manager.send(message, client)
+				manager.drop(client)
 			}
 
-		// Broadcasting
-		case message := <-manager.broadcast:
-			manager.cassandra.LogMessage(message.Author.Name, message.Text[0])
-			for client := range manager.connections {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(manager.connections, client)
-				}
+		// Frames sent by clients
+		case f := <-manager.incoming:
+			manager.handle(f)
+
+		// Frames the database has answered for
+		case answer := <-manager.answers:
+			answer()
+
+		// Users removed from a channel can't be sent it any longer
+		case r := <-manager.revocations:
+			manager.revoke(r)
+
+		// Broadcasts off the backplane, from this node or any other
+		case d := <-manager.broadcast:
+			manager.deliver(d)
+
+		// Remind the other nodes who is connected to this one so they don't forget them
+		case <-heartbeat.C:
+			manager.publishPresence(manager.presence.Local(), true)
+
+		case now := <-sweep.C:
+			manager.expireTyping(now)
+		}
+	}
+}
+
+// handle acts on a frame from a client.  Frames that need the database, to check the client's
+// role in the channel or to store what it says, are passed to the client to post so a slow query
+// doesn't hold up every other client.  The rest are handled here.
+func (manager *ClientManager) handle(f *frame) {
+	var client = f.client
+
+	if _, ok := manager.connections[client]; !ok {
+		return
+	}
+
+	if f.err != nil {
+		manager.fail(f, protocol.CodeInvalidFrame, f.err.Error())
+		return
+	} else if !f.Type.FromClient() {
+		manager.fail(f, protocol.CodeInvalidFrame, fmt.Sprintf("%s frames can't be sent by clients", f.Type))
+		return
+	}
+
+	switch f.Type {
+
+	case protocol.TypeJoin, protocol.TypeSend, protocol.TypeRead:
+		manager.pass(f)
+
+	// leaving doesn't need a role, a client whose user was removed from the channel can still go
+	case protocol.TypeLeave:
+		manager.leave(client, f.Channel)
+
+	case protocol.TypeTyping:
+		if _, ok := manager.channels.Subscribers(channelID(f.Channel))[client.id]; !ok {
+			manager.fail(f, protocol.CodeForbidden, "not subscribed to the channel")
+			return
+		}
+		manager.pass(f)
+
+	case protocol.TypePresence:
+		p := &protocol.Presence{}
+		f.Unmarshal(p)
+
+		if p.Status == presence.Offline {
+			manager.fail(f, protocol.CodeInvalidFrame, "clients can only be online or away")
+			return
+		}
+		manager.setPresence(client, p.Status)
+
+	case protocol.TypeAck:
+		ack := &protocol.Ack{}
+		f.Unmarshal(ack)
+		client.acknowledge(ack.Seq)
+
+		// the next page of a replay waits for the client to have the last one
+		if len(client.replays) > 0 && ack.Seq >= client.replays[0].seq {
+			manager.replayPage(client)
+		}
+	}
+}
+
+// pass queues the frame for the client to post.  A client with too many frames waiting on the
+// database has the frame answered with an error frame rather than hold up the loop.
+func (manager *ClientManager) pass(f *frame) {
+	select {
+	case f.client.posts <- f:
+	default:
+		manager.fail(f, protocol.CodeInternal, "too many frames waiting to be handled")
+	}
+}
+
+// post handles a frame passed on by handle once the client's role in the channel permits it.  It's
+// called by the client rather than the manager loop, what the frame changes in the manager is
+// handed back to the loop through answers.
+func (manager *ClientManager) post(f *frame) {
+	var action = structs.ActionRead
+	if f.Type == protocol.TypeSend || f.Type == protocol.TypeTyping {
+		action = structs.ActionPost
+	}
+	if !manager.authorize(f, action) {
+		return
+	}
+
+	switch f.Type {
+	case protocol.TypeJoin:
+		manager.answers <- func() { manager.join(f) }
+	case protocol.TypeTyping:
+		manager.answers <- func() { manager.setTyping(f) }
+	case protocol.TypeSend:
+		manager.store(f)
+	case protocol.TypeRead:
+		manager.read(f)
+	}
+}
+
+// join subscribes the client to the channel of the frame and replays what it missed there
+func (manager *ClientManager) join(f *frame) {
+	var (
+		client = f.client
+		cid    = channelID(f.Channel)
+	)
+
+	// the client may have disconnected while its role was checked
+	if _, ok := manager.connections[client]; !ok {
+		return
+	}
+
+	if manager.channels.Subscribe(cid, client) {
+		manager.subscribe(cid)
+		manager.replay(client, f.Channel)
+		manager.system(f.Channel, fmt.Sprintf("%s has joined the conversation", client.user.Name), client)
+		manager.sendPresence(cid, client.user.ID, manager.presence.Status(client.user.ID), client)
+	}
+}
+
+// leave unsubscribes the client from the channel
+func (manager *ClientManager) leave(client *Client, channel string) {
+	var cid = channelID(channel)
+
+	if manager.channels.Unsubscribe(cid, client) {
+		manager.stopTyping(cid, client)
+		manager.stopReplay(client, channel)
+		manager.unsubscribe(cid)
+		manager.system(channel, fmt.Sprintf("%s has left the conversation", client.user.Name), client)
+	}
+}
+
+// revoked hands the loop the users removed from a channel.  It's called by the backplane rather
+// than the manager loop.
+func (manager *ClientManager) revoked(channel string, data []byte) {
+	r := &revocation{}
+	if err := json.Unmarshal(data, r); err != nil || r.Channel == "" {
+		log.Printf("invalid revocation: %v", err)
+		return
+	}
+	manager.revocations <- r
+}
+
+// revoke unsubscribes the clients on this node of the users removed from the channel
+func (manager *ClientManager) revoke(r *revocation) {
+	removed := make(map[string]bool, len(r.Users))
+	for _, user := range r.Users {
+		removed[user] = true
+	}
+
+	for _, client := range manager.channels.Subscribers(channelID(r.Channel)) {
+		if removed[client.user.ID] {
+			manager.leave(client, r.Channel)
+		}
+	}
+}
+
+// setTyping starts or stops the client typing in the channel of a typing frame, unless it left
+// the channel while its role was checked
+func (manager *ClientManager) setTyping(f *frame) {
+	var cid = channelID(f.Channel)
+
+	if _, ok := manager.channels.Subscribers(cid)[f.client.id]; !ok {
+		return
+	}
+
+	typing := &protocol.Typing{}
+	f.Unmarshal(typing)
+
+	if typing.Active {
+		manager.startTyping(cid, f.client)
+	} else {
+		manager.stopTyping(cid, f.client)
+	}
+}
+
+// store logs the message of a send frame along with its attachments, indexes it and marks it read
+// by its author.  It's called by the client rather than the manager loop, the message is handed
+// back to the loop to be sent once it's stored.
+func (manager *ClientManager) store(f *frame) {
+	var client = f.client
+
+	send := &protocol.Send{}
+	f.Unmarshal(send)
+
+	var (
+		message     *structs.Message
+		thread      *structs.Thread
+		attachments []*structs.Attachment
+		err         error
+	)
+	if len(send.Attachments) > 0 {
+		attachments, err = manager.cassandra.Attachable(f.Channel, client.user.ID, send.Attachments)
+		if err == cassandra.ErrInvalidAttachment {
+			manager.refuse(f, protocol.CodeInvalidFrame, err.Error())
+			return
+		} else if err != nil {
+			log.Printf("checking the attachments sent to %s: %s", f.Channel, err)
+			manager.refuse(f, protocol.CodeInternal, "could not store the message")
+			return
+		}
+	}
+
+	if send.Parent == "" {
+		message, err = manager.cassandra.LogMessage(f.Channel, client.user.ID, send.Text, f.html)
+	} else {
+		message, thread, err = manager.cassandra.LogReply(f.Channel, send.Parent, client.user.ID, send.Text, f.html)
+	}
+	if err == cassandra.ErrParentNotFound {
+		manager.refuse(f, protocol.CodeInvalidFrame, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("logging message to %s: %s", f.Channel, err)
+		manager.refuse(f, protocol.CodeInternal, "could not store the message")
+		return
+	}
+	message.Author = client.user
+
+	if len(attachments) > 0 {
+		if err := manager.cassandra.Attach(f.Channel, message.ID, attachments); err != nil {
+			log.Printf("attaching files to %s: %s", message.ID, err)
+		} else {
+			message.Attachments = attachments
+		}
+	}
+
+	if err := manager.index.Index(message); err != nil {
+		log.Printf("indexing %s: %s", message.ID, err)
+	}
+
+	// you've read what you wrote
+	if _, err := manager.cassandra.MarkRead(f.Channel, client.user.ID, message.ID); err != nil {
+		log.Printf("marking %s read by %s: %s", message.ID, client.user.ID, err)
+	}
+
+	manager.answers <- func() { manager.stored(f, message, thread) }
+}
+
+// stored sends the channel the message of a send frame once it's been stored, has its links
+// unfurled and acks the frame
+func (manager *ClientManager) stored(f *frame, message *structs.Message, thread *structs.Thread) {
+	manager.stopTyping(channelID(f.Channel), f.client)
+
+	if envelope, err := protocol.New(protocol.TypeMessage, f.Channel, message); err == nil {
+		manager.send(envelope, nil)
+	}
+	if thread != nil {
+		if envelope, err := protocol.New(protocol.TypeThread, f.Channel, thread); err == nil {
+			manager.send(envelope, nil)
+		}
+	}
+	if links := unfurl.Links(message.Text...); len(links) > 0 && manager.unfurler != nil {
+		select {
+		case manager.unfurls <- struct{}{}:
+			go manager.unfurl(f.Channel, message.ID, links)
+		default:
+			log.Printf("not unfurling %s, %d messages are being unfurled", message.ID, maxUnfurls)
+		}
+	}
+	if ack, err := f.Reply(protocol.TypeAck, &protocol.Ack{Message: message.ID}); err == nil {
+		manager.reply(f.client, ack)
+	}
+}
+
+// read moves the client's read cursor in the channel of a read frame.  It's called by the client
+// rather than the manager loop, the loop tells the channel if the cursor moved.
+func (manager *ClientManager) read(f *frame) {
+	var client = f.client
+
+	read := &protocol.Read{}
+	f.Unmarshal(read)
+
+	moved, err := manager.cassandra.MarkRead(f.Channel, client.user.ID, read.Message)
+	if err == cassandra.ErrMessageNotFound {
+		manager.refuse(f, protocol.CodeInvalidFrame, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("marking %s read by %s: %s", read.Message, client.user.ID, err)
+		manager.refuse(f, protocol.CodeInternal, "could not store the read cursor")
+		return
+	}
+
+	if !moved {
+		return
+	}
+
+	// the rest of the channel sees who has read up to where, the client's other connections
+	// see what they no longer have to show as unread
+	read.User = client.user.ID
+	if envelope, err := protocol.New(protocol.TypeRead, f.Channel, read); err == nil {
+		manager.answers <- func() { manager.send(envelope, client) }
+	}
+}
+
+// startTyping tells the channel the client is typing unless it already has.  The client stops
+// typing on its own once typingTimeout passes without it saying it still is.
+func (manager *ClientManager) startTyping(cid channelID, client *Client) {
+	clients, ok := manager.typing[cid]
+	if !ok {
+		clients = make(map[*Client]time.Time)
+		manager.typing[cid] = clients
+	}
+
+	_, typing := clients[client]
+	clients[client] = time.Now().Add(manager.typingTimeout)
+	if !typing {
+		manager.sendTyping(cid, client, true)
+	}
+}
+
+// stopTyping tells the channel the client stopped typing if it was
+func (manager *ClientManager) stopTyping(cid channelID, client *Client) {
+	if _, ok := manager.typing[cid][client]; !ok {
+		return
+	}
+
+	delete(manager.typing[cid], client)
+	if len(manager.typing[cid]) == 0 {
+		delete(manager.typing, cid)
+	}
+	manager.sendTyping(cid, client, false)
+}
+
+// expireTyping stops the clients that haven't said they're still typing in time
+func (manager *ClientManager) expireTyping(now time.Time) {
+	for cid, clients := range manager.typing {
+		for client, expires := range clients {
+			if !now.Before(expires) {
+				manager.stopTyping(cid, client)
+			}
+		}
+	}
+}
+
+// sendTyping tells every client in the channel but the one typing whether it's typing
+func (manager *ClientManager) sendTyping(cid channelID, client *Client, active bool) {
+	typing := &protocol.Typing{Active: active, Author: client.user.ID}
+	if envelope, err := protocol.New(protocol.TypeTyping, string(cid), typing); err == nil {
+		manager.send(envelope, client)
+	}
+}
+
+// setPresence records the status of the client's connection and shares it with the other nodes.
+// If the user's status changed then the channels their clients on this node are subscribed to are
+// told, along with any extra channels given.
+func (manager *ClientManager) setPresence(client *Client, status presence.Status, channels ...channelID) {
+	var user = client.user.ID
+
+	before, after := manager.presence.Set(user, string(client.id), status)
+
+	local, ok := manager.presence.Local(user)[user]
+	if !ok {
+		local = presence.Offline
+	}
+	manager.publishPresence(map[string]presence.Status{user: local}, false)
+
+	if before == after {
+		return
+	}
+
+	told := make(map[channelID]bool)
+	for _, cid := range append(channels, manager.channels.ChannelsOf(user)...) {
+		if !told[cid] {
+			told[cid] = true
+			manager.sendPresence(cid, user, after, nil)
+		}
+	}
+}
+
+// sendPresence tells every client in the channel except ignore the status of the user
+func (manager *ClientManager) sendPresence(cid channelID, user string, status presence.Status, ignore *Client) {
+	p := &protocol.Presence{User: user, Status: status}
+	if envelope, err := protocol.New(protocol.TypePresence, string(cid), p); err == nil {
+		manager.send(envelope, ignore)
+	}
+}
+
+// publishPresence shares the status of users connected to this node with the other nodes
+func (manager *ClientManager) publishPresence(users map[string]presence.Status, full bool) {
+	data, err := json.Marshal(&presenceUpdate{Node: manager.node, Users: users, Full: full})
+	if err == nil {
+		err = manager.backplane.Publish(presenceChannel, data)
+	}
+	if err != nil {
+		log.Printf("publishing presence: %s", err)
+	}
+}
+
+// merge records what another node published about the users connected to it.  It's called by the
+// backplane rather than the manager loop, the tracker is safe for concurrent use.
+func (manager *ClientManager) merge(channel string, data []byte) {
+	update := &presenceUpdate{}
+	if err := json.Unmarshal(data, update); err != nil {
+		log.Printf("invalid presence update: %s", err)
+		return
+	}
+	if update.Node != manager.node {
+		manager.presence.Merge(update.Node, update.Users, update.Full)
+	}
+}
+
+// Presence responds with the status of each of the users in the comma separated "users" query
+// param keyed by user id.  Only users who share a channel with the caller are reported, the rest
+// are left out.
+func (manager *ClientManager) Presence(w http.ResponseWriter, r *http.Request) {
+	var (
+		users    = make([]string, 0)
+		statuses = make(map[string]presence.Status)
+	)
+	for _, user := range strings.Split(r.URL.Query().Get("users"), ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			users = append(users, user)
+		}
+	}
+
+	if len(users) == 0 || len(users) > maxPresenceUsers {
+		RespondWithJSON(w, http.StatusBadRequest, ErrInvalidPresenceUsers)
+		return
+	}
+
+	contacts, err := manager.cassandra.Contacts(auth.UserID(r.Context()))
+	if err != nil {
+		RespondWithJSON(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	for _, user := range users {
+		if contacts[user] {
+			statuses[user] = manager.presence.Status(user)
+		}
+	}
+	RespondWithJSON(w, http.StatusOK, map[string]interface{}{"users": statuses})
+}
+
+// replay sends the client the messages of the channel it missed since it last saw a message.
+// Channels are replayed one after the other a page at a time, so a client that missed a lot isn't
+// sent more than its send buffer holds.  Messages posted while a channel is replayed may be sent
+// twice, clients tell them apart by id.
+func (manager *ClientManager) replay(client *Client, channel string) {
+	if client.lastSeen == "" {
+		return
+	}
+
+	client.replays = append(client.replays, &replay{channel: channel, after: client.lastSeen})
+	if len(client.replays) == 1 {
+		manager.replayPage(client)
+	}
+}
+
+// replayPage fetches the next page of the channel being replayed to the client unless it's already
+// being fetched.  The page is fetched outside the manager loop and handed back to it to be sent.
+func (manager *ClientManager) replayPage(client *Client) {
+	if len(client.replays) == 0 || client.replays[0].fetching {
+		return
+	}
+
+	var (
+		r       = client.replays[0]
+		after   = r.after
+		authors = r.authors
+		limit   = replayPageSize
+	)
+	if left := maxReplayMessages - r.sent; left < limit {
+		limit = left
+	}
+	r.fetching = true
+
+	go func() {
+		if authors == nil {
+			authors = manager.authors(r.channel)
+		}
+
+		messages, err := manager.cassandra.GetMessagesSince(r.channel, after, limit)
+		if err != nil {
+			log.Printf("replaying %s to %s: %s", r.channel, client.user.ID, err)
+		}
+
+		manager.answers <- func() { manager.replayed(client, r, authors, messages, limit, err) }
+	}()
+}
+
+// replayed sends the client a page of the channel being replayed to it, moving on to the next
+// channel once there's nothing left to replay in it
+func (manager *ClientManager) replayed(client *Client, r *replay, authors map[string]*structs.User, messages []*structs.Message, limit int, err error) {
+	r.fetching = false
+	r.authors = authors
+
+	// the client may have left the channel or disconnected while the page was fetched
+	if _, ok := manager.connections[client]; !ok || len(client.replays) == 0 || client.replays[0] != r {
+		return
+	}
+
+	for _, message := range messages {
+		if author, ok := authors[message.Author.ID]; ok {
+			message.Author = author
+		}
+		if envelope, err := protocol.New(protocol.TypeMessage, r.channel, message); err == nil {
+			manager.reply(client, envelope)
+		}
+	}
+
+	// the client may have been dropped for falling behind
+	if _, ok := manager.connections[client]; !ok {
+		return
+	}
+
+	r.sent += len(messages)
+	if err == nil && len(messages) == limit && r.sent < maxReplayMessages {
+		r.after = messages[len(messages)-1].ID
+	} else if client.replays = client.replays[1:]; len(messages) == 0 {
+		manager.replayPage(client)
+		return
+	}
+
+	// the next page waits for the client to ack this one
+	if len(client.replays) > 0 {
+		client.replays[0].seq = client.seq
+	}
+}
+
+// stopReplay stops replaying the channel to the client, moving on to the next channel if it was
+// the one being replayed
+func (manager *ClientManager) stopReplay(client *Client, channel string) {
+	for i, r := range client.replays {
+		if r.channel != channel {
+			continue
+		}
+		client.replays = append(client.replays[:i], client.replays[i+1:]...)
+		if i == 0 {
+			manager.replayPage(client)
+		}
+		return
+	}
+}
+
+// authors returns the members of the channel keyed by id
+func (manager *ClientManager) authors(channel string) map[string]*structs.User {
+	users, err := manager.cassandra.GetUsersInChannel(channel)
+	if err != nil {
+		log.Printf("looking up the members of %s: %s", channel, err)
+	}
+
+	authors := make(map[string]*structs.User, len(users))
+	for _, user := range users {
+		authors[user.ID] = user
+	}
+	return authors
+}
+
+// system sends a system message to every client in the channel except ignore
+func (manager *ClientManager) system(channel, text string, ignore *Client) {
+	message := structs.NewSystemMessage(channel, text)
+	if envelope, err := protocol.New(protocol.TypeSystem, channel, message); err == nil {
+		manager.send(envelope, ignore)
+	}
+}
+
+// authorize answers the frame with an error frame unless the client's role in the channel of the
+// frame permits the action.  It's called by the client rather than the manager loop.
+func (manager *ClientManager) authorize(f *frame, action structs.Action) bool {
+	var uid = f.client.user.ID
+
+	role, err := manager.cassandra.Authorize(f.Channel, uid, action)
+	switch {
+	case err == nil:
+		return true
+	case err == cassandra.ErrNotPermitted && role == structs.RoleNone:
+		manager.refuse(f, protocol.CodeForbidden, "not a member of the channel")
+	case err == cassandra.ErrNotPermitted:
+		manager.refuse(f, protocol.CodeForbidden, fmt.Sprintf("a %s of the channel can't %s", role, action))
+	default:
+		log.Printf("authorizing %s to %s in %s: %s", uid, action, f.Channel, err)
+		manager.refuse(f, protocol.CodeInternal, "could not check membership")
+	}
+	return false
+}
+
+// fail answers the frame with an error frame
+func (manager *ClientManager) fail(f *frame, code, message string) {
+	var (
+		envelope *protocol.Envelope
+		err      error
+	)
+	if f.Envelope != nil {
+		envelope, err = f.Reply(protocol.TypeError, protocol.NewError(code, message))
+	} else {
+		envelope, err = protocol.New(protocol.TypeError, "", protocol.NewError(code, message))
+	}
+
+	if err == nil {
+		manager.reply(f.client, envelope)
+	}
+}
+
+// refuse hands the loop the frame to answer with an error frame.  It's called by the client rather
+// than the manager loop.
+func (manager *ClientManager) refuse(f *frame, code, message string) {
+	manager.answers <- func() { manager.fail(f, code, message) }
+}
+
+// reply sends the envelope to a single client.  A client that can't keep up or stops acking is
+// dropped rather than have frames silently skipped, it catches up by reconnecting with the id of
+// the last message it saw as last_seen.
+func (manager *ClientManager) reply(client *Client, envelope *protocol.Envelope) {
+	if _, ok := manager.connections[client]; !ok {
+		return
+	}
+
+	if !client.queue(envelope) {
+		log.Printf("dropping %s, %d frames unacked", client.user.ID, len(client.unacked))
+		manager.drop(client)
+	}
+}
+
+// send publishes the envelope to the backplane for every client subscribed to the envelope's
+// channel except ignore.  If the backplane can't be reached the envelope is only delivered to
+// the clients on this node.
+func (manager *ClientManager) send(envelope *protocol.Envelope, ignore *Client) {
+	d := &delivery{Envelope: envelope}
+	if ignore != nil {
+		d.Ignore = ignore.id
+	}
+
+	if err := manager.publish(d); err != nil {
+		log.Printf("publishing %s frame to %s: %s", envelope.Type, envelope.Channel, err)
+		manager.deliver(d)
+	}
+}
+
+// publish publishes the delivery to the backplane for the envelope's channel
+func (manager *ClientManager) publish(d *delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return manager.backplane.Publish(d.Envelope.Channel, data)
+}
+
+// unfurl fetches the previews of the links in the message of the channel, stores them and tells
+// the channel.  It runs outside the manager loop so slow pages don't hold it up, if the backplane
+// can't be reached the loop is handed the previews to deliver to the clients on this node.  It
+// gives back the token the loop took from unfurls once it's done.
+func (manager *ClientManager) unfurl(channel, mid string, links []string) {
+	defer func() { <-manager.unfurls }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), unfurlTimeout)
+	defer cancel()
+
+	var (
+		fetched = make([]*structs.Preview, len(links))
+		wg      sync.WaitGroup
+	)
+	for i, link := range links {
+		wg.Add(1)
+		go func(i int, link string) {
+			defer wg.Done()
+			preview, err := manager.unfurler.Fetch(ctx, link)
+			if err != nil {
+				log.Printf("unfurling %s in %s: %s", link, mid, err)
+				return
 			}
+			fetched[i] = preview
+		}(i, link)
+	}
+	wg.Wait()
+
+	previews := make([]*structs.Preview, 0, len(fetched))
+	for _, preview := range fetched {
+		if preview != nil {
+			previews = append(previews, preview)
 		}
 	}
+	if len(previews) == 0 {
+		return
+	}
+
+	if err := manager.cassandra.SetPreviews(channel, mid, previews); err != nil {
+		log.Printf("storing the previews of %s: %s", mid, err)
+		return
+	}
+
+	envelope, err := protocol.New(protocol.TypePreview, channel, &structs.Previews{Message: mid, Previews: previews})
+	if err != nil {
+		return
+	}
+	d := &delivery{Envelope: envelope}
+	if err := manager.publish(d); err != nil {
+		log.Printf("publishing %s frame to %s: %s", envelope.Type, channel, err)
+		manager.broadcast <- d
+	}
 }
 
-func (manager ClientManager) send(message *structs.Message, ignore *Client) {
-	for client := range manager.connections {
-		if client.id != ignore.id {
-			//log.Printf("  %s > %s | %s\n", ignore.id, client.id, message)
-			client.send <- message
+// deliver sends the envelope to the clients on this node subscribed to its channel.  Clients
+// that can't keep up are dropped.
+func (manager *ClientManager) deliver(d *delivery) {
+	for id, client := range manager.channels.Subscribers(channelID(d.Envelope.Channel)) {
+		if id == d.Ignore {
+			continue
 		}
+		manager.reply(client, d.Envelope)
 	}
 }
 
+// subscribe listens to the channel on the backplane if this node isn't already.  Broadcasts are
+// handed to the manager loop through the broadcast channel.
+func (manager *ClientManager) subscribe(cid channelID) {
+	if _, ok := manager.subscriptions[cid]; ok {
+		return
+	}
+
+	subscription, err := manager.backplane.Subscribe(string(cid), func(channel string, data []byte) {
+		d := &delivery{}
+		if err := json.Unmarshal(data, d); err != nil || d.Envelope == nil {
+			log.Printf("invalid broadcast on %s: %v", channel, err)
+			return
+		}
+		manager.broadcast <- d
+	})
+	if err != nil {
+		log.Printf("subscribing to %s: %s", cid, err)
+		return
+	}
+	manager.subscriptions[cid] = subscription
+}
+
+// unsubscribe stops listening to the channel on the backplane once no client on this node is
+// subscribed to it
+func (manager *ClientManager) unsubscribe(cid channelID) {
+	subscription, ok := manager.subscriptions[cid]
+	if !ok || len(manager.channels.Subscribers(cid)) > 0 {
+		return
+	}
+
+	delete(manager.subscriptions, cid)
+	if err := subscription.Unsubscribe(); err != nil {
+		log.Printf("unsubscribing from %s: %s", cid, err)
+	}
+}
+
+// drop removes the client from the manager, letting the channels it was in know it has left
+func (manager *ClientManager) drop(client *Client) {
+	if _, ok := manager.connections[client]; !ok {
+		return
+	}
+	delete(manager.connections, client)
+	close(client.send)
+	close(client.posts)
+
+	channels := manager.channels.Remove(client)
+	for _, cid := range channels {
+		manager.stopTyping(cid, client)
+		manager.unsubscribe(cid)
+		manager.system(string(cid), fmt.Sprintf("%s has left the conversation", client.user.Name), client)
+	}
+	manager.setPresence(client, presence.Offline, channels...)
+}
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
-func (manager ClientManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (manager *ClientManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -92,12 +948,18 @@ func (manager ClientManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	name := r.Context().Value(ContextName)
-	picture := r.Context().Value(ContextPicture).(string)
-	gid := r.Context().Value(ContextGID).(string)
+	var (
+		name     = r.Context().Value(auth.ContextName).(string)
+		picture  = r.Context().Value(auth.ContextPicture).(string)
+		uid      = auth.UserID(r.Context())
+		user     = structs.NewUser(uid, name, picture)
+		lastSeen = r.URL.Query().Get("last_seen")
+	)
 
-	client := NewClient(&manager, conn, gid, name.(string), picture)
-	manager.register <- client
+	if _, err := gocql.ParseUUID(lastSeen); lastSeen != "" && err != nil {
+		log.Printf("ignoring invalid last_seen %q from %s", lastSeen, uid)
+		lastSeen = ""
+	}
 
-	conn.WriteJSON(structs.NewInitializeMessage(client, fmt.Sprintf("Welcome %s", client.name)))
+	manager.register <- NewClient(manager, conn, user, lastSeen)
 }
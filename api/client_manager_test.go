@@ -0,0 +1,885 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gocql/gocql"
+	"github.com/sir-wiggles/chat/api/auth"
+	"github.com/sir-wiggles/chat/api/backplane"
+	"github.com/sir-wiggles/chat/api/cassandra"
+	"github.com/sir-wiggles/chat/api/presence"
+	"github.com/sir-wiggles/chat/api/protocol"
+	"github.com/sir-wiggles/chat/api/search"
+	"github.com/sir-wiggles/chat/api/structs"
+	"github.com/sir-wiggles/chat/api/unfurl"
+)
+
+// testClient returns a client with no socket, frames queued for it are read straight off send
+func testClient(manager *ClientManager, name string) *Client {
+	client := &Client{
+		id:      clientID(gocql.TimeUUID().String()),
+		user:    structs.NewUser(name, name, ""),
+		manager: manager,
+		send:    make(chan *protocol.Envelope, maxUnackedFrames),
+		posts:   make(chan *frame, clientPostBufferSize),
+	}
+	go client.post()
+	return client
+}
+
+// next returns the next frame queued for the client
+func next(t *testing.T, client *Client) *protocol.Envelope {
+	t.Helper()
+	select {
+	case envelope := <-client.send:
+		return envelope
+	case <-time.After(time.Second):
+		t.Fatalf("expected a frame for %s", client.user.ID)
+	}
+	return nil
+}
+
+// heardJoin fails unless the client is told the user joined the channel and how present they are
+func heardJoin(t *testing.T, client *Client, user string) {
+	t.Helper()
+	if e := next(t, client); e.Type != protocol.TypeSystem {
+		t.Fatalf("expected %s to hear %s join got %s", client.user.ID, user, e.Type)
+	}
+	p := &protocol.Presence{}
+	if e := next(t, client); e.Type != protocol.TypePresence || e.Unmarshal(p) != nil {
+		t.Fatalf("expected %s to get the presence of %s got %s", client.user.ID, user, e.Type)
+	} else if p.User != user || p.Status != presence.Online {
+		t.Fatalf("expected %s online got %+v", user, p)
+	}
+}
+
+// quiet fails if a frame is queued for the client
+func quiet(t *testing.T, client *Client) {
+	t.Helper()
+	select {
+	case envelope := <-client.send:
+		t.Fatalf("expected nothing for %s got %s", client.user.ID, envelope.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClientManagerAcrossNodes(t *testing.T) {
+	var (
+		bp   = backplane.NewMemory()
+		cass = func() *cassandra.MockCassandra {
+			return &cassandra.MockCassandra{
+				AuthorizeFn: func(cid, uid string, action structs.Action) (structs.Role, error) {
+					return structs.RoleMember, nil
+				},
+				LogMessageFn: func(cid, oid, body, html string) (*structs.Message, error) {
+					return structs.NewMessage(cid, &structs.User{ID: oid}, body, time.Now()), nil
+				},
+				MarkReadFn: func(cid, uid, mid string) (bool, error) {
+					return true, nil
+				},
+			}
+		}
+
+		// two nodes behind a load balancer with alice connected to one and bob to the other
+		nodeA = NewClientManager(cass(), bp, search.NewMemory(), nil)
+		nodeB = NewClientManager(cass(), bp, search.NewMemory(), nil)
+		alice = testClient(nodeA, "alice")
+		bob   = testClient(nodeB, "bob")
+	)
+	defer bp.Close()
+
+	post := func(client *Client, t protocol.Type, payload interface{}) {
+		envelope, _ := protocol.New(t, "general", payload)
+		client.manager.incoming <- &frame{Envelope: envelope, client: client}
+	}
+
+	nodeA.register <- alice
+	nodeB.register <- bob
+	if e := next(t, alice); e.Type != protocol.TypeInitialize {
+		t.Fatalf("expected an initialize frame got %s", e.Type)
+	}
+	if e := next(t, bob); e.Type != protocol.TypeInitialize {
+		t.Fatalf("expected an initialize frame got %s", e.Type)
+	}
+
+	post(alice, protocol.TypeJoin, nil)
+	quiet(t, alice)
+
+	post(bob, protocol.TypeJoin, nil)
+	heardJoin(t, alice, "bob")
+	quiet(t, bob)
+
+	// a message posted on one node reaches the subscribers on both.  The ack can beat the message
+	// back to alice as the message makes a round trip through the backplane.
+	post(alice, protocol.TypeSend, &protocol.Send{Text: "hi bob"})
+
+	frames := map[protocol.Type]*protocol.Envelope{}
+	for i := 0; i < 2; i++ {
+		e := next(t, alice)
+		frames[e.Type] = e
+	}
+	if frames[protocol.TypeAck] == nil {
+		t.Fatal("expected alice's post to be acked")
+	}
+
+	for client, e := range map[*Client]*protocol.Envelope{alice: frames[protocol.TypeMessage], bob: next(t, bob)} {
+		if e == nil || e.Type != protocol.TypeMessage {
+			t.Fatalf("expected %s to get the message got %v", client.user.ID, e)
+		}
+
+		message := &structs.Message{}
+		if err := e.Unmarshal(message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Author.ID != "alice" || message.Text[0] != "hi bob" {
+			t.Fatalf("unexpected message %+v", message)
+		}
+	}
+
+	// typing isn't echoed to the client typing, even though it went through the other node
+	post(bob, protocol.TypeTyping, &protocol.Typing{Active: true})
+	if e := next(t, alice); e.Type != protocol.TypeTyping {
+		t.Fatalf("expected alice to see bob typing got %s", e.Type)
+	}
+	quiet(t, bob)
+
+	// leaving stops bob typing before alice hears he's gone
+	nodeB.unregister <- bob
+	for _, expected := range []protocol.Type{protocol.TypeTyping, protocol.TypeSystem, protocol.TypePresence} {
+		if e := next(t, alice); e.Type != expected {
+			t.Fatalf("expected alice to get a %s frame as bob leaves got %s", expected, e.Type)
+		}
+	}
+	quiet(t, alice)
+}
+
+func TestClientManagerRoles(t *testing.T) {
+	var (
+		bp    = backplane.NewMemory()
+		roles = map[string]structs.Role{"alice": structs.RoleMember, "gus": structs.RoleGuest}
+		cass  = &cassandra.MockCassandra{
+			AuthorizeFn: func(cid, uid string, action structs.Action) (structs.Role, error) {
+				if role := roles[uid]; !role.Permits(action) {
+					return role, cassandra.ErrNotPermitted
+				}
+				return roles[uid], nil
+			},
+			LogMessageFn: func(cid, oid, body, html string) (*structs.Message, error) {
+				return structs.NewMessage(cid, &structs.User{ID: oid}, body, time.Now()), nil
+			},
+			MarkReadFn: func(cid, uid, mid string) (bool, error) {
+				return true, nil
+			},
+		}
+		index   = search.NewMemory()
+		manager = NewClientManager(cass, bp, index, nil)
+		alice   = testClient(manager, "alice")
+		gus     = testClient(manager, "gus")
+		eve     = testClient(manager, "eve")
+	)
+	defer bp.Close()
+
+	post := func(client *Client, t protocol.Type, payload interface{}) {
+		envelope, _ := protocol.New(t, "general", payload)
+		client.manager.incoming <- &frame{Envelope: envelope, client: client}
+	}
+
+	for _, client := range []*Client{alice, gus, eve} {
+		manager.register <- client
+		if e := next(t, client); e.Type != protocol.TypeInitialize {
+			t.Fatalf("expected an initialize frame got %s", e.Type)
+		}
+	}
+
+	// someone that isn't in the channel can't even join it
+	post(eve, protocol.TypeJoin, nil)
+	if e := next(t, eve); e.Type != protocol.TypeError {
+		t.Fatalf("expected eve's join to be refused got %s", e.Type)
+	}
+
+	post(alice, protocol.TypeJoin, nil)
+	quiet(t, alice)
+	post(gus, protocol.TypeJoin, nil)
+	heardJoin(t, alice, "gus")
+
+	// a guest can read the channel but can't post or type in it
+	post(gus, protocol.TypeSend, &protocol.Send{Text: "hello?"})
+	post(gus, protocol.TypeTyping, &protocol.Typing{Active: true})
+	for i := 0; i < 2; i++ {
+		if e := next(t, gus); e.Type != protocol.TypeError {
+			t.Fatalf("expected gus to be refused got %s", e.Type)
+		}
+	}
+	quiet(t, alice)
+
+	post(alice, protocol.TypeSend, &protocol.Send{Text: "welcome gus"})
+	if e := next(t, gus); e.Type != protocol.TypeMessage {
+		t.Fatalf("expected gus to read alice's message got %s", e.Type)
+	}
+
+	// only the message that was logged can be found
+	for text, want := range map[string]int{"welcome": 1, "hello": 0} {
+		hits, err := index.Search(&search.Query{Text: text, Channels: []string{"general"}})
+		if err != nil || len(hits) != want {
+			t.Fatalf("expected %d hits for %q got %v %v", want, text, hits, err)
+		}
+	}
+}
+
+func TestClientManagerRevoked(t *testing.T) {
+	var (
+		bp    = backplane.NewMemory()
+		mu    sync.Mutex
+		roles = map[string]structs.Role{"alice": structs.RoleMember, "bob": structs.RoleMember}
+		cass  = &cassandra.MockCassandra{
+			AuthorizeFn: func(cid, uid string, action structs.Action) (structs.Role, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if role := roles[uid]; !role.Permits(action) {
+					return role, cassandra.ErrNotPermitted
+				}
+				return roles[uid], nil
+			},
+			LogMessageFn: func(cid, oid, body, html string) (*structs.Message, error) {
+				return structs.NewMessage(cid, &structs.User{ID: oid}, body, time.Now()), nil
+			},
+			MarkReadFn: func(cid, uid, mid string) (bool, error) {
+				return true, nil
+			},
+		}
+		manager = NewClientManager(cass, bp, search.NewMemory(), nil)
+		alice   = testClient(manager, "alice")
+		phone   = testClient(manager, "bob")
+		laptop  = testClient(manager, "bob")
+	)
+	defer bp.Close()
+
+	post := func(client *Client, t protocol.Type, payload interface{}) {
+		envelope, _ := protocol.New(t, "general", payload)
+		client.manager.incoming <- &frame{Envelope: envelope, client: client}
+	}
+
+	for _, client := range []*Client{alice, phone, laptop} {
+		manager.register <- client
+		if e := next(t, client); e.Type != protocol.TypeInitialize {
+			t.Fatalf("expected an initialize frame got %s", e.Type)
+		}
+	}
+
+	post(alice, protocol.TypeJoin, nil)
+	quiet(t, alice)
+	for _, client := range []*Client{phone, laptop} {
+		post(client, protocol.TypeJoin, nil)
+		heardJoin(t, alice, "bob")
+	}
+	next(t, phone)
+	next(t, phone)
+
+	mu.Lock()
+	delete(roles, "bob")
+	mu.Unlock()
+
+	// bob was removed from the channel but can still leave it
+	post(phone, protocol.TypeLeave, nil)
+	if e := next(t, alice); e.Type != protocol.TypeSystem {
+		t.Fatalf("expected alice to hear bob leave got %s", e.Type)
+	}
+	next(t, laptop)
+	quiet(t, phone)
+
+	// bob's other client is unsubscribed once the removal is published
+	data, _ := json.Marshal(&revocation{Channel: "general", Users: []string{"bob"}})
+	if err := bp.Publish(membershipChannel, data); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(t, alice); e.Type != protocol.TypeSystem {
+		t.Fatalf("expected alice to hear bob removed got %s", e.Type)
+	}
+
+	post(alice, protocol.TypeSend, &protocol.Send{Text: "bob's gone"})
+	got := map[protocol.Type]bool{next(t, alice).Type: true, next(t, alice).Type: true}
+	if !got[protocol.TypeMessage] || !got[protocol.TypeAck] {
+		t.Fatalf("expected alice's message and its ack got %v", got)
+	}
+	quiet(t, phone)
+	quiet(t, laptop)
+}
+
+func TestClientManagerSlowStore(t *testing.T) {
+	var (
+		bp      = backplane.NewMemory()
+		storing = make(chan struct{})
+		release = make(chan struct{})
+		cass    = &cassandra.MockCassandra{
+			AuthorizeFn: func(cid, uid string, action structs.Action) (structs.Role, error) {
+				return structs.RoleMember, nil
+			},
+			LogMessageFn: func(cid, oid, body, html string) (*structs.Message, error) {
+				close(storing)
+				<-release
+				return structs.NewMessage(cid, &structs.User{ID: oid}, body, time.Now()), nil
+			},
+			MarkReadFn: func(cid, uid, mid string) (bool, error) {
+				return true, nil
+			},
+		}
+		manager = NewClientManager(cass, bp, search.NewMemory(), nil)
+		alice   = testClient(manager, "alice")
+		bob     = testClient(manager, "bob")
+	)
+	defer bp.Close()
+
+	post := func(client *Client, t protocol.Type, payload interface{}) {
+		envelope, _ := protocol.New(t, "general", payload)
+		client.manager.incoming <- &frame{Envelope: envelope, client: client}
+	}
+
+	for _, client := range []*Client{alice, bob} {
+		manager.register <- client
+		if e := next(t, client); e.Type != protocol.TypeInitialize {
+			t.Fatalf("expected an initialize frame got %s", e.Type)
+		}
+	}
+
+	post(alice, protocol.TypeJoin, nil)
+	quiet(t, alice)
+	post(bob, protocol.TypeJoin, nil)
+	heardJoin(t, alice, "bob")
+
+	// bob is heard typing while alice's message is still being stored
+	post(alice, protocol.TypeSend, &protocol.Send{Text: "hello"})
+	<-storing
+	post(bob, protocol.TypeTyping, &protocol.Typing{Active: true})
+	if e := next(t, alice); e.Type != protocol.TypeTyping {
+		t.Fatalf("expected alice to hear bob typing got %s", e.Type)
+	}
+
+	close(release)
+	if e := next(t, bob); e.Type != protocol.TypeMessage {
+		t.Fatalf("expected bob to get alice's message got %s", e.Type)
+	}
+}
+
+func TestClientManagerThreads(t *testing.T) {
+	var (
+		bp   = backplane.NewMemory()
+		cass = &cassandra.MockCassandra{
+			AuthorizeFn: func(cid, uid string, action structs.Action) (structs.Role, error) {
+				return structs.RoleMember, nil
+			},
+			LogReplyFn: func(cid, parent, oid, body, html string) (*structs.Message, *structs.Thread, error) {
+				if parent != "root" {
+					return nil, nil, cassandra.ErrParentNotFound
+				}
+				message := structs.NewMessage(cid, &structs.User{ID: oid}, body, time.Now())
+				message.Parent = parent
+				return message, &structs.Thread{Parent: parent, Replies: 3, LastReply: message.Time}, nil
+			},
+			MarkReadFn: func(cid, uid, mid string) (bool, error) {
+				return true, nil
+			},
+		}
+		manager = NewClientManager(cass, bp, search.NewMemory(), nil)
+		alice   = testClient(manager, "alice")
+		bob     = testClient(manager, "bob")
+	)
+	defer bp.Close()
+
+	post := func(client *Client, t protocol.Type, payload interface{}) {
+		envelope, _ := protocol.New(t, "general", payload)
+		client.manager.incoming <- &frame{Envelope: envelope, client: client}
+	}
+
+	for _, client := range []*Client{alice, bob} {
+		manager.register <- client
+		if e := next(t, client); e.Type != protocol.TypeInitialize {
+			t.Fatalf("expected an initialize frame got %s", e.Type)
+		}
+	}
+	post(alice, protocol.TypeJoin, nil)
+	quiet(t, alice)
+	post(bob, protocol.TypeJoin, nil)
+	heardJoin(t, alice, "bob")
+
+	// the reply is followed by the summary of the thread it's in
+	post(alice, protocol.TypeSend, &protocol.Send{Text: "agreed", Parent: "root"})
+	if e := next(t, bob); e.Type != protocol.TypeMessage {
+		t.Fatalf("expected bob to get the reply got %s", e.Type)
+	} else if message := (&structs.Message{}); e.Unmarshal(message) != nil || message.Parent != "root" {
+		t.Fatalf("expected a reply to root got %s", e.Payload)
+	}
+	if e := next(t, bob); e.Type != protocol.TypeThread {
+		t.Fatalf("expected bob to get the thread got %s", e.Type)
+	} else if thread := (&structs.Thread{}); e.Unmarshal(thread) != nil || thread.Parent != "root" || thread.Replies != 3 {
+		t.Fatalf("unexpected thread %s", e.Payload)
+	}
+
+	// replying to a message that isn't in the channel is refused.  Alice has the reply, the
+	// thread and the ack of her reply to get through first.
+	for i := 0; i < 3; i++ {
+		next(t, alice)
+	}
+	post(alice, protocol.TypeSend, &protocol.Send{Text: "what?", Parent: "elsewhere"})
+	if e := next(t, alice); e.Type != protocol.TypeError {
+		t.Fatalf("expected alice's reply to be refused got %s", e.Type)
+	}
+	quiet(t, bob)
+}
+
+func TestClientManagerPresence(t *testing.T) {
+	defer func(timeout time.Duration) { typingTimeout = timeout }(typingTimeout)
+	typingTimeout = 100 * time.Millisecond
+
+	var (
+		bp   = backplane.NewMemory()
+		cass = &cassandra.MockCassandra{
+			AuthorizeFn: func(cid, uid string, action structs.Action) (structs.Role, error) {
+				return structs.RoleMember, nil
+			},
+			ContactsFn: func(uid string) (map[string]bool, error) {
+				return map[string]bool{uid: true, "fry": true, "zoidberg": true}, nil
+			},
+		}
+		manager = NewClientManager(cass, bp, search.NewMemory(), nil)
+		other   = NewClientManager(cass, bp, search.NewMemory(), nil)
+		leela   = testClient(manager, "leela")
+		fry     = testClient(manager, "fry")
+		fryTab  = testClient(manager, "fry")
+	)
+	defer bp.Close()
+
+	post := func(client *Client, t protocol.Type, payload interface{}) {
+		envelope, _ := protocol.New(t, "general", payload)
+		client.manager.incoming <- &frame{Envelope: envelope, client: client}
+	}
+
+	expect := func(client *Client, user string, status presence.Status) {
+		t.Helper()
+		p := &protocol.Presence{}
+		if e := next(t, client); e.Type != protocol.TypePresence || e.Unmarshal(p) != nil {
+			t.Fatalf("expected a presence frame got %s", e.Type)
+		} else if p.User != user || p.Status != status {
+			t.Fatalf("expected %s %s got %+v", user, status, p)
+		}
+	}
+
+	for _, client := range []*Client{leela, fry, fryTab} {
+		manager.register <- client
+		if e := next(t, client); e.Type != protocol.TypeInitialize {
+			t.Fatalf("expected an initialize frame got %s", e.Type)
+		}
+	}
+	post(leela, protocol.TypeJoin, nil)
+	quiet(t, leela)
+	post(fry, protocol.TypeJoin, nil)
+	heardJoin(t, leela, "fry")
+	post(fryTab, protocol.TypeJoin, nil)
+	heardJoin(t, leela, "fry")
+	heardJoin(t, fry, "fry")
+
+	// fry is as present as his most present connection
+	post(fry, protocol.TypePresence, &protocol.Presence{Status: presence.Away})
+	quiet(t, leela)
+	post(fryTab, protocol.TypePresence, &protocol.Presence{Status: presence.Away})
+	expect(leela, "fry", presence.Away)
+	expect(fry, "fry", presence.Away)
+	expect(fryTab, "fry", presence.Away)
+
+	// only the server can say someone is offline
+	post(fry, protocol.TypePresence, &protocol.Presence{Status: presence.Offline})
+	if e := next(t, fry); e.Type != protocol.TypeError {
+		t.Fatalf("expected fry's offline to be refused got %s", e.Type)
+	}
+
+	// typing is only announced when it starts and stops on its own when it isn't repeated
+	post(leela, protocol.TypeTyping, &protocol.Typing{Active: true})
+	post(leela, protocol.TypeTyping, &protocol.Typing{Active: true})
+	typing := &protocol.Typing{}
+	if e := next(t, fry); e.Type != protocol.TypeTyping || e.Unmarshal(typing) != nil || !typing.Active {
+		t.Fatalf("expected fry to see leela typing got %s", e.Payload)
+	}
+	if e := next(t, fry); e.Type != protocol.TypeTyping || e.Unmarshal(typing) != nil || typing.Active {
+		t.Fatalf("expected leela's typing to expire got %s", e.Payload)
+	}
+	quiet(t, leela)
+
+	// none of it is stored
+	if cass.LogMessageInvoked {
+		t.Fatal("expected ephemeral frames not to be logged")
+	}
+
+	// every node can answer for the users connected to any other
+	deadline := time.Now().Add(time.Second)
+	for other.presence.Status("leela") != presence.Online {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the other node to learn leela is online")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// asked by leela, who doesn't share a channel with hermes
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := &auth.Claims{StandardClaims: jwt.StandardClaims{Subject: "leela"}}
+		other.Presence(w, r.WithContext(auth.NewContext(r.Context(), claims)))
+	}))
+	defer server.Close()
+
+	for query, code := range map[string]int{"?users=leela,fry,zoidberg,hermes": http.StatusOK, "?users=": http.StatusBadRequest} {
+		rsp, err := http.Get(server.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != code {
+			t.Fatalf("expected %d for %s got %d", code, query, rsp.StatusCode)
+		} else if code != http.StatusOK {
+			continue
+		}
+
+		body := struct {
+			Users map[string]presence.Status `json:"users"`
+		}{}
+		if err := json.NewDecoder(rsp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]presence.Status{"leela": presence.Online, "fry": presence.Away, "zoidberg": presence.Offline}
+		if !reflect.DeepEqual(body.Users, expected) {
+			t.Fatalf("expected %v got %v", expected, body.Users)
+		}
+	}
+
+	// fry is only offline once both his connections are gone
+	manager.unregister <- fry
+	if e := next(t, leela); e.Type != protocol.TypeSystem {
+		t.Fatalf("expected leela to hear fry leave got %s", e.Type)
+	}
+	quiet(t, leela)
+	manager.unregister <- fryTab
+	if e := next(t, leela); e.Type != protocol.TypeSystem {
+		t.Fatalf("expected leela to hear fry leave got %s", e.Type)
+	}
+	expect(leela, "fry", presence.Offline)
+}
+
+func TestClientManagerReads(t *testing.T) {
+	var (
+		bp      = backplane.NewMemory()
+		cursors = map[string]string{}
+		cass    = &cassandra.MockCassandra{
+			AuthorizeFn: func(cid, uid string, action structs.Action) (structs.Role, error) {
+				return structs.RoleMember, nil
+			},
+			LogMessageFn: func(cid, oid, body, html string) (*structs.Message, error) {
+				message := structs.NewMessage(cid, &structs.User{ID: oid}, body, time.Now())
+				message.ID = "m3"
+				return message, nil
+			},
+			MarkReadFn: func(cid, uid, mid string) (bool, error) {
+				if mid == "elsewhere" {
+					return false, cassandra.ErrMessageNotFound
+				} else if mid <= cursors[uid] {
+					return false, nil
+				}
+				cursors[uid] = mid
+				return true, nil
+			},
+		}
+		manager = NewClientManager(cass, bp, search.NewMemory(), nil)
+		alice   = testClient(manager, "alice")
+		bob     = testClient(manager, "bob")
+	)
+	defer bp.Close()
+
+	post := func(client *Client, t protocol.Type, payload interface{}) {
+		envelope, _ := protocol.New(t, "general", payload)
+		client.manager.incoming <- &frame{Envelope: envelope, client: client}
+	}
+
+	for _, client := range []*Client{alice, bob} {
+		manager.register <- client
+		if e := next(t, client); e.Type != protocol.TypeInitialize {
+			t.Fatalf("expected an initialize frame got %s", e.Type)
+		}
+	}
+	post(alice, protocol.TypeJoin, nil)
+	quiet(t, alice)
+	post(bob, protocol.TypeJoin, nil)
+	heardJoin(t, alice, "bob")
+
+	// alice sees bob has read up to m2
+	post(bob, protocol.TypeRead, &protocol.Read{Message: "m2"})
+	read := &protocol.Read{}
+	if e := next(t, alice); e.Type != protocol.TypeRead || e.Unmarshal(read) != nil {
+		t.Fatalf("expected alice to see bob's read got %s", e.Type)
+	} else if read.User != "bob" || read.Message != "m2" {
+		t.Fatalf("unexpected read %+v", read)
+	}
+	quiet(t, bob)
+
+	// cursors only move forward so going back over old messages says nothing
+	post(bob, protocol.TypeRead, &protocol.Read{Message: "m1"})
+	quiet(t, alice)
+
+	post(bob, protocol.TypeRead, &protocol.Read{Message: "elsewhere"})
+	if e := next(t, bob); e.Type != protocol.TypeError {
+		t.Fatalf("expected bob's read to be refused got %s", e.Type)
+	}
+
+	// posting a message reads it
+	post(alice, protocol.TypeSend, &protocol.Send{Text: "caught up?"})
+	if e := next(t, bob); e.Type != protocol.TypeMessage {
+		t.Fatalf("expected bob to get the message got %s", e.Type)
+	}
+	if cursors["alice"] != "m3" {
+		t.Fatalf("expected alice to have read her message got %q", cursors["alice"])
+	}
+}
+
+func TestClientManagerAttachments(t *testing.T) {
+	var (
+		bp       = backplane.NewMemory()
+		uploaded = map[string]*structs.Attachment{
+			"a1": {ID: "a1", Channel: "general", Uploader: "alice", Name: "plan.pdf"},
+			"b1": {ID: "b1", Channel: "general", Uploader: "bob", Name: "bob.png"},
+		}
+		attached string
+		cass     = &cassandra.MockCassandra{
+			AuthorizeFn: func(cid, uid string, action structs.Action) (structs.Role, error) {
+				return structs.RoleMember, nil
+			},
+			AttachableFn: func(cid, uid string, ids []string) ([]*structs.Attachment, error) {
+				attachments := make([]*structs.Attachment, 0, len(ids))
+				for _, id := range ids {
+					a, ok := uploaded[id]
+					if !ok || a.Uploader != uid || a.Message != "" {
+						return nil, cassandra.ErrInvalidAttachment
+					}
+					attachments = append(attachments, a)
+				}
+				return attachments, nil
+			},
+			AttachFn: func(cid, mid string, attachments []*structs.Attachment) error {
+				for _, a := range attachments {
+					a.Message = mid
+				}
+				attached = mid
+				return nil
+			},
+			LogMessageFn: func(cid, oid, body, html string) (*structs.Message, error) {
+				message := structs.NewMessage(cid, &structs.User{ID: oid}, body, time.Now())
+				message.ID = "m1"
+				return message, nil
+			},
+			MarkReadFn: func(cid, uid, mid string) (bool, error) {
+				return true, nil
+			},
+		}
+		manager = NewClientManager(cass, bp, search.NewMemory(), nil)
+		alice   = testClient(manager, "alice")
+	)
+	defer bp.Close()
+
+	post := func(payload *protocol.Send) {
+		envelope, _ := protocol.New(protocol.TypeSend, "general", payload)
+		manager.incoming <- &frame{Envelope: envelope, client: alice}
+	}
+
+	manager.register <- alice
+	if e := next(t, alice); e.Type != protocol.TypeInitialize {
+		t.Fatalf("expected an initialize frame got %s", e.Type)
+	}
+	envelope, _ := protocol.New(protocol.TypeJoin, "general", nil)
+	manager.incoming <- &frame{Envelope: envelope, client: alice}
+	quiet(t, alice)
+
+	// bob's upload isn't alice's to send
+	post(&protocol.Send{Text: "look", Attachments: []string{"a1", "b1"}})
+	if e := next(t, alice); e.Type != protocol.TypeError {
+		t.Fatalf("expected sending bob's attachment to be refused got %s", e.Type)
+	}
+	if cass.LogMessageInvoked {
+		t.Fatal("expected nothing to be logged")
+	}
+
+	// the ack comes straight back while the message goes around the backplane
+	post(&protocol.Send{Attachments: []string{"a1"}})
+	message := &structs.Message{}
+	for i := 0; i < 2; i++ {
+		switch e := next(t, alice); e.Type {
+		case protocol.TypeAck:
+		case protocol.TypeMessage:
+			e.Unmarshal(message)
+		default:
+			t.Fatalf("expected the message and an ack got %s", e.Type)
+		}
+	}
+	if attached != "m1" || len(message.Attachments) != 1 || message.Attachments[0].Name != "plan.pdf" {
+		t.Fatalf("expected plan.pdf to be sent with m1 got %+v", message.Attachments)
+	}
+
+	// an attachment is only sent once
+	post(&protocol.Send{Text: "again", Attachments: []string{"a1"}})
+	if e := next(t, alice); e.Type != protocol.TypeError {
+		t.Fatalf("expected sending a1 again to be refused got %s", e.Type)
+	}
+}
+
+func TestClientManagerPreviews(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<html><head><meta property="og:title" content="Launch plan"></head></html>`)
+	}))
+	defer server.Close()
+
+	var (
+		bp     = backplane.NewMemory()
+		stored = make(chan []*structs.Preview, 1)
+		cass   = &cassandra.MockCassandra{
+			AuthorizeFn: func(cid, uid string, action structs.Action) (structs.Role, error) {
+				return structs.RoleMember, nil
+			},
+			LogMessageFn: func(cid, oid, body, html string) (*structs.Message, error) {
+				message := structs.NewMessage(cid, &structs.User{ID: oid}, body, time.Now())
+				message.ID = "m1"
+				return message, nil
+			},
+			MarkReadFn: func(cid, uid, mid string) (bool, error) {
+				return true, nil
+			},
+			SetPreviewsFn: func(cid, mid string, previews []*structs.Preview) error {
+				stored <- previews
+				return nil
+			},
+		}
+		manager = NewClientManager(cass, bp, search.NewMemory(), unfurl.NewFetcher(server.Client()))
+		alice   = testClient(manager, "alice")
+		link    = server.URL + "/plan"
+	)
+	defer bp.Close()
+
+	manager.register <- alice
+	if e := next(t, alice); e.Type != protocol.TypeInitialize {
+		t.Fatalf("expected an initialize frame got %s", e.Type)
+	}
+	envelope, _ := protocol.New(protocol.TypeJoin, "general", nil)
+	manager.incoming <- &frame{Envelope: envelope, client: alice}
+	quiet(t, alice)
+
+	envelope, _ = protocol.New(protocol.TypeSend, "general", &protocol.Send{Text: "the plan (" + link + ")."})
+	manager.incoming <- &frame{Envelope: envelope, client: alice}
+
+	// the preview follows the message and its ack once the page has been fetched
+	previews := &structs.Previews{}
+	for i := 0; i < 3; i++ {
+		switch e := next(t, alice); e.Type {
+		case protocol.TypeAck, protocol.TypeMessage:
+		case protocol.TypePreview:
+			e.Unmarshal(previews)
+		default:
+			t.Fatalf("expected the message, an ack and its previews got %s", e.Type)
+		}
+	}
+
+	if previews.Message != "m1" || len(previews.Previews) != 1 {
+		t.Fatalf("expected the preview of m1 got %+v", previews)
+	}
+	if p := previews.Previews[0]; p.URL != link || p.Title != "Launch plan" {
+		t.Fatalf("expected the preview of %s got %+v", link, p)
+	}
+	if p := <-stored; len(p) != 1 || p[0].URL != link {
+		t.Fatalf("expected the preview to be stored got %+v", p)
+	}
+
+	// links aren't unfurled while as many messages as allowed are being unfurled
+	for i := 0; i < maxUnfurls; i++ {
+		manager.unfurls <- struct{}{}
+	}
+	manager.incoming <- &frame{Envelope: envelope, client: alice}
+	for i := 0; i < 2; i++ {
+		if e := next(t, alice); e.Type != protocol.TypeAck && e.Type != protocol.TypeMessage {
+			t.Fatalf("expected the message and an ack got %s", e.Type)
+		}
+	}
+	quiet(t, alice)
+}
+
+func TestClientManagerReplay(t *testing.T) {
+	var (
+		bp     = backplane.NewMemory()
+		stored = map[string]int{"general": 2*replayPageSize + 3, "random": 2}
+		cass   = &cassandra.MockCassandra{
+			AuthorizeFn: func(cid, uid string, action structs.Action) (structs.Role, error) {
+				return structs.RoleMember, nil
+			},
+			GetUsersInChannelFn: func(cid string) ([]*structs.User, error) {
+				return []*structs.User{structs.NewUser("bob", "Bob", "")}, nil
+			},
+			GetMessagesSinceFn: func(cid, since string, limit int) ([]*structs.Message, error) {
+				messages := []*structs.Message{}
+				for i := 1; i <= stored[cid] && len(messages) < limit; i++ {
+					if id := fmt.Sprintf("%02d", i); id > since {
+						message := structs.NewMessage(cid, &structs.User{ID: "bob"}, id, time.Now())
+						message.ID = id
+						messages = append(messages, message)
+					}
+				}
+				return messages, nil
+			},
+		}
+		manager = NewClientManager(cass, bp, search.NewMemory(), nil)
+		alice   = testClient(manager, "alice")
+	)
+	defer bp.Close()
+
+	// alice's send buffer is no bigger than a real client's and she's missed more than fits in it
+	alice.send = make(chan *protocol.Envelope, clientSendBufferSize)
+	alice.lastSeen = "00"
+
+	post := func(t protocol.Type, channel string, payload interface{}) {
+		envelope, _ := protocol.New(t, channel, payload)
+		manager.incoming <- &frame{Envelope: envelope, client: alice}
+	}
+
+	// replayed expects the next n frames to be the missed messages of the channel and acks them
+	replayed := func(channel string, from, n int) {
+		t.Helper()
+		var seq uint64
+		for i := from; i < from+n; i++ {
+			e := next(t, alice)
+			message := &structs.Message{}
+			if e.Type != protocol.TypeMessage || e.Unmarshal(message) != nil {
+				t.Fatalf("expected a replayed message got %s", e.Type)
+			}
+			if id := fmt.Sprintf("%02d", i); e.Channel != channel || message.ID != id {
+				t.Fatalf("expected %s %s got %s %s", channel, id, e.Channel, message.ID)
+			} else if message.Author.Name != "Bob" {
+				t.Fatalf("expected the author to be filled in got %+v", message.Author)
+			}
+			seq = e.Seq
+		}
+		quiet(t, alice)
+		post(protocol.TypeAck, "", &protocol.Ack{Seq: seq})
+	}
+
+	manager.register <- alice
+	if e := next(t, alice); e.Type != protocol.TypeInitialize {
+		t.Fatalf("expected an initialize frame got %s", e.Type)
+	}
+
+	// random waits for general to finish replaying
+	post(protocol.TypeJoin, "general", nil)
+	post(protocol.TypeJoin, "random", nil)
+
+	replayed("general", 1, replayPageSize)
+	replayed("general", replayPageSize+1, replayPageSize)
+	replayed("general", 2*replayPageSize+1, 3)
+	replayed("random", 1, 2)
+}
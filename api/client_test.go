@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sir-wiggles/chat/api/protocol"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+func TestClientQueue(t *testing.T) {
+	var (
+		client      = &Client{send: make(chan *protocol.Envelope, maxUnackedFrames+1)}
+		envelope, _ = protocol.New(protocol.TypeSystem, "general", nil)
+	)
+
+	for i := 0; i < 3; i++ {
+		if !client.queue(envelope) {
+			t.Fatalf("frame %d was not queued", i)
+		}
+	}
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		if e := <-client.send; e.Seq != seq {
+			t.Fatalf("expected seq %d got %d", seq, e.Seq)
+		}
+	}
+
+	if envelope.Seq != 0 {
+		t.Fatal("the shared envelope should not be numbered")
+	}
+
+	client.acknowledge(2)
+	if len(client.unacked) != 1 || client.unacked[0].Seq != 3 {
+		t.Fatalf("expected only seq 3 to be unacked got %v", client.unacked)
+	}
+
+	client.acknowledge(3)
+	if len(client.unacked) != 0 {
+		t.Fatalf("expected nothing to be unacked got %v", client.unacked)
+	}
+}
+
+func TestClientQueueBackPressure(t *testing.T) {
+	var envelope, _ = protocol.New(protocol.TypeSystem, "general", nil)
+
+	// a full send buffer refuses the frame without using up a seq
+	full := &Client{send: make(chan *protocol.Envelope)}
+	if full.queue(envelope) || full.seq != 0 {
+		t.Fatal("expected the frame to be refused")
+	}
+
+	// as does a client that has stopped acking
+	slow := &Client{send: make(chan *protocol.Envelope, maxUnackedFrames+1)}
+	for i := 0; i < maxUnackedFrames; i++ {
+		slow.queue(envelope)
+	}
+	if slow.queue(envelope) {
+		t.Fatal("expected the frame to be refused")
+	}
+
+	slow.acknowledge(slow.seq)
+	if !slow.queue(envelope) {
+		t.Fatal("expected the frame to be queued once acked")
+	}
+}
+
+func TestClientHeartbeat(t *testing.T) {
+	defer func(pong, ping time.Duration) { pongWait, pingPeriod = pong, ping }(pongWait, pingPeriod)
+	pongWait, pingPeriod = 200*time.Millisecond, 50*time.Millisecond
+
+	var (
+		manager = &ClientManager{unregister: make(chan *Client, 1)}
+		clients = make(chan *Client, 1)
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		socket, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients <- NewClient(manager, socket, &structs.User{ID: "alice"}, "")
+	}))
+	defer server.Close()
+
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	reaped := reapedConnections.Value()
+
+	// a peer that keeps reading answers pings and outlives pongWait
+	alive := dial()
+	<-clients
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-manager.unregister:
+		t.Fatal("a responsive connection was reaped")
+	case <-time.After(3 * pongWait):
+	}
+
+	// a peer that never reads never answers a ping
+	silent := dial()
+	defer silent.Close()
+	client := <-clients
+
+	select {
+	case c := <-manager.unregister:
+		if c != client {
+			t.Fatal("the wrong client was unregistered")
+		}
+	case <-time.After(3 * pongWait):
+		t.Fatal("the silent connection was not reaped")
+	}
+
+	if n := reapedConnections.Value() - reaped; n != 1 {
+		t.Fatalf("expected 1 reaped connection got %d", n)
+	}
+
+	// a peer that closes is unregistered without being counted as reaped
+	alive.Close()
+	<-manager.unregister
+	if n := reapedConnections.Value() - reaped; n != 1 {
+		t.Fatalf("expected 1 reaped connection got %d", n)
+	}
+}
+
+func TestVars(t *testing.T) {
+	w := httptest.NewRecorder()
+	vars(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+
+	var counters map[string]int64
+	if err := json.Unmarshal(w.Body.Bytes(), &counters); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := counters["reaped_connections"]; !ok || len(counters) != 1 {
+		t.Fatalf("expected only the reaped connections got %s", w.Body)
+	}
+}
+
+func TestClientRendersMarkdown(t *testing.T) {
+	var (
+		manager = &ClientManager{incoming: make(chan *frame, 2), unregister: make(chan *Client, 1)}
+		clients = make(chan *Client, 1)
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		socket, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients <- NewClient(manager, socket, &structs.User{ID: "alice"}, "")
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-clients
+
+	for _, frame := range []struct {
+		typ     protocol.Type
+		payload interface{}
+	}{
+		{protocol.TypeSend, &protocol.Send{Text: "**hi** <b>"}},
+		{protocol.TypeTyping, &protocol.Typing{Active: true}},
+	} {
+		envelope, _ := protocol.New(frame.typ, "general", frame.payload)
+		data, _ := protocol.Encode(envelope)
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the text of send frames is rendered before the manager gets them
+	if f := <-manager.incoming; f.html != "<p><strong>hi</strong> &lt;b&gt;</p>" {
+		t.Fatalf("expected the send frame to be rendered got %q", f.html)
+	}
+	if f := <-manager.incoming; f.html != "" {
+		t.Fatalf("expected only send frames to be rendered got %q", f.html)
+	}
+}
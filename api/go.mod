@@ -2,8 +2,11 @@ module github.com/sir-wiggles/chat/api
 
 require (
 	cloud.google.com/go v0.34.0 // indirect
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gocql/gocql v0.0.0-20181124151448-70385f88b28b
+	github.com/gomodule/redigo v1.8.9
 	github.com/gorilla/context v1.1.1 // indirect
 	github.com/gorilla/handlers v1.4.0
 	github.com/gorilla/mux v1.6.2
@@ -14,7 +17,9 @@ require (
 	github.com/mattn/go-isatty v0.0.4 // indirect
 	github.com/pilu/config v0.0.0-20131214182432-3eb99e6c0b9a // indirect
 	github.com/pilu/fresh v0.0.0-20170301142741-9c0092493eff // indirect
-	golang.org/x/net v0.0.0-20181217023233-e147a9138326 // indirect
+	github.com/yuin/gopher-lua v0.0.0-20220504180219-658193537a64 // indirect
+	golang.org/x/crypto v0.0.0-20190103213133-ff983b9c42bc
+	golang.org/x/net v0.0.0-20181217023233-e147a9138326
 	golang.org/x/oauth2 v0.0.0-20181203162652-d668ce993890
 	golang.org/x/sync v0.0.0-20181108010431-42b317875d0f // indirect
 	google.golang.org/appengine v1.3.0 // indirect
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// attemptLimiter counts failed attempts per key, such as a username or an ip, refusing further
+// attempts once max of them have failed within the window
+type attemptLimiter struct {
+	mu       sync.Mutex
+	max      int
+	window   time.Duration
+	failures map[string][]time.Time
+
+	// swept is when every key was last pruned
+	swept time.Time
+}
+
+func newAttemptLimiter(max int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		max:      max,
+		window:   window,
+		failures: make(map[string][]time.Time),
+	}
+}
+
+// Allow reports whether an attempt may be made for every key.  If not the time until the oldest
+// failure of the most limited key leaves the window is returned.
+func (l *attemptLimiter) Allow(keys ...string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var (
+		now   = time.Now()
+		retry time.Duration
+	)
+	l.sweep(now)
+	for _, key := range keys {
+		failures := l.prune(key, now)
+		if len(failures) < l.max {
+			continue
+		}
+		if wait := failures[len(failures)-l.max].Add(l.window).Sub(now); wait > retry {
+			retry = wait
+		}
+	}
+	return retry == 0, retry
+}
+
+// Fail records a failed attempt against every key
+func (l *attemptLimiter) Fail(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	for _, key := range keys {
+		l.failures[key] = append(l.prune(key, now), now)
+	}
+}
+
+// Reset forgets the failures of the keys after a successful attempt
+func (l *attemptLimiter) Reset(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+}
+
+// sweep prunes every key once per window so the keys that are never tried again, such as the
+// usernames guessed by someone, are forgotten
+func (l *attemptLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.window {
+		return
+	}
+	l.swept = now
+	for key := range l.failures {
+		l.prune(key, now)
+	}
+}
+
+// prune drops the failures of the key that have left the window
+func (l *attemptLimiter) prune(key string, now time.Time) []time.Time {
+	failures := l.failures[key]
+
+	i := 0
+	for i < len(failures) && now.Sub(failures[i]) >= l.window {
+		i++
+	}
+	failures = failures[i:]
+
+	if len(failures) == 0 {
+		delete(l.failures, key)
+		return nil
+	}
+	l.failures[key] = failures
+	return failures
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -16,59 +15,99 @@ import (
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"github.com/sir-wiggles/chat/api/backplane"
 	"github.com/sir-wiggles/chat/api/cassandra"
 	"github.com/sir-wiggles/chat/api/postgres"
+	"github.com/sir-wiggles/chat/api/search"
+	"github.com/sir-wiggles/chat/api/unfurl"
 )
 
-func init() {
-
-	data, err := ioutil.ReadFile("./oauth.json")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	dataReader := bytes.NewReader(data)
-
-	clientInfo := struct {
-		ID     string `json:"client_id"`
-		Secret string `json:"client_secret"`
-	}{}
-
-	err = json.NewDecoder(dataReader).Decode(&clientInfo)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	googleClientID = clientInfo.ID
-	googleClientSecret = clientInfo.Secret
-
-	log.Println(clientInfo)
-
-}
-
 var (
 	port               = os.Getenv("PORT")
 	host               = os.Getenv("HOST")
 	postgresURL        = os.Getenv("POSTGRES_URL")
 	cassandraURL       = os.Getenv("CASSANDRA_URL")
 	cassandraURLs      []string
+	backplaneURL       = os.Getenv("BACKPLANE_URL")
+	searchURL          = os.Getenv("SEARCH_URL")
 	corsAllowedHeaders = os.Getenv("CORS_ALLOWED_HEADERS")
 	corsAllowedMethods = os.Getenv("CORS_ALLOWED_METHODS")
 	corsAllowedOrigins = os.Getenv("CORS_ALLOWED_ORIGINS")
 
+	// debugAddress is the internal address the connection counters are served on.  It defaults to
+	// localhost so they aren't reachable from outside, setting it empty doesn't serve them at all.
+	debugAddress = os.Getenv("DEBUG_ADDRESS")
+
 	secretSigningKey = os.Getenv("JWT_SECRET_KEY")
 	jwtIssuer        = os.Getenv("JWT_ISSUER")
+	jwtAudience      = os.Getenv("JWT_AUDIENCE")
 	jwtExpiresAt     int64
 	_jwtExpiresAt    = os.Getenv("JWT_EXPIRES_IN_MINUTES")
 
+	// refreshTokenTTL is how long a refresh token can be used for
+	refreshTokenTTL = 30 * 24 * time.Hour
+
+	// maxFailedLogins is how many logins may fail for a username or ip within failedLoginWindow
+	// before further attempts are refused
+	maxFailedLogins   = 5
+	failedLoginWindow = 15 * time.Minute
+
+	incomingChannelBufferSize   = 8
 	broadcastChannelBufferSize  = 8
 	registerChannelBufferSize   = 8
 	unregisterChannelBufferSize = 8
+	answerChannelBufferSize     = 8
+	revocationChannelBufferSize = 8
+	clientSendBufferSize        = 32
+
+	// clientPostBufferSize is how many frames of a client may wait on the database, frames sent
+	// while that many wait are answered with an error
+	clientPostBufferSize = 8
+
+	// maxUnackedFrames is how far a client may fall behind acking before it's dropped
+	maxUnackedFrames = 256
+
+	// maxReplayMessages is the most messages per channel replayed to a reconnecting client
+	maxReplayMessages = 500
+
+	// replayPageSize is how many messages are replayed to a client before it has to ack them, it
+	// leaves room in the send buffer for the frames sent alongside
+	replayPageSize = clientSendBufferSize / 2
+
+	// unfurlLinks is whether previews of the links in messages are fetched, unfurlTimeout is how
+	// long fetching the previews of a message may take
+	unfurlLinks   = true
+	unfurlTimeout = unfurl.DefaultTimeout
+
+	// maxUnfurls is the most messages whose links are unfurled at once, the links of messages sent
+	// while that many are being unfurled aren't
+	maxUnfurls = 32
+
+	// typingTimeout is how long a client is typing for unless it says it still is
+	typingTimeout = 6 * time.Second
+
+	// presenceHeartbeat is how often a node reminds the others who is connected to it.  A node
+	// that misses three heartbeats is taken to have gone away along with its users.
+	presenceHeartbeat = 30 * time.Second
+
+	// pongWait is how long a client has to answer a ping before its connection is reaped.
+	// pingPeriod must be less than pongWait.
+	pongWait   = 60 * time.Second
+	pingPeriod = 50 * time.Second
 
-	googleClientID     string
-	googleClientSecret string
+	// writeWait is how long a write to a client may take before its connection is reaped
+	writeWait = 10 * time.Second
 
-	googleUserInfoURL = "https://www.googleapis.com/oauth2/v2/userinfo"
+	// maxMessageSize is the largest frame in bytes a client may send
+	maxMessageSize int64 = 64 * 1024
+
+	// providersConfig is the json file the oauth identity providers are configured from
+	providersConfig = os.Getenv("AUTH_PROVIDERS_CONFIG")
+
+	// trustedProxies are the proxies, such as the load balancer, whose X-Forwarded-For header is
+	// believed when limiting attempts per ip
+	trustedProxies  []*net.IPNet
+	_trustedProxies = os.Getenv("TRUSTED_PROXIES")
 )
 
 func main() {
@@ -79,27 +118,55 @@ func main() {
 	if err != nil {
 		log.Fatalf("Postgres Connection Error: %s", err)
 	}
+	defer db.Close()
 
 	cass, err := cassandra.New(cassandraURLs)
 	if err != nil {
-		log.Fatal("Cassandra Connection Error: %s", err)
+		log.Fatalf("Cassandra Connection Error: %s", err)
+	}
+
+	bp, err := backplane.Open(backplaneURL)
+	if err != nil {
+		log.Fatalf("Backplane Connection Error: %s", err)
+	}
+	defer bp.Close()
+
+	// messages are indexed in the postgres database unless another index is given
+	var messages search.Index = search.NewPostgres(db.DB)
+	if searchURL != "" {
+		if messages, err = search.Open(searchURL); err != nil {
+			log.Fatalf("Search Index Error: %s", err)
+		}
+	}
+	defer messages.Close()
+
+	// links are fetched by a client that won't connect to internal addresses
+	var fetcher *unfurl.Fetcher
+	if unfurlLinks {
+		fetcher = unfurl.NewFetcher(unfurl.NewClient(unfurlTimeout))
 	}
 
 	var (
-		auth    = NewAuthenticationController(cass)
+		auth    = NewAuthenticationController(cass, db, NewProviders(providersConfig, &http.Client{Timeout: 10 * time.Second}))
 		router  = mux.NewRouter()
-		chat    = NewClientManager(cass)
+		chat    = NewClientManager(cass, bp, messages, fetcher)
 		address = fmt.Sprintf("%s:%s", host, port)
 	)
 	router.NotFoundHandler = &NotFoundHandler{}
 
 	authR := router.NewRoute().PathPrefix("/auth").Methods("POST").Subrouter()
-	authR.Handle("/google", auth.SetHandler(auth.Google))
+	authR.Handle("/refresh", auth.SetHandler(auth.Refresh))
+	authR.Handle("/logout", auth.Middleware(auth.SetHandler(auth.Logout)))
+	authR.Handle("/{provider}", auth.SetHandler(auth.SignIn))
 
 	apiR := router.NewRoute().PathPrefix("/api").Subrouter()
 	apiR.Use(auth.Middleware)
 	apiR.Handle("/ws", chat).Methods("GET").Queries("token", "{token}")
 	apiR.HandleFunc("/health", health).Methods("GET")
+	apiR.HandleFunc("/presence", chat.Presence).Methods("GET")
+
+	router.Handle("/register", auth.SetHandler(auth.Register)).Methods("POST")
+	router.Handle("/authenticate", auth.SetHandler(auth.signInWith("local"))).Methods("POST")
 
 	router.HandleFunc("/chat", index)
 
@@ -120,6 +187,15 @@ func main() {
 		WriteTimeout: time.Second * 10,
 	}
 
+	if debugAddress != "" {
+		go func() {
+			debug := http.NewServeMux()
+			debug.HandleFunc("/debug/vars", vars)
+			log.Printf("debug server listening on %s", debugAddress)
+			log.Fatal(http.ListenAndServe(debugAddress, debug))
+		}()
+	}
+
 	log.Printf("server listening on %s", address)
 	log.Fatal(server.ListenAndServe())
 }
@@ -136,6 +212,37 @@ func health(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// vars serves the counters of the server as json.  Unlike expvar.Handler it leaves out the command
+// line, which holds the jwt secret, and the memory stats.
+func vars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{%q: %s}\n", "reaped_connections", reapedConnections.String())
+}
+
+// parseCIDRs parses a comma separated list of cidrs, a bare ip is taken as a cidr of just that ip
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var cidrs = make([]*net.IPNet, 0)
+	for _, cidr := range strings.Split(list, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, network)
+	}
+	return cidrs, nil
+}
+
 type NotFoundHandler struct{}
 
 func (h NotFoundHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -149,19 +256,60 @@ func flags() {
 	flag.StringVar(&host, "host", host, "host to serve on")
 	flag.StringVar(&postgresURL, "postgres", postgresURL, "postgres url")
 	flag.StringVar(&cassandraURL, "cassandra", cassandraURL, "cassandra url")
+	flag.StringVar(&backplaneURL, "backplane", backplaneURL, "backplane url shared by every node, redis://host:port or memory:// for a single node")
+	flag.StringVar(&searchURL, "search", searchURL, "search index url, postgres://... or memory:// for a single node, defaults to the postgres database")
 	flag.StringVar(&corsAllowedHeaders, "corsAllowedHeaders", corsAllowedHeaders, "headers allowed for cors")
 	flag.StringVar(&corsAllowedMethods, "corsAllowedMethods", corsAllowedMethods, "methods allowed for cors")
 	flag.StringVar(&corsAllowedOrigins, "corsAllowedOrigins", corsAllowedOrigins, "origins allowed for cors")
+	if debugAddress == "" {
+		debugAddress = "localhost:6060"
+	}
+	flag.StringVar(&debugAddress, "debug", debugAddress, "internal address the connection counters are served on at /debug/vars, empty to not serve them")
+	if providersConfig == "" {
+		providersConfig = "./oauth.json"
+	}
+	flag.StringVar(&providersConfig, "providers", providersConfig, "json file configuring the oauth identity providers")
 	flag.StringVar(&secretSigningKey, "jwtSecretKey", secretSigningKey, "secret for jwt token signing")
 	flag.StringVar(&jwtIssuer, "jwtIssuer", jwtIssuer, "issuer of the jwt token")
+	flag.StringVar(&jwtAudience, "jwtAudience", jwtAudience, "audience of the jwt token")
 
 	jwtExpiresAt, err = strconv.ParseInt(_jwtExpiresAt, 10, 64)
 	if err != nil {
 		log.Fatalf("Invalid value for jwtExpiresAt: %s should be a number", _jwtExpiresAt)
 	}
-	flag.Int64Var(&jwtExpiresAt, "jwtExpiresAt", jwtExpiresAt, "expiration of the jwt token")
+	flag.Int64Var(&jwtExpiresAt, "jwtExpiresAt", jwtExpiresAt, "minutes until the jwt token expires")
+	flag.DurationVar(&refreshTokenTTL, "refreshTokenTTL", refreshTokenTTL, "how long a refresh token can be used for")
+	flag.IntVar(&maxFailedLogins, "maxFailedLogins", maxFailedLogins, "failed logins allowed per username or ip within failedLoginWindow")
+	flag.DurationVar(&failedLoginWindow, "failedLoginWindow", failedLoginWindow, "window failed logins are counted over")
+	flag.StringVar(&_trustedProxies, "trustedProxies", _trustedProxies, "comma separated ips or cidrs of the proxies whose X-Forwarded-For is believed")
+
+	flag.DurationVar(&pongWait, "pongWait", pongWait, "time allowed to answer a ping before the connection is reaped")
+	flag.DurationVar(&pingPeriod, "pingPeriod", pingPeriod, "how often clients are pinged, must be less than pongWait")
+	flag.DurationVar(&writeWait, "writeWait", writeWait, "time allowed to write a frame to a client")
+	flag.Int64Var(&maxMessageSize, "maxMessageSize", maxMessageSize, "largest frame in bytes a client may send")
+	flag.BoolVar(&unfurlLinks, "unfurl", unfurlLinks, "fetch previews of the links in messages")
+	flag.DurationVar(&unfurlTimeout, "unfurlTimeout", unfurlTimeout, "how long fetching the previews of a message may take")
+	flag.IntVar(&maxUnfurls, "maxUnfurls", maxUnfurls, "most messages whose links are unfurled at once")
+	flag.DurationVar(&typingTimeout, "typingTimeout", typingTimeout, "how long a client is typing for unless it says it still is")
+	flag.DurationVar(&presenceHeartbeat, "presenceHeartbeat", presenceHeartbeat, "how often a node shares who is connected to it")
 
 	cassandraURLs = strings.Split(cassandraURL, ",")
 
 	flag.Parse()
+
+	if trustedProxies, err = parseCIDRs(_trustedProxies); err != nil {
+		log.Fatalf("Invalid value for trustedProxies: %s", err)
+	}
+
+	if secretSigningKey == "" || jwtIssuer == "" || jwtAudience == "" {
+		log.Fatal("jwtSecretKey, jwtIssuer and jwtAudience must all be set")
+	} else if jwtExpiresAt <= 0 {
+		log.Fatalf("Invalid value for jwtExpiresAt: %d should be a positive number of minutes", jwtExpiresAt)
+	}
+
+	if pingPeriod >= pongWait {
+		log.Fatalf("Invalid value for pingPeriod: %s should be less than pongWait %s", pingPeriod, pongWait)
+	} else if typingTimeout <= 0 || presenceHeartbeat <= 0 {
+		log.Fatal("typingTimeout and presenceHeartbeat must be positive")
+	}
 }
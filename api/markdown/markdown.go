@@ -0,0 +1,402 @@
+// Package markdown renders the markdown of messages to HTML.
+//
+// Only a subset of CommonMark is understood: paragraphs and line breaks, fenced code blocks,
+// code spans, emphasis, strong emphasis, links and backslash escapes.  Everything else is text.
+// The HTML is safe to render as is, raw HTML in the source is escaped rather than passed through
+// and links are only kept to http, https and mailto urls.
+package markdown
+
+import (
+	"html"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// maxDepth is how deeply emphasis and links are nested before the rest is taken as text
+	maxDepth = 16
+
+	// maxLabel and maxTarget are the longest label and url of a link
+	maxLabel  = 1000
+	maxTarget = 2048
+)
+
+// Render returns the markdown source as HTML.  Paragraphs are wrapped in <p> and code blocks in
+// <pre><code>, a source with neither gives an empty string.
+func Render(source string) string {
+	var (
+		out       = &strings.Builder{}
+		paragraph []string
+		lines     = strings.Split(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(source), "\n")
+	)
+
+	flush := func() {
+		if len(paragraph) == 0 {
+			return
+		}
+		text := strings.TrimSpace(strings.Join(paragraph, "\n"))
+		paragraph = paragraph[:0]
+		if text == "" {
+			return
+		}
+		if out.Len() > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString("<p>")
+		out.WriteString(render(text, 0))
+		out.WriteString("</p>")
+	}
+
+	for i := 0; i < len(lines); i++ {
+		fence, info, ok := openFence(lines[i])
+		if !ok {
+			if strings.TrimSpace(lines[i]) == "" {
+				flush()
+			} else {
+				paragraph = append(paragraph, lines[i])
+			}
+			continue
+		}
+
+		flush()
+		var code []string
+		for i++; i < len(lines) && !closesFence(lines[i], fence); i++ {
+			code = append(code, lines[i])
+		}
+		if out.Len() > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString("<pre><code")
+		if info != "" {
+			out.WriteString(` class="language-`)
+			out.WriteString(info)
+			out.WriteString(`"`)
+		}
+		out.WriteString(">")
+		for _, line := range code {
+			out.WriteString(html.EscapeString(line))
+			out.WriteByte('\n')
+		}
+		out.WriteString("</code></pre>")
+	}
+	flush()
+
+	return out.String()
+}
+
+// openFence reports whether the line opens a fenced code block returning the fence and the
+// language of the block if it's one that's safe to use as a class name
+func openFence(line string) (fence, info string, ok bool) {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 || len(trimmed) < 3 {
+		return "", "", false
+	}
+
+	var char = trimmed[0]
+	if char != '`' && char != '~' {
+		return "", "", false
+	}
+	n := 0
+	for n < len(trimmed) && trimmed[n] == char {
+		n++
+	}
+	if n < 3 {
+		return "", "", false
+	}
+
+	rest := strings.TrimSpace(trimmed[n:])
+	if char == '`' && strings.ContainsRune(rest, '`') {
+		return "", "", false
+	}
+	if fields := strings.Fields(rest); len(fields) > 0 && isLanguage(fields[0]) {
+		info = fields[0]
+	}
+	return trimmed[:n], info, true
+}
+
+// closesFence reports whether the line closes the block the fence opened
+func closesFence(line, fence string) bool {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return false
+	}
+	trimmed = strings.TrimRight(trimmed, " \t")
+	return len(trimmed) >= len(fence) && strings.Trim(trimmed, fence[:1]) == ""
+}
+
+// isLanguage reports whether the language of a code block is made of letters, digits, "+", "-"
+// and "_" only
+func isLanguage(s string) bool {
+	for _, r := range s {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("+-_", r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// inline is the text of a paragraph, or of the emphasis or link in it, being rendered.  It
+// remembers the delimiters that have no closer in the text so a source full of them isn't
+// searched again for each one.
+type inline struct {
+	unclosed map[string]bool
+}
+
+// render returns the text as HTML, depth is how deeply the text is nested in emphasis and links
+func render(text string, depth int) string {
+	var (
+		in  = &inline{unclosed: make(map[string]bool)}
+		out = &strings.Builder{}
+	)
+
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+
+		case c == '\\' && i+1 < len(text) && isPunct(text[i+1]):
+			out.WriteString(html.EscapeString(text[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '\n':
+			out.WriteString("<br>\n")
+			i++
+			continue
+
+		case c == '`':
+			if code, n, ok := in.codeSpan(text[i:]); ok {
+				out.WriteString("<code>")
+				out.WriteString(html.EscapeString(code))
+				out.WriteString("</code>")
+				i += n
+				continue
+			}
+			// a run of backticks without a closer is text
+			n := run(text[i:], '`')
+			out.WriteString(text[i : i+n])
+			i += n
+			continue
+
+		case c == '[' && depth < maxDepth:
+			if label, href, n, ok := in.link(text[i:]); ok {
+				out.WriteString(`<a href="`)
+				out.WriteString(html.EscapeString(href))
+				out.WriteString(`" rel="nofollow noopener noreferrer">`)
+				out.WriteString(render(label, depth+1))
+				out.WriteString("</a>")
+				i += n
+				continue
+			}
+
+		case (c == '*' || c == '_') && depth < maxDepth:
+			if tag, inner, n, ok := in.emphasis(text, i); ok {
+				out.WriteString("<" + tag + ">")
+				out.WriteString(render(inner, depth+1))
+				out.WriteString("</" + tag + ">")
+				i += n
+				continue
+			}
+			// a run of delimiters that doesn't open anything is text
+			n := run(text[i:], c)
+			out.WriteString(text[i : i+n])
+			i += n
+			continue
+		}
+
+		_, size := utf8.DecodeRuneInString(text[i:])
+		out.WriteString(html.EscapeString(text[i : i+size]))
+		i += size
+	}
+	return out.String()
+}
+
+// codeSpan returns the code of the span the text starts with and how long the span is.  A span
+// is closed by a run of as many backticks as it was opened with.
+func (in *inline) codeSpan(text string) (string, int, bool) {
+	var (
+		n     = run(text, '`')
+		fence = text[:n]
+	)
+	if in.unclosed[fence] {
+		return "", 0, false
+	}
+
+	for i := n; i < len(text); {
+		j := strings.Index(text[i:], fence)
+		if j < 0 {
+			break
+		}
+		j += i
+		if m := run(text[j:], '`'); m != n {
+			i = j + m
+			continue
+		}
+
+		code := strings.Replace(text[n:j], "\n", " ", -1)
+		if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+			code = code[1 : len(code)-1]
+		}
+		return code, j + n, true
+	}
+
+	in.unclosed[fence] = true
+	return "", 0, false
+}
+
+// link returns the label and url of the link the text starts with and how long the link is.
+// Links to urls that aren't http, https or mailto aren't links.
+func (in *inline) link(text string) (label, href string, n int, ok bool) {
+	nesting := 0
+	end := -1
+	for i := 1; i < len(text) && i <= maxLabel && end < 0; i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '[':
+			nesting++
+		case ']':
+			if nesting == 0 {
+				end = i
+			}
+			nesting--
+		}
+	}
+	if end < 0 {
+		return "", "", 0, false
+	}
+
+	rest := text[end+1:]
+	if !strings.HasPrefix(rest, "(") {
+		return "", "", 0, false
+	}
+	if len(rest) > maxTarget+2 {
+		rest = rest[:maxTarget+2]
+	}
+	closing := strings.IndexByte(rest, ')')
+	if closing < 0 {
+		return "", "", 0, false
+	}
+
+	target := strings.TrimSpace(rest[1:closing])
+	if strings.HasPrefix(target, "<") && strings.HasSuffix(target, ">") {
+		target = target[1 : len(target)-1]
+	}
+	if target == "" || strings.ContainsAny(target, " \t\n<>") {
+		return "", "", 0, false
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "mailto") {
+		return "", "", 0, false
+	}
+	if label = text[1:end]; strings.TrimSpace(label) == "" {
+		return "", "", 0, false
+	}
+	return label, u.String(), end + 1 + closing + 1, true
+}
+
+// emphasis returns the tag and text of the emphasis opened by the delimiter at i and how long it
+// is.  Two delimiters give strong emphasis and one gives emphasis.  Underscores only open and
+// close emphasis at the edges of words so snake_case_names are left be.
+func (in *inline) emphasis(text string, i int) (tag, inner string, n int, ok bool) {
+	var (
+		c     = text[i]
+		count = run(text[i:], c)
+	)
+
+	for _, size := range []int{2, 1} {
+		if count < size {
+			continue
+		}
+		delim := strings.Repeat(string(c), size)
+		if in.unclosed[delim] {
+			continue
+		}
+
+		start := i + size
+		if start >= len(text) {
+			continue
+		}
+		if r, _ := utf8.DecodeRuneInString(text[start:]); isSpace(r) {
+			continue
+		}
+		if c == '_' && i > 0 && isWordByte(text, i-1) {
+			continue
+		}
+
+		if end, found := in.closer(text, start, delim); found {
+			tag = "em"
+			if size == 2 {
+				tag = "strong"
+			}
+			return tag, text[start:end], end + size - i, true
+		}
+	}
+	return "", "", 0, false
+}
+
+// closer returns where the delimiter that closes emphasis opened before start is.  A closer
+// follows text rather than space and a single delimiter isn't part of a longer run.
+func (in *inline) closer(text string, start int, delim string) (int, bool) {
+	var c = delim[0]
+
+	for j := start + 1; j < len(text); {
+		k := strings.Index(text[j:], delim)
+		if k < 0 {
+			break
+		}
+		k += j
+
+		var (
+			before, _ = utf8.DecodeLastRuneInString(text[:k])
+			after     = k + len(delim)
+		)
+		switch {
+		case text[k-1] == '\\' || isSpace(before):
+		case len(delim) == 1 && (text[k-1] == c || (after < len(text) && text[after] == c)):
+		case c == '_' && after < len(text) && isWordByte(text, after):
+		default:
+			// a longer run closes with its last delimiters so ***both*** nests the emphasis
+			return k + run(text[k:], c) - len(delim), true
+		}
+		j = k + 1
+	}
+
+	// a closer that isn't there for this opener isn't there for any later one either
+	in.unclosed[delim] = true
+	return 0, false
+}
+
+// run returns how many times c repeats at the start of the text
+func run(text string, c byte) int {
+	n := 0
+	for n < len(text) && text[n] == c {
+		n++
+	}
+	return n
+}
+
+// isPunct reports whether the byte is ASCII punctuation, which can be backslash escaped
+func isPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+// isSpace reports whether the rune is white space
+func isSpace(r rune) bool {
+	return unicode.IsSpace(r)
+}
+
+// isWordByte reports whether the character at i is a letter or digit
+func isWordByte(text string, i int) bool {
+	if text[i] < utf8.RuneSelf {
+		r := rune(text[i])
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+	for i > 0 && !utf8.RuneStart(text[i]) {
+		i--
+	}
+	r, _ := utf8.DecodeRuneInString(text[i:])
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,147 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRender(t *testing.T) {
+	var tt = []struct {
+		name   string
+		source string
+		html   string
+	}{
+		{
+			name:   "renders nothing for an empty source",
+			source: " \n\n ",
+			html:   "",
+		},
+		{
+			name:   "renders paragraphs and line breaks",
+			source: "one\ntwo\n\n\nthree\r\n",
+			html:   "<p>one<br>\ntwo</p>\n<p>three</p>",
+		},
+		{
+			name:   "renders emphasis",
+			source: "**bold** __bold__ *italic* _italic_",
+			html:   "<p><strong>bold</strong> <strong>bold</strong> <em>italic</em> <em>italic</em></p>",
+		},
+		{
+			name:   "renders emphasis around multi-byte runes",
+			source: "*voilà* **à la carte** _ça_",
+			html:   "<p><em>voilà</em> <strong>à la carte</strong> <em>ça</em></p>",
+		},
+		{
+			name:   "nests emphasis",
+			source: "***both*** **bold *and italic***",
+			html:   "<p><strong><em>both</em></strong> <strong>bold <em>and italic</em></strong></p>",
+		},
+		{
+			name:   "leaves delimiters that don't open anything",
+			source: "2 * 3 * 4, snake_case_name, ** spaced ** and *unclosed",
+			html:   "<p>2 * 3 * 4, snake_case_name, ** spaced ** and *unclosed</p>",
+		},
+		{
+			name:   "renders code spans literally",
+			source: "run `go **test** <b>` or ``a ` b``",
+			html:   "<p>run <code>go **test** &lt;b&gt;</code> or <code>a ` b</code></p>",
+		},
+		{
+			name:   "renders code blocks literally",
+			source: "before\n```go\nfunc main() {\n\t<b>*x*</b>\n}\n```\nafter",
+			html:   "<p>before</p>\n<pre><code class=\"language-go\">func main() {\n\t&lt;b&gt;*x*&lt;/b&gt;\n}\n</code></pre>\n<p>after</p>",
+		},
+		{
+			name:   "closes code blocks at the end of the source",
+			source: "~~~\nno closer",
+			html:   "<pre><code>no closer\n</code></pre>",
+		},
+		{
+			name:   "renders links",
+			source: "[the **docs**](https://example.com/a?b=1&c=2) and [mail](mailto:a@example.com)",
+			html: `<p><a href="https://example.com/a?b=1&amp;c=2" rel="nofollow noopener noreferrer">the <strong>docs</strong></a>` +
+				` and <a href="mailto:a@example.com" rel="nofollow noopener noreferrer">mail</a></p>`,
+		},
+		{
+			name:   "renders backslash escapes",
+			source: `\*not italic\* \[not a link](https://example.com) \<`,
+			html:   `<p>*not italic* [not a link](https://example.com) &lt;</p>`,
+		},
+	}
+
+	for _, tt := range tt {
+		t.Run(tt.name, func(t *testing.T) {
+			if html := Render(tt.source); html != tt.html {
+				t.Fatalf("expected\n%s\ngot\n%s", tt.html, html)
+			}
+		})
+	}
+}
+
+func TestRenderSanitizes(t *testing.T) {
+	var tt = []struct {
+		name   string
+		source string
+		html   string
+	}{
+		{
+			name:   "escapes html",
+			source: `<script>alert(1)</script><img src=x onerror="alert(1)">`,
+			html:   `<p>&lt;script&gt;alert(1)&lt;/script&gt;&lt;img src=x onerror=&#34;alert(1)&#34;&gt;</p>`,
+		},
+		{
+			name:   "drops javascript links",
+			source: `[click](javascript:alert(1)) [click](JavaScript:alert(1))`,
+			html:   `<p>[click](javascript:alert(1)) [click](JavaScript:alert(1))</p>`,
+		},
+		{
+			name:   "drops data and relative links",
+			source: `[a](data:text/html,hi) [b](/relative) [c](//example.com)`,
+			html:   `<p>[a](data:text/html,hi) [b](/relative) [c](//example.com)</p>`,
+		},
+		{
+			name:   "keeps quotes in links out of the attribute",
+			source: `[a](https://example.com/"onmouseover="alert(1))`,
+			html:   `<p><a href="https://example.com/%22onmouseover=%22alert%281" rel="nofollow noopener noreferrer">a</a>)</p>`,
+		},
+		{
+			name:   "escapes the language of code blocks it doesn't drop",
+			source: "```\"><script>\nx\n```",
+			html:   "<pre><code>x\n</code></pre>",
+		},
+		{
+			name:   "escapes text in emphasis and links",
+			source: `**<i>** [<b>](https://example.com)`,
+			html:   `<p><strong>&lt;i&gt;</strong> <a href="https://example.com" rel="nofollow noopener noreferrer">&lt;b&gt;</a></p>`,
+		},
+	}
+
+	for _, tt := range tt {
+		t.Run(tt.name, func(t *testing.T) {
+			if html := Render(tt.source); html != tt.html {
+				t.Fatalf("expected\n%s\ngot\n%s", tt.html, html)
+			}
+		})
+	}
+}
+
+func TestRenderPathological(t *testing.T) {
+	var sources = []string{
+		strings.Repeat("*a ", 20000),
+		strings.Repeat("_", 60000),
+		strings.Repeat("[", 30000) + "]",
+		strings.Repeat("**a ", 15000),
+		strings.Repeat("`", 60000),
+		strings.Repeat("[a](", 15000),
+		strings.Repeat("*", 20000) + "a" + strings.Repeat("*", 20000),
+	}
+
+	for _, source := range sources {
+		start := time.Now()
+		Render(source)
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("expected %.20q... to render quickly took %s", source, elapsed)
+		}
+	}
+}
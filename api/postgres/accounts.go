@@ -0,0 +1,60 @@
+package postgres
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+var (
+	ErrUsernameTaken = errors.New("username is taken")
+	ErrUserNotFound  = errors.New("user not found")
+)
+
+// uniqueViolation is the postgres error code for a unique constraint failing
+const uniqueViolation = "23505"
+
+// CreateLocalUser stores a user that signs in with a username and password rather than google.
+// The ID of the user must already be set.
+func (db *Postgres) CreateLocalUser(user *structs.User, username string, passwordHash []byte) error {
+	const query = `
+		INSERT INTO
+			users (uuid, name, email, picture, username, password_hash)
+		VALUES
+			($1, $2, NULLIF($3, ''), $4, $5, $6);`
+
+	_, err := db.conn.Exec(query, user.ID, user.Name, user.Email, user.Avatar, username, string(passwordHash))
+	if e, ok := err.(*pq.Error); ok && e.Code == uniqueViolation {
+		return ErrUsernameTaken
+	}
+	return err
+}
+
+// GetLocalUser returns the user with the username along with their password hash
+func (db *Postgres) GetLocalUser(username string) (*structs.User, []byte, error) {
+	const query = `
+		SELECT
+			uuid, name, picture, password_hash
+		FROM
+			users
+		WHERE
+			username = $1;`
+
+	var (
+		user    = &structs.User{}
+		picture sql.NullString
+		hash    string
+	)
+
+	err := db.QueryRow(query, username).Scan(&user.ID, &user.Name, &picture, &hash)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	user.Avatar = picture.String
+	return user, []byte(hash), nil
+}
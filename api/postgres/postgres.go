@@ -2,14 +2,24 @@ package postgres
 
 import (
 	"database/sql"
+	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/sir-wiggles/chat/api/structs"
 )
 
 // Controller exposes the methods needed to mock
 type Controller interface {
 	QueryRow(query string, args ...interface{}) Scanner
-	GetOrCreateUser(user *UserModel) error
+	GetOrCreateUser(user *structs.User) (bool, error)
+	CreateLocalUser(user *structs.User, username string, passwordHash []byte) error
+	GetLocalUser(username string) (*structs.User, []byte, error)
+
+	CreateRefreshToken(token *RefreshToken) error
+	RotateRefreshToken(hash []byte, next *RefreshToken) (*RefreshToken, error)
+	RevokeRefreshToken(hash []byte, userID string) error
+	RevokeToken(jti string, expiresAt time.Time) error
+	IsTokenRevoked(jti string) (bool, error)
 }
 
 // Scanner provides an interface around the Row scan function for easy testing
@@ -34,7 +44,7 @@ func New(url string) (*Postgres, error) {
 		return nil, err
 	}
 
-	return &Postgres{conn: conn}, nil
+	return &Postgres{DB: conn, conn: conn}, nil
 }
 
 // QueryRow wraps the default sql.QueryRow but with a custom Scanner interface for testing
@@ -42,23 +52,17 @@ func (db Postgres) QueryRow(query string, args ...interface{}) Scanner {
 	return db.conn.QueryRow(query, args...)
 }
 
-type UserModel struct {
-	GID        string `json:"id"`
-	Email      string `json:"email"`
-	Name       string `json:"name"`
-	Picture    string `json:"picture"`
-	WasCreated bool   `json:"was_created"`
-}
-
 // GetOrCreateUser is a query that will create a user if one does not exist or retrieve an
 // existing one. There are four args in this query: name, email picture and gid respectively.
-func (db *Postgres) GetOrCreateUser(user *UserModel) error {
+// The ID of the user is filled in and true is returned if the user was created.
+func (db *Postgres) GetOrCreateUser(user *structs.User) (bool, error) {
 
 	var (
-		name    = user.Name
-		email   = user.Email
-		picture = user.Picture
-		gid     = user.GID
+		name     = user.Name
+		email    = user.Email
+		picture  = user.Avatar
+		gid      = user.GID
+		existing bool
 	)
 
 	const query = `
@@ -89,7 +93,8 @@ func (db *Postgres) GetOrCreateUser(user *UserModel) error {
 		WHERE
 			gid = $4;`
 
-	return db.QueryRow(query, name, email, picture, gid).
-		Scan(&user.WasCreated)
+	err := db.QueryRow(query, name, email, picture, gid).
+		Scan(&user.ID, &existing)
 
+	return !existing, err
 }
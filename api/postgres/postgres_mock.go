@@ -1,8 +1,38 @@
 package postgres
 
+import (
+	"time"
+
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
 type MockPostgres struct {
 	QueryRowFn      func(string, ...interface{}) Scanner
 	QueryRowInvoked bool
+
+	GetOrCreateUserFn      func(*structs.User) (bool, error)
+	GetOrCreateUserInvoked bool
+
+	CreateLocalUserFn      func(*structs.User, string, []byte) error
+	CreateLocalUserInvoked bool
+
+	GetLocalUserFn      func(string) (*structs.User, []byte, error)
+	GetLocalUserInvoked bool
+
+	CreateRefreshTokenFn      func(*RefreshToken) error
+	CreateRefreshTokenInvoked bool
+
+	RotateRefreshTokenFn      func([]byte, *RefreshToken) (*RefreshToken, error)
+	RotateRefreshTokenInvoked bool
+
+	RevokeRefreshTokenFn      func([]byte, string) error
+	RevokeRefreshTokenInvoked bool
+
+	RevokeTokenFn      func(string, time.Time) error
+	RevokeTokenInvoked bool
+
+	IsTokenRevokedFn      func(string) (bool, error)
+	IsTokenRevokedInvoked bool
 }
 
 func (m *MockPostgres) QueryRow(query string, args ...interface{}) Scanner {
@@ -10,6 +40,46 @@ func (m *MockPostgres) QueryRow(query string, args ...interface{}) Scanner {
 	return m.QueryRowFn(query, args...)
 }
 
+func (m *MockPostgres) GetOrCreateUser(user *structs.User) (bool, error) {
+	m.GetOrCreateUserInvoked = true
+	return m.GetOrCreateUserFn(user)
+}
+
+func (m *MockPostgres) CreateLocalUser(user *structs.User, username string, passwordHash []byte) error {
+	m.CreateLocalUserInvoked = true
+	return m.CreateLocalUserFn(user, username, passwordHash)
+}
+
+func (m *MockPostgres) GetLocalUser(username string) (*structs.User, []byte, error) {
+	m.GetLocalUserInvoked = true
+	return m.GetLocalUserFn(username)
+}
+
+func (m *MockPostgres) CreateRefreshToken(token *RefreshToken) error {
+	m.CreateRefreshTokenInvoked = true
+	return m.CreateRefreshTokenFn(token)
+}
+
+func (m *MockPostgres) RotateRefreshToken(hash []byte, next *RefreshToken) (*RefreshToken, error) {
+	m.RotateRefreshTokenInvoked = true
+	return m.RotateRefreshTokenFn(hash, next)
+}
+
+func (m *MockPostgres) RevokeRefreshToken(hash []byte, userID string) error {
+	m.RevokeRefreshTokenInvoked = true
+	return m.RevokeRefreshTokenFn(hash, userID)
+}
+
+func (m *MockPostgres) RevokeToken(jti string, expiresAt time.Time) error {
+	m.RevokeTokenInvoked = true
+	return m.RevokeTokenFn(jti, expiresAt)
+}
+
+func (m *MockPostgres) IsTokenRevoked(jti string) (bool, error) {
+	m.IsTokenRevokedInvoked = true
+	return m.IsTokenRevokedFn(jti)
+}
+
 type MockScanner struct {
 	ScanFn      func(dest ...interface{}) error
 	ScanInvoked bool
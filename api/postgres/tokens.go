@@ -0,0 +1,155 @@
+package postgres
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid")
+	ErrRefreshTokenExpired = errors.New("refresh token has expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, every token of the sign in has been revoked")
+)
+
+// RefreshToken is a refresh token as it's stored.  Only the hash of the token is kept so a leak
+// of the table doesn't leak usable tokens.
+type RefreshToken struct {
+	ID        string
+	Family    string
+	UserID    string
+	Hash      []byte
+	ExpiresAt time.Time
+}
+
+// CreateRefreshToken stores a new refresh token
+func (db *Postgres) CreateRefreshToken(token *RefreshToken) error {
+	const query = `
+		INSERT INTO
+			refresh_tokens (id, family, user_id, token_hash, expires_at)
+		VALUES
+			($1, $2, $3, $4, $5);`
+
+	_, err := db.conn.Exec(query, token.ID, token.Family, token.UserID, token.Hash, token.ExpiresAt)
+	return err
+}
+
+// RotateRefreshToken exchanges the refresh token with the given hash for next.  next joins the
+// family of the token it replaces and belongs to the same user, the replaced token is returned.
+// Presenting a token that was already rotated revokes its whole family.
+func (db *Postgres) RotateRefreshToken(hash []byte, next *RefreshToken) (*RefreshToken, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	const selectQuery = `
+		SELECT
+			id, family, user_id, expires_at, rotated_at, revoked_at
+		FROM
+			refresh_tokens
+		WHERE
+			token_hash = $1
+		FOR UPDATE;`
+
+	var (
+		current   = &RefreshToken{Hash: hash}
+		rotatedAt sql.NullString
+		revokedAt sql.NullString
+	)
+	err = tx.QueryRow(selectQuery, hash).
+		Scan(&current.ID, &current.Family, &current.UserID, &current.ExpiresAt, &rotatedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrRefreshTokenInvalid
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case revokedAt.Valid:
+		return nil, ErrRefreshTokenInvalid
+
+	case rotatedAt.Valid:
+		if err := revokeFamily(tx, current.Family); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+
+	case current.ExpiresAt.Before(time.Now()):
+		return nil, ErrRefreshTokenExpired
+	}
+
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET rotated_at = now() WHERE id = $1;`, current.ID); err != nil {
+		return nil, err
+	}
+
+	next.Family, next.UserID = current.Family, current.UserID
+	const insertQuery = `
+		INSERT INTO
+			refresh_tokens (id, family, user_id, token_hash, expires_at)
+		VALUES
+			($1, $2, $3, $4, $5);`
+
+	if _, err := tx.Exec(insertQuery, next.ID, next.Family, next.UserID, next.Hash, next.ExpiresAt); err != nil {
+		return nil, err
+	}
+
+	return current, tx.Commit()
+}
+
+// RevokeRefreshToken revokes every token in the family of the user's refresh token with the given
+// hash.  Revoking a token that doesn't exist or belongs to someone else is a no-op.
+func (db *Postgres) RevokeRefreshToken(hash []byte, userID string) error {
+	const query = `
+		UPDATE
+			refresh_tokens
+		SET
+			revoked_at = now()
+		WHERE
+			family = (
+				SELECT
+					family
+				FROM
+					refresh_tokens
+				WHERE
+					token_hash = $1 AND user_id = $2
+			)
+			AND revoked_at IS NULL;`
+
+	_, err := db.conn.Exec(query, hash, userID)
+	return err
+}
+
+// RevokeToken adds the jti of an access token to the deny list until the token expires.  Entries
+// for tokens that have since expired are cleared out along the way.
+func (db *Postgres) RevokeToken(jti string, expiresAt time.Time) error {
+	if _, err := db.conn.Exec(`DELETE FROM revoked_tokens WHERE expires_at < now();`); err != nil {
+		return err
+	}
+
+	const query = `
+		INSERT INTO
+			revoked_tokens (jti, expires_at)
+		VALUES
+			($1, $2)
+		ON CONFLICT (jti) DO NOTHING;`
+
+	_, err := db.conn.Exec(query, jti, expiresAt)
+	return err
+}
+
+// IsTokenRevoked reports whether the access token with the jti is on the deny list
+func (db *Postgres) IsTokenRevoked(jti string) (bool, error) {
+	var revoked bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1);`, jti).Scan(&revoked)
+	return revoked, err
+}
+
+func revokeFamily(tx *sql.Tx, family string) error {
+	_, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = now() WHERE family = $1 AND revoked_at IS NULL;`, family)
+	return err
+}
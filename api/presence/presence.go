@@ -0,0 +1,182 @@
+// Package presence tracks whether users are online, away or offline.
+//
+// A user is as present as their most present connection.  Every node tracks the connections of its
+// own clients and merges in what the other nodes say about theirs, so a user connected to two nodes
+// is online if either connection is.  What a node says about its users is forgotten once it stops
+// repeating it, so a node that goes away doesn't leave its users online forever.
+package presence
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrInvalidStatus is returned when parsing a status that doesn't exist
+var ErrInvalidStatus = errors.New("status must be one of online, away or offline")
+
+// Status is how present a user is
+type Status string
+
+const (
+	// Offline users have no connections
+	Offline Status = "offline"
+
+	// Away users are connected but idle
+	Away Status = "away"
+
+	// Online users have at least one active connection
+	Online Status = "online"
+)
+
+var statusRanks = map[Status]int{
+	Offline: 0,
+	Away:    1,
+	Online:  2,
+}
+
+// ParseStatus returns the status with the name
+func ParseStatus(name string) (Status, error) {
+	status := Status(name)
+	if _, ok := statusRanks[status]; !ok {
+		return Offline, ErrInvalidStatus
+	}
+	return status, nil
+}
+
+// more returns the more present of the two statuses
+func more(a, b Status) Status {
+	if statusRanks[b] > statusRanks[a] {
+		return b
+	}
+	return a
+}
+
+// node is what another node last said about the users connected to it
+type node struct {
+	users   map[string]Status
+	expires time.Time
+}
+
+// Tracker aggregates the status of every connection of a user.  It's safe for concurrent use.
+type Tracker struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	now func() time.Time
+
+	// local are the statuses of the connections to this node keyed by user then connection
+	local map[string]map[string]Status
+
+	// remote are the other nodes keyed by their id
+	remote map[string]*node
+}
+
+// NewTracker returns a tracker that forgets what another node said about its users ttl after it
+// last said it
+func NewTracker(ttl time.Duration) *Tracker {
+	return &Tracker{
+		ttl:    ttl,
+		now:    time.Now,
+		local:  make(map[string]map[string]Status),
+		remote: make(map[string]*node),
+	}
+}
+
+// Set records the status of one of the user's connections to this node, Offline forgets the
+// connection.  The user's status before and after the change is returned.
+func (t *Tracker) Set(user, connection string, status Status) (before, after Status) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	before = t.status(user)
+
+	if status == Offline {
+		delete(t.local[user], connection)
+		if len(t.local[user]) == 0 {
+			delete(t.local, user)
+		}
+	} else {
+		if t.local[user] == nil {
+			t.local[user] = make(map[string]Status)
+		}
+		t.local[user][connection] = status
+	}
+
+	return before, t.status(user)
+}
+
+// Status returns the status of the user across every node
+func (t *Tracker) Status(user string) Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status(user)
+}
+
+// Local returns the status of every user connected to this node.  Users without a connection to
+// this node aren't included.
+func (t *Tracker) Local(users ...string) map[string]Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(users) == 0 {
+		users = make([]string, 0, len(t.local))
+		for user := range t.local {
+			users = append(users, user)
+		}
+	}
+
+	statuses := make(map[string]Status, len(users))
+	for _, user := range users {
+		if status := t.localStatus(user); status != Offline {
+			statuses[user] = status
+		}
+	}
+	return statuses
+}
+
+// Merge records what another node says about the users connected to it.  A full update replaces
+// everything the node said before, otherwise only the users given are changed and an Offline user
+// is forgotten.  Either way what the node said is kept for another ttl.
+func (t *Tracker) Merge(id string, users map[string]Status, full bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n, ok := t.remote[id]
+	if !ok || full || t.expired(n) {
+		n = &node{users: make(map[string]Status, len(users))}
+		t.remote[id] = n
+	}
+	n.expires = t.now().Add(t.ttl)
+
+	for user, status := range users {
+		if status == Offline {
+			delete(n.users, user)
+		} else {
+			n.users[user] = status
+		}
+	}
+}
+
+func (t *Tracker) localStatus(user string) Status {
+	status := Offline
+	for _, s := range t.local[user] {
+		status = more(status, s)
+	}
+	return status
+}
+
+func (t *Tracker) status(user string) Status {
+	status := t.localStatus(user)
+	for id, n := range t.remote {
+		if t.expired(n) {
+			delete(t.remote, id)
+			continue
+		}
+		status = more(status, n.users[user])
+	}
+	return status
+}
+
+func (t *Tracker) expired(n *node) bool {
+	return !t.now().Before(n.expires)
+}
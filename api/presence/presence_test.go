@@ -0,0 +1,91 @@
+package presence
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTrackerConnections(t *testing.T) {
+	tracker := NewTracker(time.Minute)
+
+	var tt = []struct {
+		connection string
+		status     Status
+		before     Status
+		after      Status
+	}{
+		{connection: "tab-1", status: Online, before: Offline, after: Online},
+		{connection: "tab-2", status: Away, before: Online, after: Online},
+		{connection: "tab-1", status: Away, before: Online, after: Away},
+		{connection: "tab-2", status: Online, before: Away, after: Online},
+		{connection: "tab-2", status: Offline, before: Online, after: Away},
+		{connection: "tab-1", status: Offline, before: Away, after: Offline},
+	}
+
+	for i, tt := range tt {
+		before, after := tracker.Set("fry", tt.connection, tt.status)
+		if before != tt.before || after != tt.after {
+			t.Fatalf("%d: expected %s -> %s got %s -> %s", i, tt.before, tt.after, before, after)
+		}
+	}
+
+	if got := tracker.Local(); len(got) != 0 {
+		t.Fatalf("expected no one connected got %v", got)
+	}
+}
+
+func TestTrackerNodes(t *testing.T) {
+	var (
+		now     = time.Date(3000, time.January, 1, 0, 0, 0, 0, time.UTC)
+		tracker = NewTracker(time.Minute)
+	)
+	tracker.now = func() time.Time { return now }
+
+	tracker.Set("fry", "tab-1", Away)
+	tracker.Merge("node-b", map[string]Status{"fry": Online, "leela": Away}, true)
+
+	if got := tracker.Status("fry"); got != Online {
+		t.Fatalf("expected fry online on the other node got %s", got)
+	}
+	if got := tracker.Status("leela"); got != Away {
+		t.Fatalf("expected leela away got %s", got)
+	}
+
+	// only this node's connections are local
+	if got, expected := tracker.Local(), map[string]Status{"fry": Away}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v got %v", expected, got)
+	}
+
+	// a partial update only changes the users it names
+	tracker.Merge("node-b", map[string]Status{"leela": Offline}, false)
+	if got := tracker.Status("leela"); got != Offline {
+		t.Fatalf("expected leela offline got %s", got)
+	}
+	if got := tracker.Status("fry"); got != Online {
+		t.Fatalf("expected fry still online got %s", got)
+	}
+
+	// a full update replaces what the node said before
+	tracker.Merge("node-b", map[string]Status{"bender": Online}, true)
+	if got := tracker.Status("fry"); got != Away {
+		t.Fatalf("expected fry back to away got %s", got)
+	}
+
+	// a node that stops repeating itself is forgotten
+	now = now.Add(time.Minute)
+	if got := tracker.Status("bender"); got != Offline {
+		t.Fatalf("expected bender to expire got %s", got)
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	for _, name := range []string{"online", "away", "offline"} {
+		if status, err := ParseStatus(name); err != nil || string(status) != name {
+			t.Fatalf("expected %s got %s %v", name, status, err)
+		}
+	}
+	if _, err := ParseStatus("busy"); err != ErrInvalidStatus {
+		t.Fatalf("expected ErrInvalidStatus got %v", err)
+	}
+}
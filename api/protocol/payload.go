@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"strings"
+
+	"github.com/sir-wiggles/chat/api/presence"
+)
+
+type validator interface {
+	validate() error
+}
+
+// MaxAttachments is the most attachments a message can be sent with
+const MaxAttachments = 10
+
+// Send is the payload of a send frame.  Parent is the id of the message it replies to, if any.
+// Attachments are the ids of attachments the sender uploaded to the channel, a message with
+// attachments may have no text.
+type Send struct {
+	Text        string   `json:"text"`
+	Parent      string   `json:"parent,omitempty"`
+	Attachments []string `json:"attachments,omitempty"`
+}
+
+func (s *Send) validate() error {
+	if len(s.Attachments) > MaxAttachments {
+		return ErrInvalidPayload
+	}
+	if strings.TrimSpace(s.Text) == "" && len(s.Attachments) == 0 {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+// Typing is the payload of a typing frame.  Author is filled in by the server.
+type Typing struct {
+	Active bool   `json:"active"`
+	Author string `json:"author,omitempty"`
+}
+
+func (t *Typing) validate() error {
+	return nil
+}
+
+// Presence is the payload of a presence frame.  User is filled in by the server.
+type Presence struct {
+	User   string          `json:"user,omitempty"`
+	Status presence.Status `json:"status"`
+}
+
+func (p *Presence) validate() error {
+	if _, err := presence.ParseStatus(string(p.Status)); err != nil {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+// Read is the payload of a read frame.  Message is the id of the last message read, User is
+// filled in by the server.
+type Read struct {
+	Message string `json:"message"`
+	User    string `json:"user,omitempty"`
+}
+
+func (r *Read) validate() error {
+	if strings.TrimSpace(r.Message) == "" {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+// Ack is the payload of an ack frame.  When the server acks a send frame, Message is the id the
+// message was stored under.  When a client acks, Seq is the highest seq it has handled and
+// acknowledges every frame up to and including it.
+type Ack struct {
+	Message string `json:"message,omitempty"`
+	Seq     uint64 `json:"seq,omitempty"`
+}
+
+func (a *Ack) validate() error {
+	return nil
+}
+
+// Codes of the Error payload
+const (
+	CodeInvalidFrame = "invalid_frame"
+	CodeForbidden    = "forbidden"
+	CodeInternal     = "internal"
+)
+
+// Error is the payload of an error frame
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewError returns an error payload
+func NewError(code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e *Error) validate() error {
+	if e.Code == "" {
+		return ErrInvalidPayload
+	}
+	return nil
+}
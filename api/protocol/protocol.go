@@ -0,0 +1,277 @@
+// Package protocol is the wire format of the chat websockets.
+//
+// Every frame sent in either direction is a JSON encoded Envelope:
+//
+//	{
+//	    "v":       1,                                      // protocol version
+//	    "type":    "send",                                 // what the payload holds
+//	    "channel": "2b5c9d4e-7a61-4f0e-9f0a-2a3b8c1d0e4f", // channel the frame targets
+//	    "id":      "client-generated-id",                  // echoed back in acks and errors
+//	    "payload": {"text": "hello"},                      // depends on type
+//	    "seq":     42,                                     // set by the server
+//	    "time":    "2019-01-02T15:04:05Z"                  // set by the server
+//	}
+//
+// Clients send join, leave, send, typing, presence, read and ack frames.  The server sends
+// initialize, system, message, thread, edited, deleted, reaction, typing, presence, read, ack and
+// error frames.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Version is the current version of the protocol.  Frames with any other version are rejected.
+const Version = 1
+
+// Type says what kind of payload an envelope carries
+type Type string
+
+const (
+	// TypeJoin subscribes the client to a channel, it has an empty payload
+	TypeJoin Type = "join"
+
+	// TypeLeave unsubscribes the client from a channel, it has an empty payload
+	TypeLeave Type = "leave"
+
+	// TypeSend posts a message to a channel, the payload is a Send
+	TypeSend Type = "send"
+
+	// TypeTyping tells a channel the author is typing, the payload is a Typing.  Typing stops on
+	// its own if it isn't repeated.
+	TypeTyping Type = "typing"
+
+	// TypePresence sets whether the client is online or away.  The server sends it to the
+	// channels of a user whose status changed.  The payload is a Presence.
+	TypePresence Type = "presence"
+
+	// TypeRead marks the messages of a channel up to and including one as read.  The server sends
+	// it to the channel when someone's read cursor moves.  The payload is a Read.
+	TypeRead Type = "read"
+
+	// TypeAck acknowledges a frame, the payload is an Ack
+	TypeAck Type = "ack"
+
+	// TypeError is sent by the server when a frame could not be handled, the payload is an Error
+	TypeError Type = "error"
+
+	// TypeInitialize is the first frame the server sends on a new connection
+	TypeInitialize Type = "initialize"
+
+	// TypeSystem is a notice from the server to a channel, e.g. someone joined
+	TypeSystem Type = "system"
+
+	// TypeMessage is a message posted to a channel
+	TypeMessage Type = "message"
+
+	// TypeThread follows the message frame of a reply, the payload is the structs.Thread of the
+	// message replied to
+	TypeThread Type = "thread"
+
+	// TypeEdited is sent when a message is edited, the payload is the message after the edit
+	TypeEdited Type = "edited"
+
+	// TypeDeleted is sent when a message is deleted, the payload is the tombstone of the message
+	TypeDeleted Type = "deleted"
+
+	// TypeReaction is sent when a reaction is added to or removed from a message, the payload is
+	// the structs.Reactions of the message
+	TypeReaction Type = "reaction"
+
+	// TypePreview is sent once the links of a message have been unfurled, the payload is the
+	// structs.Previews of the message
+	TypePreview Type = "preview"
+)
+
+// types are the known types and whether or not a client is allowed to send them
+var types = map[Type]bool{
+	TypeJoin:       true,
+	TypeLeave:      true,
+	TypeSend:       true,
+	TypeTyping:     true,
+	TypePresence:   true,
+	TypeRead:       true,
+	TypeAck:        true,
+	TypeError:      false,
+	TypeInitialize: false,
+	TypeSystem:     false,
+	TypeMessage:    false,
+	TypeThread:     false,
+	TypeEdited:     false,
+	TypeDeleted:    false,
+	TypeReaction:   false,
+	TypePreview:    false,
+}
+
+// channelRequired are the types that must target a channel
+var channelRequired = map[Type]bool{
+	TypeJoin:     true,
+	TypeLeave:    true,
+	TypeSend:     true,
+	TypeTyping:   true,
+	TypeRead:     true,
+	TypeSystem:   true,
+	TypeMessage:  true,
+	TypeThread:   true,
+	TypeEdited:   true,
+	TypeDeleted:  true,
+	TypeReaction: true,
+	TypePreview:  true,
+}
+
+// Known returns true if the type is part of the protocol
+func (t Type) Known() bool {
+	_, ok := types[t]
+	return ok
+}
+
+// FromClient returns true if a client is allowed to send frames of this type
+func (t Type) FromClient() bool {
+	return types[t]
+}
+
+var (
+	// ErrVersion is returned when decoding a frame of another protocol version
+	ErrVersion = errors.New("protocol: unsupported version")
+
+	// ErrUnknownType is returned when a frame has a type that isn't part of the protocol
+	ErrUnknownType = errors.New("protocol: unknown type")
+
+	// ErrMissingChannel is returned when a frame that must target a channel doesn't
+	ErrMissingChannel = errors.New("protocol: missing channel")
+
+	// ErrInvalidPayload is returned when the payload doesn't match the type of the frame
+	ErrInvalidPayload = errors.New("protocol: invalid payload")
+)
+
+// Envelope wraps every frame sent over the socket
+type Envelope struct {
+
+	// Version is the protocol version the frame was written for
+	Version int `json:"v"`
+
+	// Type says what the Payload holds
+	Type Type `json:"type"`
+
+	// Channel is the channel the frame targets
+	Channel string `json:"channel,omitempty"`
+
+	// ID is generated by the client so it can match acks and errors to the frame it sent
+	ID string `json:"id,omitempty"`
+
+	// Payload is the JSON encoded payload, use Unmarshal to decode it
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// Seq numbers the frames the server sends on a connection starting at one.  Clients ack the
+	// highest seq they have handled, see Ack.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Time is set by the server when it sends or receives the frame
+	Time time.Time `json:"time"`
+}
+
+// New creates a frame with the given payload stamped with the current time
+func New(t Type, channel string, payload interface{}) (*Envelope, error) {
+	e := &Envelope{
+		Version: Version,
+		Type:    t,
+		Channel: channel,
+		Time:    time.Now().UTC(),
+	}
+
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		e.Payload = data
+	}
+
+	return e, e.Validate()
+}
+
+// Reply creates a frame that answers this one, it targets the same channel and carries the same id
+func (e *Envelope) Reply(t Type, payload interface{}) (*Envelope, error) {
+	reply, err := New(t, e.Channel, payload)
+	if reply != nil {
+		reply.ID = e.ID
+	}
+	return reply, err
+}
+
+// Encode validates the frame and returns it as JSON
+func Encode(e *Envelope) ([]byte, error) {
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(e)
+}
+
+// Decode parses and validates a frame, stamping it with the time it was received
+func Decode(data []byte) (*Envelope, error) {
+	e := &Envelope{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+
+	if err := e.Validate(); err != nil {
+		return e, err
+	}
+
+	e.Time = time.Now().UTC()
+	return e, nil
+}
+
+// Unmarshal decodes the payload into v
+func (e *Envelope) Unmarshal(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return ErrInvalidPayload
+	}
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+// Validate checks the version, type and channel of the frame and that the payload matches the
+// type.  The payloads of join, leave, initialize, system, message, thread, edited, deleted,
+// reaction and preview frames are not checked.
+func (e *Envelope) Validate() error {
+	if e.Version != Version {
+		return ErrVersion
+	}
+
+	if !e.Type.Known() {
+		return ErrUnknownType
+	}
+
+	if channelRequired[e.Type] && strings.TrimSpace(e.Channel) == "" {
+		return ErrMissingChannel
+	}
+
+	var payload validator
+	switch e.Type {
+	case TypeSend:
+		payload = &Send{}
+	case TypeTyping:
+		payload = &Typing{}
+	case TypePresence:
+		payload = &Presence{}
+	case TypeRead:
+		payload = &Read{}
+	case TypeAck:
+		payload = &Ack{}
+	case TypeError:
+		payload = &Error{}
+	default:
+		return nil
+	}
+
+	if err := e.Unmarshal(payload); err != nil {
+		return err
+	}
+	return payload.validate()
+}
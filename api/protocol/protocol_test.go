@@ -0,0 +1,188 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var ttDecode = []struct {
+	name string
+	data string
+	err  error
+}{
+	{
+		name: "join",
+		data: `{"v": 1, "type": "join", "channel": "general"}`,
+	},
+	{
+		name: "send",
+		data: `{"v": 1, "type": "send", "channel": "general", "id": "1", "payload": {"text": "hi"}}`,
+	},
+	{
+		name: "send attachments without text",
+		data: `{"v": 1, "type": "send", "channel": "general", "payload": {"text": "", "attachments": ["1"]}}`,
+	},
+	{
+		name: "typing",
+		data: `{"v": 1, "type": "typing", "channel": "general", "payload": {"active": true}}`,
+	},
+	{
+		name: "read",
+		data: `{"v": 1, "type": "read", "channel": "general", "payload": {"message": "1"}}`,
+	},
+	{
+		name: "presence",
+		data: `{"v": 1, "type": "presence", "payload": {"status": "away"}}`,
+	},
+	{
+		name: "ack",
+		data: `{"v": 1, "type": "ack", "payload": {}}`,
+	},
+	{
+		name: "missing version",
+		data: `{"type": "join", "channel": "general"}`,
+		err:  ErrVersion,
+	},
+	{
+		name: "newer version",
+		data: `{"v": 2, "type": "join", "channel": "general"}`,
+		err:  ErrVersion,
+	},
+	{
+		name: "unknown type",
+		data: `{"v": 1, "type": "shout", "channel": "general"}`,
+		err:  ErrUnknownType,
+	},
+	{
+		name: "missing channel",
+		data: `{"v": 1, "type": "send", "payload": {"text": "hi"}}`,
+		err:  ErrMissingChannel,
+	},
+	{
+		name: "send without payload",
+		data: `{"v": 1, "type": "send", "channel": "general"}`,
+		err:  ErrInvalidPayload,
+	},
+	{
+		name: "read without a message",
+		data: `{"v": 1, "type": "read", "channel": "general", "payload": {}}`,
+		err:  ErrInvalidPayload,
+	},
+	{
+		name: "presence with unknown status",
+		data: `{"v": 1, "type": "presence", "payload": {"status": "busy"}}`,
+		err:  ErrInvalidPayload,
+	},
+	{
+		name: "send with blank text",
+		data: `{"v": 1, "type": "send", "channel": "general", "payload": {"text": "  "}}`,
+		err:  ErrInvalidPayload,
+	},
+	{
+		name: "send with too many attachments",
+		data: `{"v": 1, "type": "send", "channel": "general", "payload": {"text": "hi", "attachments": ["1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11"]}}`,
+		err:  ErrInvalidPayload,
+	},
+	{
+		name: "send with wrong payload",
+		data: `{"v": 1, "type": "send", "channel": "general", "payload": {"text": 1}}`,
+		err:  ErrInvalidPayload,
+	},
+	{
+		name: "error without code",
+		data: `{"v": 1, "type": "error", "payload": {"message": "oops"}}`,
+		err:  ErrInvalidPayload,
+	},
+}
+
+func TestDecode(t *testing.T) {
+	for _, tt := range ttDecode {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := Decode([]byte(tt.data))
+			if err != tt.err {
+				t.Fatalf("expected error %v got %v", tt.err, err)
+			}
+			if err == nil && e.Time.IsZero() {
+				t.Fatal("expected the frame to be stamped")
+			}
+		})
+	}
+}
+
+func TestDecodeInvalidJSON(t *testing.T) {
+	if _, err := Decode([]byte(`{"v": 1,`)); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	sent, err := New(TypeSend, "general", &Send{Text: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent.ID = "abc"
+
+	data, err := Encode(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := &Send{}
+	if err := received.Unmarshal(send); err != nil {
+		t.Fatal(err)
+	}
+
+	if received.Type != TypeSend || received.Channel != "general" || received.ID != "abc" || send.Text != "hello" {
+		t.Fatalf("frame changed in transit: %+v %+v", received, send)
+	}
+
+	reply, err := received.Reply(TypeAck, &Ack{Message: "m1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.ID != "abc" || reply.Channel != "general" {
+		t.Fatalf("reply does not match the frame: %+v", reply)
+	}
+}
+
+func TestEncodeInvalid(t *testing.T) {
+	if _, err := Encode(&Envelope{Version: Version, Type: "shout"}); err != ErrUnknownType {
+		t.Fatalf("expected %v got %v", ErrUnknownType, err)
+	}
+
+	if _, err := New(TypeSend, "general", &Send{}); err != ErrInvalidPayload {
+		t.Fatalf("expected %v got %v", ErrInvalidPayload, err)
+	}
+}
+
+func TestFromClient(t *testing.T) {
+	for _, typ := range []Type{TypeJoin, TypeLeave, TypeSend, TypeTyping, TypePresence, TypeRead, TypeAck} {
+		if !typ.FromClient() {
+			t.Errorf("%s should be allowed from clients", typ)
+		}
+	}
+	for _, typ := range []Type{TypeError, TypeInitialize, TypeSystem, TypeMessage, TypeThread, TypeEdited, TypeDeleted, TypeReaction, TypePreview, "shout"} {
+		if typ.FromClient() {
+			t.Errorf("%s should not be allowed from clients", typ)
+		}
+	}
+}
+
+func TestErrorPayload(t *testing.T) {
+	e, err := New(TypeError, "", NewError(CodeForbidden, "not a member"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var payload = struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.Unmarshal(e.Payload, &payload); err != nil || payload.Code != CodeForbidden {
+		t.Fatalf("unexpected payload %s %v", e.Payload, err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/sir-wiggles/chat/api/postgres"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// localProvider signs local accounts in with their username and password.  Failed attempts are
+// limited per username, the sign in handler limits them per ip.
+type localProvider struct {
+	postgres postgres.Controller
+	limiter  *attemptLimiter
+}
+
+// Authenticate checks the password of the account with the username
+func (p *localProvider) Authenticate(r *http.Request) (*Profile, error) {
+	var req = LocalAuthRequest{}
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, &credentialError{err}
+	}
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+
+	key := "user:" + req.Username
+	if ok, retry := p.limiter.Allow(key); !ok {
+		return nil, &tooManyAttemptsError{retry}
+	}
+
+	user, hash, err := p.postgres.GetLocalUser(req.Username)
+	if err == postgres.ErrUserNotFound {
+		hash = dummyPasswordHash
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(req.Password)); err != nil || user == nil {
+		p.limiter.Fail(key)
+		return nil, &credentialError{ErrInvalidCredentials}
+	}
+
+	p.limiter.Reset(key)
+	return &Profile{Provider: "local", ID: req.Username, Name: user.Name, Picture: user.Avatar}, nil
+}
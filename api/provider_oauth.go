@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	googleUserInfoURL = "https://www.googleapis.com/oauth2/v2/userinfo"
+	githubUserInfoURL = "https://api.github.com/user"
+
+	// oidcDiscoveryPath is where an oidc issuer publishes its configuration
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+)
+
+// OAuthRequest is the body of a sign in with an oauth provider.  The code is exchanged for an
+// access token which is used to fetch the user's profile.
+type OAuthRequest struct {
+	Code        string `json:"code"`
+	RedirectURI string `json:"redirectURI"`
+}
+
+// oauthProvider signs users in with the authorization code flow of an oauth provider
+type oauthProvider struct {
+	name   string
+	client *http.Client
+
+	// profile maps the provider's user info response into a profile
+	profile func(data []byte) (*Profile, error)
+
+	// discover fills in the endpoints of the config the first time they're needed
+	discover func() error
+
+	mu          sync.Mutex
+	config      *oauth2.Config
+	userInfoURL string
+	discovered  bool
+}
+
+// newOAuthProvider returns the provider for the config.  google and github are known by name,
+// any other provider must be an oidc provider with an issuer.
+func newOAuthProvider(name string, config *providerConfig, client *http.Client) (*oauthProvider, error) {
+	if config.ClientID == "" {
+		return nil, errors.New("missing client_id")
+	}
+
+	p := &oauthProvider{
+		name:   name,
+		client: client,
+		config: &oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Scopes:       config.Scopes,
+		},
+		userInfoURL: config.UserInfoURL,
+		discovered:  true,
+	}
+
+	switch {
+	case name == "google":
+		p.defaults(google.Endpoint, googleUserInfoURL, "postmessage", "profile", "email")
+		p.profile = googleProfile
+
+	case name == "github":
+		p.defaults(github.Endpoint, githubUserInfoURL, "", "read:user", "user:email")
+		p.profile = githubProfile
+
+	case config.Issuer != "":
+		p.defaults(oauth2.Endpoint{}, "", "", "openid", "profile", "email")
+		p.profile = oidcProfile
+		p.discover = func() error { return p.discoverOIDC(config.Issuer) }
+		p.discovered = config.AuthURL != "" && config.TokenURL != "" && config.UserInfoURL != ""
+
+	default:
+		return nil, fmt.Errorf("unknown provider, set an issuer to use it as an oidc provider")
+	}
+
+	if config.AuthURL != "" {
+		p.config.Endpoint.AuthURL = config.AuthURL
+	}
+	if config.TokenURL != "" {
+		p.config.Endpoint.TokenURL = config.TokenURL
+	}
+	return p, nil
+}
+
+// defaults fills in whatever the config left out
+func (p *oauthProvider) defaults(endpoint oauth2.Endpoint, userInfoURL, redirectURL string, scopes ...string) {
+	p.config.Endpoint = endpoint
+	if p.userInfoURL == "" {
+		p.userInfoURL = userInfoURL
+	}
+	if p.config.RedirectURL == "" {
+		p.config.RedirectURL = redirectURL
+	}
+	if len(p.config.Scopes) == 0 {
+		p.config.Scopes = scopes
+	}
+}
+
+// Authenticate exchanges the code in the request for a token and fetches the user's profile
+func (p *oauthProvider) Authenticate(r *http.Request) (*Profile, error) {
+	var req = OAuthRequest{}
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		return nil, &credentialError{errors.New("missing authorization code")}
+	}
+
+	config, userInfoURL, err := p.endpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		ctx  = context.WithValue(r.Context(), oauth2.HTTPClient, p.client)
+		opts []oauth2.AuthCodeOption
+	)
+	if req.RedirectURI != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("redirect_uri", req.RedirectURI))
+	}
+
+	token, err := config.Exchange(ctx, req.Code, opts...)
+	if err != nil {
+		return nil, &credentialError{err}
+	}
+
+	resp, err := config.Client(ctx, token).Get(userInfoURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s user info responded with %s", p.name, resp.Status)
+	}
+
+	profile, err := p.profile(data)
+	if err != nil {
+		return nil, err
+	} else if profile.ID == "" {
+		return nil, fmt.Errorf("%s user info has no user id", p.name)
+	}
+	profile.Provider = p.name
+	return profile, nil
+}
+
+// endpoints returns the config and user info url, discovering them first if need be.  A failed
+// discovery is retried on the next sign in.
+func (p *oauthProvider) endpoints() (*oauth2.Config, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.discovered {
+		if err := p.discover(); err != nil {
+			return nil, "", fmt.Errorf("discovering %s: %s", p.name, err)
+		}
+		p.discovered = true
+	}
+	return p.config, p.userInfoURL, nil
+}
+
+// discoverOIDC fills in the endpoints from the issuer's published configuration.  Endpoints that
+// were configured explicitly are kept.
+func (p *oauthProvider) discoverOIDC(issuer string) error {
+	resp, err := p.client.Get(strings.TrimSuffix(issuer, "/") + oidcDiscoveryPath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("discovery responded with %s", resp.Status)
+	}
+
+	discovery := struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return err
+	}
+
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return fmt.Errorf("discovered issuer %q does not match %q", discovery.Issuer, issuer)
+	} else if discovery.TokenEndpoint == "" || discovery.UserInfoEndpoint == "" {
+		return errors.New("discovery is missing the token or userinfo endpoint")
+	}
+
+	if p.config.Endpoint.AuthURL == "" {
+		p.config.Endpoint.AuthURL = discovery.AuthorizationEndpoint
+	}
+	if p.config.Endpoint.TokenURL == "" {
+		p.config.Endpoint.TokenURL = discovery.TokenEndpoint
+	}
+	if p.userInfoURL == "" {
+		p.userInfoURL = discovery.UserInfoEndpoint
+	}
+	return nil
+}
+
+func googleProfile(data []byte) (*Profile, error) {
+	profile := struct {
+		ID      string `json:"id"`
+		Email   string `json:"email"`
+		Name    string `json:"name"`
+		Picture string `json:"picture"`
+	}{}
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, err
+	}
+
+	return &Profile{ID: profile.ID, Name: profile.Name, Email: profile.Email, Picture: profile.Picture}, nil
+}
+
+func githubProfile(data []byte) (*Profile, error) {
+	profile := struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		Email     string `json:"email"`
+		AvatarURL string `json:"avatar_url"`
+	}{}
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, err
+	}
+
+	// the name is optional on github, the login never is
+	name := profile.Name
+	if name == "" {
+		name = profile.Login
+	}
+
+	var id string
+	if profile.ID != 0 {
+		id = strconv.FormatInt(profile.ID, 10)
+	}
+	return &Profile{ID: id, Name: name, Email: profile.Email, Picture: profile.AvatarURL}, nil
+}
+
+func oidcProfile(data []byte) (*Profile, error) {
+	profile := struct {
+		Subject           string `json:"sub"`
+		Name              string `json:"name"`
+		PreferredUsername string `json:"preferred_username"`
+		Email             string `json:"email"`
+		Picture           string `json:"picture"`
+	}{}
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, err
+	}
+
+	name := profile.Name
+	if name == "" {
+		name = profile.PreferredUsername
+	}
+	return &Profile{ID: profile.Subject, Name: name, Email: profile.Email, Picture: profile.Picture}, nil
+}
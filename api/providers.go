@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Profile is what an identity provider knows about the user that signed in with it
+type Profile struct {
+	Provider string
+	ID       string
+	Name     string
+	Email    string
+	Picture  string
+}
+
+// GID is the id the user is stored under.  Google ids are stored as is for the accounts created
+// before there were other providers, every other provider's ids are prefixed with its name.
+func (p *Profile) GID() string {
+	if p.Provider == "google" {
+		return p.ID
+	}
+	return p.Provider + ":" + p.ID
+}
+
+// Authenticator is an identity provider users can sign in with.  Authenticate verifies the
+// credentials in the sign in request returning the profile of the user they belong to.
+// Credentials that are wrong are reported with a credentialError.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Profile, error)
+}
+
+// credentialError is returned by a provider when the credentials it was given are wrong, as
+// opposed to the provider failing
+type credentialError struct {
+	err error
+}
+
+func (e *credentialError) Error() string {
+	return e.err.Error()
+}
+
+// tooManyAttemptsError is returned by a provider when the account has failed to sign in too many
+// times recently
+type tooManyAttemptsError struct {
+	retry time.Duration
+}
+
+func (e *tooManyAttemptsError) Error() string {
+	return "too many failed attempts, try again later"
+}
+
+// providerConfig is the configuration of an oauth provider.  The endpoints default to those of
+// the provider, or for oidc to those it advertises.
+type providerConfig struct {
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+
+	// Issuer makes the provider a generic oidc provider that's discovered from the issuer
+	Issuer string `json:"issuer"`
+
+	AuthURL     string `json:"auth_url"`
+	TokenURL    string `json:"token_url"`
+	UserInfoURL string `json:"userinfo_url"`
+}
+
+// Providers is the registry of the identity providers users can sign in with.  The oauth
+// providers are configured from a json file keyed by provider name that's read the first time a
+// provider is asked for.  If there is no file only the providers registered in code are
+// available.
+type Providers struct {
+	path   string
+	client *http.Client
+
+	once      sync.Once
+	mu        sync.RWMutex
+	providers map[string]Authenticator
+}
+
+// NewProviders returns a registry configured from the file at path.  The oauth providers make
+// their requests with client, if it's nil the default client is used.
+func NewProviders(path string, client *http.Client) *Providers {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Providers{
+		path:      path,
+		client:    client,
+		providers: make(map[string]Authenticator),
+	}
+}
+
+// Register adds a provider to the registry replacing any with the same name
+func (p *Providers) Register(name string, provider Authenticator) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.providers[name] = provider
+}
+
+// Get returns the provider with the name
+func (p *Providers) Get(name string) (Authenticator, bool) {
+	p.once.Do(p.load)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	provider, ok := p.providers[name]
+	return provider, ok
+}
+
+// Names returns the names of every provider, sorted
+func (p *Providers) Names() []string {
+	p.once.Do(p.load)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	names := make([]string, 0, len(p.providers))
+	for name := range p.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// load registers the providers in the config file.  A missing or broken file is logged rather
+// than stopping the server, the providers in it are just not available.
+func (p *Providers) load() {
+	if p.path == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		log.Printf("no identity provider config at %s", p.path)
+		return
+	} else if err != nil {
+		log.Printf("reading identity provider config: %s", err)
+		return
+	}
+
+	configs, err := parseProviderConfigs(data)
+	if err != nil {
+		log.Printf("parsing identity provider config %s: %s", p.path, err)
+		return
+	}
+
+	for name, config := range configs {
+		provider, err := newOAuthProvider(name, config, p.client)
+		if err != nil {
+			log.Printf("configuring identity provider %s: %s", name, err)
+			continue
+		}
+		p.Register(name, provider)
+	}
+}
+
+// parseProviderConfigs reads a config keyed by provider name.  A config with a client_id at the
+// top level is the original google only format.
+func parseProviderConfigs(data []byte) (map[string]*providerConfig, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	if _, ok := raw["client_id"]; ok {
+		google := &providerConfig{}
+		if err := json.Unmarshal(data, google); err != nil {
+			return nil, err
+		}
+		return map[string]*providerConfig{"google": google}, nil
+	}
+
+	configs := make(map[string]*providerConfig, len(raw))
+	for name, data := range raw {
+		config := &providerConfig{}
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		configs[name] = config
+	}
+	return configs, nil
+}
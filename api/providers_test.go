@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sir-wiggles/chat/api/cassandra"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+// testIdentityProvider stands in for the token, user info and discovery endpoints of an oauth
+// provider.  The code "good" is the only one exchanged for a token.
+func testIdentityProvider(t *testing.T, userInfo string) *httptest.Server {
+	var server *httptest.Server
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "access", "token_type": "Bearer"}`))
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(userInfo))
+	})
+	discovery := func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"userinfo_endpoint":      server.URL + "/userinfo",
+		})
+	}
+	mux.HandleFunc(oidcDiscoveryPath, discovery)
+	// an issuer that publishes a configuration claiming to be a different issuer
+	mux.HandleFunc("/other"+oidcDiscoveryPath, discovery)
+
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+var ttOAuthProviders = []struct {
+	name     string
+	provider string
+	userInfo string
+	config   func(url string) *providerConfig
+	profile  Profile
+	gid      string
+}{
+	{
+		name:     "google",
+		provider: "google",
+		userInfo: `{"id": "1234", "name": "Alice", "email": "alice@example.com", "picture": "alice.png"}`,
+		config: func(url string) *providerConfig {
+			return &providerConfig{ClientID: "id", TokenURL: url + "/token", UserInfoURL: url + "/userinfo"}
+		},
+		profile: Profile{Provider: "google", ID: "1234", Name: "Alice", Email: "alice@example.com", Picture: "alice.png"},
+		gid:     "1234",
+	},
+	{
+		name:     "github",
+		provider: "github",
+		userInfo: `{"id": 5678, "login": "alice", "avatar_url": "alice.png"}`,
+		config: func(url string) *providerConfig {
+			return &providerConfig{ClientID: "id", TokenURL: url + "/token", UserInfoURL: url + "/userinfo"}
+		},
+		profile: Profile{Provider: "github", ID: "5678", Name: "alice", Picture: "alice.png"},
+		gid:     "github:5678",
+	},
+	{
+		name:     "oidc",
+		provider: "corp",
+		userInfo: `{"sub": "abcd", "preferred_username": "alice", "email": "alice@corp.example.com"}`,
+		config: func(url string) *providerConfig {
+			return &providerConfig{ClientID: "id", Issuer: url}
+		},
+		profile: Profile{Provider: "corp", ID: "abcd", Name: "alice", Email: "alice@corp.example.com"},
+		gid:     "corp:abcd",
+	},
+}
+
+func TestOAuthProviders(t *testing.T) {
+	for _, tt := range ttOAuthProviders {
+		t.Run(tt.name, func(t *testing.T) {
+			server := testIdentityProvider(t, tt.userInfo)
+
+			provider, err := newOAuthProvider(tt.provider, tt.config(server.URL), server.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("POST", "/", strings.NewReader(`{"code": "bad"}`))
+			if _, err := provider.Authenticate(r); err == nil {
+				t.Fatal("expected a bad code to fail")
+			} else if _, ok := err.(*credentialError); !ok {
+				t.Fatalf("expected a credential error got %T %s", err, err)
+			}
+
+			r = httptest.NewRequest("POST", "/", strings.NewReader(`{"code": "good"}`))
+			profile, err := provider.Authenticate(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *profile != tt.profile {
+				t.Fatalf("expected %+v got %+v", tt.profile, *profile)
+			} else if profile.GID() != tt.gid {
+				t.Fatalf("expected gid %s got %s", tt.gid, profile.GID())
+			}
+		})
+	}
+}
+
+func TestOAuthProviderIssuerMismatch(t *testing.T) {
+	server := testIdentityProvider(t, `{"sub": "abcd"}`)
+
+	provider, err := newOAuthProvider("corp", &providerConfig{ClientID: "id", Issuer: server.URL + "/other"}, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"code": "good"}`))
+	if _, err := provider.Authenticate(r); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("expected the issuer mismatch to fail discovery got %v", err)
+	}
+}
+
+func TestSignIn(t *testing.T) {
+	defer testJWTConfig()()
+
+	server := testIdentityProvider(t, `{"id": 5678, "login": "alice"}`)
+
+	config, _ := json.Marshal(map[string]*providerConfig{
+		"github": {ClientID: "id", TokenURL: server.URL + "/token", UserInfoURL: server.URL + "/userinfo"},
+	})
+	path := filepath.Join(t.TempDir(), "oauth.json")
+	if err := ioutil.WriteFile(path, config, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth := testAccounts()
+	auth.providers = NewProviders(path, server.Client())
+	auth.db = &cassandra.MockCassandra{
+		GetUserFn: func(gid, name, picture string) (*structs.User, error) {
+			if gid != "github:5678" || name != "alice" {
+				t.Errorf("expected github:5678 alice got %s %s", gid, name)
+			}
+			return testUser, nil
+		},
+	}
+
+	signIn := func(provider, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/auth/"+provider, strings.NewReader(body))
+		auth.SignIn(w, mux.SetURLVars(r, map[string]string{"provider": provider}))
+		return w
+	}
+
+	authResponse(t, signIn("github", `{"code": "good"}`))
+
+	if w := signIn("github", `{"code": "bad"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a bad code to get 401 got %d %s", w.Code, w.Body)
+	}
+	if w := signIn("myspace", `{"code": "good"}`); w.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown provider to get 404 got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestProvidersMissingConfig(t *testing.T) {
+	providers := NewProviders(filepath.Join(os.TempDir(), "no-such-oauth.json"), nil)
+	providers.Register("local", &localProvider{})
+
+	if _, ok := providers.Get("google"); ok {
+		t.Fatal("expected google to be unavailable without a config")
+	}
+	if names := providers.Names(); len(names) != 1 || names[0] != "local" {
+		t.Fatalf("expected only the local provider got %v", names)
+	}
+}
+
+func TestParseProviderConfigs(t *testing.T) {
+	configs, err := parseProviderConfigs([]byte(`{"client_id": "id", "client_secret": "secret"}`))
+	if err != nil {
+		t.Fatal(err)
+	} else if google, ok := configs["google"]; !ok || len(configs) != 1 || google.ClientSecret != "secret" {
+		t.Fatalf("expected the legacy format to configure google got %+v", configs)
+	}
+
+	configs, err = parseProviderConfigs([]byte(`{"github": {"client_id": "gh"}, "corp": {"client_id": "c", "issuer": "https://sso.example.com"}}`))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(configs) != 2 || configs["github"].ClientID != "gh" || configs["corp"].Issuer != "https://sso.example.com" {
+		t.Fatalf("expected github and corp got %+v", configs)
+	}
+
+	if _, err := parseProviderConfigs([]byte(`{"github": "gh"}`)); err == nil {
+		t.Fatal("expected a malformed provider to fail")
+	}
+}
@@ -0,0 +1,174 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+// Memory is an index kept in memory.  A word of the query matches the words of a message it's a
+// prefix of so partly typed words still find something.
+type Memory struct {
+	mu       sync.RWMutex
+	channels map[string]map[string]*document
+	closed   bool
+}
+
+// document is an indexed message
+type document struct {
+	hit   Hit
+	body  string
+	words []string
+}
+
+// NewMemory returns an empty in-memory index
+func NewMemory() *Memory {
+	return &Memory{channels: make(map[string]map[string]*document)}
+}
+
+// Index adds the message or replaces the text of one that was already indexed
+func (m *Memory) Index(message *structs.Message) error {
+	doc := &document{
+		hit: Hit{
+			Message: message.ID,
+			Channel: message.Channel,
+			Parent:  message.Parent,
+			Time:    message.Time,
+		},
+		body: body(message),
+	}
+	if message.Author != nil {
+		doc.hit.Author = message.Author.ID
+	}
+	doc.words = words(doc.body)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+	messages, ok := m.channels[message.Channel]
+	if !ok {
+		messages = make(map[string]*document)
+		m.channels[message.Channel] = messages
+	}
+	messages[message.ID] = doc
+	return nil
+}
+
+// Remove drops the message from the index
+func (m *Memory) Remove(channel, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+	delete(m.channels[channel], id)
+	if len(m.channels[channel]) == 0 {
+		delete(m.channels, channel)
+	}
+	return nil
+}
+
+// Search returns the messages with every word of the query.  Messages where the words come up
+// more often are better matches.
+func (m *Memory) Search(query *Query) ([]*Hit, error) {
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	terms := words(query.Text)
+
+	matches := func(word string) bool {
+		for _, term := range terms {
+			if strings.HasPrefix(word, term) {
+				return true
+			}
+		}
+		return false
+	}
+
+	type scored struct {
+		doc   *document
+		score int
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	var found []scored
+	for _, channel := range query.Channels {
+		for _, doc := range m.channels[channel] {
+			if query.Author != "" && doc.hit.Author != query.Author {
+				continue
+			}
+			if !query.sent(doc.hit.Time) {
+				continue
+			}
+			if score := match(doc.words, terms); score > 0 {
+				found = append(found, scored{doc, score})
+			}
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].score != found[j].score {
+			return found[i].score > found[j].score
+		}
+		return found[i].doc.hit.Time.After(found[j].doc.hit.Time)
+	})
+	if len(found) > query.Limit {
+		found = found[:query.Limit]
+	}
+
+	hits := make([]*Hit, 0, len(found))
+	for _, f := range found {
+		hit := f.doc.hit
+		hit.Snippet = snippet(f.doc.body, matches)
+		hits = append(hits, &hit)
+	}
+	return hits, nil
+}
+
+// Close empties the index
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	m.channels = nil
+	return nil
+}
+
+// match returns how many of the words match a term, or zero when one of the terms matches none
+// of them
+func match(words, terms []string) int {
+	var (
+		score   int
+		matched = make([]bool, len(terms))
+	)
+	for _, word := range words {
+		hit := false
+		for i, term := range terms {
+			if strings.HasPrefix(word, term) {
+				matched[i], hit = true, true
+			}
+		}
+		if hit {
+			score++
+		}
+	}
+	for _, ok := range matched {
+		if !ok {
+			return 0
+		}
+	}
+	return score
+}
@@ -0,0 +1,97 @@
+package search
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+func TestMemorySearch(t *testing.T) {
+	var (
+		index = NewMemory()
+		now   = time.Date(3000, time.January, 1, 0, 0, 0, 0, time.UTC)
+		fry   = &structs.User{ID: "fry"}
+		leela = &structs.User{ID: "leela"}
+	)
+
+	for _, m := range []*structs.Message{
+		{ID: "1", Channel: "general", Author: fry, Text: []string{"deploy on friday?"}, Time: now},
+		{ID: "2", Channel: "general", Author: leela, Text: []string{"never deploy on friday"}, Time: now.Add(time.Minute)},
+		{ID: "3", Channel: "general", Author: leela, Text: []string{"deploying deploys", "on friday"}, Time: now.Add(2 * time.Minute)},
+		{ID: "4", Channel: "secret", Author: fry, Text: []string{"deploy on friday"}, Time: now.Add(-time.Minute)},
+		{ID: "5", Channel: "general", Author: fry, Text: []string{"lunch on friday"}, Time: now.Add(-time.Minute)},
+	} {
+		if err := index.Index(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tt = []struct {
+		name  string
+		query Query
+		want  []string
+	}{
+		{
+			name:  "best match then newest",
+			query: Query{Text: "Deploy Friday", Channels: []string{"general"}},
+			want:  []string{"3", "2", "1"},
+		},
+		{
+			name:  "every channel given",
+			query: Query{Text: "deploy", Channels: []string{"general", "secret"}, Author: "fry"},
+			want:  []string{"1", "4"},
+		},
+		{
+			name:  "no channels",
+			query: Query{Text: "deploy"},
+			want:  []string{},
+		},
+		{
+			name:  "author",
+			query: Query{Text: "friday", Channels: []string{"general"}, Author: "fry"},
+			want:  []string{"1", "5"},
+		},
+		{
+			name:  "date range",
+			query: Query{Text: "deploy", Channels: []string{"general"}, After: now.Add(time.Minute), Before: now.Add(2 * time.Minute)},
+			want:  []string{"2"},
+		},
+		{
+			name:  "limit",
+			query: Query{Text: "deploy", Channels: []string{"general"}, Limit: 1},
+			want:  []string{"3"},
+		},
+	}
+
+	for _, tt := range tt {
+		t.Run(tt.name, func(t *testing.T) {
+			hits, err := index.Search(&tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != len(tt.want) {
+				t.Fatalf("expected %v got %d hits", tt.want, len(hits))
+			}
+			for i, hit := range hits {
+				if hit.Message != tt.want[i] {
+					t.Fatalf("expected %v got %s at %d", tt.want, hit.Message, i)
+				}
+			}
+		})
+	}
+
+	hits, _ := index.Search(&Query{Text: "deploy", Channels: []string{"secret"}})
+	if want := "<mark>deploy</mark> on friday"; len(hits) != 1 || hits[0].Snippet != want {
+		t.Fatalf("expected the snippet %q got %v", want, hits)
+	}
+
+	// an edit replaces the text and a delete drops the message
+	index.Index(&structs.Message{ID: "1", Channel: "general", Author: fry, Text: []string{"ship it"}, Time: now})
+	index.Remove("general", "2")
+
+	hits, _ = index.Search(&Query{Text: "deploy", Channels: []string{"general"}})
+	if len(hits) != 1 || hits[0].Message != "3" {
+		t.Fatalf("expected only 3 to be left got %v", hits)
+	}
+}
@@ -0,0 +1,131 @@
+package search
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+// headlineOptions are the ts_headline options used to build snippets
+const headlineOptions = "StartSel=" + MarkStart + ", StopSel=" + MarkEnd + ", MinWords=8, MaxWords=24, ShortWord=2"
+
+// Postgres is an index kept in the message_search table, see migration 000004.  Words are matched
+// by their english stems so "deploying" finds "deployed".
+type Postgres struct {
+	db    *sql.DB
+	owned bool
+}
+
+// NewPostgres returns an index using an existing database connection.  Closing the index leaves
+// the connection open.
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+// OpenPostgres connects to the database at the url and returns an index using it
+func OpenPostgres(rawurl string) (*Postgres, error) {
+	db, err := sql.Open("postgres", rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Postgres{db: db, owned: true}, nil
+}
+
+// Index adds the message or replaces the text of one that was already indexed
+func (p *Postgres) Index(message *structs.Message) error {
+	var author string
+	if message.Author != nil {
+		author = message.Author.ID
+	}
+
+	const query = `
+		INSERT INTO
+			message_search (channel, message, parent, author, body, document, created_at)
+		VALUES
+			($1, $2, $3, $4, $5, to_tsvector('english', $5), $6)
+		ON CONFLICT (channel, message) DO UPDATE SET
+			body = EXCLUDED.body,
+			document = EXCLUDED.document;`
+
+	_, err := p.db.Exec(query, message.Channel, message.ID, message.Parent, author, body(message), message.Time)
+	return err
+}
+
+// Remove drops the message from the index
+func (p *Postgres) Remove(channel, id string) error {
+	_, err := p.db.Exec(`DELETE FROM message_search WHERE channel = $1 AND message = $2;`, channel, id)
+	return err
+}
+
+// Search returns the messages with every word of the query ranked by ts_rank
+func (p *Postgres) Search(query *Query) ([]*Hit, error) {
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	if len(query.Channels) == 0 {
+		return []*Hit{}, nil
+	}
+
+	// the body is escaped before ts_headline marks it so the snippet is safe to render
+	const statement = `
+		SELECT
+			message, channel, parent, author, created_at,
+			ts_headline(
+				'english',
+				replace(replace(replace(body, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'),
+				q,
+				$7
+			)
+		FROM
+			message_search, plainto_tsquery('english', $1) q
+		WHERE
+			document @@ q
+			AND channel = ANY($2)
+			AND ($3 = '' OR author = $3)
+			AND ($4::timestamptz IS NULL OR created_at >= $4)
+			AND ($5::timestamptz IS NULL OR created_at < $5)
+		ORDER BY
+			ts_rank(document, q) DESC, created_at DESC
+		LIMIT $6;`
+
+	rows, err := p.db.Query(statement,
+		query.Text, pq.Array(query.Channels), query.Author,
+		nullTime(query.After), nullTime(query.Before), query.Limit, headlineOptions,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hits := make([]*Hit, 0, query.Limit)
+	for rows.Next() {
+		hit := &Hit{}
+		if err := rows.Scan(&hit.Message, &hit.Channel, &hit.Parent, &hit.Author, &hit.Time, &hit.Snippet); err != nil {
+			return nil, err
+		}
+		hits = append(hits, hit)
+	}
+	return hits, rows.Err()
+}
+
+// Close closes the database connection if the index opened it
+func (p *Postgres) Close() error {
+	if !p.owned {
+		return nil
+	}
+	return p.db.Close()
+}
+
+// nullTime is NULL for the zero time
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
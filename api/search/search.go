@@ -0,0 +1,239 @@
+// Package search finds messages by their text.
+//
+// Messages are fed to an Index as they're logged, edited and deleted.  An Index doesn't know who
+// is in which channel so every search names the channels it may look in, callers limit those to
+// the channels the searching user is a member of.
+package search
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+const (
+	// DefaultLimit is the number of hits returned when a query doesn't set a limit
+	DefaultLimit = 20
+
+	// MaxLimit is the most hits a single search returns
+	MaxLimit = 100
+
+	// MarkStart and MarkEnd surround the matched words of a snippet.  The rest of a snippet is
+	// HTML escaped so it's safe to render as HTML.
+	MarkStart = "<mark>"
+	MarkEnd   = "</mark>"
+
+	// snippetWords is about how many words of a message a snippet shows
+	snippetWords = 24
+)
+
+var (
+	// ErrEmptyQuery is returned when searching for text without any words in it
+	ErrEmptyQuery = errors.New("search: the query has no words")
+
+	// ErrInvalidLimit is returned when a query asks for more than MaxLimit hits
+	ErrInvalidLimit = errors.New("search: limit must be between 1 and 100")
+
+	// ErrInvalidRange is returned when a query's Before isn't after its After
+	ErrInvalidRange = errors.New("search: before must be after after")
+
+	// ErrClosed is returned when using an index that has been closed
+	ErrClosed = errors.New("search: closed")
+)
+
+// Index is a full-text index of messages
+type Index interface {
+	// Index adds the message or replaces the text of one that was already indexed
+	Index(message *structs.Message) error
+
+	// Remove drops the message from the index, removing one that isn't indexed isn't an error
+	Remove(channel, id string) error
+
+	// Search returns the messages matching the query, best match first and newest first among
+	// equally good matches
+	Search(query *Query) ([]*Hit, error)
+
+	// Close releases the index's resources
+	Close() error
+}
+
+// Query is what to search for and where
+type Query struct {
+
+	// Text is the words to search for, a message must match every one of them
+	Text string
+
+	// Channels are the only channels searched, nothing is found when it's empty
+	Channels []string
+
+	// Author only finds the messages of the user with this id when it's set
+	Author string
+
+	// After only finds messages sent at or after it when it's set
+	After time.Time
+
+	// Before only finds messages sent before it when it's set
+	Before time.Time
+
+	// Limit is the most hits returned, DefaultLimit when it's zero
+	Limit int
+}
+
+// Hit is a message matching a query
+type Hit struct {
+
+	// Message is the id of the message
+	Message string `json:"message"`
+
+	// Channel is the channel the message was sent to
+	Channel string `json:"channel"`
+
+	// Parent is the id of the message this is a reply to, it's empty for messages that aren't
+	Parent string `json:"parent,omitempty"`
+
+	// Author is the id of the user that sent the message
+	Author string `json:"author"`
+
+	// Time is when the message was sent
+	Time time.Time `json:"time"`
+
+	// Snippet is the part of the message around the words that matched with them marked by
+	// MarkStart and MarkEnd
+	Snippet string `json:"snippet"`
+}
+
+// Open returns the index for the url.  An empty url or memory:// gives an in-memory index that's
+// lost on restart and only sees the messages of this process, postgres://... gives one kept in a
+// table of that database.
+func Open(rawurl string) (Index, error) {
+	if rawurl == "" {
+		return NewMemory(), nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "memory":
+		return NewMemory(), nil
+	case "postgres", "postgresql":
+		return OpenPostgres(rawurl)
+	}
+	return nil, errors.New("search: unsupported scheme " + u.Scheme)
+}
+
+// validate checks the query filling in its default limit
+func (q *Query) validate() error {
+	if len(words(q.Text)) == 0 {
+		return ErrEmptyQuery
+	}
+	if q.Limit == 0 {
+		q.Limit = DefaultLimit
+	} else if q.Limit < 0 || q.Limit > MaxLimit {
+		return ErrInvalidLimit
+	}
+	if !q.After.IsZero() && !q.Before.IsZero() && !q.Before.After(q.After) {
+		return ErrInvalidRange
+	}
+	return nil
+}
+
+// sent reports whether t is within the query's date range
+func (q *Query) sent(t time.Time) bool {
+	return (q.After.IsZero() || !t.Before(q.After)) && (q.Before.IsZero() || t.Before(q.Before))
+}
+
+// body is the text of the message as a single string
+func body(message *structs.Message) string {
+	return strings.Join(message.Text, "\n")
+}
+
+// isWord reports whether the rune is part of a word
+func isWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// words splits the text into lower case words
+func words(text string) []string {
+	return strings.Fields(strings.Map(func(r rune) rune {
+		if isWord(r) {
+			return unicode.ToLower(r)
+		}
+		return ' '
+	}, text))
+}
+
+var escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// snippet returns about snippetWords words of the text starting a little before the first word
+// that matches.  Matching words are marked and everything else is escaped.
+func snippet(text string, matches func(word string) bool) string {
+	type span struct{ start, end int }
+
+	var (
+		spans = make([]span, 0, 16)
+		start = -1
+	)
+	for i, r := range text {
+		if isWord(r) && start < 0 {
+			start = i
+		} else if !isWord(r) && start >= 0 {
+			spans = append(spans, span{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, span{start, len(text)})
+	}
+	if len(spans) == 0 {
+		return escaper.Replace(text)
+	}
+
+	first := 0
+	for i, s := range spans {
+		if matches(strings.ToLower(text[s.start:s.end])) {
+			first = i
+			break
+		}
+	}
+
+	from := first - snippetWords/4
+	if from < 0 {
+		from = 0
+	}
+	to := from + snippetWords
+	if to > len(spans) {
+		to = len(spans)
+	}
+
+	var (
+		out = &strings.Builder{}
+		at  = spans[from].start
+	)
+	if from > 0 {
+		out.WriteString("…")
+	} else {
+		at = 0
+	}
+	for _, s := range spans[from:to] {
+		out.WriteString(escaper.Replace(text[at:s.start]))
+		word := escaper.Replace(text[s.start:s.end])
+		if matches(strings.ToLower(text[s.start:s.end])) {
+			word = MarkStart + word + MarkEnd
+		}
+		out.WriteString(word)
+		at = s.end
+	}
+	if to < len(spans) {
+		out.WriteString("…")
+	} else {
+		out.WriteString(escaper.Replace(text[at:]))
+	}
+	return strings.TrimSpace(out.String())
+}
@@ -0,0 +1,92 @@
+package search
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpen(t *testing.T) {
+	for _, rawurl := range []string{"", "memory://"} {
+		index, err := Open(rawurl)
+		if err != nil {
+			t.Fatalf("%q: %s", rawurl, err)
+		}
+		if _, ok := index.(*Memory); !ok {
+			t.Fatalf("%q: expected an in-memory index got %T", rawurl, index)
+		}
+	}
+
+	if _, err := Open("bleve:///var/lib/chat"); err == nil {
+		t.Fatal("expected an unsupported scheme to fail")
+	}
+}
+
+func TestQueryValidate(t *testing.T) {
+	var (
+		now = time.Now()
+		tt  = []struct {
+			name  string
+			query Query
+			err   error
+		}{
+			{name: "words", query: Query{Text: "deploy friday"}},
+			{name: "no words", query: Query{Text: " ?! "}, err: ErrEmptyQuery},
+			{name: "too many", query: Query{Text: "deploy", Limit: MaxLimit + 1}, err: ErrInvalidLimit},
+			{name: "negative", query: Query{Text: "deploy", Limit: -1}, err: ErrInvalidLimit},
+			{name: "range", query: Query{Text: "deploy", After: now, Before: now.Add(time.Hour)}},
+			{name: "backwards range", query: Query{Text: "deploy", After: now, Before: now}, err: ErrInvalidRange},
+		}
+	)
+
+	for _, tt := range tt {
+		t.Run(tt.name, func(t *testing.T) {
+			query := tt.query
+			if err := query.validate(); err != tt.err {
+				t.Fatalf("expected %v got %v", tt.err, err)
+			}
+			if tt.err == nil && tt.query.Limit == 0 && query.Limit != DefaultLimit {
+				t.Fatalf("expected the default limit got %d", query.Limit)
+			}
+		})
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	deploy := func(word string) bool { return strings.HasPrefix(word, "deploy") }
+
+	var tt = []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "short",
+			text: "Who is Deploying today?",
+			want: "Who is <mark>Deploying</mark> today?",
+		},
+		{
+			name: "escaped",
+			text: "<b>deploy</b> & pray",
+			want: "&lt;b&gt;<mark>deploy</mark>&lt;/b&gt; &amp; pray",
+		},
+		{
+			name: "long",
+			text: strings.Repeat("a ", 20) + "deploy" + strings.Repeat(" b", 40),
+			want: "…" + strings.Repeat("a ", 6) + "<mark>deploy</mark>" + strings.Repeat(" b", 17) + "…",
+		},
+		{
+			name: "no words",
+			text: "🎉",
+			want: "🎉",
+		},
+	}
+
+	for _, tt := range tt {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := snippet(tt.text, deploy); got != tt.want {
+				t.Fatalf("expected %q got %q", tt.want, got)
+			}
+		})
+	}
+}
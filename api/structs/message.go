@@ -0,0 +1,246 @@
+package structs
+
+import (
+	"errors"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxEmojiLen is the most bytes a reaction's emoji may take, enough for joined emoji sequences
+const maxEmojiLen = 32
+
+// ErrInvalidEmoji is returned when reacting with something that can't be an emoji
+var ErrInvalidEmoji = errors.New("emoji must be a short run of printable characters")
+
+// The types of Message.  They match the protocol frame types that carry a Message.
+const (
+	TypeInitialize = "initialize"
+	TypeSystem     = "system"
+	TypeMessage    = "message"
+)
+
+// Message is something said in a channel.  Consecutive messages from the same author are grouped
+// by the web client which is why Text is a list.
+type Message struct {
+
+	// ID is the TimeUUID the message was stored under, system messages aren't stored
+	ID string `json:"id,omitempty"`
+
+	// Type is one of TypeInitialize, TypeSystem or TypeMessage
+	Type string `json:"type"`
+
+	// Channel is the channel the message was sent to
+	Channel string `json:"channel,omitempty"`
+
+	// Parent is the id of the message this is a reply to, it's empty for messages that aren't
+	Parent string `json:"parent,omitempty"`
+
+	// Thread is the summary of the replies to the message, it's nil when there are none
+	Thread *Thread `json:"thread,omitempty"`
+
+	// EditedAt is when the message was last edited, it's nil if it never was
+	EditedAt *time.Time `json:"editedAt,omitempty"`
+
+	// Deleted is set on the tombstone left by deleting a message, it has no text
+	Deleted bool `json:"deleted,omitempty"`
+
+	// Reactions are the emoji the message was reacted to with, it's empty when there are none
+	Reactions []*Reaction `json:"reactions,omitempty"`
+
+	// Attachments are the files sent with the message, it's empty when there are none
+	Attachments []*Attachment `json:"attachments,omitempty"`
+
+	// Previews are the previews of the links in the message, they're added a moment after it's
+	// sent once the pages have been fetched
+	Previews []*Preview `json:"previews,omitempty"`
+
+	// Author is who sent the message
+	Author *User `json:"author"`
+
+	// Text is the body of the message, its markdown source
+	Text []string `json:"text"`
+
+	// HTML is the markdown of the text rendered as HTML, sanitized so it's safe to render as is.
+	// It's empty for system messages and tombstones.
+	HTML string `json:"html,omitempty"`
+
+	// Time is when the message was sent
+	Time time.Time `json:"time"`
+}
+
+// Thread is the summary of the replies to a message.  Replies to a reply are replies to the
+// message it replied to so threads are only ever one level deep.
+type Thread struct {
+
+	// Parent is the id of the message that was replied to
+	Parent string `json:"parent"`
+
+	// Replies is the number of replies to the message
+	Replies int `json:"replies"`
+
+	// LastReply is when the message was last replied to
+	LastReply time.Time `json:"lastReply"`
+}
+
+// Edit is a previous version of an edited message
+type Edit struct {
+
+	// Editor is the id of the user that made the edit
+	Editor string `json:"editor"`
+
+	// Text is the body of the message before the edit
+	Text string `json:"text"`
+
+	// EditedAt is when the edit was made
+	EditedAt time.Time `json:"editedAt"`
+}
+
+// Reaction is an emoji and the users that reacted to a message with it
+type Reaction struct {
+
+	// Emoji is what the users reacted with
+	Emoji string `json:"emoji"`
+
+	// Count is the number of users that reacted with the emoji
+	Count int `json:"count"`
+
+	// Users are the ids of the users that reacted with the emoji
+	Users []string `json:"users"`
+}
+
+// Reactions are all the reactions to a message.  They're sent whenever a reaction is added to or
+// removed from the message.
+type Reactions struct {
+
+	// Message is the id of the message reacted to
+	Message string `json:"message"`
+
+	// Reactions are the reactions to the message ordered by emoji
+	Reactions []*Reaction `json:"reactions"`
+}
+
+// Attachment is a file uploaded to a channel.  It's downloaded through the channel so only those
+// that can read the channel can get it.
+type Attachment struct {
+
+	// ID is the TimeUUID the attachment was stored under
+	ID string `json:"id"`
+
+	// Channel is the channel the attachment was uploaded to
+	Channel string `json:"channel"`
+
+	// Message is the id of the message the attachment was sent with, it's empty until it's sent
+	Message string `json:"message,omitempty"`
+
+	// Uploader is the id of the user that uploaded the attachment, only they can send it
+	Uploader string `json:"uploader"`
+
+	// Name is the file name the attachment was uploaded with
+	Name string `json:"name"`
+
+	// Type is the MIME type of the attachment sniffed from its contents
+	Type string `json:"type"`
+
+	// Size is the size of the attachment in bytes
+	Size int64 `json:"size"`
+
+	// Width and Height are the dimensions of images, they're zero for other attachments
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// Thumbnail is set when a smaller version of an image attachment can be downloaded
+	Thumbnail bool `json:"thumbnail,omitempty"`
+
+	// Time is when the attachment was uploaded
+	Time time.Time `json:"time"`
+}
+
+// Preview is what a link in a message is to, read from the OpenGraph or Twitter card metadata of
+// the page.  The fields are plain text.
+type Preview struct {
+
+	// URL is the link as it was written in the message
+	URL string `json:"url"`
+
+	// Title is the title of the page
+	Title string `json:"title,omitempty"`
+
+	// Description is a summary of the page
+	Description string `json:"description,omitempty"`
+
+	// Image is the url of an image representing the page
+	Image string `json:"image,omitempty"`
+
+	// SiteName is the name of the site the page is part of
+	SiteName string `json:"site_name,omitempty"`
+}
+
+// Previews are the previews of the links in a message.  They're sent once the links of a message
+// have been unfurled.
+type Previews struct {
+
+	// Message is the id of the message the links are in
+	Message string `json:"message"`
+
+	// Previews are the previews in the order the links appear in the message
+	Previews []*Preview `json:"previews"`
+}
+
+// Unread is how much of a channel a user hasn't read
+type Unread struct {
+
+	// LastRead is the id of the last message the user read, it's empty if they never read any
+	LastRead string `json:"lastRead,omitempty"`
+
+	// Count is the number of messages after LastRead.  Counting stops at a hundred.
+	Count int `json:"count"`
+}
+
+// ValidEmoji reports whether the emoji can be reacted with.  Any short run of printable
+// characters without spaces is accepted so both unicode emoji and :shortcodes: work.
+func ValidEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiLen || !utf8.ValidString(emoji) {
+		return false
+	}
+	for _, r := range emoji {
+		// the zero width joiner glues emoji sequences together
+		if unicode.IsSpace(r) || !unicode.IsGraphic(r) && r != '\u200d' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewMessage returns a message from author to channel
+func NewMessage(channel string, author *User, text string, at time.Time) *Message {
+	return &Message{
+		Type:    TypeMessage,
+		Channel: channel,
+		Author:  author,
+		Text:    []string{text},
+		Time:    at,
+	}
+}
+
+// NewSystemMessage returns a message from the SystemUser to channel
+func NewSystemMessage(channel, text string) *Message {
+	return &Message{
+		Type:    TypeSystem,
+		Channel: channel,
+		Author:  SystemUser,
+		Text:    []string{text},
+		Time:    time.Now().UTC(),
+	}
+}
+
+// NewInitializeMessage returns the first message a user gets when connecting, it lets the client
+// know who it's signed in as
+func NewInitializeMessage(user *User, text string) *Message {
+	return &Message{
+		Type:   TypeInitialize,
+		Author: user,
+		Text:   []string{text},
+		Time:   time.Now().UTC(),
+	}
+}
@@ -0,0 +1,109 @@
+package structs
+
+import "errors"
+
+// ErrInvalidRole is returned when parsing a role that doesn't exist
+var ErrInvalidRole = errors.New("role must be one of owner, admin, member or guest")
+
+// Role is what a user may do in a channel.  Every channel has exactly one owner.
+type Role string
+
+const (
+	// RoleNone is the role of users that aren't in the channel
+	RoleNone Role = ""
+
+	// RoleGuest can read the channel but not post to it
+	RoleGuest Role = "guest"
+
+	// RoleMember can read and post to the channel
+	RoleMember Role = "member"
+
+	// RoleAdmin can also add and remove guests and members and change their roles
+	RoleAdmin Role = "admin"
+
+	// RoleOwner can also add and remove admins, transfer ownership and delete the channel
+	RoleOwner Role = "owner"
+)
+
+// Action is something done in a channel that a role may or may not permit
+type Action string
+
+const (
+	// ActionRead is joining the channel, reading its history and listing its members
+	ActionRead Action = "read"
+
+	// ActionPost is sending messages and typing notifications to the channel
+	ActionPost Action = "post"
+
+	// ActionManage is adding, removing and changing the roles of the users ranked below you
+	ActionManage Action = "manage"
+
+	// ActionOwn is transferring ownership and deleting the channel
+	ActionOwn Action = "own"
+)
+
+var (
+	roleRanks = map[Role]int{
+		RoleNone:   0,
+		RoleGuest:  1,
+		RoleMember: 2,
+		RoleAdmin:  3,
+		RoleOwner:  4,
+	}
+
+	// actionRoles is the lowest role that permits each action
+	actionRoles = map[Action]Role{
+		ActionRead:   RoleGuest,
+		ActionPost:   RoleMember,
+		ActionManage: RoleAdmin,
+		ActionOwn:    RoleOwner,
+	}
+)
+
+// ParseRole returns the role with the name.  The owner role is given by transferring ownership so
+// it isn't parsed.
+func ParseRole(name string) (Role, error) {
+	switch role := Role(name); role {
+	case RoleGuest, RoleMember, RoleAdmin:
+		return role, nil
+	}
+	return RoleNone, ErrInvalidRole
+}
+
+// Permits reports whether the role allows the action
+func (r Role) Permits(action Action) bool {
+	least, ok := actionRoles[action]
+	return ok && (r == least || r.Outranks(least))
+}
+
+// Outranks reports whether the role is higher than the other
+func (r Role) Outranks(other Role) bool {
+	return roleRanks[r] > roleRanks[other]
+}
+
+// CanAssign reports whether the role allows changing another user's role from one role to
+// another.  Adding a user to a channel is changing them from RoleNone and removing them is
+// changing them to RoleNone.  Only roles ranked below your own can be given or taken away.
+func (r Role) CanAssign(from, to Role) bool {
+	return r.Permits(ActionManage) && r.Outranks(from) && r.Outranks(to)
+}
+
+// MemberRoles returns the role of everyone in a channel keyed by user id.  Members without an
+// assigned role are members and roles that can't be parsed are demoted to guests.
+func MemberRoles(owner string, members []string, assigned map[string]string) map[string]Role {
+	roles := make(map[string]Role, len(members)+1)
+	for _, member := range members {
+		role, ok := assigned[member]
+		if !ok {
+			roles[member] = RoleMember
+		} else if parsed, err := ParseRole(role); err == nil {
+			roles[member] = parsed
+		} else {
+			roles[member] = RoleGuest
+		}
+	}
+	if owner != "" {
+		roles[owner] = RoleOwner
+	}
+	return roles
+}
@@ -0,0 +1,108 @@
+package structs
+
+import (
+	"reflect"
+	"testing"
+)
+
+var ttRolePermits = []struct {
+	role    Role
+	permits []Action
+	refuses []Action
+}{
+	{
+		role:    RoleNone,
+		refuses: []Action{ActionRead, ActionPost, ActionManage, ActionOwn},
+	},
+	{
+		role:    RoleGuest,
+		permits: []Action{ActionRead},
+		refuses: []Action{ActionPost, ActionManage, ActionOwn},
+	},
+	{
+		role:    RoleMember,
+		permits: []Action{ActionRead, ActionPost},
+		refuses: []Action{ActionManage, ActionOwn},
+	},
+	{
+		role:    RoleAdmin,
+		permits: []Action{ActionRead, ActionPost, ActionManage},
+		refuses: []Action{ActionOwn},
+	},
+	{
+		role:    RoleOwner,
+		permits: []Action{ActionRead, ActionPost, ActionManage, ActionOwn},
+		refuses: []Action{"fly"},
+	},
+}
+
+func TestRolePermits(t *testing.T) {
+	for _, tt := range ttRolePermits {
+		for _, action := range tt.permits {
+			if !tt.role.Permits(action) {
+				t.Errorf("expected %q to permit %s", tt.role, action)
+			}
+		}
+		for _, action := range tt.refuses {
+			if tt.role.Permits(action) {
+				t.Errorf("expected %q to refuse %s", tt.role, action)
+			}
+		}
+	}
+}
+
+var ttRoleCanAssign = []struct {
+	role     Role
+	from, to Role
+	can      bool
+}{
+	{role: RoleAdmin, from: RoleNone, to: RoleMember, can: true},
+	{role: RoleAdmin, from: RoleMember, to: RoleGuest, can: true},
+	{role: RoleAdmin, from: RoleGuest, to: RoleNone, can: true},
+	{role: RoleAdmin, from: RoleMember, to: RoleAdmin, can: false},
+	{role: RoleAdmin, from: RoleAdmin, to: RoleNone, can: false},
+	{role: RoleOwner, from: RoleMember, to: RoleAdmin, can: true},
+	{role: RoleOwner, from: RoleAdmin, to: RoleNone, can: true},
+	{role: RoleOwner, from: RoleAdmin, to: RoleOwner, can: false},
+	{role: RoleOwner, from: RoleOwner, to: RoleNone, can: false},
+	{role: RoleMember, from: RoleNone, to: RoleGuest, can: false},
+}
+
+func TestRoleCanAssign(t *testing.T) {
+	for _, tt := range ttRoleCanAssign {
+		if can := tt.role.CanAssign(tt.from, tt.to); can != tt.can {
+			t.Errorf("expected %s changing %q to %q to be %t", tt.role, tt.from, tt.to, tt.can)
+		}
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	for _, name := range []string{"guest", "member", "admin"} {
+		if role, err := ParseRole(name); err != nil || string(role) != name {
+			t.Errorf("expected %s to parse got %q %v", name, role, err)
+		}
+	}
+	for _, name := range []string{"", "owner", "Admin", "superuser"} {
+		if _, err := ParseRole(name); err != ErrInvalidRole {
+			t.Errorf("expected %q to be invalid got %v", name, err)
+		}
+	}
+}
+
+func TestMemberRoles(t *testing.T) {
+	roles := MemberRoles("farnsworth", []string{"farnsworth", "leela", "fry", "zoidberg"}, map[string]string{
+		"leela":    "admin",
+		"zoidberg": "janitor",
+		"bender":   "admin",
+	})
+
+	expected := map[string]Role{
+		"farnsworth": RoleOwner,
+		"leela":      RoleAdmin,
+		"fry":        RoleMember,
+		"zoidberg":   RoleGuest,
+	}
+	if !reflect.DeepEqual(roles, expected) {
+		t.Fatalf("expected %v got %v", expected, roles)
+	}
+}
@@ -0,0 +1,108 @@
+package structs
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserJSON(t *testing.T) {
+	user := NewUser("3e0c1291-b3a5-44c7-86d6-338f3b4870e9", "Fry", "/images/128x128/fry.png")
+	user.GID = "1234"
+
+	data, err := json.Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]interface{}{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"id":     "3e0c1291-b3a5-44c7-86d6-338f3b4870e9",
+		"name":   "Fry",
+		"avatar": "/images/128x128/fry.png",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v got %v", expected, got)
+	}
+}
+
+func TestMessageJSON(t *testing.T) {
+	var (
+		at      = time.Date(3000, time.January, 1, 0, 0, 0, 0, time.UTC)
+		author  = NewUser("leela", "Leela", "/images/128x128/leela.png")
+		message = NewMessage("planet-express", author, "Good news everyone!", at)
+	)
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]interface{}{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"type":    "message",
+		"channel": "planet-express",
+		"author": map[string]interface{}{
+			"id":     "leela",
+			"name":   "Leela",
+			"avatar": "/images/128x128/leela.png",
+		},
+		"text": []interface{}{"Good news everyone!"},
+		"time": "3000-01-01T00:00:00Z",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v got %v", expected, got)
+	}
+}
+
+func TestSystemMessage(t *testing.T) {
+	message := NewSystemMessage("planet-express", "Fry has joined the conversation")
+
+	if message.Type != TypeSystem || message.Author != SystemUser || message.Channel != "planet-express" {
+		t.Fatalf("unexpected system message %+v", message)
+	}
+	if message.Time.IsZero() {
+		t.Fatal("expected the message to be stamped")
+	}
+}
+
+func TestInitializeMessage(t *testing.T) {
+	user := NewUser("fry", "Fry", "")
+	message := NewInitializeMessage(user, "Welcome Fry")
+
+	if message.Type != TypeInitialize || message.Author != user || message.Text[0] != "Welcome Fry" {
+		t.Fatalf("unexpected initialize message %+v", message)
+	}
+}
+
+func TestValidEmoji(t *testing.T) {
+	var tt = []struct {
+		emoji string
+		valid bool
+	}{
+		{emoji: "👍", valid: true},
+		{emoji: "👩‍👩‍👧", valid: true},
+		{emoji: ":party_parrot:", valid: true},
+		{emoji: "", valid: false},
+		{emoji: "thumbs up", valid: false},
+		{emoji: "\x00", valid: false},
+		{emoji: "\xff", valid: false},
+		{emoji: strings.Repeat("👍", 9), valid: false},
+	}
+
+	for _, tt := range tt {
+		if got := ValidEmoji(tt.emoji); got != tt.valid {
+			t.Errorf("ValidEmoji(%q) expected %v got %v", tt.emoji, tt.valid, got)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// Package structs holds the domain types shared by the api and api2 services and sent to the web
+// client.  The JSON tags match what web/src/store.js consumes.
+package structs
+
+// SystemUser is the author of messages sent by the server itself
+var SystemUser = &User{
+	ID:     "system",
+	Name:   "Admin",
+	Avatar: "/images/128x128/system.png",
+}
+
+// User is someone that can sign in and chat
+type User struct {
+
+	// ID is the internal UUID of the user
+	ID string `json:"id"`
+
+	// Name is the display name of the user
+	Name string `json:"name"`
+
+	// Avatar is the url of the picture of the user
+	Avatar string `json:"avatar"`
+
+	// Email is the email address given by the identity provider, it may be empty
+	Email string `json:"email,omitempty"`
+
+	// GID is the id the identity provider knows the user by and is never sent to clients
+	GID string `json:"-"`
+}
+
+// NewUser returns a user with the given id, display name and avatar url
+func NewUser(id, name, picture string) *User {
+	return &User{
+		ID:     id,
+		Name:   name,
+		Avatar: picture,
+	}
+}
@@ -0,0 +1,74 @@
+package unfurl
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+// cache remembers the previews of the most recently fetched links until they expire
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// entry is a remembered fetch, a failed one has no preview
+type entry struct {
+	link    string
+	preview *structs.Preview
+	err     error
+	expires time.Time
+}
+
+// newCache returns an empty cache remembering up to size links
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+// get returns what was fetched from the link if it hasn't expired by now
+func (c *cache) get(link string, now time.Time) (*entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[link]
+	if !ok {
+		return nil, false
+	}
+	e := element.Value.(*entry)
+	if !now.Before(e.expires) {
+		c.order.Remove(element)
+		delete(c.entries, link)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return e, true
+}
+
+// put remembers what was fetched from the link until it expires, forgetting the least recently
+// used link when the cache is full
+func (c *cache) put(link string, preview *structs.Preview, err error, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &entry{link: link, preview: preview, err: err, expires: expires}
+	if element, ok := c.entries[link]; ok {
+		element.Value = e
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[link] = c.order.PushFront(e)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).link)
+	}
+}
@@ -0,0 +1,114 @@
+package unfurl
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// maxRedirects is how many redirects are followed to get to a page
+const maxRedirects = 5
+
+// forbiddenNetworks are the addresses that mustn't be fetched: this host, private and shared
+// networks, link-local addresses such as cloud metadata services, and reserved ranges.
+var forbiddenNetworks = networks(
+	"0.0.0.0/8",       // this network
+	"10.0.0.0/8",      // private
+	"100.64.0.0/10",   // carrier-grade nat
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link-local
+	"172.16.0.0/12",   // private
+	"192.0.0.0/24",    // ietf protocol assignments
+	"192.0.2.0/24",    // documentation
+	"192.88.99.0/24",  // 6to4 relay anycast
+	"192.168.0.0/16",  // private
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved and broadcast
+	"::/128",          // unspecified
+	"::1/128",         // loopback
+	"64:ff9b::/96",    // ipv4 translation, could reach any of the above
+	"64:ff9b:1::/48",  // local ipv4 translation
+	"100::/64",        // discard
+	"2001::/23",       // ietf protocol assignments
+	"2001:db8::/32",   // documentation
+	"2002::/16",       // 6to4, could reach any of the above
+	"fc00::/7",        // unique local
+	"fe80::/10",       // link-local
+	"ff00::/8",        // multicast
+)
+
+// networks parses the cidrs
+func networks(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// Forbidden reports whether the address mustn't be fetched
+func Forbidden(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range forbiddenNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewClient returns a client that only connects to public addresses.  The address is checked
+// once the host has been resolved, just before connecting, so neither redirects nor a host that
+// resolves to another address by the time it's connected to can get around it.  Proxies from the
+// environment aren't used as they'd do the connecting.  The timeout covers the whole fetch,
+// redirects included.
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || Forbidden(ip) {
+				return ErrForbiddenAddress
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConns:          16,
+			IdleConnTimeout:       time.Minute,
+		},
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// checkRedirect follows up to maxRedirects redirects to other http and https urls
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("unfurl: too many redirects")
+	}
+	if _, err := parseLink(req.URL.String()); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package unfurl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestForbidden(t *testing.T) {
+	var tt = []struct {
+		ip        string
+		forbidden bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"255.255.255.255", true},
+		{"::1", true},
+		{"::", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"64:ff9b::a00:1", true},
+		{"8.8.8.8", false},
+		{"172.32.0.1", false},
+		{"1.1.1.1", false},
+		{"2606:4700:4700::1111", false},
+	}
+
+	for _, tt := range tt {
+		t.Run(tt.ip, func(t *testing.T) {
+			if forbidden := Forbidden(net.ParseIP(tt.ip)); forbidden != tt.forbidden {
+				t.Fatalf("expected %s forbidden to be %t", tt.ip, tt.forbidden)
+			}
+		})
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	var fetched bool
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<title>Internal</title>`)
+	}))
+	defer internal.Close()
+
+	fetcher := NewFetcher(NewClient(time.Second))
+
+	// the test server listens on loopback as an internal service would
+	_, port, _ := net.SplitHostPort(internal.Listener.Addr().String())
+	links := []string{internal.URL, "http://localhost:" + port}
+	for _, link := range links {
+		if _, err := fetcher.Fetch(context.Background(), link); err != ErrForbiddenAddress {
+			t.Fatalf("expected fetching %s to be forbidden got %v", link, err)
+		}
+	}
+	if fetched {
+		t.Fatal("expected the internal server not to be reached")
+	}
+
+	if _, err := fetcher.Fetch(context.Background(), "file:///etc/passwd"); err != ErrInvalidURL {
+		t.Fatalf("expected a file url to be invalid got %v", err)
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	var (
+		external, _ = http.NewRequest(http.MethodGet, "https://example.com/", nil)
+		file, _     = http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	)
+	file.URL.Scheme = "file"
+
+	if err := checkRedirect(external, nil); err != nil {
+		t.Fatalf("expected the redirect to be followed got %v", err)
+	}
+	if err := checkRedirect(file, nil); err != ErrInvalidURL {
+		t.Fatalf("expected a redirect to a file url to be refused got %v", err)
+	}
+	if err := checkRedirect(external, make([]*http.Request, maxRedirects)); err == nil {
+		t.Fatal("expected too many redirects to be refused")
+	}
+}
@@ -0,0 +1,103 @@
+package unfurl
+
+import (
+	"io"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sir-wiggles/chat/api/structs"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// maxTitle and maxDescription are the most runes of a page's title and description kept
+	maxTitle       = 200
+	maxDescription = 500
+)
+
+// parse reads the preview from the head of the page at base.  OpenGraph properties win over
+// Twitter card ones which win over the title and description of the page.
+func parse(r io.Reader, base *url.URL) *structs.Preview {
+	var (
+		z     = html.NewTokenizer(r)
+		meta  = make(map[string]string)
+		title string
+	)
+
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return preview(meta, title, base)
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			switch token.DataAtom {
+			case atom.Body:
+				return preview(meta, title, base)
+
+			case atom.Title:
+				if z.Next() == html.TextToken && title == "" {
+					title = string(z.Text())
+				}
+
+			case atom.Meta:
+				var key, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						key = strings.ToLower(strings.TrimSpace(attr.Val))
+					case "content":
+						content = attr.Val
+					}
+				}
+				if _, ok := meta[key]; !ok && key != "" {
+					meta[key] = content
+				}
+			}
+
+		case html.EndTagToken:
+			if z.Token().DataAtom == atom.Head {
+				return preview(meta, title, base)
+			}
+		}
+	}
+}
+
+// preview picks the first of the properties of the page that's set for each field
+func preview(meta map[string]string, title string, base *url.URL) *structs.Preview {
+	first := func(values ...string) string {
+		for _, v := range values {
+			if v = strings.Join(strings.Fields(v), " "); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	p := &structs.Preview{
+		Title:       truncate(first(meta["og:title"], meta["twitter:title"], title), maxTitle),
+		Description: truncate(first(meta["og:description"], meta["twitter:description"], meta["description"]), maxDescription),
+		SiteName:    truncate(first(meta["og:site_name"]), maxTitle),
+	}
+
+	// the image is fetched by clients so only http and https images are kept
+	if image := first(meta["og:image:secure_url"], meta["og:image"], meta["twitter:image"], meta["twitter:image:src"]); image != "" {
+		if u, err := base.Parse(image); err == nil {
+			if _, err := parseLink(u.String()); err == nil {
+				p.Image = u.String()
+			}
+		}
+	}
+	return p
+}
+
+// truncate cuts the text down to max runes ending it with an ellipsis if it was longer
+func truncate(text string, max int) string {
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	runes := []rune(text)
+	return strings.TrimSpace(string(runes[:max-1])) + "…"
+}
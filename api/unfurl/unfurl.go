@@ -0,0 +1,233 @@
+// Package unfurl fetches previews of the links in messages.
+//
+// A preview is the OpenGraph or Twitter card metadata of a page, falling back to its title and
+// description.  Links are posted by users so the pages are fetched by a client that refuses to
+// connect to private, loopback and other internal addresses, see NewClient.
+package unfurl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+const (
+	// MaxLinks is the most links of a message that are unfurled
+	MaxLinks = 3
+
+	// DefaultTimeout is how long fetching a page may take, redirects included
+	DefaultTimeout = 5 * time.Second
+
+	// maxBodySize is the most bytes of a page read looking for its metadata
+	maxBodySize = 512 << 10
+
+	// maxURLLength is the longest link that's unfurled
+	maxURLLength = 2048
+
+	// cacheSize is how many links' previews are remembered
+	cacheSize = 1024
+
+	// cacheTTL is how long a preview is remembered, failures are remembered for failureTTL so a
+	// broken link isn't fetched for every message it's posted in
+	cacheTTL   = time.Hour
+	failureTTL = 5 * time.Minute
+)
+
+var (
+	// ErrInvalidURL is returned when unfurling a link that isn't an absolute http or https url
+	ErrInvalidURL = errors.New("unfurl: not an http or https url")
+
+	// ErrForbiddenAddress is returned when a link resolves to an address that mustn't be fetched
+	ErrForbiddenAddress = errors.New("unfurl: forbidden address")
+
+	// ErrNotHTML is returned when a link isn't to an html page
+	ErrNotHTML = errors.New("unfurl: not an html page")
+
+	// ErrNoPreview is returned when a page has nothing to preview
+	ErrNoPreview = errors.New("unfurl: nothing to preview")
+)
+
+// Fetcher fetches the previews of links, remembering them for a while.  It's safe for concurrent
+// use, concurrent fetches of the same link share a single request.
+type Fetcher struct {
+	client *http.Client
+	cache  *cache
+
+	mu       sync.Mutex
+	inflight map[string]*call
+}
+
+// call is a fetch of a link in flight, whoever else fetches the link meanwhile waits for it
+type call struct {
+	done    chan struct{}
+	preview *structs.Preview
+	err     error
+}
+
+// NewFetcher returns a fetcher using the client, a nil client gives NewClient(DefaultTimeout).
+// Only pass another client where the pages fetched are trusted, such as in tests.
+func NewFetcher(client *http.Client) *Fetcher {
+	if client == nil {
+		client = NewClient(DefaultTimeout)
+	}
+	return &Fetcher{client: client, cache: newCache(cacheSize), inflight: make(map[string]*call)}
+}
+
+// Fetch returns the preview of the page at the link.  Previews are shared with every caller
+// fetching the same link while it's remembered so they mustn't be changed.
+func (f *Fetcher) Fetch(ctx context.Context, link string) (*structs.Preview, error) {
+	if e, ok := f.cache.get(link, time.Now()); ok {
+		return e.preview, e.err
+	}
+
+	f.mu.Lock()
+	c, ok := f.inflight[link]
+	if !ok {
+		c = &call{done: make(chan struct{})}
+		f.inflight[link] = c
+	}
+	f.mu.Unlock()
+
+	if ok {
+		select {
+		case <-c.done:
+			return c.preview, c.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	c.preview, c.err = f.fetch(ctx, link)
+
+	// a canceled fetch says nothing about the link
+	if ctx.Err() == nil {
+		ttl := cacheTTL
+		if c.err != nil {
+			ttl = failureTTL
+		}
+		f.cache.put(link, c.preview, c.err, time.Now().Add(ttl))
+	}
+
+	f.mu.Lock()
+	delete(f.inflight, link)
+	f.mu.Unlock()
+	close(c.done)
+
+	return c.preview, c.err
+}
+
+// fetch gets the page at the link and reads its preview
+func (f *Fetcher) fetch(ctx context.Context, link string) (*structs.Preview, error) {
+	u, err := parseLink(link)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, ErrInvalidURL
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("User-Agent", "chat-unfurl/1.0")
+
+	rsp, err := f.client.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrForbiddenAddress) {
+			return nil, ErrForbiddenAddress
+		}
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.New("unfurl: " + rsp.Status)
+	}
+	if t, _, _ := mime.ParseMediaType(rsp.Header.Get("Content-Type")); t != "text/html" && t != "application/xhtml+xml" {
+		return nil, ErrNotHTML
+	}
+
+	preview := parse(io.LimitReader(rsp.Body, maxBodySize), rsp.Request.URL)
+	if preview.Title == "" && preview.Description == "" {
+		return nil, ErrNoPreview
+	}
+	preview.URL = link
+	return preview, nil
+}
+
+// parseLink returns the link if it's an absolute http or https url
+func parseLink(link string) (*url.URL, error) {
+	if len(link) > maxURLLength {
+		return nil, ErrInvalidURL
+	}
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+		return nil, ErrInvalidURL
+	}
+	return u, nil
+}
+
+// Links returns up to MaxLinks distinct http and https links in the text, in the order they
+// first appear
+func Links(text ...string) []string {
+	var (
+		links = make([]string, 0, MaxLinks)
+		seen  = make(map[string]bool, MaxLinks)
+	)
+	for _, t := range text {
+		for _, field := range strings.FieldsFunc(t, isSpace) {
+			start := strings.Index(field, "http://")
+			if i := strings.Index(field, "https://"); i >= 0 && (start < 0 || i < start) {
+				start = i
+			}
+			if start < 0 {
+				continue
+			}
+
+			link := trimLink(field[start:])
+			if seen[link] {
+				continue
+			}
+			if _, err := parseLink(link); err != nil {
+				continue
+			}
+			seen[link] = true
+			links = append(links, link)
+			if len(links) == MaxLinks {
+				return links
+			}
+		}
+	}
+	return links
+}
+
+// isSpace splits text into the words links are found in, the angle brackets and quotes a link is
+// written in aren't part of it
+func isSpace(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(`<>"`, r)
+}
+
+// trimLink drops the punctuation ending a sentence or closing a bracket the link was written in
+func trimLink(link string) string {
+	for len(link) > 0 {
+		last := link[len(link)-1]
+		switch {
+		case strings.IndexByte(".,;:!?'*", last) >= 0:
+		case last == ')' && strings.Count(link, "(") < strings.Count(link, ")"):
+		case last == ']' && strings.Count(link, "[") < strings.Count(link, "]"):
+		default:
+			return link
+		}
+		link = link[:len(link)-1]
+	}
+	return link
+}
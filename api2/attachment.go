@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	// decoders for the images that get thumbnails
+	_ "image/gif"
+	_ "image/jpeg"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+	"github.com/sir-wiggles/chat/api/blob"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+const (
+	// defaultMaxAttachmentSize is the largest attachment in bytes that can be uploaded unless
+	// MAX_ATTACHMENT_BYTES says otherwise
+	defaultMaxAttachmentSize = 10 << 20
+
+	// uploadOverhead is how many bytes of a request body on top of the attachment are allowed for
+	// the multipart boundaries and headers
+	uploadOverhead = 64 << 10
+
+	// maxAttachmentName is the longest file name in bytes an attachment keeps
+	maxAttachmentName = 255
+
+	// thumbnailSize is the most pixels a thumbnail is wide or high
+	thumbnailSize = 320
+
+	// maxThumbnailPixels is the largest image in pixels that's decoded to make a thumbnail
+	maxThumbnailPixels = 4096 * 4096
+
+	// thumbnailSamples is how many pixels across and down are averaged for each thumbnail pixel
+	thumbnailSamples = 4
+
+	// defaultAttachmentTTL is how long an attachment can be left unsent unless ATTACHMENT_TTL
+	// says otherwise
+	defaultAttachmentTTL = 24 * time.Hour
+
+	// sweepInterval is how often attachments left unsent for too long are swept
+	sweepInterval = 10 * time.Minute
+
+	// minTransferRate is the slowest in bytes per second an attachment can be uploaded or
+	// downloaded at without the request timing out
+	minTransferRate = 32 << 10
+)
+
+var (
+	// maxAttachmentSize is the largest attachment in bytes that can be uploaded
+	maxAttachmentSize int64 = defaultMaxAttachmentSize
+
+	// attachmentTTL is how long an attachment can be left unsent before it's dropped
+	attachmentTTL = defaultAttachmentTTL
+
+	// ErrAttachmentTooLarge is returned when uploading an attachment larger than the limit
+	ErrAttachmentTooLarge = errors.New("attachment is too large")
+
+	// ErrAttachmentType is returned when uploading a file of a type that can't be attached
+	ErrAttachmentType = errors.New("attachments must be images, pdf, zip or plain text files")
+
+	// ErrMissingFile is returned when an upload has no "file" part or it's empty
+	ErrMissingFile = errors.New(`a non empty "file" is required`)
+
+	// attachmentTypes are the media types that can be attached and whether they're shown inline
+	attachmentTypes = map[string]bool{
+		"image/png":       true,
+		"image/jpeg":      true,
+		"image/gif":       true,
+		"image/webp":      true,
+		"application/pdf": false,
+		"application/zip": false,
+		"text/plain":      false,
+	}
+)
+
+// transferTimeout is how long reading or writing a request may take, enough for the largest
+// attachment at minTransferRate on top of the 15 seconds any request gets
+func transferTimeout() time.Duration {
+	return 15*time.Second + time.Duration(maxAttachmentSize/minTransferRate)*time.Second
+}
+
+// attachmentKey is where the attachment is kept in the blob store
+func attachmentKey(a *structs.Attachment) string {
+	return a.Channel + "/" + a.ID
+}
+
+// thumbnailKey is where the thumbnail of the attachment is kept in the blob store
+func thumbnailKey(a *structs.Attachment) string {
+	return attachmentKey(a) + ".thumb"
+}
+
+// UploadAttachment stores the "file" part of a multipart upload as an attachment of the channel.
+// Its type is sniffed from its contents and a thumbnail is made of images.  The attachment can be
+// sent with a message by its uploader, until then only they can download it.  It's dropped if it
+// isn't sent within attachmentTTL.
+func (c *Channel) UploadAttachment(w http.ResponseWriter, r *http.Request) {
+	var rw = w.(*ResponseWriter)
+
+	a, ok := c.authorize(w, r, "", "", structs.ActionPost)
+	if !ok {
+		return
+	}
+
+	part, err := attachmentPart(r)
+	if err != nil {
+		rw.JSON(err, http.StatusBadRequest)
+		return
+	}
+	defer part.Close()
+
+	var (
+		attachment = &structs.Attachment{
+			ID:       gocql.TimeUUID().String(),
+			Channel:  a.channel,
+			Uploader: a.user,
+			Name:     attachmentName(part.FileName()),
+		}
+		body = bufio.NewReaderSize(part, 512)
+	)
+
+	// a short file is all there is to sniff so the error reading it doesn't matter
+	head, _ := body.Peek(512)
+	if len(head) == 0 {
+		rw.JSON(ErrMissingFile, http.StatusBadRequest)
+		return
+	}
+	attachment.Type = http.DetectContentType(head)
+	if _, ok := attachmentTypes[mediaType(attachment.Type)]; !ok {
+		rw.JSON(ErrAttachmentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// one byte over the limit is read to know the file is too large
+	attachment.Size, err = c.blobs.Put(attachmentKey(attachment), io.LimitReader(body, maxAttachmentSize+1))
+	if err != nil {
+		rw.JSON(err)
+		return
+	}
+	if attachment.Size > maxAttachmentSize {
+		c.removeBlob(attachmentKey(attachment))
+		rw.JSON(ErrAttachmentTooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if strings.HasPrefix(attachment.Type, "image/") {
+		c.thumbnail(attachment)
+	}
+
+	if err := c.database.CreateAttachment(attachment); err != nil {
+		c.removeBlob(attachmentKey(attachment))
+		if attachment.Thumbnail {
+			c.removeBlob(thumbnailKey(attachment))
+		}
+		rw.JSON(err)
+		return
+	}
+	rw.JSON(attachment, http.StatusCreated)
+}
+
+// DownloadAttachment responds with the file of the attachment of the route
+func (c *Channel) DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := c.authorizeAttachment(w, r)
+	if !ok {
+		return
+	}
+	c.download(w, r, attachment, attachmentKey(attachment), attachment.Type)
+}
+
+// DownloadThumbnail responds with the thumbnail of the image attachment of the route, attachments
+// without one aren't found
+func (c *Channel) DownloadThumbnail(w http.ResponseWriter, r *http.Request) {
+	var rw = w.(*ResponseWriter)
+
+	attachment, ok := c.authorizeAttachment(w, r)
+	if !ok {
+		return
+	}
+	if !attachment.Thumbnail {
+		rw.JSON(ErrAttachmentNotFound, http.StatusNotFound)
+		return
+	}
+	c.download(w, r, attachment, thumbnailKey(attachment), "image/png")
+}
+
+// authorizeAttachment gets the attachment of the route if the authenticated user can read the
+// channel.  Attachments that haven't been sent can only be downloaded by their uploader.
+func (c *Channel) authorizeAttachment(w http.ResponseWriter, r *http.Request) (*structs.Attachment, bool) {
+	var rw = w.(*ResponseWriter)
+
+	a, ok := c.authorize(w, r, "", "", structs.ActionRead)
+	if !ok {
+		return nil, false
+	}
+
+	var attachment = &structs.Attachment{
+		Channel: a.channel,
+		ID:      mux.Vars(r)["aid"],
+	}
+	if err := c.database.GetAttachment(attachment); err == ErrAttachmentNotFound {
+		rw.JSON(err, http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		rw.JSON(err)
+		return nil, false
+	}
+	if attachment.Message == "" && attachment.Uploader != a.user {
+		rw.JSON(ErrAttachmentNotFound, http.StatusNotFound)
+		return nil, false
+	}
+	return attachment, true
+}
+
+// download streams the blob to the client.  Only images are shown inline, everything else is
+// downloaded, and the client isn't allowed to guess another type.
+func (c *Channel) download(w http.ResponseWriter, r *http.Request, attachment *structs.Attachment, key, contentType string) {
+	var rw = w.(*ResponseWriter)
+
+	file, err := c.blobs.Get(key)
+	if err == blob.ErrNotFound {
+		rw.JSON(ErrAttachmentNotFound, http.StatusNotFound)
+		return
+	} else if err != nil {
+		rw.JSON(err)
+		return
+	}
+	defer file.Close()
+
+	disposition := "attachment"
+	if attachmentTypes[mediaType(contentType)] {
+		disposition = "inline"
+	}
+
+	header := rw.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+
+	// the file skips the JSON buffer, seekable blobs get range requests
+	if seeker, ok := file.(io.ReadSeeker); ok {
+		http.ServeContent(rw.ResponseWriter, r, attachment.Name, attachment.Time, seeker)
+		return
+	}
+	rw.ResponseWriter.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(rw.ResponseWriter, file); err != nil {
+		log.Printf("attachment: failed to send %s: %s", key, err)
+	}
+}
+
+// thumbnail fills in the dimensions of the image attachment and stores a thumbnail of it if it's
+// larger than one.  Images that can't be decoded are still attached, just without a thumbnail.
+func (c *Channel) thumbnail(attachment *structs.Attachment) {
+	file, err := c.blobs.Get(attachmentKey(attachment))
+	if err != nil {
+		log.Printf("attachment: failed to read %s: %s", attachment.ID, err)
+		return
+	}
+	defer file.Close()
+
+	body := bufio.NewReader(file)
+	head, _ := body.Peek(64 << 10)
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil {
+		return
+	}
+	attachment.Width, attachment.Height = config.Width, config.Height
+
+	if config.Width*config.Height > maxThumbnailPixels {
+		return
+	}
+	if config.Width <= thumbnailSize && config.Height <= thumbnailSize {
+		return
+	}
+
+	img, _, err := image.Decode(body)
+	if err != nil {
+		return
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(png.Encode(pw, scale(img, thumbnailSize)))
+	}()
+	if _, err := c.blobs.Put(thumbnailKey(attachment), pr); err != nil {
+		log.Printf("attachment: failed to store the thumbnail of %s: %s", attachment.ID, err)
+		pr.CloseWithError(err)
+		return
+	}
+	attachment.Thumbnail = true
+}
+
+// SweepAttachments drops the attachments left unsent for longer than attachmentTTL along with
+// their files every sweepInterval, it never returns
+func (c *Channel) SweepAttachments() {
+	for range time.Tick(sweepInterval) {
+		c.sweepAttachments(time.Now().Add(-attachmentTTL))
+	}
+}
+
+// sweepAttachments drops the attachments uploaded before the time that haven't been sent
+func (c *Channel) sweepAttachments(before time.Time) {
+	dropped, err := c.database.DropUnsentAttachments(before)
+	if err != nil {
+		log.Printf("attachment: failed to sweep unsent attachments: %s", err)
+	}
+	c.removeAttachments(dropped)
+}
+
+// removeBlob deletes the blob, failing to is only logged as it's no longer referenced
+func (c *Channel) removeBlob(key string) {
+	if err := c.blobs.Delete(key); err != nil && err != blob.ErrNotFound {
+		log.Printf("attachment: failed to remove %s: %s", key, err)
+	}
+}
+
+// removeAttachments deletes the files of the attachments
+func (c *Channel) removeAttachments(attachments []*structs.Attachment) {
+	for _, attachment := range attachments {
+		c.removeBlob(attachmentKey(attachment))
+		if attachment.Thumbnail {
+			c.removeBlob(thumbnailKey(attachment))
+		}
+	}
+}
+
+// attachmentPart returns the "file" part of the multipart request
+func attachmentPart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, ErrMissingFile
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, ErrMissingFile
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// attachmentName is the base name of the uploaded file name cut down to maxAttachmentName bytes
+func attachmentName(name string) string {
+	name = strings.TrimSpace(path.Base(strings.Replace(name, "\\", "/", -1)))
+	if name == "" || name == "." || name == "/" {
+		return "attachment"
+	}
+	for len(name) > maxAttachmentName {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// mediaType is the content type without its parameters
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return t
+}
+
+// scale shrinks the image to fit within size pixels across and down keeping its aspect ratio.
+// Each pixel is the average of a grid of pixels sampled from the area of the image it covers.
+func scale(img image.Image, size int) image.Image {
+	var (
+		bounds = img.Bounds()
+		w, h   = bounds.Dx(), bounds.Dy()
+		tw, th = size, size
+	)
+	if w > h {
+		th = h * size / w
+	} else {
+		tw = w * size / h
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		for x := 0; x < tw; x++ {
+			var r, g, b, a uint32
+			for sy := 0; sy < thumbnailSamples; sy++ {
+				for sx := 0; sx < thumbnailSamples; sx++ {
+					px := bounds.Min.X + (x*thumbnailSamples+sx)*w/(tw*thumbnailSamples)
+					py := bounds.Min.Y + (y*thumbnailSamples+sy)*h/(th*thumbnailSamples)
+					cr, cg, cb, ca := img.At(px, py).RGBA()
+					r, g, b, a = r+cr, g+cg, b+cb, a+ca
+				}
+			}
+			n := uint32(thumbnailSamples * thumbnailSamples)
+			thumb.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return thumb
+}
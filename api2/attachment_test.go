@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+	. "github.com/onsi/gomega"
+	"github.com/sir-wiggles/chat/api/blob"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+// testBlobs is a blob store in a directory removed after the test
+func testBlobs(t *testing.T) blob.Store {
+	store, err := blob.NewFilesystem(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// testPNG encodes a w by h image
+func testPNG(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testUpload is a multipart body with the file as its "file" part
+func testUpload(t *testing.T, field, name string, file []byte) (*bytes.Buffer, string) {
+	var (
+		body   = &bytes.Buffer{}
+		writer = multipart.NewWriter(body)
+	)
+	part, err := writer.CreateFormFile(field, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(file)
+	writer.Close()
+	return body, writer.FormDataContentType()
+}
+
+var ttUploadAttachment = []struct {
+	name      string
+	user      string
+	field     string
+	file      string
+	limit     int64
+	code      int
+	kind      string
+	thumbnail bool
+}{
+	{
+		name:      "members upload images with a thumbnail",
+		user:      "member-1",
+		file:      "image",
+		code:      http.StatusCreated,
+		kind:      "image/png",
+		thumbnail: true,
+	},
+	{
+		name: "members upload text files",
+		user: "member-1",
+		file: "hello, world",
+		code: http.StatusCreated,
+		kind: "text/plain; charset=utf-8",
+	},
+	{
+		name: "guests can't upload",
+		user: "guest-1",
+		file: "hello, world",
+		code: http.StatusForbidden,
+	},
+	{
+		name: "outsiders can't upload",
+		user: "outsider-1",
+		file: "hello, world",
+		code: http.StatusForbidden,
+	},
+	{
+		name: "fails for html",
+		user: "member-1",
+		file: "<html><script>alert(1)</script></html>",
+		code: http.StatusUnsupportedMediaType,
+	},
+	{
+		name: "fails for empty files",
+		user: "member-1",
+		code: http.StatusBadRequest,
+	},
+	{
+		name:  "fails without a file part",
+		user:  "member-1",
+		field: "other",
+		file:  "hello, world",
+		code:  http.StatusBadRequest,
+	},
+	{
+		name:  "fails for files over the limit",
+		user:  "member-1",
+		file:  "hello, world",
+		limit: 5,
+		code:  http.StatusRequestEntityTooLarge,
+	},
+}
+
+func TestUploadAttachment(t *testing.T) {
+	for _, tt := range ttUploadAttachment {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g       = NewGomegaWithT(t)
+				store   = testBlobs(t)
+				created *structs.Attachment
+				db      = &MockCassandra{
+					ChannelRolesFn: func(cid string) (map[string]structs.Role, error) {
+						return map[string]structs.Role{
+							UUIDRecal("owner-1"):  structs.RoleOwner,
+							UUIDRecal("member-1"): structs.RoleMember,
+							UUIDRecal("guest-1"):  structs.RoleGuest,
+						}, nil
+					},
+					CreateAttachmentFn: func(a *structs.Attachment) error {
+						created = a
+						return nil
+					},
+				}
+				channel = &Channel{database: db, blobs: store}
+				handler = channel.Register(mux.NewRouter())
+			)
+
+			if tt.limit > 0 {
+				defer func(limit int64) { maxAttachmentSize = limit }(maxAttachmentSize)
+				maxAttachmentSize = tt.limit
+			}
+
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			file := []byte(tt.file)
+			if tt.file == "image" {
+				file = testPNG(t, 640, 320)
+			}
+			field := tt.field
+			if field == "" {
+				field = "file"
+			}
+			body, contentType := testUpload(t, field, "../dir/upload.bin", file)
+
+			url := fmt.Sprintf("%s/channel/%s/attachments", server.URL, UUIDRecal("channel-1"))
+			req, err := http.NewRequest(http.MethodPost, url, body)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal(tt.user)))
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+
+			if tt.code != http.StatusCreated {
+				g.Expect(db.CreateAttachmentInvoked).Should(BeFalse())
+				return
+			}
+
+			attachment := &structs.Attachment{}
+			g.Expect(json.NewDecoder(rsp.Body).Decode(attachment)).Should(Succeed())
+			g.Expect(attachment).Should(Equal(created))
+			g.Expect(attachment.Channel).Should(Equal(UUIDRecal("channel-1")))
+			g.Expect(attachment.Uploader).Should(Equal(UUIDRecal(tt.user)))
+			g.Expect(attachment.Name).Should(Equal("upload.bin"))
+			g.Expect(attachment.Type).Should(Equal(tt.kind))
+			g.Expect(attachment.Size).Should(BeEquivalentTo(len(file)))
+			g.Expect(attachment.Thumbnail).Should(Equal(tt.thumbnail))
+
+			stored, err := store.Get(attachmentKey(attachment))
+			g.Expect(err).ShouldNot(HaveOccurred())
+			defer stored.Close()
+			g.Expect(ioutil.ReadAll(stored)).Should(Equal(file))
+
+			if !tt.thumbnail {
+				return
+			}
+			g.Expect(attachment.Width).Should(Equal(640))
+			g.Expect(attachment.Height).Should(Equal(320))
+
+			thumb, err := store.Get(thumbnailKey(attachment))
+			g.Expect(err).ShouldNot(HaveOccurred())
+			defer thumb.Close()
+			config, err := png.DecodeConfig(thumb)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(config.Width).Should(Equal(thumbnailSize))
+			g.Expect(config.Height).Should(Equal(thumbnailSize / 2))
+		})
+	}
+}
+
+var ttDownloadAttachment = []struct {
+	name      string
+	user      string
+	path      string
+	sent      bool
+	thumbnail bool
+	code      int
+	kind      string
+}{
+	{
+		name: "members download sent attachments",
+		user: "member-1",
+		sent: true,
+		code: http.StatusOK,
+		kind: "image/png",
+	},
+	{
+		name: "guests download sent attachments",
+		user: "guest-1",
+		sent: true,
+		code: http.StatusOK,
+		kind: "image/png",
+	},
+	{
+		name: "uploaders download attachments they haven't sent",
+		user: "owner-1",
+		code: http.StatusOK,
+		kind: "image/png",
+	},
+	{
+		name: "others can't download attachments that haven't been sent",
+		user: "member-1",
+		code: http.StatusNotFound,
+	},
+	{
+		name: "outsiders can't download",
+		user: "outsider-1",
+		sent: true,
+		code: http.StatusForbidden,
+	},
+	{
+		name: "fails for attachments that don't exist",
+		user: "member-1",
+		path: gocql.TimeUUID().String(),
+		code: http.StatusNotFound,
+	},
+	{
+		name:      "members download thumbnails",
+		user:      "member-1",
+		path:      "/thumbnail",
+		sent:      true,
+		thumbnail: true,
+		code:      http.StatusOK,
+		kind:      "image/png",
+	},
+	{
+		name: "fails for thumbnails of attachments without one",
+		user: "member-1",
+		path: "/thumbnail",
+		sent: true,
+		code: http.StatusNotFound,
+	},
+}
+
+func TestDownloadAttachment(t *testing.T) {
+	for _, tt := range ttDownloadAttachment {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g          = NewGomegaWithT(t)
+				store      = testBlobs(t)
+				file       = testPNG(t, 16, 16)
+				attachment = &structs.Attachment{
+					ID:        gocql.TimeUUID().String(),
+					Channel:   UUIDRecal("channel-1"),
+					Uploader:  UUIDRecal("owner-1"),
+					Name:      "photo.png",
+					Type:      "image/png",
+					Size:      int64(len(file)),
+					Thumbnail: tt.thumbnail,
+				}
+				db = &MockCassandra{
+					ChannelRolesFn: func(cid string) (map[string]structs.Role, error) {
+						return map[string]structs.Role{
+							UUIDRecal("owner-1"):  structs.RoleOwner,
+							UUIDRecal("member-1"): structs.RoleMember,
+							UUIDRecal("guest-1"):  structs.RoleGuest,
+						}, nil
+					},
+					GetAttachmentFn: func(a *structs.Attachment) error {
+						if a.Channel != attachment.Channel || a.ID != attachment.ID {
+							return ErrAttachmentNotFound
+						}
+						*a = *attachment
+						return nil
+					},
+				}
+				channel = &Channel{database: db, blobs: store}
+				handler = channel.Register(mux.NewRouter())
+			)
+
+			if tt.sent {
+				attachment.Message = gocql.TimeUUID().String()
+			}
+			_, err := store.Put(attachmentKey(attachment), bytes.NewReader(file))
+			g.Expect(err).ShouldNot(HaveOccurred())
+			if tt.thumbnail {
+				_, err := store.Put(thumbnailKey(attachment), bytes.NewReader(file))
+				g.Expect(err).ShouldNot(HaveOccurred())
+			}
+
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			path := attachment.ID + tt.path
+			if tt.path != "" && tt.path[0] != '/' {
+				path = tt.path
+			}
+			url := fmt.Sprintf("%s/channel/%s/attachments/%s", server.URL, UUIDRecal("channel-1"), path)
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal(tt.user)))
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			defer rsp.Body.Close()
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+
+			if tt.code != http.StatusOK {
+				return
+			}
+			g.Expect(rsp.Header.Get("Content-Type")).Should(Equal(tt.kind))
+			g.Expect(rsp.Header.Get("X-Content-Type-Options")).Should(Equal("nosniff"))
+			g.Expect(rsp.Header.Get("Content-Disposition")).Should(Equal(`inline; filename=photo.png`))
+			g.Expect(ioutil.ReadAll(rsp.Body)).Should(Equal(file))
+		})
+	}
+}
+
+func TestSweepAttachments(t *testing.T) {
+	var (
+		g      = NewGomegaWithT(t)
+		store  = testBlobs(t)
+		before = time.Now().Add(-attachmentTTL)
+		unsent = &structs.Attachment{ID: gocql.TimeUUID().String(), Channel: UUIDRecal("channel-1"), Thumbnail: true}
+		sent   = &structs.Attachment{ID: gocql.TimeUUID().String(), Channel: UUIDRecal("channel-1")}
+		db     = &MockCassandra{
+			DropUnsentAttachmentsFn: func(t time.Time) ([]*structs.Attachment, error) {
+				g.Expect(t).Should(Equal(before))
+				return []*structs.Attachment{unsent}, nil
+			},
+		}
+		channel = &Channel{database: db, blobs: store}
+	)
+
+	for _, key := range []string{attachmentKey(unsent), thumbnailKey(unsent), attachmentKey(sent)} {
+		_, err := store.Put(key, bytes.NewReader([]byte("hello, world")))
+		g.Expect(err).ShouldNot(HaveOccurred())
+	}
+
+	channel.sweepAttachments(before)
+	g.Expect(db.DropUnsentAttachmentsInvoked).Should(BeTrue())
+
+	// only the files of the dropped attachments are removed
+	for _, key := range []string{attachmentKey(unsent), thumbnailKey(unsent)} {
+		_, err := store.Get(key)
+		g.Expect(err).Should(Equal(blob.ErrNotFound))
+	}
+	file, err := store.Get(attachmentKey(sent))
+	g.Expect(err).ShouldNot(HaveOccurred())
+	file.Close()
+}
+
+func TestTransferTimeout(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	// the largest attachment still arrives from a client at a few hundred kilobits a second
+	g.Expect(transferTimeout()).Should(Equal(15*time.Second + 320*time.Second))
+
+	defer func(limit int64) { maxAttachmentSize = limit }(maxAttachmentSize)
+	maxAttachmentSize = 1 << 20
+	g.Expect(transferTimeout()).Should(Equal(15*time.Second + 32*time.Second))
+}
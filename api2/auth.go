@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/sir-wiggles/chat/api/auth"
+)
+
+var (
+	// ErrUnauthenticated should be returned when a request has no valid token
+	ErrUnauthenticated = errors.New("a valid token is required")
+
+	// ErrForbidden should be returned when a request acts on behalf of a user other than the one
+	// it was authenticated as
+	ErrForbidden = errors.New("not allowed to act on behalf of another user")
+
+	// ErrTokenRevoked should be returned when a request's token was revoked by logging out
+	ErrTokenRevoked = errors.New("token has been revoked")
+)
+
+// Revocations is the deny-list of tokens revoked by the api service
+type Revocations interface {
+	IsTokenRevoked(jti string) (bool, error)
+}
+
+// Authentication verifies the tokens issued by the api service
+type Authentication struct {
+	config      *auth.Config
+	revocations Revocations
+}
+
+// Middleware rejects requests without a valid token and puts the user the token was issued to in
+// the request context.  It must come after JSONMiddleWare.
+func (a *Authentication) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rw = w.(*ResponseWriter)
+
+		token, err := auth.FromRequest(r)
+		if err != nil {
+			rw.JSON(ErrUnauthenticated, http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := a.config.Parse(token)
+		if err != nil {
+			rw.JSON(err, http.StatusUnauthorized)
+			return
+		}
+
+		revoked, err := a.revocations.IsTokenRevoked(claims.Id)
+		if err != nil {
+			rw.JSON(err, http.StatusInternalServerError)
+			return
+		} else if revoked {
+			rw.JSON(ErrTokenRevoked, http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), claims)))
+	})
+}
+
+// actingUser returns the id of the authenticated user.  Payloads may still name the user they act
+// on behalf of, ok is false when the claimed user isn't the authenticated one.
+func actingUser(r *http.Request, claimed string) (uid string, ok bool) {
+	uid = auth.UserID(r.Context())
+	return uid, uid != "" && (claimed == "" || claimed == uid)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/onsi/gomega"
+	"github.com/sir-wiggles/chat/api/auth"
+	"github.com/sir-wiggles/chat/api/postgres"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+// revokedTokens are the jtis of the tokens testAuth takes to have been revoked
+var revokedTokens = make(map[string]bool)
+
+var testAuth = &Authentication{
+	config: &auth.Config{Key: []byte("secret"), Issuer: "chat.test", Audience: "chat", ExpiresIn: time.Hour},
+	revocations: &postgres.MockPostgres{
+		IsTokenRevokedFn: func(jti string) (bool, error) { return revokedTokens[jti], nil },
+	},
+}
+
+// testToken issues a token for the user with the id
+func testToken(t *testing.T, uid string) string {
+	token, err := testAuth.config.Issue(structs.NewUser(uid, "test", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testRevokedToken issues a token for the user with the id and revokes it
+func testRevokedToken(t *testing.T, uid string) string {
+	token := testToken(t, uid)
+	claims, err := testAuth.config.Parse(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedTokens[claims.Id] = true
+	return token
+}
+
+var ttUserRoutes = []struct {
+	name  string
+	path  string
+	body  string
+	token string
+	code  int
+}{
+	{
+		name:  "lists the authenticated user's channels",
+		path:  UUIDRecal("owner-1") + "/channels",
+		token: "owner-1",
+		code:  http.StatusOK,
+	},
+	{
+		name: "fails without a token",
+		path: UUIDRecal("owner-1") + "/channels",
+		code: http.StatusUnauthorized,
+	},
+	{
+		name:  "fails for another user's channels",
+		path:  UUIDRecal("owner-2") + "/channels",
+		token: "owner-1",
+		code:  http.StatusForbidden,
+	},
+	{
+		name:  "fails when the body names another owner",
+		path:  UUIDRecal("owner-1") + "/channels",
+		body:  fmt.Sprintf(`{"owner": "%s"}`, UUIDRecal("owner-2")),
+		token: "owner-1",
+		code:  http.StatusForbidden,
+	},
+	{
+		name:  "deletes the authenticated user's channel",
+		path:  UUIDRecal("owner-1") + "/" + UUIDRecal("channel-1"),
+		body:  fmt.Sprintf(`{"channels": ["%s"]}`, UUIDRecal("channel-1")),
+		token: "owner-1",
+		code:  http.StatusOK,
+	},
+	{
+		name:  "fails to delete as another user",
+		path:  UUIDRecal("owner-2") + "/" + UUIDRecal("channel-1"),
+		body:  fmt.Sprintf(`{"owner": "%s", "channels": ["%s"]}`, UUIDRecal("owner-2"), UUIDRecal("channel-1")),
+		token: "owner-1",
+		code:  http.StatusForbidden,
+	},
+}
+
+func TestUserRoutes(t *testing.T) {
+	for _, tt := range ttUserRoutes {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g     = NewGomegaWithT(t)
+				owner string
+				db    = &MockCassandra{
+					ListChannelsFn:   func(i *ChannelInfo) error { owner = i.Owner; return nil },
+					DeleteChannelsFn: func(i *ChannelInfo) error { owner = i.Owner; return nil },
+				}
+				user    = &User{database: db}
+				handler = user.Register(mux.NewRouter())
+			)
+
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/user/"+tt.path, strings.NewReader(tt.body))
+			g.Expect(err).ShouldNot(HaveOccurred())
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal(tt.token)))
+			}
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+
+			if tt.code == http.StatusOK {
+				g.Expect(owner).Should(Equal(UUIDRecal(tt.token)))
+			} else {
+				g.Expect(owner).Should(BeEmpty())
+			}
+		})
+	}
+}
+
+func TestRevokedToken(t *testing.T) {
+	var (
+		g       = NewGomegaWithT(t)
+		db      = &MockCassandra{ListChannelsFn: func(i *ChannelInfo) error { return nil }}
+		handler = (&User{database: db}).Register(mux.NewRouter())
+	)
+	handler.Use(JSONMiddleWare, testAuth.Middleware)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for token, code := range map[string]int{
+		testToken(t, UUIDRecal("owner-1")):        http.StatusOK,
+		testRevokedToken(t, UUIDRecal("owner-1")): http.StatusUnauthorized,
+	} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/user/"+UUIDRecal("owner-1")+"/channels", nil)
+		g.Expect(err).ShouldNot(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rsp, err := http.DefaultClient.Do(req)
+		g.Expect(err).ShouldNot(HaveOccurred())
+		g.Expect(rsp.StatusCode).Should(Equal(code))
+		g.Expect(db.ListChannelsInvoked).Should(Equal(code == http.StatusOK))
+		db.ListChannelsInvoked = false
+	}
+}
+
+func TestDeleteChannelUnsubscribes(t *testing.T) {
+	var (
+		g  = NewGomegaWithT(t)
+		db = &MockCassandra{
+			// only the first channel is the owner's
+			DeleteChannelsFn: func(i *ChannelInfo) error { i.Channels = i.Channels[:1]; return nil },
+		}
+		hub     = &Hub{subscription: make(chan *subscription, 2)}
+		handler = (&User{database: db, hub: hub}).Register(mux.NewRouter())
+	)
+	handler.Use(JSONMiddleWare, testAuth.Middleware)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	body := fmt.Sprintf(`{"channels": ["%s", "%s"]}`, UUIDRecal("channel-1"), UUIDRecal("channel-2"))
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/user/"+UUIDRecal("owner-1")+"/"+UUIDRecal("channel-1"), strings.NewReader(body))
+	g.Expect(err).ShouldNot(HaveOccurred())
+	req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal("owner-1")))
+
+	rsp, err := http.DefaultClient.Do(req)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(rsp.StatusCode).Should(Equal(http.StatusOK))
+
+	g.Expect(hub.subscription).Should(HaveLen(1))
+	g.Expect((<-hub.subscription).channel).Should(Equal(UUIDRecal("channel-1")))
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gocql/gocql"
 	"github.com/google/uuid"
+	"github.com/sir-wiggles/chat/api/cassandra"
+	"github.com/sir-wiggles/chat/api/markdown"
+	"github.com/sir-wiggles/chat/api/search"
+	"github.com/sir-wiggles/chat/api/structs"
 )
 
 var (
@@ -26,42 +35,191 @@ var (
 
 	// ErrInvalidChannelLen should be returned when channels has invalid len
 	ErrInvalidChannelLen = errors.New(`Invalid "Channels" length, must be more than one`)
+
+	// ErrInvalidMember should be returned when a member is missing or invalid
+	ErrInvalidMember = errors.New(`Invalid "ID" field in UserInfo`)
+
+	// ErrInvalidLimit should be returned when a page limit is missing or out of range
+	ErrInvalidLimit = errors.New(`Invalid "Limit" field in MessagePage`)
+
+	// ErrInvalidCursor should be returned when a page cursor can't be decoded
+	ErrInvalidCursor = errors.New(`Invalid "Cursor" field in MessagePage`)
+
+	// ErrInvalidRoles should be returned when roles are missing or can't be given
+	ErrInvalidRoles = errors.New(`Invalid "Roles" field in ChannelInfo`)
+
+	// ErrChannelNotFound should be returned when a channel doesn't exist
+	ErrChannelNotFound = errors.New("channel not found")
+
+	// ErrNotPermitted should be returned when the user's role doesn't permit what they tried
+	ErrNotPermitted = cassandra.ErrNotPermitted
+
+	// ErrInvalidExpires should be returned when an invite would already have expired
+	ErrInvalidExpires = errors.New(`Invalid "Expires" field in InviteInfo`)
+
+	// ErrInvalidMaxUses should be returned when an invite couldn't be used at least once
+	ErrInvalidMaxUses = errors.New(`Invalid "MaxUses" field in InviteInfo`)
+
+	// ErrInvalidInvite should be returned when an invite doesn't exist, is for another channel,
+	// has expired or has been used up
+	ErrInvalidInvite = errors.New("invite is invalid, expired or used up")
+
+	// ErrInviteRequired should be returned when joining a private channel without an invite
+	ErrInviteRequired = errors.New("an invite is required to join a private channel")
+
+	// ErrInvalidBody should be returned when a message has no text
+	ErrInvalidBody = errors.New(`Invalid "Body" field in MessageInfo`)
+
+	// ErrMessageNotFound should be returned when a message isn't in the channel
+	ErrMessageNotFound = cassandra.ErrMessageNotFound
+
+	// ErrParentNotFound should be returned when replying to a message that isn't in the channel
+	ErrParentNotFound = cassandra.ErrParentNotFound
+
+	// ErrAttachmentNotFound should be returned when an attachment isn't in the channel
+	ErrAttachmentNotFound = cassandra.ErrAttachmentNotFound
+
+	// ErrInvalidAttachment should be returned when sending an attachment that isn't in the
+	// channel, was uploaded by someone else or was already sent
+	ErrInvalidAttachment = cassandra.ErrInvalidAttachment
+
+	// ErrInvalidQuery should be returned when searching without any words to search for
+	ErrInvalidQuery = errors.New(`Invalid "Query" field in SearchPage`)
+
+	// ErrInvalidRange should be returned when a search's "Before" isn't after its "After"
+	ErrInvalidRange = errors.New(`Invalid "After" and "Before" fields in SearchPage`)
+)
+
+const (
+	// directoryBucket is the partition of the channel directory.  Every public channel is kept in
+	// the one partition so it can be searched by name in order.
+	directoryBucket = 0
+
+	// sweepPageSize is how many unsent attachments are looked at a time when sweeping them
+	sweepPageSize = 100
+
+	// inviteTokenSize is the number of random bytes in an invite token
+	inviteTokenSize = 24
+
+	// inviteRedeemAttempts is how many times redeeming an invite is retried when it's being used
+	// by someone else at the same time
+	inviteRedeemAttempts = 5
+
+	// minGroupMembers is the fewest users in a group conversation, any fewer is a direct message
+	minGroupMembers = 3
+
+	// maxGroupMembers is the most users in a group conversation
+	maxGroupMembers = 8
 )
 
-// DatabaseController is composed of the user and channel controller interfaces
+// conversationNamespace is the namespace the ids of conversations are derived in
+var conversationNamespace = uuid.MustParse("6f1c2a8e-3b5d-4e0f-9a7c-1d2e3f405162")
+
+// ChannelKind is what sort of channel a channel is
+type ChannelKind string
+
+const (
+	// KindChannel is a named channel with an owner.  Channels created before there were other
+	// kinds don't have a kind so it's empty.
+	KindChannel ChannelKind = ""
+
+	// KindDirect is a conversation between two users
+	KindDirect ChannelKind = "dm"
+
+	// KindGroup is a conversation between three to eight users
+	KindGroup ChannelKind = "group"
+)
+
+// IsConversation reports whether the kind is a direct or group conversation.  Conversations have
+// no name or owner, all their users are members and the users in them never change.
+func (k ChannelKind) IsConversation() bool {
+	return k == KindDirect || k == KindGroup
+}
+
+// DatabaseController is composed of the user, channel and message controller interfaces
 type DatabaseController interface {
+	AttachmentController
 	ChannelController
+	InviteController
+	MessageController
 	UserController
 }
 
 // UserController is the user related method actions
 type UserController interface {
 	AddUsersToChannel(*ChannelInfo) error
-	CreateUser(*UserInfo) error
+	CreateUser(*structs.User) error
 	DeleteUsersFromChannel(*ChannelInfo) error
+	ListConversations(*UserInfo) error
+	ListUserChannels(*UserInfo) error
 	ListUsersInChannel(*ChannelInfo) error
 }
 
 // ChannelController is the channel related method actions
 type ChannelController interface {
+	Authorize(string, string, structs.Action) (structs.Role, error)
+	ChannelRoles(string) (map[string]structs.Role, error)
 	CreateChannel(*ChannelInfo) error
+	CreateConversation(*ChannelInfo) (bool, error)
 	DeleteChannels(*ChannelInfo) error
+	GetChannel(*ChannelInfo) error
 	ListChannels(*ChannelInfo) error
+	ListPublicChannels(*ChannelDirectory) error
+	ListReads(*ChannelInfo) error
+	SetRoles(*ChannelInfo) error
+	TransferChannel(*ChannelInfo, string) error
 }
 
-// Cassandra is the connection to cassandra
+// AttachmentController is the attachment related method actions
+type AttachmentController interface {
+	Attachable(*MessageInfo, []string) error
+	CreateAttachment(*structs.Attachment) error
+	DropUnsentAttachments(time.Time) ([]*structs.Attachment, error)
+	GetAttachment(*structs.Attachment) error
+}
+
+// InviteController is the invite related method actions
+type InviteController interface {
+	CreateInvite(*InviteInfo) error
+	RedeemInvite(*InviteInfo) error
+}
+
+// MessageController is the message related method actions
+type MessageController interface {
+	AddReaction(*MessageInfo, string, string) error
+	CreateMessage(*MessageInfo) error
+	CreateReply(*MessageInfo) (*structs.Thread, error)
+	DeleteMessage(*MessageInfo) error
+	EditMessage(*MessageInfo, string) error
+	GetMessage(*MessageInfo) error
+	ListEdits(*MessageInfo) error
+	ListMessages(*MessagePage) error
+	ListThread(*ThreadPage) error
+	MarkRead(*MessageInfo, string) (bool, error)
+	RemoveReaction(*MessageInfo, string, string) error
+	SearchMessages(*SearchPage) error
+}
+
+// Cassandra is the connection to cassandra.  Messages are kept in step with the search index as
+// they're created, edited and deleted.
 type Cassandra struct {
 	*gocql.Session
+	index search.Index
+
+	// shared runs the queries the api service shares with this one on the same session
+	shared *cassandra.Cassandra
 }
 
 // NewCassandra returns a new connection to cassandra using keyspace chatter
-func NewCassandra(urls []string) (*Cassandra, error) {
+func NewCassandra(urls []string, index search.Index) (*Cassandra, error) {
 	cluster := gocql.NewCluster(urls...)
 	cluster.Keyspace = keyspace
 	session, err := cluster.CreateSession()
 
 	return &Cassandra{
-		session,
+		Session: session,
+		index:   index,
+		shared:  &cassandra.Cassandra{Session: session},
 	}, err
 }
 
@@ -71,32 +229,280 @@ type ChannelInfo struct {
 	// ID is generated when creating a channel. It will have the UUID form
 	ID string `json:"id,omitempty"`
 
-	// Owner is the user that owns the channel and has the UUID form
+	// Owner is the user that owns the channel and has the UUID form.  Conversations don't have one.
 	Owner string `json:"owner,omitempty"`
 
+	// Kind is whether this is a named channel or a direct or group conversation
+	Kind ChannelKind `json:"kind,omitempty"`
+
 	// Created is when the channel was created and is generated when calling CreateChannel
 	Created time.Time `json:"created,omitempty"`
 
 	// Members are the users in the channel.  When createing a channel the Owner will be added
 	// to the list automatically
-	Members []*UserInfo `json:"members,omitempty"`
+	Members []*structs.User `json:"members,omitempty"`
+
+	// Roles are the roles of the members keyed by user id.  Members without a role are members.
+	Roles map[string]structs.Role `json:"roles,omitempty"`
 
 	// Name is the human readable name of the channel
 	Name string `json:"name,omitempty"`
 
-	// TODO: do we want this?
+	// Private channels are left out of the directory and can only be joined with an invite
 	Private bool `json:"private,omitempty"`
 
+	// Unread is how much of the channel the user it was listed for hasn't read
+	Unread *structs.Unread `json:"unread,omitempty"`
+
+	// Reads are the id of the last message each member has read keyed by user id
+	Reads map[string]string `json:"reads,omitempty"`
+
 	// Channels is the lists of channels of a given user
 	Channels []*ChannelInfo `json:"channels,omitempty"`
 }
 
-// UserInfo hold information for a particular user
+// UserInfo holds a user along with the channels they're a member of
 type UserInfo struct {
-	ID      string `json:"id"`
-	Name    string `json:"name"`
-	Picture string `json:"picture"`
-	GID     string `json:"-"`
+	structs.User
+
+	// Channels are the channels the user is a member of
+	Channels []*ChannelInfo `json:"channels,omitempty"`
+}
+
+// ChannelDirectory is a search of the public channels by name
+type ChannelDirectory struct {
+
+	// Name is matched against the start of the channel names ignoring case.  Leave it empty to
+	// list every public channel
+	Name string `json:"name"`
+
+	// Limit is the maximum number of channels to return
+	Limit int `json:"-"`
+
+	// Channels are the public channels matching "Name" in name order
+	Channels []*ChannelInfo `json:"channels"`
+}
+
+// InviteInfo is the model of channel invites in cassandra.  Only a hash of the token is stored so
+// the token is handed back when the invite is created and never again.
+type InviteInfo struct {
+
+	// Token is generated when creating an invite and is what's redeemed to join the channel
+	Token string `json:"token,omitempty"`
+
+	// Channel is the channel the invite joins
+	Channel string `json:"channel"`
+
+	// CreatedBy is the user that created the invite
+	CreatedBy string `json:"createdBy"`
+
+	// Expires is when the invite can no longer be redeemed
+	Expires time.Time `json:"expires"`
+
+	// MaxUses is the number of times the invite can be redeemed
+	MaxUses int `json:"maxUses"`
+
+	// Uses is the number of times the invite has been redeemed
+	Uses int `json:"uses"`
+}
+
+// conversationID is the id of the conversation between the users.  It's derived from the sorted
+// ids of the users so the same users always have the same conversation.
+func conversationID(users []string) string {
+	sorted := append([]string(nil), users...)
+	sort.Strings(sorted)
+	return uuid.NewSHA1(conversationNamespace, []byte(strings.Join(sorted, ","))).String()
+}
+
+// hashInvite is the key an invite token is stored under
+func hashInvite(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// MessageInfo is the model of messages in cassandra
+type MessageInfo struct {
+
+	// ID is the TimeUUID generated when the message was logged
+	ID string `json:"id"`
+
+	// Channel is the channel the message was posted to
+	Channel string `json:"channel"`
+
+	// Owner is the user that posted the message
+	Owner string `json:"owner"`
+
+	// Body is the text of the message, it's markdown
+	Body string `json:"body"`
+
+	// HTML is the body rendered by the markdown package, it's safe to display as is
+	HTML string `json:"html,omitempty"`
+
+	// Parent is the message this is a reply to, it's empty for messages that aren't
+	Parent string `json:"parent,omitempty"`
+
+	// Thread is the summary of the replies to the message, it's nil when there are none
+	Thread *structs.Thread `json:"thread,omitempty"`
+
+	// EditedAt is when the message was last edited, it's nil if it never was
+	EditedAt *time.Time `json:"editedAt,omitempty"`
+
+	// Deleted is set on the tombstone left by deleting a message, it has no body
+	Deleted bool `json:"deleted,omitempty"`
+
+	// Reactions are the emoji the message was reacted to with, it's empty when there are none
+	Reactions []*structs.Reaction `json:"reactions,omitempty"`
+
+	// Attachments are the files sent with the message, it's empty when there are none
+	Attachments []*structs.Attachment `json:"attachments,omitempty"`
+
+	// Previews are the previews of the links in the message, it's empty until the api service
+	// has unfurled them
+	Previews []*structs.Preview `json:"previews,omitempty"`
+
+	// Edits are the previous versions of the message, most recent first.  They're only filled in
+	// by ListEdits.
+	Edits []*structs.Edit `json:"edits,omitempty"`
+
+	// Created is derived from the timestamp embedded in the ID
+	Created time.Time `json:"created"`
+}
+
+// newMessageInfo converts a message of the api service
+func newMessageInfo(m *structs.Message) *MessageInfo {
+	return &MessageInfo{
+		ID:          m.ID,
+		Channel:     m.Channel,
+		Owner:       m.Author.ID,
+		Body:        strings.Join(m.Text, "\n"),
+		HTML:        m.HTML,
+		Parent:      m.Parent,
+		Thread:      m.Thread,
+		EditedAt:    m.EditedAt,
+		Deleted:     m.Deleted,
+		Reactions:   m.Reactions,
+		Attachments: m.Attachments,
+		Previews:    m.Previews,
+		Created:     m.Time,
+	}
+}
+
+// message converts the message to one of the api service
+func (i *MessageInfo) message() *structs.Message {
+	m := structs.NewMessage(i.Channel, &structs.User{ID: i.Owner}, i.Body, i.Created)
+	m.ID = i.ID
+	m.HTML = i.HTML
+	m.Parent = i.Parent
+	m.Thread = i.Thread
+	m.EditedAt = i.EditedAt
+	m.Reactions = i.Reactions
+	m.Attachments = i.Attachments
+	m.Previews = i.Previews
+	if m.Deleted = i.Deleted; m.Deleted {
+		m.Text = []string{}
+		m.HTML = ""
+	}
+	return m
+}
+
+// fill copies the message of the api service into the message
+func (i *MessageInfo) fill(m *structs.Message) {
+	*i = *newMessageInfo(m)
+}
+
+// MessagePage is a window into the history of a channel, newest message first
+type MessagePage struct {
+
+	// Channel is the channel to page through and is required
+	Channel string `json:"channel"`
+
+	// Limit is the maximum number of messages to return
+	Limit int `json:"-"`
+
+	// Cursor is the "Next" value of the previous page.  Leave it empty to start from the most
+	// recent message
+	Cursor string `json:"-"`
+
+	// Messages are the messages in this page
+	Messages []*MessageInfo `json:"messages"`
+
+	// Next is the cursor of the following page.  It will be empty when there are no older messages
+	Next string `json:"next,omitempty"`
+}
+
+// ThreadPage is a window into the replies to a message, oldest reply first
+type ThreadPage struct {
+
+	// Channel is the channel of the message and is required
+	Channel string `json:"channel"`
+
+	// Root is the id of the message whose replies to page through and is required.  If it's a
+	// reply the thread it's in is paged through instead.
+	Root string `json:"-"`
+
+	// Limit is the maximum number of replies to return
+	Limit int `json:"-"`
+
+	// Cursor is the "Next" value of the previous page.  Leave it empty to start from the first
+	// reply
+	Cursor string `json:"-"`
+
+	// Parent is the message that was replied to along with the summary of its thread
+	Parent *MessageInfo `json:"parent"`
+
+	// Messages are the replies in this page
+	Messages []*MessageInfo `json:"messages"`
+
+	// Next is the cursor of the following page.  It will be empty when there are no newer replies
+	Next string `json:"next,omitempty"`
+}
+
+// SearchPage is the messages found searching the channels a user is a member of, best match first
+type SearchPage struct {
+
+	// User is the id of the user searching and is required
+	User string `json:"-"`
+
+	// Query is the words to search for and is required
+	Query string `json:"query"`
+
+	// Author only finds the messages of the user with this id when it's set
+	Author string `json:"author,omitempty"`
+
+	// Channel only searches this channel when it's set, the user must be a member of it
+	Channel string `json:"channel,omitempty"`
+
+	// After only finds messages sent at or after it when it's set
+	After *time.Time `json:"after,omitempty"`
+
+	// Before only finds messages sent before it when it's set
+	Before *time.Time `json:"before,omitempty"`
+
+	// Limit is the maximum number of messages to return
+	Limit int `json:"-"`
+
+	// Hits are the messages found with a snippet of each
+	Hits []*search.Hit `json:"hits"`
+}
+
+// EncodeCursor turns a message id into an opaque cursor that can be handed to clients
+func EncodeCursor(id gocql.UUID) string {
+	return base64.RawURLEncoding.EncodeToString(id.Bytes())
+}
+
+// DecodeCursor is the inverse of EncodeCursor.  ErrInvalidCursor is returned if the cursor was
+// not made from a TimeUUID.
+func DecodeCursor(cursor string) (gocql.UUID, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return gocql.UUID{}, ErrInvalidCursor
+	}
+
+	id, err := gocql.UUIDFromBytes(data)
+	if err != nil || id.Version() != 1 {
+		return gocql.UUID{}, ErrInvalidCursor
+	}
+	return id, nil
 }
 
 // CreateChannel takes ChannelInfo as input with the following fields required: "Owner" which is
@@ -114,7 +520,7 @@ func (c *Cassandra) CreateChannel(i *ChannelInfo) error {
 		return ErrInvalidName
 	}
 
-	i.Members = append(i.Members, &UserInfo{ID: i.Owner})
+	i.Members = append(i.Members, &structs.User{ID: i.Owner})
 	i.Created = time.Now().UTC()
 
 	cid, err := uuid.NewRandom()
@@ -127,13 +533,23 @@ func (c *Cassandra) CreateChannel(i *ChannelInfo) error {
 		members = append(members, member.ID)
 	}
 
-	err = c.Query(`INSERT INTO channels
+	batch := c.NewBatch(gocql.LoggedBatch)
+	batch.Query(`INSERT INTO channels
 		(id, owner, created, members, name, private)
 	VALUES
 		(?, ?, now(), ?, ?, ?)`,
-		cid.String(), i.Owner, members, i.Name, i.Private).Exec()
+		cid.String(), i.Owner, members, i.Name, i.Private)
+
+	// public channels are listed in the directory as well
+	if !i.Private {
+		batch.Query(`INSERT INTO channel_directory
+			(bucket, search, id, name, created)
+		VALUES
+			(?, ?, ?, ?, ?)`,
+			directoryBucket, strings.ToLower(i.Name), cid.String(), i.Name, i.Created)
+	}
 
-	if err != nil {
+	if err := c.ExecuteBatch(batch); err != nil {
 		return err
 	}
 
@@ -150,27 +566,65 @@ func (c *Cassandra) ListChannels(i *ChannelInfo) error {
 	}
 
 	iter := c.Query(
-		`SELECT id, created, name FROM channels WHERE owner = ?`,
+		`SELECT id, created, name, private FROM channels WHERE owner = ?`,
 		i.Owner,
 	).Iter().Scanner()
 
 	channels := make([]*ChannelInfo, 0, 2)
 	for iter.Next() {
 		ci := &ChannelInfo{}
-		err := iter.Scan(&ci.ID, &ci.Created, &ci.Name)
+		err := iter.Scan(&ci.ID, &ci.Created, &ci.Name, &ci.Private)
 		if err != nil {
 			return err
 		}
 		channels = append(channels, ci)
 	}
 
+	if err := c.unread(i.Owner, channels); err != nil {
+		return err
+	}
 	i.Channels = channels
 
 	return nil
 }
 
+// unread fills in how much of each of the channels the user hasn't read
+func (c *Cassandra) unread(user string, channels []*ChannelInfo) error {
+	ids := make([]string, 0, len(channels))
+	for _, ci := range channels {
+		ids = append(ids, ci.ID)
+	}
+
+	unread, err := c.shared.Unread(user, ids)
+	if err != nil {
+		return err
+	}
+	for _, ci := range channels {
+		ci.Unread = unread[ci.ID]
+	}
+
+	return nil
+}
+
+// ListReads fills in the "Reads" of the channel "ID"
+func (c *Cassandra) ListReads(i *ChannelInfo) error {
+
+	if i.ID == "" {
+		return ErrInvalidChannel
+	}
+
+	reads, err := c.shared.ReadCursors(i.ID)
+	if err != nil {
+		return err
+	}
+	i.Reads = reads
+
+	return nil
+}
+
 // DeleteChannels will delete the channels specified in the "Channels" field array. The "Owner"
-// field must be set and the "Owner" must own the channels they're trying to delete.
+// field must be set and the "Owner" must own the channels they're trying to delete, "Channels" is
+// left with only the channels that were deleted.
 func (c *Cassandra) DeleteChannels(i *ChannelInfo) error {
 
 	if i.Owner == "" {
@@ -186,16 +640,256 @@ func (c *Cassandra) DeleteChannels(i *ChannelInfo) error {
 		return ErrInvalidChannelLen
 	}
 
-	err := c.Query(
-		`DELETE FROM channels WHERE id IN ? AND owner = ?`,
+	// the directory is keyed by name so the names of the public channels are needed to take them
+	// out of it
+	scanner := c.Query(
+		`SELECT id, name, private FROM channels WHERE id IN ? AND owner = ?`,
 		ids, i.Owner,
+	).Iter().Scanner()
+
+	var (
+		batch   = c.NewBatch(gocql.LoggedBatch)
+		deleted = make([]*ChannelInfo, 0, len(ids))
+		owned   = make([]string, 0, len(ids))
+	)
+	for scanner.Next() {
+		var (
+			id, name string
+			private  bool
+		)
+		if err := scanner.Scan(&id, &name, &private); err != nil {
+			return err
+		}
+		deleted = append(deleted, &ChannelInfo{ID: id})
+		owned = append(owned, id)
+		if !private {
+			batch.Query(
+				`DELETE FROM channel_directory WHERE bucket = ? AND search = ? AND id = ?`,
+				directoryBucket, strings.ToLower(name), id,
+			)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	i.Channels = deleted
+	if len(owned) == 0 {
+		return nil
+	}
+	batch.Query(`DELETE FROM channels WHERE id IN ? AND owner = ?`, owned, i.Owner)
+
+	return c.ExecuteBatch(batch)
+}
+
+// GetChannel fills in the owner, kind, name, privacy and creation time of the channel "ID".
+// ErrChannelNotFound is returned if there is no such channel.
+func (c *Cassandra) GetChannel(i *ChannelInfo) error {
+
+	if i.ID == "" {
+		return ErrInvalidChannel
+	}
+
+	// created is set with now() so it's a timeuuid
+	var (
+		created gocql.UUID
+		kind    string
+	)
+	err := c.Query(`
+		SELECT owner, kind, name, private, created FROM channels WHERE id = ?`,
+		i.ID,
+	).Scan(&i.Owner, &kind, &i.Name, &i.Private, &created)
+
+	if err == gocql.ErrNotFound {
+		return ErrChannelNotFound
+	} else if err != nil {
+		return err
+	}
+	i.Kind = ChannelKind(kind)
+	i.Created = created.Time()
+
+	return nil
+}
+
+// CreateConversation returns the conversation between the "Members", starting it if they haven't
+// talked before.  Two members make a direct message and three to eight a group.  The id is derived
+// from the members so a conversation is only ever inserted once, created reports whether this call
+// inserted it.
+//
+// Conversations are private channels without a name or an owner so everything that works on
+// channels works on them, but nobody can manage them.
+func (c *Cassandra) CreateConversation(i *ChannelInfo) (created bool, err error) {
+
+	var (
+		members = make([]string, 0, len(i.Members))
+		seen    = make(map[string]bool, len(i.Members))
+	)
+	for _, member := range i.Members {
+		if member.ID == "" {
+			return false, ErrInvalidMember
+		} else if !seen[member.ID] {
+			seen[member.ID] = true
+			members = append(members, member.ID)
+		}
+	}
+	sort.Strings(members)
+
+	switch n := len(members); {
+	case n == 2:
+		i.Kind = KindDirect
+	case n >= minGroupMembers && n <= maxGroupMembers:
+		i.Kind = KindGroup
+	default:
+		return false, ErrInvalidMembersLen
+	}
+	i.ID = conversationID(members)
+
+	created, err = c.Query(`
+		INSERT INTO channels (id, owner, created, members, kind, private)
+		VALUES (?, '', now(), ?, ?, true) IF NOT EXISTS`,
+		i.ID, members, string(i.Kind),
+	).MapScanCAS(map[string]interface{}{})
+
+	if err != nil {
+		return false, err
+	}
+
+	i.Members = convertUsers(members)
+	return created, c.GetChannel(i)
+}
+
+// ListPublicChannels fills the directory with at most "Limit" public channels whose names start
+// with "Name" ignoring case
+func (c *Cassandra) ListPublicChannels(d *ChannelDirectory) error {
+
+	if d.Limit < 1 {
+		return ErrInvalidLimit
+	}
+
+	var query *gocql.Query
+	if prefix := strings.ToLower(d.Name); prefix == "" {
+		query = c.Query(`
+			SELECT id, name, created FROM channel_directory WHERE bucket = ? LIMIT ?`,
+			directoryBucket, d.Limit,
+		)
+	} else {
+		// every name starting with the prefix sorts between it and the prefix followed by the
+		// largest rune
+		query = c.Query(`
+			SELECT id, name, created FROM channel_directory
+			WHERE bucket = ? AND search >= ? AND search < ? LIMIT ?`,
+			directoryBucket, prefix, prefix+string(utf8.MaxRune), d.Limit,
+		)
+	}
+
+	var (
+		scanner  = query.Iter().Scanner()
+		channels = make([]*ChannelInfo, 0, d.Limit)
+	)
+	for scanner.Next() {
+		ci := &ChannelInfo{}
+		if err := scanner.Scan(&ci.ID, &ci.Name, &ci.Created); err != nil {
+			return err
+		}
+		channels = append(channels, ci)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	d.Channels = channels
+
+	return nil
+}
+
+// CreateInvite makes an invite to the channel "Channel" generating its "Token".  "CreatedBy" is
+// required, the invite can be redeemed "MaxUses" times until "Expires" after which cassandra
+// drops it.
+func (c *Cassandra) CreateInvite(i *InviteInfo) error {
+
+	ttl := int(time.Until(i.Expires).Seconds())
+
+	if i.Channel == "" {
+		return ErrInvalidChannel
+	} else if i.CreatedBy == "" {
+		return ErrInvalidOwner
+	} else if ttl < 1 {
+		return ErrInvalidExpires
+	} else if i.MaxUses < 1 {
+		return ErrInvalidMaxUses
+	}
+
+	token := make([]byte, inviteTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	i.Token = base64.RawURLEncoding.EncodeToString(token)
+	i.Expires = i.Expires.UTC()
+	i.Uses = 0
+
+	return c.Query(`
+		INSERT INTO channel_invites (hash, channel, created_by, expires, max_uses, uses)
+		VALUES (?, ?, ?, ?, ?, 0) USING TTL ?`,
+		hashInvite(i.Token), i.Channel, i.CreatedBy, i.Expires, i.MaxUses, ttl,
 	).Exec()
+}
 
-	return err
+// RedeemInvite uses up one of the uses of the invite "Token" to join "Channel" filling in the rest
+// of the invite.  ErrInvalidInvite is returned if the invite can't be redeemed for the channel.
+//
+// The uses are compared and set so an invite is never redeemed more than "MaxUses" times, if
+// someone else redeems it at the same time it's tried again.
+func (c *Cassandra) RedeemInvite(i *InviteInfo) error {
+
+	if i.Token == "" {
+		return ErrInvalidInvite
+	} else if i.Channel == "" {
+		return ErrInvalidChannel
+	}
+
+	var (
+		hash    = hashInvite(i.Token)
+		channel string
+	)
+	err := c.Query(`
+		SELECT channel, created_by, expires, max_uses, uses FROM channel_invites WHERE hash = ?`,
+		hash,
+	).Scan(&channel, &i.CreatedBy, &i.Expires, &i.MaxUses, &i.Uses)
+
+	if err == gocql.ErrNotFound {
+		return ErrInvalidInvite
+	} else if err != nil {
+		return err
+	} else if channel != i.Channel {
+		return ErrInvalidInvite
+	}
+
+	for attempt := 0; attempt < inviteRedeemAttempts; attempt++ {
+		ttl := int(time.Until(i.Expires).Seconds())
+		if ttl < 1 || i.Uses >= i.MaxUses {
+			return ErrInvalidInvite
+		}
+
+		// the update keeps the ttl of the row otherwise the uses would outlive the invite
+		applied, err := c.Query(`
+			UPDATE channel_invites USING TTL ? SET uses = ? WHERE hash = ? IF uses = ?`,
+			ttl, i.Uses+1, hash, i.Uses,
+		).ScanCAS(&i.Uses)
+
+		if err != nil {
+			return err
+		} else if applied {
+			i.Uses++
+			return nil
+		}
+	}
+	return ErrInvalidInvite
 }
 
 // AddUsersToChannel will add users to a channel given the channel id and the owner.
-// the members should be an array of uuids representing the users you want to add.
+// the members should be an array of uuids representing the users you want to add.  The users are
+// given the role they have in "Roles", or member if they don't have one.  ErrChannelNotFound is
+// returned if the channel isn't owned by "Owner".
 func (c *Cassandra) AddUsersToChannel(i *ChannelInfo) error {
 
 	if i.Owner == "" {
@@ -207,20 +901,27 @@ func (c *Cassandra) AddUsersToChannel(i *ChannelInfo) error {
 	}
 
 	members := make([]string, 0, len(i.Members))
+	roles := make(map[string]string, len(i.Members))
 	for _, member := range i.Members {
 		members = append(members, member.ID)
+
+		roles[member.ID] = string(structs.RoleMember)
+		if role, ok := i.Roles[member.ID]; ok {
+			roles[member.ID] = string(role)
+		}
 	}
 
-	err := c.Query(
-		`UPDATE channels SET members = members + ?
-		WHERE id = ? AND owner = ?`,
-		members, i.ID, i.Owner,
-	).Exec()
+	applied, err := c.Query(
+		`UPDATE channels SET members = members + ?, roles = roles + ?
+		WHERE id = ? AND owner = ? IF EXISTS`,
+		members, roles, i.ID, i.Owner,
+	).MapScanCAS(map[string]interface{}{})
 
-	return err
+	return channelApplied(applied, err)
 }
 
-// DeleteUsersFromChannel will remove the specified users from a channel given the users uuids
+// DeleteUsersFromChannel will remove the specified users from a channel given the users uuids.
+// ErrChannelNotFound is returned if the channel isn't owned by "Owner".
 func (c *Cassandra) DeleteUsersFromChannel(i *ChannelInfo) error {
 
 	if i.Owner == "" {
@@ -234,38 +935,154 @@ func (c *Cassandra) DeleteUsersFromChannel(i *ChannelInfo) error {
 		members = append(members, member.ID)
 	}
 
-	err := c.Query(`
-		UPDATE channels SET members = members - ?
-		WHERE id = ? AND owner = ?`,
-		members, i.ID, i.Owner,
-	).Exec()
+	applied, err := c.Query(`
+		UPDATE channels SET members = members - ?, roles = roles - ?
+		WHERE id = ? AND owner = ? IF EXISTS`,
+		members, members, i.ID, i.Owner,
+	).MapScanCAS(map[string]interface{}{})
 
-	return err
+	return channelApplied(applied, err)
 }
 
-// ListUsersInChannel will list all the users in a channel
-func (c *Cassandra) ListUsersInChannel(i *ChannelInfo) error {
+// ChannelRoles returns the role of everyone in the channel keyed by user id
+func (c *Cassandra) ChannelRoles(cid string) (map[string]structs.Role, error) {
+	return c.shared.ChannelRoles(cid)
+}
 
-	members := make([]string, 0, 2)
-	err := c.Query(`
-		SELECT members FROM channels WHERE id = ?`,
-		i.ID,
-	).Scan(&members)
+// Authorize returns the role of the user in the channel.  ErrNotPermitted is returned along with
+// the role if it doesn't permit the action.  It's the same check the api makes of websocket frames.
+func (c *Cassandra) Authorize(cid, uid string, action structs.Action) (structs.Role, error) {
+	return c.shared.Authorize(cid, uid, action)
+}
 
-	fmt.Println("members", members)
+// SetRoles changes the roles of the members in "Roles" of the channel "ID" owned by "Owner".  The
+// owner's role can't be set, ownership is changed with TransferChannel.  ErrChannelNotFound is
+// returned if the channel isn't owned by "Owner".
+func (c *Cassandra) SetRoles(i *ChannelInfo) error {
 
-	if err != nil {
-		return err
+	if i.Owner == "" {
+		return ErrInvalidOwner
+	} else if i.ID == "" {
+		return ErrInvalidChannel
+	} else if len(i.Roles) == 0 {
+		return ErrInvalidRoles
 	}
 
-	scanner := c.Query(`
-		SELECT id, gid, name, picture FROM users WHERE id IN ?`, members,
-	).Iter().Scanner()
-
-	users := make([]*UserInfo, 0, len(members))
+	roles := make(map[string]string, len(i.Roles))
+	for member, role := range i.Roles {
+		if member == i.Owner || role == structs.RoleOwner || role == structs.RoleNone {
+			return ErrInvalidRoles
+		}
+		roles[member] = string(role)
+	}
+
+	applied, err := c.Query(`
+		UPDATE channels SET roles = roles + ?
+		WHERE id = ? AND owner = ? IF EXISTS`,
+		roles, i.ID, i.Owner,
+	).MapScanCAS(map[string]interface{}{})
+
+	return channelApplied(applied, err)
+}
+
+// channelApplied is the error of a conditional update of a channel row.  The owner is part of the
+// key so an update that isn't applied lost a race with TransferChannel, or the channel is gone.
+// Without IF EXISTS it would create a second row under the old owner.
+func channelApplied(applied bool, err error) error {
+	if err != nil {
+		return err
+	} else if !applied {
+		return ErrChannelNotFound
+	}
+	return nil
+}
+
+// TransferChannel makes the member "to" the owner of the channel "ID" owned by "Owner".  The
+// previous owner stays on as an admin.
+//
+// The owner is part of the key of the channel so the row is moved rather than updated.  The delete
+// and insert are batched so the channel is never without an owner.
+func (c *Cassandra) TransferChannel(i *ChannelInfo, to string) error {
+
+	if i.Owner == "" {
+		return ErrInvalidOwner
+	} else if i.ID == "" {
+		return ErrInvalidChannel
+	} else if to == "" || to == i.Owner {
+		return ErrInvalidMember
+	}
+
+	// created is set with now() so it's a timeuuid
+	var (
+		created  gocql.UUID
+		name     string
+		private  bool
+		members  []string
+		assigned map[string]string
+	)
+	err := c.Query(`
+		SELECT created, name, private, members, roles FROM channels WHERE id = ? AND owner = ?`,
+		i.ID, i.Owner,
+	).Scan(&created, &name, &private, &members, &assigned)
+
+	if err == gocql.ErrNotFound {
+		return ErrChannelNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if structs.MemberRoles(i.Owner, members, assigned)[to] == structs.RoleNone {
+		return ErrInvalidMember
+	}
+
+	if assigned == nil {
+		assigned = make(map[string]string, 1)
+	}
+	delete(assigned, to)
+	assigned[i.Owner] = string(structs.RoleAdmin)
+
+	batch := c.NewBatch(gocql.LoggedBatch)
+	batch.Query(`DELETE FROM channels WHERE id = ? AND owner = ?`, i.ID, i.Owner)
+	batch.Query(`
+		INSERT INTO channels (id, owner, created, members, name, private, roles)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		i.ID, to, created, members, name, private, assigned,
+	)
+	if err := c.ExecuteBatch(batch); err != nil {
+		return err
+	}
+
+	i.Owner = to
+	return nil
+}
+
+// ListUsersInChannel will list all the users in a channel along with their roles
+func (c *Cassandra) ListUsersInChannel(i *ChannelInfo) error {
+
+	var (
+		members  = make([]string, 0, 2)
+		assigned map[string]string
+	)
+	err := c.Query(`
+		SELECT owner, members, roles FROM channels WHERE id = ?`,
+		i.ID,
+	).Scan(&i.Owner, &members, &assigned)
+
+	fmt.Println("members", members)
+
+	if err != nil {
+		return err
+	}
+	i.Roles = structs.MemberRoles(i.Owner, members, assigned)
+
+	scanner := c.Query(`
+		SELECT id, gid, name, picture FROM users WHERE id IN ?`, members,
+	).Iter().Scanner()
+
+	users := make([]*structs.User, 0, len(members))
 	for scanner.Next() {
-		user := &UserInfo{}
-		err = scanner.Scan(&user.ID, &user.GID, &user.Name, &user.Picture)
+		user := &structs.User{}
+		err = scanner.Scan(&user.ID, &user.GID, &user.Name, &user.Avatar)
 		if err != nil {
 			return err
 		}
@@ -278,14 +1095,88 @@ func (c *Cassandra) ListUsersInChannel(i *ChannelInfo) error {
 	return nil
 }
 
+// ListConversations lists the direct and group conversations the user is in along with the ids of
+// the users in them
+func (c *Cassandra) ListConversations(i *UserInfo) error {
+
+	if i.ID == "" {
+		return ErrInvalidMember
+	}
+
+	scanner := c.Query(
+		`SELECT id, kind, members, created FROM channels WHERE members CONTAINS ?`,
+		i.ID,
+	).Iter().Scanner()
+
+	conversations := make([]*ChannelInfo, 0, 2)
+	for scanner.Next() {
+		var (
+			ci      = &ChannelInfo{}
+			kind    string
+			members []string
+			created gocql.UUID
+		)
+		if err := scanner.Scan(&ci.ID, &kind, &members, &created); err != nil {
+			return err
+		}
+
+		// the kind isn't indexed so channels are skipped here rather than in the query
+		if ci.Kind = ChannelKind(kind); !ci.Kind.IsConversation() {
+			continue
+		}
+		ci.Members = convertUsers(members)
+		ci.Created = created.Time()
+		conversations = append(conversations, ci)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := c.unread(i.ID, conversations); err != nil {
+		return err
+	}
+	i.Channels = conversations
+
+	return nil
+}
+
+// ListUserChannels lists the ids of all the channels the user is a member of
+func (c *Cassandra) ListUserChannels(i *UserInfo) error {
+
+	if i.ID == "" {
+		return ErrInvalidMember
+	}
+
+	scanner := c.Query(
+		`SELECT id FROM channels WHERE members CONTAINS ?`,
+		i.ID,
+	).Iter().Scanner()
+
+	channels := make([]*ChannelInfo, 0, 2)
+	for scanner.Next() {
+		ci := &ChannelInfo{}
+		if err := scanner.Scan(&ci.ID); err != nil {
+			return err
+		}
+		channels = append(channels, ci)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	i.Channels = channels
+
+	return nil
+}
+
 // CreateUser adds a user to the database if the user does not already exist otherwise populate
 // the user info with the existing fields.
-func (c *Cassandra) CreateUser(i *UserInfo) error {
+func (c *Cassandra) CreateUser(i *structs.User) error {
 
 	err := c.Query(`
 		SELECT id, name, picture FROM users WHERE gid = ?`,
 		i.GID,
-	).Scan(&i.ID, &i.Name, &i.Picture)
+	).Scan(&i.ID, &i.Name, &i.Avatar)
 
 	if err == gocql.ErrNotFound {
 	} else if err != nil {
@@ -294,8 +1185,537 @@ func (c *Cassandra) CreateUser(i *UserInfo) error {
 
 	err = c.Query(`
 		INSERT INTO users (gid, id, name, picture) VALUES (?, ?, ?, ?) IF NOT EXISTS`,
-		i.GID, i.ID, i.Name, i.Picture,
+		i.GID, i.ID, i.Name, i.Avatar,
 	).Exec()
 
 	return err
 }
+
+// CreateMessage logs the message to "Channel" generating the TimeUUID "ID" of the message.  Its
+// "Attachments" must have been checked by Attachable.
+func (c *Cassandra) CreateMessage(i *MessageInfo) error {
+
+	if i.Channel == "" {
+		return ErrInvalidChannel
+	} else if i.Owner == "" {
+		return ErrInvalidOwner
+	}
+
+	id := gocql.TimeUUID()
+	i.HTML = markdown.Render(i.Body)
+
+	err := c.Query(`
+		INSERT INTO messages (channel, id, owner, body, html) VALUES (?, ?, ?, ?, ?)`,
+		i.Channel, id, i.Owner, i.Body, i.HTML,
+	).Exec()
+
+	if err != nil {
+		return err
+	}
+
+	i.ID = id.String()
+	i.Created = id.Time()
+	c.indexMessage(i)
+
+	return c.attach(i)
+}
+
+// CreateReply logs the message to "Channel" as a reply to "Parent" generating its "ID".  The parent
+// is changed to the message that was replied to if "Parent" is a reply itself.  The summary of the
+// thread the reply is in is returned, ErrParentNotFound if "Parent" isn't in the channel.  Its
+// "Attachments" must have been checked by Attachable.
+func (c *Cassandra) CreateReply(i *MessageInfo) (*structs.Thread, error) {
+
+	if i.Channel == "" {
+		return nil, ErrInvalidChannel
+	} else if i.Owner == "" {
+		return nil, ErrInvalidOwner
+	}
+
+	message, thread, err := c.shared.LogReply(i.Channel, i.Parent, i.Owner, i.Body, markdown.Render(i.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	i.ID = message.ID
+	i.HTML = message.HTML
+	i.Parent = message.Parent
+	i.Created = message.Time
+	c.indexMessage(i)
+
+	return thread, c.attach(i)
+}
+
+// GetMessage fills in the message "ID" of "Channel".  Deleted messages are tombstones with
+// "Deleted" set, ErrMessageNotFound is returned if the message isn't in the channel.
+func (c *Cassandra) GetMessage(i *MessageInfo) error {
+
+	if i.Channel == "" {
+		return ErrInvalidChannel
+	}
+
+	message, err := c.shared.GetMessage(i.Channel, i.ID)
+	if err != nil {
+		return err
+	}
+	i.fill(message)
+
+	return nil
+}
+
+// EditMessage replaces the body of the message "ID" of "Channel" with "Body" on behalf of editor.
+// The body it replaces is kept in the message's history.  ErrMessageNotFound is returned if the
+// message isn't in the channel or has been deleted.
+func (c *Cassandra) EditMessage(i *MessageInfo, editor string) error {
+
+	if i.Channel == "" {
+		return ErrInvalidChannel
+	} else if editor == "" {
+		return ErrInvalidOwner
+	} else if strings.TrimSpace(i.Body) == "" {
+		return ErrInvalidBody
+	}
+
+	message, err := c.shared.EditMessage(i.Channel, i.ID, editor, i.Body, markdown.Render(i.Body))
+	if err != nil {
+		return err
+	}
+	i.fill(message)
+	c.indexMessage(i)
+
+	return nil
+}
+
+// DeleteMessage replaces the message "ID" of "Channel" with a tombstone dropping its body and
+// history.  ErrMessageNotFound is returned if the message isn't in the channel or has already
+// been deleted.
+func (c *Cassandra) DeleteMessage(i *MessageInfo) error {
+
+	if i.Channel == "" {
+		return ErrInvalidChannel
+	}
+
+	message, err := c.shared.DeleteMessage(i.Channel, i.ID)
+	if err != nil {
+		return err
+	}
+	i.fill(message)
+
+	if err := c.index.Remove(i.Channel, i.ID); err != nil {
+		log.Printf("cassandra: failed to remove %s from the search index: %s", i.ID, err)
+	}
+
+	return nil
+}
+
+// AddReaction reacts to the message "ID" of "Channel" with the emoji on behalf of the user and
+// fills in the message's "Reactions".  ErrMessageNotFound is returned if the message isn't in the
+// channel or has been deleted.
+func (c *Cassandra) AddReaction(i *MessageInfo, user, emoji string) error {
+
+	if i.Channel == "" {
+		return ErrInvalidChannel
+	} else if user == "" {
+		return ErrInvalidMember
+	} else if !structs.ValidEmoji(emoji) {
+		return structs.ErrInvalidEmoji
+	}
+
+	reactions, err := c.shared.AddReaction(i.Channel, i.ID, user, emoji)
+	if err != nil {
+		return err
+	}
+	i.Reactions = reactions.Reactions
+
+	return nil
+}
+
+// RemoveReaction takes back the user's reaction to the message "ID" of "Channel" with the emoji
+// and fills in the message's "Reactions".  ErrMessageNotFound is returned if the message isn't in
+// the channel or has been deleted.
+func (c *Cassandra) RemoveReaction(i *MessageInfo, user, emoji string) error {
+
+	if i.Channel == "" {
+		return ErrInvalidChannel
+	} else if user == "" {
+		return ErrInvalidMember
+	} else if !structs.ValidEmoji(emoji) {
+		return structs.ErrInvalidEmoji
+	}
+
+	reactions, err := c.shared.RemoveReaction(i.Channel, i.ID, user, emoji)
+	if err != nil {
+		return err
+	}
+	i.Reactions = reactions.Reactions
+
+	return nil
+}
+
+// MarkRead moves the user's read cursor in "Channel" up to the message "ID".  Cursors only move
+// forward, false is returned if the user had already read the message.  ErrMessageNotFound is
+// returned if the message isn't in the channel.
+func (c *Cassandra) MarkRead(i *MessageInfo, user string) (bool, error) {
+
+	if i.Channel == "" {
+		return false, ErrInvalidChannel
+	} else if user == "" {
+		return false, ErrInvalidMember
+	}
+
+	return c.shared.MarkRead(i.Channel, user, i.ID)
+}
+
+// ListEdits fills in the "Edits" of the message "ID" of "Channel"
+func (c *Cassandra) ListEdits(i *MessageInfo) error {
+
+	if i.Channel == "" {
+		return ErrInvalidChannel
+	}
+
+	edits, err := c.shared.GetEdits(i.Channel, i.ID)
+	if err != nil {
+		return err
+	}
+	i.Edits = edits
+
+	return nil
+}
+
+// ListThread fills the page with the message "Root" of "Channel" and at most "Limit" of its replies
+// that are newer than "Cursor".  ErrMessageNotFound is returned if "Root" isn't in the channel.
+func (c *Cassandra) ListThread(p *ThreadPage) error {
+
+	if p.Channel == "" {
+		return ErrInvalidChannel
+	} else if p.Limit < 1 {
+		return ErrInvalidLimit
+	}
+
+	var after string
+	if p.Cursor != "" {
+		id, err := DecodeCursor(p.Cursor)
+		if err != nil {
+			return err
+		}
+		after = id.String()
+	}
+
+	parent, err := c.shared.GetMessage(p.Channel, p.Root)
+	if err == nil && parent.Parent != "" {
+		parent, err = c.shared.GetMessage(p.Channel, parent.Parent)
+	}
+	if err != nil {
+		return err
+	}
+
+	// one extra reply is fetched to know if there is a next page without another round trip
+	replies, err := c.shared.GetThread(p.Channel, parent.ID, after, p.Limit+1)
+	if err != nil {
+		return err
+	}
+
+	p.Next = ""
+	if len(replies) > p.Limit {
+		replies = replies[:p.Limit]
+
+		last, err := gocql.ParseUUID(replies[p.Limit-1].ID)
+		if err != nil {
+			return err
+		}
+		p.Next = EncodeCursor(last)
+	}
+
+	p.Parent = newMessageInfo(parent)
+	p.Messages = make([]*MessageInfo, 0, len(replies))
+	for _, reply := range replies {
+		p.Messages = append(p.Messages, newMessageInfo(reply))
+	}
+
+	return nil
+}
+
+// ListMessages fills the page with at most "Limit" messages of "Channel" that are older than
+// "Cursor".  Cassandra can't skip rows cheaply so rather than an offset the id of the last message
+// in the page is handed back as "Next" to continue from.
+func (c *Cassandra) ListMessages(p *MessagePage) error {
+
+	if p.Channel == "" {
+		return ErrInvalidChannel
+	} else if p.Limit < 1 {
+		return ErrInvalidLimit
+	}
+
+	// one extra row is fetched to know if there is a next page without another round trip
+	var query *gocql.Query
+	if p.Cursor == "" {
+		query = c.Query(`
+			SELECT id, owner, body, html, parent_id, last_reply, edited_at, deleted_at FROM messages
+			WHERE channel = ?
+			ORDER BY id DESC LIMIT ?`,
+			p.Channel, p.Limit+1,
+		)
+	} else {
+		before, err := DecodeCursor(p.Cursor)
+		if err != nil {
+			return err
+		}
+		query = c.Query(`
+			SELECT id, owner, body, html, parent_id, last_reply, edited_at, deleted_at FROM messages
+			WHERE channel = ? AND id < ?
+			ORDER BY id DESC LIMIT ?`,
+			p.Channel, before, p.Limit+1,
+		)
+	}
+
+	var (
+		scanner  = query.Iter().Scanner()
+		messages = make([]*MessageInfo, 0, p.Limit+1)
+		ids      = make([]gocql.UUID, 0, p.Limit+1)
+		threads  = make(map[gocql.UUID]*structs.Thread)
+	)
+	for scanner.Next() {
+		var (
+			id        gocql.UUID
+			parent    gocql.UUID
+			lastReply gocql.UUID
+			editedAt  time.Time
+			deletedAt time.Time
+			message   = &MessageInfo{Channel: p.Channel}
+		)
+		err := scanner.Scan(&id, &message.Owner, &message.Body, &message.HTML, &parent, &lastReply, &editedAt, &deletedAt)
+		if err != nil {
+			return err
+		}
+		message.ID = id.String()
+		message.Created = id.Time()
+
+		if !deletedAt.IsZero() {
+			message.Body = ""
+			message.HTML = ""
+			message.Deleted = true
+		} else if !editedAt.IsZero() {
+			message.EditedAt = &editedAt
+		}
+		if message.HTML == "" && !message.Deleted {
+			// messages logged before bodies were rendered
+			message.HTML = markdown.Render(message.Body)
+		}
+
+		if parent != (gocql.UUID{}) {
+			message.Parent = parent.String()
+		}
+		if lastReply != (gocql.UUID{}) {
+			message.Thread = &structs.Thread{Parent: message.ID, LastReply: lastReply.Time()}
+			threads[id] = message.Thread
+		}
+
+		ids = append(ids, id)
+		messages = append(messages, message)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var live = make([]gocql.UUID, 0, len(ids))
+	for i, message := range messages {
+		if !message.Deleted {
+			live = append(live, ids[i])
+		}
+	}
+	reactions, err := c.shared.Reactions(p.Channel, live)
+	if err != nil {
+		return err
+	}
+	attachments, err := c.shared.Attachments(p.Channel, live)
+	if err != nil {
+		return err
+	}
+	previews, err := c.shared.Previews(p.Channel, live)
+	if err != nil {
+		return err
+	}
+	for i, message := range messages {
+		message.Reactions = reactions[ids[i]]
+		message.Attachments = attachments[ids[i]]
+		message.Previews = previews[ids[i]]
+	}
+
+	if len(threads) > 0 {
+		parents := make([]gocql.UUID, 0, len(threads))
+		for id := range threads {
+			parents = append(parents, id)
+		}
+
+		counts, err := c.shared.ReplyCounts(p.Channel, parents)
+		if err != nil {
+			return err
+		}
+		for id, thread := range threads {
+			thread.Replies = counts[id]
+		}
+	}
+
+	p.Next = ""
+	if len(messages) > p.Limit {
+		messages = messages[:p.Limit]
+		p.Next = EncodeCursor(ids[p.Limit-1])
+	}
+	p.Messages = messages
+
+	return nil
+}
+
+// SearchMessages fills in the "Hits" of the page searching only the channels "User" is a member
+// of.  ErrNotPermitted is returned when "Channel" is set to a channel they aren't a member of.
+func (c *Cassandra) SearchMessages(p *SearchPage) error {
+
+	if p.User == "" {
+		return ErrInvalidMember
+	}
+
+	user := &UserInfo{User: structs.User{ID: p.User}}
+	if err := c.ListUserChannels(user); err != nil {
+		return err
+	}
+
+	query, err := p.query(user.Channels)
+	if err != nil {
+		return err
+	}
+
+	hits, err := c.index.Search(query)
+	switch err {
+	case nil:
+	case search.ErrEmptyQuery:
+		return ErrInvalidQuery
+	case search.ErrInvalidLimit:
+		return ErrInvalidLimit
+	case search.ErrInvalidRange:
+		return ErrInvalidRange
+	default:
+		return err
+	}
+	p.Hits = hits
+
+	return nil
+}
+
+// query is the search of the page limited to the channels, those the user is a member of
+func (p *SearchPage) query(channels []*ChannelInfo) (*search.Query, error) {
+	var query = &search.Query{
+		Text:     p.Query,
+		Author:   p.Author,
+		Limit:    p.Limit,
+		Channels: make([]string, 0, len(channels)),
+	}
+
+	for _, channel := range channels {
+		if p.Channel == "" || p.Channel == channel.ID {
+			query.Channels = append(query.Channels, channel.ID)
+		}
+	}
+	if p.Channel != "" && len(query.Channels) == 0 {
+		return nil, ErrNotPermitted
+	}
+
+	if p.After != nil {
+		query.After = *p.After
+	}
+	if p.Before != nil {
+		query.Before = *p.Before
+	}
+	return query, nil
+}
+
+// indexMessage adds the message to the search index.  It's already stored so failing to index it
+// is only logged.
+func (c *Cassandra) indexMessage(i *MessageInfo) {
+	if err := c.index.Index(i.message()); err != nil {
+		log.Printf("cassandra: failed to index %s: %s", i.ID, err)
+	}
+}
+
+// Attachable fills in the "Attachments" of the message "Owner" is about to send to "Channel".
+// ErrInvalidAttachment is returned unless each of the ids is an attachment they uploaded to the
+// channel that hasn't been sent yet.
+func (c *Cassandra) Attachable(i *MessageInfo, ids []string) error {
+
+	if i.Channel == "" {
+		return ErrInvalidChannel
+	} else if i.Owner == "" {
+		return ErrInvalidOwner
+	}
+
+	attachments, err := c.shared.Attachable(i.Channel, i.Owner, ids)
+	if err != nil {
+		return err
+	}
+	i.Attachments = attachments
+
+	return nil
+}
+
+// attach marks the "Attachments" of the message as sent with it
+func (c *Cassandra) attach(i *MessageInfo) error {
+	if len(i.Attachments) == 0 {
+		return nil
+	}
+	return c.shared.Attach(i.Channel, i.ID, i.Attachments)
+}
+
+// CreateAttachment stores the metadata of an attachment uploaded to "Channel" under its "ID".  The
+// file itself is kept in the blob store.
+func (c *Cassandra) CreateAttachment(a *structs.Attachment) error {
+
+	if a.Channel == "" {
+		return ErrInvalidChannel
+	} else if a.Uploader == "" {
+		return ErrInvalidOwner
+	}
+
+	return c.shared.CreateAttachment(a)
+}
+
+// DropUnsentAttachments drops the attachments uploaded before the time that still haven't been
+// sent and returns them so their files can be removed.  The attachments dropped before an error
+// are returned along with it.
+func (c *Cassandra) DropUnsentAttachments(before time.Time) ([]*structs.Attachment, error) {
+	var dropped = []*structs.Attachment{}
+	for {
+		pending, err := c.shared.PendingAttachments(before, sweepPageSize)
+		if err != nil {
+			return dropped, err
+		}
+		for _, attachment := range pending {
+			ok, err := c.shared.DropPending(attachment)
+			if err != nil {
+				return dropped, err
+			}
+			if ok {
+				dropped = append(dropped, attachment)
+			}
+		}
+		if len(pending) < sweepPageSize {
+			return dropped, nil
+		}
+	}
+}
+
+// GetAttachment fills in the attachment "ID" of "Channel", ErrAttachmentNotFound is returned if it
+// isn't in the channel
+func (c *Cassandra) GetAttachment(a *structs.Attachment) error {
+
+	if a.Channel == "" {
+		return ErrInvalidChannel
+	}
+
+	attachment, err := c.shared.GetAttachment(a.Channel, a.ID)
+	if err != nil {
+		return err
+	}
+	*a = *attachment
+
+	return nil
+}
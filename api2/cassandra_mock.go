@@ -0,0 +1,290 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+// MockCassandra is a DatabaseController where each method calls the matching Fn field
+type MockCassandra struct {
+	AddReactionFn      func(*MessageInfo, string, string) error
+	AddReactionInvoked bool
+
+	AttachableFn      func(*MessageInfo, []string) error
+	AttachableInvoked bool
+
+	AuthorizeFn      func(string, string, structs.Action) (structs.Role, error)
+	AuthorizeInvoked bool
+
+	ChannelRolesFn      func(string) (map[string]structs.Role, error)
+	ChannelRolesInvoked bool
+
+	AddUsersToChannelFn      func(*ChannelInfo) error
+	AddUsersToChannelInvoked bool
+
+	CreateAttachmentFn      func(*structs.Attachment) error
+	CreateAttachmentInvoked bool
+
+	CreateChannelFn      func(*ChannelInfo) error
+	CreateChannelInvoked bool
+
+	CreateConversationFn      func(*ChannelInfo) (bool, error)
+	CreateConversationInvoked bool
+
+	CreateInviteFn      func(*InviteInfo) error
+	CreateInviteInvoked bool
+
+	CreateMessageFn      func(*MessageInfo) error
+	CreateMessageInvoked bool
+
+	CreateReplyFn      func(*MessageInfo) (*structs.Thread, error)
+	CreateReplyInvoked bool
+
+	CreateUserFn      func(*structs.User) error
+	CreateUserInvoked bool
+
+	DeleteChannelsFn      func(*ChannelInfo) error
+	DeleteChannelsInvoked bool
+
+	DeleteMessageFn      func(*MessageInfo) error
+	DeleteMessageInvoked bool
+
+	DeleteUsersFromChannelFn      func(*ChannelInfo) error
+	DeleteUsersFromChannelInvoked bool
+
+	DropUnsentAttachmentsFn      func(time.Time) ([]*structs.Attachment, error)
+	DropUnsentAttachmentsInvoked bool
+
+	EditMessageFn      func(*MessageInfo, string) error
+	EditMessageInvoked bool
+
+	GetAttachmentFn      func(*structs.Attachment) error
+	GetAttachmentInvoked bool
+
+	GetChannelFn      func(*ChannelInfo) error
+	GetChannelInvoked bool
+
+	GetMessageFn      func(*MessageInfo) error
+	GetMessageInvoked bool
+
+	ListEditsFn      func(*MessageInfo) error
+	ListEditsInvoked bool
+
+	ListReadsFn      func(*ChannelInfo) error
+	ListReadsInvoked bool
+
+	MarkReadFn      func(*MessageInfo, string) (bool, error)
+	MarkReadInvoked bool
+
+	RemoveReactionFn      func(*MessageInfo, string, string) error
+	RemoveReactionInvoked bool
+
+	SearchMessagesFn      func(*SearchPage) error
+	SearchMessagesInvoked bool
+
+	ListConversationsFn      func(*UserInfo) error
+	ListConversationsInvoked bool
+
+	ListChannelsFn      func(*ChannelInfo) error
+	ListChannelsInvoked bool
+
+	ListPublicChannelsFn      func(*ChannelDirectory) error
+	ListPublicChannelsInvoked bool
+
+	ListMessagesFn      func(*MessagePage) error
+	ListMessagesInvoked bool
+
+	ListThreadFn      func(*ThreadPage) error
+	ListThreadInvoked bool
+
+	ListUserChannelsFn      func(*UserInfo) error
+	ListUserChannelsInvoked bool
+
+	ListUsersInChannelFn      func(*ChannelInfo) error
+	ListUsersInChannelInvoked bool
+
+	RedeemInviteFn      func(*InviteInfo) error
+	RedeemInviteInvoked bool
+
+	SetRolesFn      func(*ChannelInfo) error
+	SetRolesInvoked bool
+
+	TransferChannelFn      func(*ChannelInfo, string) error
+	TransferChannelInvoked bool
+}
+
+func (m *MockCassandra) Attachable(i *MessageInfo, ids []string) error {
+	m.AttachableInvoked = true
+	return m.AttachableFn(i, ids)
+}
+
+func (m *MockCassandra) Authorize(cid, uid string, action structs.Action) (structs.Role, error) {
+	m.AuthorizeInvoked = true
+	return m.AuthorizeFn(cid, uid, action)
+}
+
+func (m *MockCassandra) ChannelRoles(cid string) (map[string]structs.Role, error) {
+	m.ChannelRolesInvoked = true
+	return m.ChannelRolesFn(cid)
+}
+
+func (m *MockCassandra) AddUsersToChannel(i *ChannelInfo) error {
+	m.AddUsersToChannelInvoked = true
+	return m.AddUsersToChannelFn(i)
+}
+
+func (m *MockCassandra) CreateAttachment(a *structs.Attachment) error {
+	m.CreateAttachmentInvoked = true
+	return m.CreateAttachmentFn(a)
+}
+
+func (m *MockCassandra) CreateChannel(i *ChannelInfo) error {
+	m.CreateChannelInvoked = true
+	return m.CreateChannelFn(i)
+}
+
+func (m *MockCassandra) CreateConversation(i *ChannelInfo) (bool, error) {
+	m.CreateConversationInvoked = true
+	return m.CreateConversationFn(i)
+}
+
+func (m *MockCassandra) CreateInvite(i *InviteInfo) error {
+	m.CreateInviteInvoked = true
+	return m.CreateInviteFn(i)
+}
+
+func (m *MockCassandra) CreateMessage(i *MessageInfo) error {
+	m.CreateMessageInvoked = true
+	return m.CreateMessageFn(i)
+}
+
+func (m *MockCassandra) CreateReply(i *MessageInfo) (*structs.Thread, error) {
+	m.CreateReplyInvoked = true
+	return m.CreateReplyFn(i)
+}
+
+func (m *MockCassandra) CreateUser(i *structs.User) error {
+	m.CreateUserInvoked = true
+	return m.CreateUserFn(i)
+}
+
+func (m *MockCassandra) DeleteChannels(i *ChannelInfo) error {
+	m.DeleteChannelsInvoked = true
+	return m.DeleteChannelsFn(i)
+}
+
+func (m *MockCassandra) DeleteMessage(i *MessageInfo) error {
+	m.DeleteMessageInvoked = true
+	return m.DeleteMessageFn(i)
+}
+
+func (m *MockCassandra) DeleteUsersFromChannel(i *ChannelInfo) error {
+	m.DeleteUsersFromChannelInvoked = true
+	return m.DeleteUsersFromChannelFn(i)
+}
+
+func (m *MockCassandra) DropUnsentAttachments(before time.Time) ([]*structs.Attachment, error) {
+	m.DropUnsentAttachmentsInvoked = true
+	return m.DropUnsentAttachmentsFn(before)
+}
+
+func (m *MockCassandra) EditMessage(i *MessageInfo, editor string) error {
+	m.EditMessageInvoked = true
+	return m.EditMessageFn(i, editor)
+}
+
+func (m *MockCassandra) GetAttachment(a *structs.Attachment) error {
+	m.GetAttachmentInvoked = true
+	return m.GetAttachmentFn(a)
+}
+
+func (m *MockCassandra) GetChannel(i *ChannelInfo) error {
+	m.GetChannelInvoked = true
+	return m.GetChannelFn(i)
+}
+
+func (m *MockCassandra) GetMessage(i *MessageInfo) error {
+	m.GetMessageInvoked = true
+	return m.GetMessageFn(i)
+}
+
+func (m *MockCassandra) ListEdits(i *MessageInfo) error {
+	m.ListEditsInvoked = true
+	return m.ListEditsFn(i)
+}
+
+func (m *MockCassandra) ListReads(i *ChannelInfo) error {
+	m.ListReadsInvoked = true
+	return m.ListReadsFn(i)
+}
+
+func (m *MockCassandra) MarkRead(i *MessageInfo, user string) (bool, error) {
+	m.MarkReadInvoked = true
+	return m.MarkReadFn(i, user)
+}
+
+func (m *MockCassandra) AddReaction(i *MessageInfo, user, emoji string) error {
+	m.AddReactionInvoked = true
+	return m.AddReactionFn(i, user, emoji)
+}
+
+func (m *MockCassandra) RemoveReaction(i *MessageInfo, user, emoji string) error {
+	m.RemoveReactionInvoked = true
+	return m.RemoveReactionFn(i, user, emoji)
+}
+
+func (m *MockCassandra) SearchMessages(p *SearchPage) error {
+	m.SearchMessagesInvoked = true
+	return m.SearchMessagesFn(p)
+}
+
+func (m *MockCassandra) ListConversations(i *UserInfo) error {
+	m.ListConversationsInvoked = true
+	return m.ListConversationsFn(i)
+}
+
+func (m *MockCassandra) ListChannels(i *ChannelInfo) error {
+	m.ListChannelsInvoked = true
+	return m.ListChannelsFn(i)
+}
+
+func (m *MockCassandra) ListPublicChannels(d *ChannelDirectory) error {
+	m.ListPublicChannelsInvoked = true
+	return m.ListPublicChannelsFn(d)
+}
+
+func (m *MockCassandra) ListMessages(p *MessagePage) error {
+	m.ListMessagesInvoked = true
+	return m.ListMessagesFn(p)
+}
+
+func (m *MockCassandra) ListThread(p *ThreadPage) error {
+	m.ListThreadInvoked = true
+	return m.ListThreadFn(p)
+}
+
+func (m *MockCassandra) ListUserChannels(i *UserInfo) error {
+	m.ListUserChannelsInvoked = true
+	return m.ListUserChannelsFn(i)
+}
+
+func (m *MockCassandra) ListUsersInChannel(i *ChannelInfo) error {
+	m.ListUsersInChannelInvoked = true
+	return m.ListUsersInChannelFn(i)
+}
+
+func (m *MockCassandra) RedeemInvite(i *InviteInfo) error {
+	m.RedeemInviteInvoked = true
+	return m.RedeemInviteFn(i)
+}
+
+func (m *MockCassandra) SetRoles(i *ChannelInfo) error {
+	m.SetRolesInvoked = true
+	return m.SetRolesFn(i)
+}
+
+func (m *MockCassandra) TransferChannel(i *ChannelInfo, to string) error {
+	m.TransferChannelInvoked = true
+	return m.TransferChannelFn(i, to)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gocql/gocql"
+	. "github.com/onsi/gomega"
+)
+
+func TestCursor(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	id := gocql.TimeUUID()
+	cursor := EncodeCursor(id)
+
+	decoded, err := DecodeCursor(cursor)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(decoded).Should(Equal(id))
+
+	random, err := gocql.RandomUUID()
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	for _, cursor := range []string{"", "not base64!", "c2hvcnQ", EncodeCursor(random)} {
+		_, err = DecodeCursor(cursor)
+		g.Expect(err).Should(Equal(ErrInvalidCursor), cursor)
+	}
+}
+
+func TestConversationID(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	var (
+		alice = UUIDRecal("alice")
+		bob   = UUIDRecal("bob")
+		carol = UUIDRecal("carol")
+	)
+
+	g.Expect(conversationID([]string{alice, bob})).Should(Equal(conversationID([]string{bob, alice})))
+	g.Expect(conversationID([]string{alice, bob})).ShouldNot(Equal(conversationID([]string{alice, carol})))
+	g.Expect(conversationID([]string{alice, bob, carol})).ShouldNot(Equal(conversationID([]string{alice, bob})))
+}
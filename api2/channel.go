@@ -3,36 +3,99 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/sir-wiggles/chat/api/blob"
+	"github.com/sir-wiggles/chat/api/protocol"
+	"github.com/sir-wiggles/chat/api/structs"
 )
 
 // Channel handles all channel related operations that the API can use
 type Channel struct {
 	Handler  http.HandlerFunc
 	database DatabaseController
+	hub      *Hub
+	blobs    blob.Store
 }
 
-// Register initializes the given router with user related routes returning the sub router.
-func (c *Channel) Register(router *mux.Router) {
+const (
+	// defaultMessageLimit is the page size used when no limit is given
+	defaultMessageLimit = 50
+
+	// maxMessageLimit is the largest page size a client may ask for
+	maxMessageLimit = 200
+
+	// defaultDirectoryLimit is the number of public channels listed when no limit is given
+	defaultDirectoryLimit = 50
+
+	// maxDirectoryLimit is the most public channels a client may ask for
+	maxDirectoryLimit = 200
+
+	// defaultInviteExpiry is how long an invite lasts when it isn't given an expiry
+	defaultInviteExpiry = 24 * time.Hour
+
+	// defaultInviteUses is how many times an invite can be redeemed when it isn't given a limit
+	defaultInviteUses = 1
+)
+
+// Register initializes the given router with channel related routes returning the sub router.
+func (c *Channel) Register(router *mux.Router) *mux.Router {
+
+	/*
+	 *GET    /channels/public?name=N&limit=L                 -- Search the public channels by name
+	 */
+	// it has to come first otherwise the /channel prefix matches it
+	router.Path("/channels/public").Handler(c.setHandler(c.PublicChannels)).Methods("GET")
 
 	/*
 	 *PUT    /channel                                        -- Create a channel
 	 */
-	sub := router.NewRoute().PathPrefix("/channel").Subrouter()
-	sub.Path("/").Handler(c.setHandler(c.CreateChannel)).Methods("PUT")
+	channel := router.NewRoute().PathPrefix("/channel").Subrouter()
+	channel.Path("/").Handler(c.setHandler(c.CreateChannel)).Methods("PUT")
 
 	/*
 	 *PUT    /channel/{channel_id}/users 					 -- Add one or more users to a channel
 	 *DELETE /channel/{channel_id}/users                     -- Delete one or more users in a channel
 	 *GET    /channel/{channel_id}/users					 -- Get all the users in a channel
-	 *GET    /channel/{channel_id}/messages?limit=N&offset=M -- Get message in a channel
+	 *PUT    /channel/{channel_id}/roles                     -- Change the roles of users in a channel
+	 *PUT    /channel/{channel_id}/owner                     -- Transfer ownership of a channel
+	 *POST   /channel/{channel_id}/invites                   -- Create an invite to a channel
+	 *POST   /channel/{channel_id}/join                      -- Join a public channel or redeem an invite
+	 *GET    /channel/{channel_id}/messages?limit=N&cursor=C -- Get message in a channel
+	 *GET    /channel/{channel_id}/messages/{message_id}/thread?limit=N&cursor=C
+	 *                                                       -- Get the replies to a message
+	 *POST   /channel/{channel_id}/attachments               -- Upload a file to send with a message
+	 *GET    /channel/{channel_id}/attachments/{attachment_id}
+	 *                                                       -- Download an attachment
+	 *GET    /channel/{channel_id}/attachments/{attachment_id}/thumbnail
+	 *                                                       -- Download the thumbnail of an image
 	 */
-	sub = sub.PathPrefix(fmt.Sprintf("/{cid:%s}", UUIDPattern)).Subrouter()
+	sub := channel.PathPrefix(fmt.Sprintf("/{cid:%s}", UUIDPattern)).Subrouter()
 	sub.Path("/users").Handler(c.setHandler(c.AddUsers)).Methods("PUT")
 	sub.Path("/users").Handler(c.setHandler(c.ListUsers)).Methods("GET")
 	sub.Path("/users").Handler(c.setHandler(c.DeleteUsers)).Methods("DELETE")
+	sub.Path("/roles").Handler(c.setHandler(c.SetRoles)).Methods("PUT")
+	sub.Path("/owner").Handler(c.setHandler(c.TransferOwnership)).Methods("PUT")
+	sub.Path("/invites").Handler(c.setHandler(c.CreateInvite)).Methods("POST")
+	sub.Path("/join").Handler(c.setHandler(c.Join)).Methods("POST")
 	sub.Path("/messages").Handler(c.setHandler(c.Messages)).Methods("GET")
+	sub.Path("/read").Handler(c.setHandler(c.MarkRead)).Methods("PUT")
+	sub.Path("/reads").Handler(c.setHandler(c.ListReads)).Methods("GET")
+	sub.Path(fmt.Sprintf("/messages/{mid:%s}", UUIDPattern)).Handler(c.setHandler(c.EditMessage)).Methods("PATCH")
+	sub.Path(fmt.Sprintf("/messages/{mid:%s}", UUIDPattern)).Handler(c.setHandler(c.DeleteMessage)).Methods("DELETE")
+	sub.Path(fmt.Sprintf("/messages/{mid:%s}/edits", UUIDPattern)).Handler(c.setHandler(c.MessageEdits)).Methods("GET")
+	sub.Path(fmt.Sprintf("/messages/{mid:%s}/reactions", UUIDPattern)).Handler(c.setHandler(c.AddReaction)).Methods("PUT")
+	sub.Path(fmt.Sprintf("/messages/{mid:%s}/reactions", UUIDPattern)).Handler(c.setHandler(c.RemoveReaction)).Methods("DELETE")
+	sub.Path(fmt.Sprintf("/messages/{mid:%s}/thread", UUIDPattern)).Handler(c.setHandler(c.Thread)).Methods("GET")
+	sub.Path("/attachments").Handler(c.setHandler(c.UploadAttachment)).Methods("POST")
+	sub.Path(fmt.Sprintf("/attachments/{aid:%s}", UUIDPattern)).Handler(c.setHandler(c.DownloadAttachment)).Methods("GET")
+	sub.Path(fmt.Sprintf("/attachments/{aid:%s}/thumbnail", UUIDPattern)).Handler(c.setHandler(c.DownloadThumbnail)).Methods("GET")
+
+	return channel
 }
 
 func (c *Channel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -46,10 +109,66 @@ func (c Channel) setHandler(h http.HandlerFunc) http.Handler {
 	return &n
 }
 
+// access is who is acting on the channel of the route and the role of everyone in it
+type access struct {
+	channel string
+	user    string
+	owner   string
+	roles   map[string]structs.Role
+}
+
+// role is the role of the acting user
+func (a *access) role() structs.Role {
+	return a.roles[a.user]
+}
+
+// authorize checks the authenticated user's role in the channel of the route permits the action.
+// The id a payload gives must be the channel of the route and the owner it claims to act as must
+// be the authenticated user.  If the action isn't permitted the error is responded with.
+func (c *Channel) authorize(w http.ResponseWriter, r *http.Request, id, claimed string, action structs.Action) (*access, bool) {
+	var (
+		rw = w.(*ResponseWriter)
+		a  = &access{channel: mux.Vars(r)["cid"]}
+		ok bool
+	)
+
+	if id != "" && id != a.channel {
+		rw.JSON(ErrInvalidChannel, http.StatusBadRequest)
+		return nil, false
+	}
+
+	if a.user, ok = actingUser(r, claimed); !ok {
+		rw.JSON(ErrForbidden, http.StatusForbidden)
+		return nil, false
+	}
+
+	roles, err := c.database.ChannelRoles(a.channel)
+	if err != nil {
+		rw.JSON(err)
+		return nil, false
+	}
+	a.roles = roles
+
+	if !a.role().Permits(action) {
+		rw.JSON(ErrNotPermitted, http.StatusForbidden)
+		return nil, false
+	}
+
+	for member, role := range roles {
+		if role == structs.RoleOwner {
+			a.owner = member
+		}
+	}
+	return a, true
+}
+
+// addChannelPayload is the channel to create.  The owner is the authenticated user, if it's given
+// it must be them.  Channels are public unless they're made private.
 type addChannelPayload struct {
-	Owner   string   `json:"owner"   validate:"required,uuid"`
+	Owner   string   `json:"owner"   validate:"omitempty,uuid"`
 	Name    string   `json:"name"    validate:"required"`
 	Members []string `json:"members" validate:"required,gt=0,dive,uuid"`
+	Private bool     `json:"private"`
 }
 
 // CreateChannel makes a new channel
@@ -63,33 +182,370 @@ func (c *Channel) CreateChannel(w http.ResponseWriter, r *http.Request) {
 		rw.JSON(err)
 		return
 	}
+	owner, ok := actingUser(r, payload.Owner)
+	if !ok {
+		rw.JSON(ErrForbidden, http.StatusForbidden)
+		return
+	}
 	var members = convertUsers(payload.Members)
 
 	var info = &ChannelInfo{
-		Owner:   payload.Owner,
+		Owner:   owner,
 		Name:    payload.Name,
 		Members: members,
+		Private: payload.Private,
 	}
 
 	if err := c.database.CreateChannel(info); err != nil {
 		rw.JSON(err)
 		return
 	}
+	c.hub.Subscribe(info.ID, userIDs(info.Members)...)
+
 	rw.JSON(info, http.StatusCreated)
 }
 
-// Messages get the messages for a given channel
+// Messages gets a page of messages for a given channel, newest first.  The "limit" query param
+// sets the page size and "cursor" takes the "next" value of a previous page to continue from.
+// Only users whose role lets them read the channel may page through it.
 func (c *Channel) Messages(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("not implemented"))
+	var (
+		rw    = w.(*ResponseWriter)
+		query = r.URL.Query()
+		page  = &MessagePage{
+			Channel: mux.Vars(r)["cid"],
+			Cursor:  query.Get("cursor"),
+		}
+	)
+
+	if _, ok := c.authorize(w, r, "", "", structs.ActionRead); !ok {
+		return
+	}
+
+	limit, err := pageLimit(query, defaultMessageLimit, maxMessageLimit)
+	if err != nil {
+		rw.JSON(err, http.StatusBadRequest)
+		return
+	}
+	page.Limit = limit
+
+	if err = c.database.ListMessages(page); err == ErrInvalidCursor {
+		rw.JSON(err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		rw.JSON(err)
+		return
+	}
+	rw.JSON(page)
+}
+
+// Thread gets the message of the route along with a page of its replies, oldest first.  The
+// "limit" query param sets the page size and "cursor" takes the "next" value of a previous page to
+// continue from.  Only users whose role lets them read the channel may read its threads.
+func (c *Channel) Thread(w http.ResponseWriter, r *http.Request) {
+	var (
+		rw    = w.(*ResponseWriter)
+		vars  = mux.Vars(r)
+		query = r.URL.Query()
+		page  = &ThreadPage{
+			Channel: vars["cid"],
+			Root:    vars["mid"],
+			Cursor:  query.Get("cursor"),
+		}
+	)
+
+	if _, ok := c.authorize(w, r, "", "", structs.ActionRead); !ok {
+		return
+	}
+
+	limit, err := pageLimit(query, defaultMessageLimit, maxMessageLimit)
+	if err != nil {
+		rw.JSON(err, http.StatusBadRequest)
+		return
+	}
+	page.Limit = limit
+
+	if err = c.database.ListThread(page); err == ErrInvalidCursor {
+		rw.JSON(err, http.StatusBadRequest)
+		return
+	} else if err == ErrMessageNotFound {
+		rw.JSON(err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		rw.JSON(err)
+		return
+	}
+	rw.JSON(page)
+}
+
+// pageLimit is the "limit" query param, the given limit if there isn't one.  ErrInvalidLimit is
+// returned if it isn't a number from 1 to max.
+func pageLimit(query url.Values, limit, max int) (int, error) {
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > max {
+			return 0, ErrInvalidLimit
+		}
+		limit = n
+	}
+	return limit, nil
+}
+
+// authorizeMessage checks the authenticated user may change the message of the route.  Authors
+// may change their own messages and users whose role lets them manage the channel may change the
+// messages of those ranked below them.  Missing and deleted messages are not found.
+func (c *Channel) authorizeMessage(w http.ResponseWriter, r *http.Request) (*access, *MessageInfo, bool) {
+	var rw = w.(*ResponseWriter)
+
+	a, ok := c.authorize(w, r, "", "", structs.ActionRead)
+	if !ok {
+		return nil, nil, false
+	}
+
+	var message = &MessageInfo{
+		Channel: a.channel,
+		ID:      mux.Vars(r)["mid"],
+	}
+	if err := c.database.GetMessage(message); err == ErrMessageNotFound {
+		rw.JSON(err, http.StatusNotFound)
+		return nil, nil, false
+	} else if err != nil {
+		rw.JSON(err)
+		return nil, nil, false
+	}
+	if message.Deleted {
+		rw.JSON(ErrMessageNotFound, http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	var role = a.role()
+	if message.Owner != a.user && !(role.Permits(structs.ActionManage) && role.Outranks(a.roles[message.Owner])) {
+		rw.JSON(ErrNotPermitted, http.StatusForbidden)
+		return nil, nil, false
+	}
+	return a, message, true
+}
+
+// editMessagePayload is the new body of a message
+type editMessagePayload struct {
+	Body string `json:"body" validate:"required"`
+}
+
+// EditMessage replaces the body of the message of the route keeping the body it replaces in the
+// message's history.  The sockets of the channel are sent an edited frame.
+func (c *Channel) EditMessage(w http.ResponseWriter, r *http.Request) {
+	var (
+		payload = &editMessagePayload{}
+		rw      = w.(*ResponseWriter)
+	)
+
+	if err := ValidateBody(payload, r.Body); err != nil {
+		rw.JSON(err)
+		return
+	}
+	if strings.TrimSpace(payload.Body) == "" {
+		rw.JSON(ErrInvalidBody, http.StatusBadRequest)
+		return
+	}
+
+	a, message, ok := c.authorizeMessage(w, r)
+	if !ok {
+		return
+	}
+
+	message.Body = payload.Body
+	if err := c.database.EditMessage(message, a.user); err == ErrMessageNotFound {
+		rw.JSON(err, http.StatusNotFound)
+		return
+	} else if err == ErrInvalidBody {
+		rw.JSON(err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		rw.JSON(err)
+		return
+	}
+	c.hub.Notify(protocol.TypeEdited, message)
+
+	rw.JSON(message)
+}
+
+// DeleteMessage replaces the message of the route with a tombstone dropping its body and history.
+// The sockets of the channel are sent a deleted frame.
+func (c *Channel) DeleteMessage(w http.ResponseWriter, r *http.Request) {
+	var rw = w.(*ResponseWriter)
+
+	_, message, ok := c.authorizeMessage(w, r)
+	if !ok {
+		return
+	}
+
+	// deleting the message forgets its attachments, their files go once it's gone
+	attachments := message.Attachments
+	if err := c.database.DeleteMessage(message); err == ErrMessageNotFound {
+		rw.JSON(err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		rw.JSON(err)
+		return
+	}
+	c.removeAttachments(attachments)
+	c.hub.Notify(protocol.TypeDeleted, message)
+
+	rw.JSON(message)
+}
+
+// MessageEdits gets the message of the route along with its previous versions, most recent first.
+// Only those who may change a message may read its history.
+func (c *Channel) MessageEdits(w http.ResponseWriter, r *http.Request) {
+	var rw = w.(*ResponseWriter)
+
+	_, message, ok := c.authorizeMessage(w, r)
+	if !ok {
+		return
+	}
+
+	if err := c.database.ListEdits(message); err != nil {
+		rw.JSON(err)
+		return
+	}
+	rw.JSON(message)
+}
+
+// markReadPayload is the last message read
+type markReadPayload struct {
+	Message string `json:"message" validate:"required,uuid"`
+}
+
+// MarkRead moves the authenticated user's read cursor in the channel up to the message.  Cursors
+// only move forward, when one does the sockets of the channel are sent a read frame.
+func (c *Channel) MarkRead(w http.ResponseWriter, r *http.Request) {
+	var (
+		payload = &markReadPayload{}
+		rw      = w.(*ResponseWriter)
+	)
+
+	if err := ValidateBody(payload, r.Body); err != nil {
+		rw.JSON(err)
+		return
+	}
+
+	a, ok := c.authorize(w, r, "", "", structs.ActionRead)
+	if !ok {
+		return
+	}
+
+	var (
+		message = &MessageInfo{Channel: a.channel, ID: payload.Message}
+		read    = &protocol.Read{Message: payload.Message, User: a.user}
+	)
+	moved, err := c.database.MarkRead(message, a.user)
+	if err == ErrMessageNotFound {
+		rw.JSON(err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		rw.JSON(err)
+		return
+	}
+	if moved {
+		c.hub.NotifyRead(a.channel, read)
+	}
+
+	rw.JSON(read)
+}
+
+// ListReads gets the last message each member of the channel has read so clients can show who
+// has seen a message
+func (c *Channel) ListReads(w http.ResponseWriter, r *http.Request) {
+	var rw = w.(*ResponseWriter)
+
+	a, ok := c.authorize(w, r, "", "", structs.ActionRead)
+	if !ok {
+		return
+	}
+
+	var info = &ChannelInfo{ID: a.channel}
+	if err := c.database.ListReads(info); err != nil {
+		rw.JSON(err)
+		return
+	}
+	rw.JSON(info)
+}
+
+// reactionPayload is the emoji to react to a message with
+type reactionPayload struct {
+	Emoji string `json:"emoji" validate:"required"`
+}
+
+// AddReaction reacts to the message of the route with the emoji on behalf of the authenticated
+// user.  Anyone in the channel may react to its messages.  The sockets of the channel are sent a
+// reaction frame.
+func (c *Channel) AddReaction(w http.ResponseWriter, r *http.Request) {
+	c.react(w, r, c.database.AddReaction)
+}
+
+// RemoveReaction takes back the authenticated user's reaction to the message of the route with
+// the emoji.  The sockets of the channel are sent a reaction frame.
+func (c *Channel) RemoveReaction(w http.ResponseWriter, r *http.Request) {
+	c.react(w, r, c.database.RemoveReaction)
+}
+
+// react changes the reactions to the message of the route with change responding with the
+// message's reactions
+func (c *Channel) react(w http.ResponseWriter, r *http.Request, change func(*MessageInfo, string, string) error) {
+	var (
+		payload = &reactionPayload{}
+		rw      = w.(*ResponseWriter)
+	)
+
+	if err := ValidateBody(payload, r.Body); err != nil {
+		rw.JSON(err)
+		return
+	}
+	if !structs.ValidEmoji(payload.Emoji) {
+		rw.JSON(structs.ErrInvalidEmoji, http.StatusBadRequest)
+		return
+	}
+
+	a, ok := c.authorize(w, r, "", "", structs.ActionRead)
+	if !ok {
+		return
+	}
+
+	var message = &MessageInfo{
+		Channel: a.channel,
+		ID:      mux.Vars(r)["mid"],
+	}
+	if err := change(message, a.user, payload.Emoji); err == ErrMessageNotFound {
+		rw.JSON(err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		rw.JSON(err)
+		return
+	}
+
+	var reactions = &structs.Reactions{
+		Message:   message.ID,
+		Reactions: message.Reactions,
+	}
+	if reactions.Reactions == nil {
+		reactions.Reactions = []*structs.Reaction{}
+	}
+	c.hub.NotifyReactions(message.Channel, reactions)
+
+	rw.JSON(reactions)
 }
 
+// addUsersPayload is the users to add to a channel and the role to give them, which defaults to
+// member
 type addUsersPayload struct {
-	ID      string   `json:"id"      validate:"required,uuid"`
-	Owner   string   `json:"owner"   validate:"required,uuid"`
+	ID      string   `json:"id"      validate:"omitempty,uuid"`
+	Owner   string   `json:"owner"   validate:"omitempty,uuid"`
 	Members []string `json:"members" validate:"required,gt=0,dive,uuid"`
+	Role    string   `json:"role"    validate:"omitempty,oneof=guest member admin"`
 }
 
-// AddUsers will add a user to the channel members set
+// AddUsers will add a user to the channel members set.  Admins may add guests and members, only
+// the owner of the channel may add admins.
 func (c *Channel) AddUsers(w http.ResponseWriter, r *http.Request) {
 	var (
 		payload = &addUsersPayload{}
@@ -100,27 +556,64 @@ func (c *Channel) AddUsers(w http.ResponseWriter, r *http.Request) {
 		rw.JSON(err)
 		return
 	}
+	a, ok := c.authorize(w, r, payload.ID, payload.Owner, structs.ActionManage)
+	if !ok {
+		return
+	}
 
-	var members = convertUsers(payload.Members)
+	var role = structs.RoleMember
+	if payload.Role != "" {
+		role = structs.Role(payload.Role)
+	}
+	if !a.role().CanAssign(structs.RoleNone, role) {
+		rw.JSON(ErrNotPermitted, http.StatusForbidden)
+		return
+	}
+
+	var (
+		members = make([]*structs.User, 0, len(payload.Members))
+		added   = make([]string, 0, len(payload.Members))
+		roles   = make(map[string]structs.Role, len(payload.Members))
+	)
+	for _, member := range payload.Members {
+		// users already in the channel keep their role, it's changed through SetRoles
+		if a.roles[member] != structs.RoleNone {
+			continue
+		}
+		members = append(members, &structs.User{ID: member})
+		added = append(added, member)
+		roles[member] = role
+	}
+	if len(members) == 0 {
+		rw.JSON("OK")
+		return
+	}
 
 	var info = &ChannelInfo{
-		ID:      payload.ID,
-		Owner:   payload.Owner,
+		ID:      a.channel,
+		Owner:   a.owner,
 		Members: members,
+		Roles:   roles,
 	}
 
-	if err := c.database.AddUsersToChannel(info); err != nil {
+	if err := c.database.AddUsersToChannel(info); err == ErrChannelNotFound {
+		rw.JSON(err, http.StatusNotFound)
+		return
+	} else if err != nil {
 		rw.JSON(err)
 		return
 	}
+	c.hub.Subscribe(info.ID, added...)
+
 	rw.JSON("OK")
 }
 
 type listUsersPayload struct {
-	ID string `json:"id" validate:"required,uuid"`
+	ID string `json:"id" validate:"omitempty,uuid"`
 }
 
-// ListUsers lists all users in a channel
+// ListUsers lists all users in a channel along with their roles.  Anyone that can read the channel
+// may list its users.
 func (c *Channel) ListUsers(w http.ResponseWriter, r *http.Request) {
 
 	var (
@@ -131,9 +624,13 @@ func (c *Channel) ListUsers(w http.ResponseWriter, r *http.Request) {
 		rw.JSON(err)
 		return
 	}
+	a, ok := c.authorize(w, r, payload.ID, "", structs.ActionRead)
+	if !ok {
+		return
+	}
 
 	var info = &ChannelInfo{
-		ID: payload.ID,
+		ID: a.channel,
 	}
 
 	if err := c.database.ListUsersInChannel(info); err != nil {
@@ -144,12 +641,15 @@ func (c *Channel) ListUsers(w http.ResponseWriter, r *http.Request) {
 }
 
 type deleteUsersPayload struct {
-	ID      string   `json:"id"      validate:"required,uuid"`
-	Owner   string   `json:"owner"   validate:"required,uuid"`
+	ID      string   `json:"id"      validate:"omitempty,uuid"`
+	Owner   string   `json:"owner"   validate:"omitempty,uuid"`
 	Members []string `json:"members" validate:"required,gt=0,dive,uuid"`
 }
 
-// DeleteUsers removes a user from a given channel.  Only the owner of the channel may remove a user
+// DeleteUsers removes a user from a given channel.  Users may only remove those ranked below them,
+// so admins may remove guests and members and the owner may remove anyone but themselves.  Anyone
+// but the owner may remove themselves to leave the channel.  Conversations have no owner and
+// nobody can leave them.
 func (c *Channel) DeleteUsers(w http.ResponseWriter, r *http.Request) {
 	var (
 		payload = &deleteUsersPayload{}
@@ -159,30 +659,294 @@ func (c *Channel) DeleteUsers(w http.ResponseWriter, r *http.Request) {
 		rw.JSON(err)
 		return
 	}
+	a, ok := c.authorize(w, r, payload.ID, payload.Owner, structs.ActionRead)
+	if !ok {
+		return
+	} else if a.owner == "" {
+		rw.JSON(ErrNotPermitted, http.StatusForbidden)
+		return
+	}
+	for _, member := range payload.Members {
+		var (
+			role    = a.roles[member]
+			leaving = member == a.user && role != structs.RoleOwner
+		)
+		if !leaving && !a.role().CanAssign(role, structs.RoleNone) {
+			rw.JSON(ErrNotPermitted, http.StatusForbidden)
+			return
+		}
+	}
+
 	var members = convertUsers(payload.Members)
 	var info = &ChannelInfo{
-		ID:      payload.ID,
-		Owner:   payload.Owner,
+		ID:      a.channel,
+		Owner:   a.owner,
 		Members: members,
 	}
 
-	if err := c.database.DeleteUsersFromChannel(info); err != nil {
+	if err := c.database.DeleteUsersFromChannel(info); err == ErrChannelNotFound {
+		rw.JSON(err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		rw.JSON(err)
+		return
+	}
+	c.hub.Unsubscribe(info.ID, payload.Members...)
+
+	rw.JSON("OK")
+}
+
+type setRolesPayload struct {
+	Roles map[string]string `json:"roles" validate:"required,gt=0"`
+}
+
+// SetRoles changes the roles of users already in the channel.  Users may only give and take away
+// roles ranked below their own, so admins may make members guests and the owner may make admins.
+func (c *Channel) SetRoles(w http.ResponseWriter, r *http.Request) {
+	var (
+		payload = &setRolesPayload{}
+		rw      = w.(*ResponseWriter)
+	)
+	if err := ValidateBody(payload, r.Body); err != nil {
+		rw.JSON(err)
+		return
+	}
+	a, ok := c.authorize(w, r, "", "", structs.ActionManage)
+	if !ok {
+		return
+	}
+
+	var roles = make(map[string]structs.Role, len(payload.Roles))
+	for member, name := range payload.Roles {
+		role, err := structs.ParseRole(name)
+		if err != nil {
+			rw.JSON(err, http.StatusBadRequest)
+			return
+		} else if a.roles[member] == structs.RoleNone {
+			rw.JSON(ErrInvalidMember, http.StatusBadRequest)
+			return
+		} else if !a.role().CanAssign(a.roles[member], role) {
+			rw.JSON(ErrNotPermitted, http.StatusForbidden)
+			return
+		}
+		roles[member] = role
+	}
+
+	var info = &ChannelInfo{
+		ID:    a.channel,
+		Owner: a.owner,
+		Roles: roles,
+	}
+	if err := c.database.SetRoles(info); err == ErrChannelNotFound {
+		rw.JSON(err, http.StatusNotFound)
+		return
+	} else if err != nil {
 		rw.JSON(err)
 		return
 	}
 	rw.JSON("OK")
 }
 
-func convertUsers(users []string) []*UserInfo {
-	var members = make([]*UserInfo, 0, len(users))
+type transferOwnershipPayload struct {
+	User string `json:"user" validate:"required,uuid"`
+}
+
+// TransferOwnership makes another user in the channel its owner.  Only the owner may transfer the
+// channel and they stay on as an admin.
+func (c *Channel) TransferOwnership(w http.ResponseWriter, r *http.Request) {
+	var (
+		payload = &transferOwnershipPayload{}
+		rw      = w.(*ResponseWriter)
+	)
+	if err := ValidateBody(payload, r.Body); err != nil {
+		rw.JSON(err)
+		return
+	}
+	a, ok := c.authorize(w, r, "", "", structs.ActionOwn)
+	if !ok {
+		return
+	}
+	if payload.User == a.user || a.roles[payload.User] == structs.RoleNone {
+		rw.JSON(ErrInvalidMember, http.StatusBadRequest)
+		return
+	}
+
+	var info = &ChannelInfo{
+		ID:    a.channel,
+		Owner: a.owner,
+	}
+	if err := c.database.TransferChannel(info, payload.User); err == ErrChannelNotFound {
+		rw.JSON(err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		rw.JSON(err)
+		return
+	}
+	rw.JSON(info)
+}
+
+// PublicChannels searches the directory of public channels.  The "name" query param matches the
+// start of channel names ignoring case and "limit" sets how many are returned.
+func (c *Channel) PublicChannels(w http.ResponseWriter, r *http.Request) {
+	var (
+		rw        = w.(*ResponseWriter)
+		query     = r.URL.Query()
+		directory = &ChannelDirectory{
+			Name: query.Get("name"),
+		}
+	)
+
+	limit, err := pageLimit(query, defaultDirectoryLimit, maxDirectoryLimit)
+	if err != nil {
+		rw.JSON(err, http.StatusBadRequest)
+		return
+	}
+	directory.Limit = limit
+
+	if err := c.database.ListPublicChannels(directory); err != nil {
+		rw.JSON(err)
+		return
+	}
+	rw.JSON(directory)
+}
+
+// createInvitePayload is how long in seconds the invite lasts, up to 30 days, and how many times it
+// can be redeemed.  By default an invite lasts a day and can be redeemed once.
+type createInvitePayload struct {
+	ExpiresIn int `json:"expiresIn" validate:"omitempty,min=60,max=2592000"`
+	MaxUses   int `json:"maxUses"   validate:"omitempty,min=1,max=1000"`
+}
+
+// CreateInvite makes an invite token that adds whoever redeems it to the channel as a member.
+// Admins and the owner may create invites.
+func (c *Channel) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	var (
+		payload = &createInvitePayload{}
+		rw      = w.(*ResponseWriter)
+	)
+	if err := ValidateBody(payload, r.Body); err != nil {
+		rw.JSON(err)
+		return
+	}
+	a, ok := c.authorize(w, r, "", "", structs.ActionManage)
+	if !ok {
+		return
+	}
+
+	var info = &InviteInfo{
+		Channel:   a.channel,
+		CreatedBy: a.user,
+		Expires:   time.Now().Add(defaultInviteExpiry),
+		MaxUses:   defaultInviteUses,
+	}
+	if payload.ExpiresIn != 0 {
+		info.Expires = time.Now().Add(time.Duration(payload.ExpiresIn) * time.Second)
+	}
+	if payload.MaxUses != 0 {
+		info.MaxUses = payload.MaxUses
+	}
+
+	if err := c.database.CreateInvite(info); err != nil {
+		rw.JSON(err)
+		return
+	}
+	rw.JSON(info, http.StatusCreated)
+}
+
+type joinPayload struct {
+	Invite string `json:"invite" validate:"omitempty,max=64"`
+}
+
+// Join adds the authenticated user to the channel as a member.  Anyone may join a public channel,
+// private channels need an invite which is used up by joining.  Users already in the channel keep
+// their role and don't use up the invite.  Conversations can't be joined.
+func (c *Channel) Join(w http.ResponseWriter, r *http.Request) {
+	var (
+		payload = &joinPayload{}
+		rw      = w.(*ResponseWriter)
+		info    = &ChannelInfo{ID: mux.Vars(r)["cid"]}
+	)
+	if err := ValidateBody(payload, r.Body); err != nil {
+		rw.JSON(err)
+		return
+	}
+	uid, ok := actingUser(r, "")
+	if !ok {
+		rw.JSON(ErrForbidden, http.StatusForbidden)
+		return
+	}
+
+	if err := c.database.GetChannel(info); err == ErrChannelNotFound {
+		rw.JSON(err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		rw.JSON(err)
+		return
+	}
+
+	roles, err := c.database.ChannelRoles(info.ID)
+	if err != nil {
+		rw.JSON(err)
+		return
+	} else if roles[uid] != structs.RoleNone {
+		rw.JSON(info)
+		return
+	} else if info.Kind.IsConversation() {
+		rw.JSON(ErrNotPermitted, http.StatusForbidden)
+		return
+	}
+
+	if info.Private {
+		if payload.Invite == "" {
+			rw.JSON(ErrInviteRequired, http.StatusForbidden)
+			return
+		}
+		invite := &InviteInfo{Token: payload.Invite, Channel: info.ID}
+		if err := c.database.RedeemInvite(invite); err == ErrInvalidInvite {
+			rw.JSON(err, http.StatusForbidden)
+			return
+		} else if err != nil {
+			rw.JSON(err)
+			return
+		}
+	}
+
+	var join = &ChannelInfo{
+		ID:      info.ID,
+		Owner:   info.Owner,
+		Members: []*structs.User{{ID: uid}},
+		Roles:   map[string]structs.Role{uid: structs.RoleMember},
+	}
+	if err := c.database.AddUsersToChannel(join); err == ErrChannelNotFound {
+		rw.JSON(err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		rw.JSON(err)
+		return
+	}
+	c.hub.Subscribe(info.ID, uid)
+
+	rw.JSON(info)
+}
+
+func convertUsers(users []string) []*structs.User {
+	var members = make([]*structs.User, 0, len(users))
 	for _, member := range users {
-		members = append(members, &UserInfo{
+		members = append(members, &structs.User{
 			ID: member,
 		})
 	}
 	return members
 }
 
+func userIDs(users []*structs.User) []string {
+	var ids = make([]string, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	return ids
+}
+
 func convertChannels(channels []string) []*ChannelInfo {
 	var chs = make([]*ChannelInfo, 0, len(channels))
 	for _, channel := range channels {
@@ -2,35 +2,68 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/gocql/gocql"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	. "github.com/onsi/gomega"
+	"github.com/sir-wiggles/chat/api/protocol"
+	"github.com/sir-wiggles/chat/api/structs"
 )
 
 var ttAddChannel = []struct {
-	name string
-	body *bytes.Buffer
-	code int
+	name  string
+	body  *bytes.Buffer
+	token string
+	code  int
 }{
 	{
-		name: "fails with empty body",
-		body: bytes.NewBufferString("{}"),
-		code: http.StatusBadRequest,
+		name:  "fails with empty body",
+		body:  bytes.NewBufferString("{}"),
+		token: "owner-1",
+		code:  http.StatusBadRequest,
 	},
 	{
 		name: "passes with valid fields",
 		body: bytes.NewBufferString(
-			fmt.Sprintf(`{"id": "%s", "owner": "%s", "name": "%s"}`,
+			fmt.Sprintf(`{"id": "%s", "owner": "%s", "name": "%s", "members": ["%s"]}`,
 				UUIDRecal("id-1"),
 				UUIDRecal("owner-1"),
 				"ch-name",
+				UUIDRecal("member-1"),
 			)),
-		code: http.StatusOK,
+		token: "owner-1",
+		code:  http.StatusCreated,
+	},
+	{
+		name: "passes without an owner",
+		body: bytes.NewBufferString(
+			fmt.Sprintf(`{"name": "%s", "members": ["%s"]}`, "ch-name", UUIDRecal("member-1"))),
+		token: "owner-1",
+		code:  http.StatusCreated,
+	},
+	{
+		name: "fails with another user as the owner",
+		body: bytes.NewBufferString(
+			fmt.Sprintf(`{"owner": "%s", "name": "%s", "members": ["%s"]}`,
+				UUIDRecal("owner-2"),
+				"ch-name",
+				UUIDRecal("member-1"),
+			)),
+		token: "owner-1",
+		code:  http.StatusForbidden,
+	},
+	{
+		name: "fails without a token",
+		body: bytes.NewBufferString(
+			fmt.Sprintf(`{"name": "%s", "members": ["%s"]}`, "ch-name", UUIDRecal("member-1"))),
+		code: http.StatusUnauthorized,
 	},
 }
 
@@ -38,13 +71,18 @@ func TestAddChannel(t *testing.T) {
 	for _, tt := range ttAddChannel {
 		t.Run(tt.name, func(t *testing.T) {
 			var (
-				g       = NewGomegaWithT(t)
-				channel = &Channel{}
+				g     = NewGomegaWithT(t)
+				owner string
+				db    = &MockCassandra{CreateChannelFn: func(i *ChannelInfo) error {
+					owner = i.Owner
+					return nil
+				}}
+				channel = &Channel{database: db}
 				router  = mux.NewRouter()
 				handler = channel.Register(router)
 			)
 
-			handler.Use(JSONMiddleWare)
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
 			server := httptest.NewServer(handler)
 			defer server.Close()
 
@@ -52,14 +90,457 @@ func TestAddChannel(t *testing.T) {
 
 			req, err := http.NewRequest(http.MethodPut, url, tt.body)
 			g.Expect(err).ShouldNot(HaveOccurred())
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal(tt.token)))
+			}
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+
+			if tt.code == http.StatusCreated {
+				g.Expect(owner).Should(Equal(UUIDRecal(tt.token)))
+			}
+
+		})
+	}
+
+}
+
+var ttMessages = []struct {
+	name  string
+	query string
+	err   error
+	code  int
+}{
+	{
+		name:  "passes with no query",
+		query: "",
+		code:  http.StatusOK,
+	},
+	{
+		name:  "passes with limit and cursor",
+		query: "?limit=10&cursor=" + EncodeCursor(gocql.TimeUUID()),
+		code:  http.StatusOK,
+	},
+	{
+		name:  "fails with zero limit",
+		query: "?limit=0",
+		code:  http.StatusBadRequest,
+	},
+	{
+		name:  "fails with limit over max",
+		query: fmt.Sprintf("?limit=%d", maxMessageLimit+1),
+		code:  http.StatusBadRequest,
+	},
+	{
+		name:  "fails with non numeric limit",
+		query: "?limit=ten",
+		code:  http.StatusBadRequest,
+	},
+	{
+		name:  "fails with invalid cursor",
+		query: "?cursor=nope",
+		err:   ErrInvalidCursor,
+		code:  http.StatusBadRequest,
+	},
+}
+
+func TestMessages(t *testing.T) {
+	for _, tt := range ttMessages {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g     = NewGomegaWithT(t)
+				dbErr = tt.err
+				db    = &MockCassandra{
+					ChannelRolesFn: func(cid string) (map[string]structs.Role, error) {
+						return map[string]structs.Role{UUIDRecal("member-1"): structs.RoleGuest}, nil
+					},
+					ListMessagesFn: func(p *MessagePage) error {
+						p.Messages = []*MessageInfo{}
+						return dbErr
+					},
+				}
+				channel = &Channel{database: db}
+				router  = mux.NewRouter()
+				handler = channel.Register(router)
+			)
+
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			url := fmt.Sprintf("%s/channel/%s/messages%s", server.URL, UUIDRecal("channel-1"), tt.query)
+
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal("member-1")))
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+		})
+	}
+}
+
+var ttJoinChannel = []struct {
+	name    string
+	channel string
+	body    string
+	user    string
+	redeem  bool
+	joined  bool
+	code    int
+}{
+	{
+		name:    "joins a public channel",
+		channel: "public-1",
+		user:    "new-1",
+		joined:  true,
+		code:    http.StatusOK,
+	},
+	{
+		name:    "members don't join twice",
+		channel: "public-1",
+		user:    "member-1",
+		code:    http.StatusOK,
+	},
+	{
+		name:    "private channel needs an invite",
+		channel: "private-1",
+		user:    "new-1",
+		code:    http.StatusForbidden,
+	},
+	{
+		name:    "joins a private channel with an invite",
+		channel: "private-1",
+		body:    `{"invite": "good"}`,
+		user:    "new-1",
+		redeem:  true,
+		joined:  true,
+		code:    http.StatusOK,
+	},
+	{
+		name:    "fails with a used up invite",
+		channel: "private-1",
+		body:    `{"invite": "used"}`,
+		user:    "new-1",
+		redeem:  true,
+		code:    http.StatusForbidden,
+	},
+	{
+		name:    "members don't use up invites",
+		channel: "private-1",
+		body:    `{"invite": "good"}`,
+		user:    "member-1",
+		code:    http.StatusOK,
+	},
+	{
+		name:    "fails with an unknown channel",
+		channel: "missing-1",
+		user:    "new-1",
+		code:    http.StatusNotFound,
+	},
+}
+
+func TestJoinChannel(t *testing.T) {
+	for _, tt := range ttJoinChannel {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g      = NewGomegaWithT(t)
+				joined *ChannelInfo
+				db     = &MockCassandra{
+					GetChannelFn: func(i *ChannelInfo) error {
+						switch i.ID {
+						case UUIDRecal("public-1"):
+						case UUIDRecal("private-1"):
+							i.Private = true
+						default:
+							return ErrChannelNotFound
+						}
+						i.Owner = UUIDRecal("owner-1")
+						return nil
+					},
+					ChannelRolesFn: func(cid string) (map[string]structs.Role, error) {
+						return map[string]structs.Role{
+							UUIDRecal("owner-1"):  structs.RoleOwner,
+							UUIDRecal("member-1"): structs.RoleMember,
+						}, nil
+					},
+					RedeemInviteFn: func(i *InviteInfo) error {
+						g.Expect(i.Channel).Should(Equal(UUIDRecal(tt.channel)))
+						if i.Token != "good" {
+							return ErrInvalidInvite
+						}
+						return nil
+					},
+					AddUsersToChannelFn: func(i *ChannelInfo) error {
+						joined = i
+						return nil
+					},
+				}
+				channel = &Channel{database: db}
+				handler = channel.Register(mux.NewRouter())
+			)
+
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			url := fmt.Sprintf("%s/channel/%s/join", server.URL, UUIDRecal(tt.channel))
+
+			req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(tt.body))
+			g.Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal(tt.user)))
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+			g.Expect(db.RedeemInviteInvoked).Should(Equal(tt.redeem))
+
+			if !tt.joined {
+				g.Expect(joined).Should(BeNil())
+				return
+			}
+			g.Expect(joined).ShouldNot(BeNil())
+			g.Expect(joined.Owner).Should(Equal(UUIDRecal("owner-1")))
+			g.Expect(userIDs(joined.Members)).Should(Equal([]string{UUIDRecal(tt.user)}))
+			g.Expect(joined.Roles[UUIDRecal(tt.user)]).Should(Equal(structs.RoleMember))
+		})
+	}
+}
+
+var ttCreateInvite = []struct {
+	name    string
+	body    string
+	user    string
+	expires time.Duration
+	uses    int
+	code    int
+}{
+	{
+		name:    "admin creates an invite with the defaults",
+		user:    "admin-1",
+		expires: defaultInviteExpiry,
+		uses:    defaultInviteUses,
+		code:    http.StatusCreated,
+	},
+	{
+		name:    "owner creates an invite",
+		body:    `{"expiresIn": 3600, "maxUses": 10}`,
+		user:    "owner-1",
+		expires: time.Hour,
+		uses:    10,
+		code:    http.StatusCreated,
+	},
+	{
+		name: "member can't create invites",
+		user: "member-1",
+		code: http.StatusForbidden,
+	},
+	{
+		name: "fails with too many uses",
+		body: `{"maxUses": 1001}`,
+		user: "owner-1",
+		code: http.StatusBadRequest,
+	},
+	{
+		name: "fails with too long an expiry",
+		body: `{"expiresIn": 2592001}`,
+		user: "owner-1",
+		code: http.StatusBadRequest,
+	},
+}
+
+func TestCreateInvite(t *testing.T) {
+	for _, tt := range ttCreateInvite {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g       = NewGomegaWithT(t)
+				created *InviteInfo
+				db      = &MockCassandra{
+					ChannelRolesFn: func(cid string) (map[string]structs.Role, error) {
+						return map[string]structs.Role{
+							UUIDRecal("owner-1"):  structs.RoleOwner,
+							UUIDRecal("admin-1"):  structs.RoleAdmin,
+							UUIDRecal("member-1"): structs.RoleMember,
+						}, nil
+					},
+					CreateInviteFn: func(i *InviteInfo) error {
+						created = i
+						i.Token = "token"
+						return nil
+					},
+				}
+				channel = &Channel{database: db}
+				handler = channel.Register(mux.NewRouter())
+			)
+
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			url := fmt.Sprintf("%s/channel/%s/invites", server.URL, UUIDRecal("channel-1"))
+
+			req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(tt.body))
+			g.Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal(tt.user)))
 
 			rsp, err := http.DefaultClient.Do(req)
 			g.Expect(err).ShouldNot(HaveOccurred())
 			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
 
+			if tt.code != http.StatusCreated {
+				g.Expect(created).Should(BeNil())
+				return
+			}
+			g.Expect(created.Channel).Should(Equal(UUIDRecal("channel-1")))
+			g.Expect(created.CreatedBy).Should(Equal(UUIDRecal(tt.user)))
+			g.Expect(created.MaxUses).Should(Equal(tt.uses))
+			g.Expect(created.Expires).Should(BeTemporally("~", time.Now().Add(tt.expires), time.Minute))
+
+			var body InviteInfo
+			g.Expect(json.NewDecoder(rsp.Body).Decode(&body)).Should(Succeed())
+			g.Expect(body.Token).Should(Equal("token"))
 		})
 	}
+}
 
+var ttPublicChannels = []struct {
+	name  string
+	query string
+	match string
+	limit int
+	code  int
+}{
+	{
+		name:  "lists every public channel",
+		limit: defaultDirectoryLimit,
+		code:  http.StatusOK,
+	},
+	{
+		name:  "searches by name",
+		query: "?name=Gen&limit=10",
+		match: "Gen",
+		limit: 10,
+		code:  http.StatusOK,
+	},
+	{
+		name:  "fails with limit over max",
+		query: fmt.Sprintf("?limit=%d", maxDirectoryLimit+1),
+		code:  http.StatusBadRequest,
+	},
+}
+
+func TestPublicChannels(t *testing.T) {
+	for _, tt := range ttPublicChannels {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g      = NewGomegaWithT(t)
+				search *ChannelDirectory
+				db     = &MockCassandra{
+					ListPublicChannelsFn: func(d *ChannelDirectory) error {
+						search = d
+						d.Channels = []*ChannelInfo{}
+						return nil
+					},
+				}
+				channel = &Channel{database: db}
+				router  = mux.NewRouter()
+			)
+
+			channel.Register(router)
+			router.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(router)
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/channels/public"+tt.query, nil)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal("member-1")))
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+
+			if tt.code != http.StatusOK {
+				g.Expect(search).Should(BeNil())
+				return
+			}
+			g.Expect(search.Name).Should(Equal(tt.match))
+			g.Expect(search.Limit).Should(Equal(tt.limit))
+		})
+	}
+}
+
+var ttThread = []struct {
+	name  string
+	query string
+	err   error
+	code  int
+}{
+	{
+		name: "passes with no query",
+		code: http.StatusOK,
+	},
+	{
+		name:  "passes with limit and cursor",
+		query: "?limit=10&cursor=" + EncodeCursor(gocql.TimeUUID()),
+		code:  http.StatusOK,
+	},
+	{
+		name:  "fails with limit over max",
+		query: fmt.Sprintf("?limit=%d", maxMessageLimit+1),
+		code:  http.StatusBadRequest,
+	},
+	{
+		name: "fails with a message that isn't in the channel",
+		err:  ErrMessageNotFound,
+		code: http.StatusNotFound,
+	},
+}
+
+func TestThread(t *testing.T) {
+	for _, tt := range ttThread {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g     = NewGomegaWithT(t)
+				root  = gocql.TimeUUID().String()
+				dbErr = tt.err
+				page  *ThreadPage
+				db    = &MockCassandra{
+					ChannelRolesFn: func(cid string) (map[string]structs.Role, error) {
+						return map[string]structs.Role{UUIDRecal("member-1"): structs.RoleGuest}, nil
+					},
+					ListThreadFn: func(p *ThreadPage) error {
+						page = p
+						p.Messages = []*MessageInfo{}
+						return dbErr
+					},
+				}
+				channel = &Channel{database: db}
+				handler = channel.Register(mux.NewRouter())
+			)
+
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			url := fmt.Sprintf("%s/channel/%s/messages/%s/thread%s", server.URL, UUIDRecal("channel-1"), root, tt.query)
+
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal("member-1")))
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+
+			if tt.code != http.StatusBadRequest {
+				g.Expect(page.Channel).Should(Equal(UUIDRecal("channel-1")))
+				g.Expect(page.Root).Should(Equal(root))
+			}
+		})
+	}
 }
 
 var _uuids = map[string]string{}
@@ -80,3 +561,695 @@ func UUIDRecal(keys ...string) string {
 
 	return _uuids[key]
 }
+
+var ttChannelRoles = []struct {
+	name   string
+	method string
+	path   string
+	body   string
+	user   string
+	moved  bool
+	code   int
+}{
+	{
+		name:   "admin adds a member",
+		method: http.MethodPut,
+		path:   "users",
+		body:   fmt.Sprintf(`{"members": ["%s"]}`, UUIDRecal("new-1")),
+		user:   "admin-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "admin can't add an admin",
+		method: http.MethodPut,
+		path:   "users",
+		body:   fmt.Sprintf(`{"members": ["%s"], "role": "admin"}`, UUIDRecal("new-1")),
+		user:   "admin-1",
+		code:   http.StatusForbidden,
+	},
+	{
+		name:   "owner adds an admin",
+		method: http.MethodPut,
+		path:   "users",
+		body:   fmt.Sprintf(`{"members": ["%s"], "role": "admin"}`, UUIDRecal("new-1")),
+		user:   "owner-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "member can't add users",
+		method: http.MethodPut,
+		path:   "users",
+		body:   fmt.Sprintf(`{"members": ["%s"]}`, UUIDRecal("new-1")),
+		user:   "member-1",
+		code:   http.StatusForbidden,
+	},
+	{
+		name:   "outsider can't list users",
+		method: http.MethodGet,
+		path:   "users",
+		user:   "new-1",
+		code:   http.StatusForbidden,
+	},
+	{
+		name:   "guest lists users",
+		method: http.MethodGet,
+		path:   "users",
+		user:   "guest-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "body naming another channel",
+		method: http.MethodGet,
+		path:   "users",
+		body:   fmt.Sprintf(`{"id": "%s"}`, UUIDRecal("channel-2")),
+		user:   "guest-1",
+		code:   http.StatusBadRequest,
+	},
+	{
+		name:   "admin removes a member",
+		method: http.MethodDelete,
+		path:   "users",
+		body:   fmt.Sprintf(`{"members": ["%s"]}`, UUIDRecal("member-1")),
+		user:   "admin-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "admin can't remove the owner",
+		method: http.MethodDelete,
+		path:   "users",
+		body:   fmt.Sprintf(`{"members": ["%s"]}`, UUIDRecal("owner-1")),
+		user:   "admin-1",
+		code:   http.StatusForbidden,
+	},
+	{
+		name:   "guest leaves",
+		method: http.MethodDelete,
+		path:   "users",
+		body:   fmt.Sprintf(`{"members": ["%s"]}`, UUIDRecal("guest-1")),
+		user:   "guest-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "owner can't leave",
+		method: http.MethodDelete,
+		path:   "users",
+		body:   fmt.Sprintf(`{"members": ["%s"]}`, UUIDRecal("owner-1")),
+		user:   "owner-1",
+		code:   http.StatusForbidden,
+	},
+	{
+		name:   "admin makes a member a guest",
+		method: http.MethodPut,
+		path:   "roles",
+		body:   fmt.Sprintf(`{"roles": {"%s": "guest"}}`, UUIDRecal("member-1")),
+		user:   "admin-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "admin can't make a member an admin",
+		method: http.MethodPut,
+		path:   "roles",
+		body:   fmt.Sprintf(`{"roles": {"%s": "admin"}}`, UUIDRecal("member-1")),
+		user:   "admin-1",
+		code:   http.StatusForbidden,
+	},
+	{
+		name:   "owner demotes an admin",
+		method: http.MethodPut,
+		path:   "roles",
+		body:   fmt.Sprintf(`{"roles": {"%s": "member"}}`, UUIDRecal("admin-1")),
+		user:   "owner-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "roles of users outside the channel",
+		method: http.MethodPut,
+		path:   "roles",
+		body:   fmt.Sprintf(`{"roles": {"%s": "member"}}`, UUIDRecal("new-1")),
+		user:   "owner-1",
+		code:   http.StatusBadRequest,
+	},
+	{
+		name:   "owner role can't be given",
+		method: http.MethodPut,
+		path:   "roles",
+		body:   fmt.Sprintf(`{"roles": {"%s": "owner"}}`, UUIDRecal("admin-1")),
+		user:   "owner-1",
+		code:   http.StatusBadRequest,
+	},
+	{
+		name:   "owner transfers the channel",
+		method: http.MethodPut,
+		path:   "owner",
+		body:   fmt.Sprintf(`{"user": "%s"}`, UUIDRecal("member-1")),
+		user:   "owner-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "admin can't transfer the channel",
+		method: http.MethodPut,
+		path:   "owner",
+		body:   fmt.Sprintf(`{"user": "%s"}`, UUIDRecal("admin-1")),
+		user:   "admin-1",
+		code:   http.StatusForbidden,
+	},
+	{
+		name:   "channel can't be transferred outside it",
+		method: http.MethodPut,
+		path:   "owner",
+		body:   fmt.Sprintf(`{"user": "%s"}`, UUIDRecal("new-1")),
+		user:   "owner-1",
+		code:   http.StatusBadRequest,
+	},
+	{
+		name:   "adding to a channel transferred since its roles were read fails",
+		method: http.MethodPut,
+		path:   "users",
+		body:   fmt.Sprintf(`{"members": ["%s"]}`, UUIDRecal("new-1")),
+		user:   "admin-1",
+		moved:  true,
+		code:   http.StatusNotFound,
+	},
+	{
+		name:   "removing from a channel transferred since its roles were read fails",
+		method: http.MethodDelete,
+		path:   "users",
+		body:   fmt.Sprintf(`{"members": ["%s"]}`, UUIDRecal("member-1")),
+		user:   "admin-1",
+		moved:  true,
+		code:   http.StatusNotFound,
+	},
+	{
+		name:   "setting roles in a channel transferred since its roles were read fails",
+		method: http.MethodPut,
+		path:   "roles",
+		body:   fmt.Sprintf(`{"roles": {"%s": "guest"}}`, UUIDRecal("member-1")),
+		user:   "admin-1",
+		moved:  true,
+		code:   http.StatusNotFound,
+	},
+}
+
+func TestChannelRoles(t *testing.T) {
+	for _, tt := range ttChannelRoles {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g     = NewGomegaWithT(t)
+				owner string
+				saved = func(i *ChannelInfo) error {
+					if tt.moved {
+						return ErrChannelNotFound
+					}
+					owner = i.Owner
+					return nil
+				}
+				db = &MockCassandra{
+					ChannelRolesFn: func(cid string) (map[string]structs.Role, error) {
+						if cid != UUIDRecal("channel-1") {
+							return map[string]structs.Role{}, nil
+						}
+						return map[string]structs.Role{
+							UUIDRecal("owner-1"):  structs.RoleOwner,
+							UUIDRecal("admin-1"):  structs.RoleAdmin,
+							UUIDRecal("member-1"): structs.RoleMember,
+							UUIDRecal("guest-1"):  structs.RoleGuest,
+						}, nil
+					},
+					AddUsersToChannelFn:      saved,
+					DeleteUsersFromChannelFn: saved,
+					ListUsersInChannelFn:     saved,
+					SetRolesFn:               saved,
+					TransferChannelFn: func(i *ChannelInfo, to string) error {
+						owner = i.Owner
+						i.Owner = to
+						return nil
+					},
+				}
+				channel = &Channel{database: db}
+				handler = channel.Register(mux.NewRouter())
+			)
+
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			url := fmt.Sprintf("%s/channel/%s/%s", server.URL, UUIDRecal("channel-1"), tt.path)
+
+			req, err := http.NewRequest(tt.method, url, bytes.NewBufferString(tt.body))
+			g.Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal(tt.user)))
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+
+			// changes are always made to the channel under its owner, whoever made them
+			if tt.code == http.StatusOK && tt.method != http.MethodGet {
+				g.Expect(owner).Should(Equal(UUIDRecal("owner-1")))
+			} else if tt.code != http.StatusOK {
+				g.Expect(owner).Should(BeEmpty())
+			}
+		})
+	}
+}
+
+var ttChangeMessage = []struct {
+	name   string
+	method string
+	body   string
+	author string
+	user   string
+	code   int
+}{
+	{
+		name:   "author edits",
+		method: http.MethodPatch,
+		body:   `{"body": "fixed"}`,
+		author: "member-1",
+		user:   "member-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "edit without a body",
+		method: http.MethodPatch,
+		body:   `{"body": "  "}`,
+		author: "member-1",
+		user:   "member-1",
+		code:   http.StatusBadRequest,
+	},
+	{
+		name:   "member can't edit another member",
+		method: http.MethodPatch,
+		body:   `{"body": "fixed"}`,
+		author: "member-2",
+		user:   "member-1",
+		code:   http.StatusForbidden,
+	},
+	{
+		name:   "admin edits a member",
+		method: http.MethodPatch,
+		body:   `{"body": "fixed"}`,
+		author: "member-1",
+		user:   "admin-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "author deletes",
+		method: http.MethodDelete,
+		author: "member-1",
+		user:   "member-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "admin deletes a member that left",
+		method: http.MethodDelete,
+		author: "new-1",
+		user:   "admin-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "admin can't delete the owner",
+		method: http.MethodDelete,
+		author: "owner-1",
+		user:   "admin-1",
+		code:   http.StatusForbidden,
+	},
+	{
+		name:   "owner deletes an admin",
+		method: http.MethodDelete,
+		author: "admin-1",
+		user:   "owner-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "outsider can't delete",
+		method: http.MethodDelete,
+		author: "new-1",
+		user:   "new-1",
+		code:   http.StatusForbidden,
+	},
+	{
+		name:   "deleted message",
+		method: http.MethodDelete,
+		author: "",
+		user:   "owner-1",
+		code:   http.StatusNotFound,
+	},
+}
+
+func TestChangeMessage(t *testing.T) {
+	for _, tt := range ttChangeMessage {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g       = NewGomegaWithT(t)
+				mid     = gocql.TimeUUID().String()
+				changed *MessageInfo
+				editor  string
+				db      = &MockCassandra{
+					ChannelRolesFn: func(cid string) (map[string]structs.Role, error) {
+						return map[string]structs.Role{
+							UUIDRecal("owner-1"):  structs.RoleOwner,
+							UUIDRecal("admin-1"):  structs.RoleAdmin,
+							UUIDRecal("member-1"): structs.RoleMember,
+							UUIDRecal("member-2"): structs.RoleMember,
+						}, nil
+					},
+					GetMessageFn: func(i *MessageInfo) error {
+						i.Body = "typo"
+						if tt.author == "" {
+							i.Body, i.Deleted = "", true
+						} else {
+							i.Owner = UUIDRecal(tt.author)
+						}
+						return nil
+					},
+					EditMessageFn: func(i *MessageInfo, by string) error {
+						changed, editor = i, by
+						return nil
+					},
+					DeleteMessageFn: func(i *MessageInfo) error {
+						changed = i
+						i.Body, i.Deleted = "", true
+						return nil
+					},
+				}
+				channel = &Channel{database: db}
+				handler = channel.Register(mux.NewRouter())
+			)
+
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			url := fmt.Sprintf("%s/channel/%s/messages/%s", server.URL, UUIDRecal("channel-1"), mid)
+
+			req, err := http.NewRequest(tt.method, url, bytes.NewBufferString(tt.body))
+			g.Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal(tt.user)))
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+
+			if tt.code != http.StatusOK {
+				g.Expect(changed).Should(BeNil())
+				return
+			}
+			g.Expect(changed.Channel).Should(Equal(UUIDRecal("channel-1")))
+			g.Expect(changed.ID).Should(Equal(mid))
+			if tt.method == http.MethodPatch {
+				g.Expect(changed.Body).Should(Equal("fixed"))
+				g.Expect(editor).Should(Equal(UUIDRecal(tt.user)))
+			}
+		})
+	}
+}
+
+var ttReactions = []struct {
+	name   string
+	method string
+	body   string
+	user   string
+	err    error
+	code   int
+}{
+	{
+		name:   "member reacts",
+		method: http.MethodPut,
+		body:   `{"emoji": "👍"}`,
+		user:   "member-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "guest reacts",
+		method: http.MethodPut,
+		body:   `{"emoji": ":tada:"}`,
+		user:   "guest-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "member takes back a reaction",
+		method: http.MethodDelete,
+		body:   `{"emoji": "👍"}`,
+		user:   "member-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "outsider can't react",
+		method: http.MethodPut,
+		body:   `{"emoji": "👍"}`,
+		user:   "new-1",
+		code:   http.StatusForbidden,
+	},
+	{
+		name:   "not an emoji",
+		method: http.MethodPut,
+		body:   `{"emoji": "thumbs up"}`,
+		user:   "member-1",
+		code:   http.StatusBadRequest,
+	},
+	{
+		name:   "deleted message",
+		method: http.MethodPut,
+		body:   `{"emoji": "👍"}`,
+		user:   "member-1",
+		err:    ErrMessageNotFound,
+		code:   http.StatusNotFound,
+	},
+}
+
+func TestReactions(t *testing.T) {
+	for _, tt := range ttReactions {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g       = NewGomegaWithT(t)
+				mid     = gocql.TimeUUID().String()
+				users   = map[string]bool{UUIDRecal("member-2"): true}
+				dbErr   = tt.err
+				changed *MessageInfo
+				react   = func(add bool) func(*MessageInfo, string, string) error {
+					return func(i *MessageInfo, user, emoji string) error {
+						if dbErr != nil {
+							return dbErr
+						}
+						changed = i
+						users[user] = add
+						reaction := &structs.Reaction{Emoji: emoji, Users: []string{}}
+						for user, reacted := range users {
+							if reacted {
+								reaction.Users = append(reaction.Users, user)
+							}
+						}
+						reaction.Count = len(reaction.Users)
+						i.Reactions = []*structs.Reaction{reaction}
+						return nil
+					}
+				}
+				db = &MockCassandra{
+					ChannelRolesFn: func(cid string) (map[string]structs.Role, error) {
+						return map[string]structs.Role{
+							UUIDRecal("owner-1"):  structs.RoleOwner,
+							UUIDRecal("member-1"): structs.RoleMember,
+							UUIDRecal("member-2"): structs.RoleMember,
+							UUIDRecal("guest-1"):  structs.RoleGuest,
+						}, nil
+					},
+					AddReactionFn:    react(true),
+					RemoveReactionFn: react(false),
+				}
+				channel = &Channel{database: db}
+				handler = channel.Register(mux.NewRouter())
+			)
+
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			url := fmt.Sprintf("%s/channel/%s/messages/%s/reactions", server.URL, UUIDRecal("channel-1"), mid)
+
+			req, err := http.NewRequest(tt.method, url, bytes.NewBufferString(tt.body))
+			g.Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal(tt.user)))
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+
+			if tt.code != http.StatusOK {
+				g.Expect(changed).Should(BeNil())
+				return
+			}
+			g.Expect(changed.Channel).Should(Equal(UUIDRecal("channel-1")))
+			g.Expect(changed.ID).Should(Equal(mid))
+
+			reactions := &structs.Reactions{}
+			g.Expect(json.NewDecoder(rsp.Body).Decode(reactions)).Should(Succeed())
+			g.Expect(reactions.Message).Should(Equal(mid))
+			g.Expect(reactions.Reactions).Should(HaveLen(1))
+
+			if tt.method == http.MethodPut {
+				g.Expect(reactions.Reactions[0].Users).Should(ContainElement(UUIDRecal(tt.user)))
+				g.Expect(reactions.Reactions[0].Count).Should(Equal(2))
+			} else {
+				g.Expect(reactions.Reactions[0].Users).ShouldNot(ContainElement(UUIDRecal(tt.user)))
+				g.Expect(reactions.Reactions[0].Count).Should(Equal(1))
+			}
+		})
+	}
+}
+
+var ttReadCursor = []struct {
+	name     string
+	method   string
+	path     string
+	body     string
+	user     string
+	err      error
+	moved    bool
+	code     int
+	marked   bool
+	notified bool
+}{
+	{
+		name:     "member reads up to a message",
+		method:   http.MethodPut,
+		path:     "read",
+		body:     `{"message": "%s"}`,
+		user:     "member-1",
+		moved:    true,
+		code:     http.StatusOK,
+		marked:   true,
+		notified: true,
+	},
+	{
+		name:   "guest rereads an older message",
+		method: http.MethodPut,
+		path:   "read",
+		body:   `{"message": "%s"}`,
+		user:   "guest-1",
+		code:   http.StatusOK,
+		marked: true,
+	},
+	{
+		name:   "outsider can't mark the channel read",
+		method: http.MethodPut,
+		path:   "read",
+		body:   `{"message": "%s"}`,
+		user:   "new-1",
+		code:   http.StatusForbidden,
+	},
+	{
+		name:   "not a message id",
+		method: http.MethodPut,
+		path:   "read",
+		body:   `{"message": "latest"}`,
+		user:   "member-1",
+		code:   http.StatusBadRequest,
+	},
+	{
+		name:   "unknown message",
+		method: http.MethodPut,
+		path:   "read",
+		body:   `{"message": "%s"}`,
+		user:   "member-1",
+		err:    ErrMessageNotFound,
+		code:   http.StatusNotFound,
+		marked: true,
+	},
+	{
+		name:   "member lists reads",
+		method: http.MethodGet,
+		path:   "reads",
+		user:   "member-1",
+		code:   http.StatusOK,
+	},
+	{
+		name:   "outsider can't list reads",
+		method: http.MethodGet,
+		path:   "reads",
+		user:   "new-1",
+		code:   http.StatusForbidden,
+	},
+}
+
+func TestReadCursor(t *testing.T) {
+	for _, tt := range ttReadCursor {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g      = NewGomegaWithT(t)
+				mid    = gocql.TimeUUID().String()
+				marked *MessageInfo
+				reader string
+				db     = &MockCassandra{
+					ChannelRolesFn: func(cid string) (map[string]structs.Role, error) {
+						return map[string]structs.Role{
+							UUIDRecal("owner-1"):  structs.RoleOwner,
+							UUIDRecal("member-1"): structs.RoleMember,
+							UUIDRecal("guest-1"):  structs.RoleGuest,
+						}, nil
+					},
+					MarkReadFn: func(i *MessageInfo, user string) (bool, error) {
+						marked, reader = i, user
+						return tt.moved, tt.err
+					},
+					ListReadsFn: func(i *ChannelInfo) error {
+						i.Reads = map[string]string{UUIDRecal("owner-1"): mid}
+						return nil
+					},
+				}
+				hub     = &Hub{notify: make(chan *protocol.Envelope, hubNotifyBufferSize)}
+				channel = &Channel{database: db, hub: hub}
+				handler = channel.Register(mux.NewRouter())
+			)
+
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			url := fmt.Sprintf("%s/channel/%s/%s", server.URL, UUIDRecal("channel-1"), tt.path)
+			body := tt.body
+			if body != "" {
+				body = fmt.Sprintf(body, mid)
+			}
+
+			req, err := http.NewRequest(tt.method, url, bytes.NewBufferString(body))
+			g.Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal(tt.user)))
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+
+			if tt.marked {
+				g.Expect(marked.Channel).Should(Equal(UUIDRecal("channel-1")))
+				g.Expect(marked.ID).Should(Equal(mid))
+				g.Expect(reader).Should(Equal(UUIDRecal(tt.user)))
+			} else {
+				g.Expect(db.MarkReadInvoked).Should(BeFalse())
+			}
+
+			if tt.notified {
+				var envelope *protocol.Envelope
+				g.Eventually(hub.notify).Should(Receive(&envelope))
+				g.Expect(envelope.Type).Should(Equal(protocol.TypeRead))
+				g.Expect(envelope.Channel).Should(Equal(UUIDRecal("channel-1")))
+			} else {
+				g.Consistently(hub.notify, 50*time.Millisecond).ShouldNot(Receive())
+			}
+
+			if tt.code != http.StatusOK {
+				return
+			}
+			if tt.method == http.MethodGet {
+				info := &ChannelInfo{}
+				g.Expect(json.NewDecoder(rsp.Body).Decode(info)).Should(Succeed())
+				g.Expect(info.Reads).Should(HaveKeyWithValue(UUIDRecal("owner-1"), mid))
+				return
+			}
+			read := &protocol.Read{}
+			g.Expect(json.NewDecoder(rsp.Body).Decode(read)).Should(Succeed())
+			g.Expect(read.Message).Should(Equal(mid))
+			g.Expect(read.User).Should(Equal(UUIDRecal(tt.user)))
+		})
+	}
+}
@@ -3,17 +3,52 @@ package main
 import (
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/sir-wiggles/chat/api/structs"
 )
 
+var upgrader = websocket.Upgrader{
+	CheckOrigin: checkOrigin,
+}
+
+// checkOrigin lets pages served from the same host or from one of the CORS_ALLOWED_ORIGINS open a
+// socket, so other sites can't open one with the user's credentials.  Requests without an origin
+// don't come from a browser.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range corsAllowedOrigins {
+		if strings.EqualFold(strings.TrimRight(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
 // Chatter is the main chat application
 type Chatter struct {
-	Handler http.HandlerFunc
+	Handler  http.HandlerFunc
+	database DatabaseController
+	hub      *Hub
 }
 
-// Register initializes the given router with chatter related operations
-func (c *Chatter) Register(router *mux.Router) {
+// Register initializes the given router with chatter related operations returning the sub router
+func (c *Chatter) Register(router *mux.Router) *mux.Router {
 
 	// This line will prevent middleware from being used if channter is registered first
 	sub := router.NewRoute().PathPrefix("/test").Subrouter()
@@ -21,6 +56,8 @@ func (c *Chatter) Register(router *mux.Router) {
 	sub.Path("/ws").Handler(c.setHandler(c.WebSocket)).Methods("GET")
 	sub.Path("/status").Handler(c.setHandler(c.Status)).Methods("GET")
 	sub.Path("/test").Handler(c.setHandler(c.Test)).Methods("POST", "GET")
+
+	return sub
 }
 
 func (c *Chatter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -33,9 +70,39 @@ func (c Chatter) setHandler(h http.HandlerFunc) http.Handler {
 	return &n
 }
 
-// WebSocket handles upgrading the websocket connection and registering the client to chatter
+// WebSocket handles upgrading the websocket connection and registering the client to chatter.
+// The socket is subscribed to every channel that the authenticated user is a member of.  The
+// "user" query param may still be given but it must be the authenticated user.
 func (c *Chatter) WebSocket(w http.ResponseWriter, r *http.Request) {
+	var rw = w.(*ResponseWriter)
+
+	uid, ok := actingUser(r, r.URL.Query().Get("user"))
+	if !ok {
+		rw.JSON(ErrForbidden, http.StatusForbidden)
+		return
+	}
+	var user = &UserInfo{User: structs.User{ID: uid}}
+
+	if err := c.database.ListUserChannels(user); err != nil {
+		rw.JSON(err)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Upgrade error: %s", err)
+		return
+	}
+
+	// the server read and write timeouts are still set on the hijacked connection
+	conn.UnderlyingConn().SetDeadline(time.Time{})
+
+	channels := make([]string, 0, len(user.Channels))
+	for _, channel := range user.Channels {
+		channels = append(channels, channel.ID)
+	}
 
+	NewSocket(c.hub, conn, user.ID, channels).Start()
 }
 
 type testPayload struct {
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+// DirectMessage handles the conversations between users that aren't named channels
+type DirectMessage struct {
+	Handler  http.HandlerFunc
+	database DatabaseController
+	hub      *Hub
+}
+
+// Register initializes the given router with direct message related routes returning the sub
+// router
+func (c *DirectMessage) Register(router *mux.Router) *mux.Router {
+	/*
+	 *GET    /dm                -- Get the conversations of the authenticated user
+	 *PUT    /dm                -- Get or start a group conversation
+	 *PUT    /dm/{user_id}      -- Get or start a conversation with another user
+	 */
+	sub := router.NewRoute().PathPrefix("/dm").Subrouter()
+	sub.Path("/").Handler(c.setHandler(c.ListConversations)).Methods("GET")
+	sub.Path("/").Handler(c.setHandler(c.Group)).Methods("PUT")
+	sub.Path(fmt.Sprintf("/{uid:%s}", UUIDPattern)).Handler(c.setHandler(c.Direct)).Methods("PUT")
+
+	return sub
+}
+
+func (c *DirectMessage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.Handler(w, r)
+}
+
+func (c DirectMessage) setHandler(h http.HandlerFunc) http.Handler {
+	n := c
+	n.Handler = h
+	return &n
+}
+
+// Direct returns the conversation between the authenticated user and the user in the route,
+// starting it if they haven't talked before
+func (c *DirectMessage) Direct(w http.ResponseWriter, r *http.Request) {
+	var rw = w.(*ResponseWriter)
+
+	uid, ok := actingUser(r, "")
+	if !ok {
+		rw.JSON(ErrForbidden, http.StatusForbidden)
+		return
+	}
+
+	other := mux.Vars(r)["uid"]
+	if other == uid {
+		rw.JSON(ErrInvalidMember, http.StatusBadRequest)
+		return
+	}
+
+	c.conversation(rw, uid, other)
+}
+
+type groupPayload struct {
+	Members []string `json:"members" validate:"required,gt=0,max=8,dive,uuid"`
+}
+
+// Group returns the conversation between the authenticated user and the members, starting it if
+// they haven't talked before.  A group has three to eight users including the authenticated user.
+func (c *DirectMessage) Group(w http.ResponseWriter, r *http.Request) {
+	var (
+		payload = &groupPayload{}
+		rw      = w.(*ResponseWriter)
+	)
+	if err := ValidateBody(payload, r.Body); err != nil {
+		rw.JSON(err)
+		return
+	}
+	uid, ok := actingUser(r, "")
+	if !ok {
+		rw.JSON(ErrForbidden, http.StatusForbidden)
+		return
+	}
+
+	var members = map[string]bool{uid: true}
+	for _, member := range payload.Members {
+		members[member] = true
+	}
+	if len(members) < minGroupMembers || len(members) > maxGroupMembers {
+		rw.JSON(ErrInvalidMembersLen, http.StatusBadRequest)
+		return
+	}
+
+	c.conversation(rw, append(payload.Members, uid)...)
+}
+
+// conversation responds with the conversation between the users subscribing them to it when it's
+// new
+func (c *DirectMessage) conversation(rw *ResponseWriter, users ...string) {
+	var info = &ChannelInfo{
+		Members: convertUsers(users),
+	}
+
+	created, err := c.database.CreateConversation(info)
+	if err == ErrInvalidMembersLen || err == ErrInvalidMember {
+		rw.JSON(err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		rw.JSON(err)
+		return
+	}
+
+	if !created {
+		rw.JSON(info)
+		return
+	}
+	c.hub.Subscribe(info.ID, userIDs(info.Members)...)
+
+	rw.JSON(info, http.StatusCreated)
+}
+
+// ListConversations lists the direct and group conversations of the authenticated user.  Named
+// channels are listed by the user routes.
+func (c *DirectMessage) ListConversations(w http.ResponseWriter, r *http.Request) {
+	var rw = w.(*ResponseWriter)
+
+	uid, ok := actingUser(r, "")
+	if !ok {
+		rw.JSON(ErrForbidden, http.StatusForbidden)
+		return
+	}
+
+	var info = &UserInfo{
+		User: structs.User{ID: uid},
+	}
+
+	if err := c.database.ListConversations(info); err != nil {
+		rw.JSON(err)
+		return
+	}
+	rw.JSON(info)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	. "github.com/onsi/gomega"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+var ttConversation = []struct {
+	name    string
+	path    string
+	body    string
+	members []string
+	exists  bool
+	code    int
+}{
+	{
+		name:    "starts a direct message",
+		path:    UUIDRecal("bob"),
+		members: []string{"alice", "bob"},
+		code:    http.StatusCreated,
+	},
+	{
+		name:    "returns the existing direct message",
+		path:    UUIDRecal("bob"),
+		members: []string{"alice", "bob"},
+		exists:  true,
+		code:    http.StatusOK,
+	},
+	{
+		name: "fails to message yourself",
+		path: UUIDRecal("alice"),
+		code: http.StatusBadRequest,
+	},
+	{
+		name:    "starts a group",
+		body:    fmt.Sprintf(`{"members": ["%s", "%s"]}`, UUIDRecal("bob"), UUIDRecal("carol")),
+		members: []string{"alice", "bob", "carol"},
+		code:    http.StatusCreated,
+	},
+	{
+		name: "fails with too few members for a group",
+		body: fmt.Sprintf(`{"members": ["%s", "%s"]}`, UUIDRecal("bob"), UUIDRecal("alice")),
+		code: http.StatusBadRequest,
+	},
+	{
+		name: "fails with too many members for a group",
+		body: fmt.Sprintf(`{"members": ["%s", "%s", "%s", "%s", "%s", "%s", "%s", "%s"]}`,
+			UUIDRecal(), UUIDRecal(), UUIDRecal(), UUIDRecal(), UUIDRecal(), UUIDRecal(), UUIDRecal(), UUIDRecal()),
+		code: http.StatusBadRequest,
+	},
+}
+
+func TestConversation(t *testing.T) {
+	for _, tt := range ttConversation {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g       = NewGomegaWithT(t)
+				members []string
+				db      = &MockCassandra{
+					CreateConversationFn: func(i *ChannelInfo) (bool, error) {
+						members = userIDs(i.Members)
+						i.ID = conversationID(members)
+						return !tt.exists, nil
+					},
+				}
+				dm      = &DirectMessage{database: db}
+				handler = dm.Register(mux.NewRouter())
+			)
+
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			url := fmt.Sprintf("%s/dm/%s", server.URL, tt.path)
+
+			req, err := http.NewRequest(http.MethodPut, url, bytes.NewBufferString(tt.body))
+			g.Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal("alice")))
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+
+			if tt.members == nil {
+				g.Expect(db.CreateConversationInvoked).Should(BeFalse())
+				return
+			}
+			var want = make([]string, 0, len(tt.members))
+			for _, member := range tt.members {
+				want = append(want, UUIDRecal(member))
+			}
+			g.Expect(members).Should(ConsistOf(want))
+
+			var body ChannelInfo
+			g.Expect(json.NewDecoder(rsp.Body).Decode(&body)).Should(Succeed())
+			g.Expect(body.ID).Should(Equal(conversationID(want)))
+		})
+	}
+}
+
+func TestListConversations(t *testing.T) {
+	var (
+		g  = NewGomegaWithT(t)
+		db = &MockCassandra{
+			ListConversationsFn: func(i *UserInfo) error {
+				g.Expect(i.ID).Should(Equal(UUIDRecal("alice")))
+				i.Channels = []*ChannelInfo{{ID: UUIDRecal("dm-1"), Kind: KindDirect}}
+				return nil
+			},
+		}
+		dm      = &DirectMessage{database: db}
+		handler = dm.Register(mux.NewRouter())
+	)
+
+	handler.Use(JSONMiddleWare, testAuth.Middleware)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/dm/", nil)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal("alice")))
+
+	rsp, err := http.DefaultClient.Do(req)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(rsp.StatusCode).Should(Equal(http.StatusOK))
+
+	var body UserInfo
+	g.Expect(json.NewDecoder(rsp.Body).Decode(&body)).Should(Succeed())
+	g.Expect(body.Channels).Should(HaveLen(1))
+	g.Expect(body.Channels[0].Kind).Should(Equal(KindDirect))
+}
+
+// conversations are channels without an owner, nobody can leave them or be added to them
+func TestConversationMembersFixed(t *testing.T) {
+	var (
+		g  = NewGomegaWithT(t)
+		db = &MockCassandra{
+			ChannelRolesFn: func(cid string) (map[string]structs.Role, error) {
+				return structs.MemberRoles("", []string{UUIDRecal("alice"), UUIDRecal("bob")}, nil), nil
+			},
+		}
+		channel = &Channel{database: db}
+		handler = channel.Register(mux.NewRouter())
+	)
+
+	handler.Use(JSONMiddleWare, testAuth.Middleware)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for method, body := range map[string]string{
+		http.MethodDelete: fmt.Sprintf(`{"members": ["%s"]}`, UUIDRecal("alice")),
+		http.MethodPut:    fmt.Sprintf(`{"members": ["%s"]}`, UUIDRecal("carol")),
+	} {
+		url := fmt.Sprintf("%s/channel/%s/users", server.URL, UUIDRecal("dm-1"))
+
+		req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+		g.Expect(err).ShouldNot(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal("alice")))
+
+		rsp, err := http.DefaultClient.Do(req)
+		g.Expect(err).ShouldNot(HaveOccurred())
+		g.Expect(rsp.StatusCode).Should(Equal(http.StatusForbidden), method)
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/sir-wiggles/chat/api/backplane"
+	"github.com/sir-wiggles/chat/api/protocol"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+const (
+	// socketSendBufferSize is how many messages can be queued for a socket before it's dropped
+	socketSendBufferSize = 32
+
+	// socketPostBufferSize is how many frames from a socket can wait to be stored before more are
+	// refused
+	socketPostBufferSize = 8
+
+	hubRegisterBufferSize     = 8
+	hubUnregisterBufferSize   = 8
+	hubBroadcastBufferSize    = 8
+	hubSubscriptionBufferSize = 8
+	hubNotifyBufferSize       = 8
+	hubAnswerBufferSize       = 8
+)
+
+// subscription changes which channels the sockets of the given users are in.  No users means
+// every socket in the channel.
+type subscription struct {
+	channel   string
+	users     []string
+	subscribe bool
+}
+
+// post is a frame sent by a socket.  If the frame could not be decoded err is set.
+type post struct {
+	socket   *Socket
+	envelope *protocol.Envelope
+	err      error
+}
+
+// answer is what a frame handled off the hub loop results in, the loop sends it on
+type answer struct {
+	socket *Socket
+
+	// frames are sent to the sockets in their channel, the socket included only if echo is set
+	frames []*protocol.Envelope
+	echo   bool
+
+	// reply is sent to the socket alone
+	reply *protocol.Envelope
+}
+
+// delivery is what's published to the backplane for a channel, it matches what the api service
+// publishes so its clients get the frame
+type delivery struct {
+	Envelope *protocol.Envelope `json:"envelope"`
+}
+
+// membershipChannel is the backplane channel removals from channels are published on, the api
+// service stops sending a channel to the clients of the users removed from it
+const membershipChannel = "_membership"
+
+// revocation is what's published to the backplane when users are removed from a channel, it
+// matches what the api service listens for
+type revocation struct {
+	Channel string   `json:"channel"`
+	Users   []string `json:"users"`
+}
+
+// Hub fans messages out to the sockets that are subscribed to a channel.  A socket is only ever
+// subscribed to the channels its user is a member of.
+type Hub struct {
+	database DatabaseController
+
+	// backplane carries frames to the clients of the api service, it's nil when there is none
+	backplane backplane.Backplane
+
+	// sockets are all the open sockets keyed by the user they belong to
+	sockets map[string]map[*Socket]bool
+
+	// channels are the sockets subscribed to a channel keyed by channel id
+	channels map[string]map[*Socket]bool
+
+	register     chan *Socket
+	unregister   chan *Socket
+	broadcast    chan *post
+	subscription chan *subscription
+	notify       chan *protocol.Envelope
+	answers      chan *answer
+}
+
+// NewHub creates a new Hub and starts the hub loop.  Changes to messages are also published to
+// the backplane if one is given.
+func NewHub(database DatabaseController, bp backplane.Backplane) *Hub {
+	hub := &Hub{
+		database:     database,
+		backplane:    bp,
+		sockets:      make(map[string]map[*Socket]bool),
+		channels:     make(map[string]map[*Socket]bool),
+		register:     make(chan *Socket, hubRegisterBufferSize),
+		unregister:   make(chan *Socket, hubUnregisterBufferSize),
+		broadcast:    make(chan *post, hubBroadcastBufferSize),
+		subscription: make(chan *subscription, hubSubscriptionBufferSize),
+		notify:       make(chan *protocol.Envelope, hubNotifyBufferSize),
+		answers:      make(chan *answer, hubAnswerBufferSize),
+	}
+
+	go hub.start()
+	return hub
+}
+
+// Subscribe adds the sockets of the given users to a channel.  It's safe to call on a nil Hub.
+func (h *Hub) Subscribe(channel string, users ...string) {
+	if h == nil || len(users) == 0 {
+		return
+	}
+	h.subscription <- &subscription{channel: channel, users: users, subscribe: true}
+}
+
+// Unsubscribe removes the sockets of the given users from a channel and publishes their removal
+// to the backplane.  If no users are given then every socket is removed from the channel.  It's
+// safe to call on a nil Hub.
+func (h *Hub) Unsubscribe(channel string, users ...string) {
+	if h == nil {
+		return
+	}
+	h.subscription <- &subscription{channel: channel, users: users}
+
+	if h.backplane == nil || len(users) == 0 {
+		return
+	}
+	data, err := json.Marshal(&revocation{Channel: channel, Users: users})
+	if err == nil {
+		err = h.backplane.Publish(membershipChannel, data)
+	}
+	if err != nil {
+		log.Printf("hub: failed to publish the removal from %s: %s", channel, err)
+	}
+}
+
+// Notify sends a frame of type t with the message to the sockets in the message's channel and
+// publishes it to the backplane.  It's safe to call on a nil Hub.
+func (h *Hub) Notify(t protocol.Type, message *MessageInfo) {
+	if h == nil {
+		return
+	}
+	h.publish(t, message.Channel, message, message.message())
+}
+
+// NotifyReactions sends a reaction frame with the reactions to a message of the channel to the
+// sockets in the channel and publishes it to the backplane.  It's safe to call on a nil Hub.
+func (h *Hub) NotifyReactions(channel string, reactions *structs.Reactions) {
+	if h == nil {
+		return
+	}
+	h.publish(protocol.TypeReaction, channel, reactions, reactions)
+}
+
+// NotifyRead sends a read frame with how far a user has read the channel to the sockets in the
+// channel and publishes it to the backplane.  It's safe to call on a nil Hub.
+func (h *Hub) NotifyRead(channel string, read *protocol.Read) {
+	if h == nil {
+		return
+	}
+	h.publish(protocol.TypeRead, channel, read, read)
+}
+
+// publish sends a frame of type t to the sockets in the channel with the local payload and
+// publishes one with the remote payload, which is in the form of the api service, to the backplane
+func (h *Hub) publish(t protocol.Type, channel string, local, remote interface{}) {
+	if envelope, err := protocol.New(t, channel, local); err == nil {
+		h.notify <- envelope
+	}
+
+	if h.backplane == nil {
+		return
+	}
+	envelope, err := protocol.New(t, channel, remote)
+	if err != nil {
+		return
+	}
+
+	data, err := json.Marshal(&delivery{Envelope: envelope})
+	if err == nil {
+		err = h.backplane.Publish(channel, data)
+	}
+	if err != nil {
+		log.Printf("hub: failed to publish %s frame to %s: %s", t, channel, err)
+	}
+}
+
+func (h *Hub) start() {
+	for {
+		select {
+
+		case socket := <-h.register:
+			if h.sockets[socket.user] == nil {
+				h.sockets[socket.user] = make(map[*Socket]bool)
+			}
+			h.sockets[socket.user][socket] = true
+
+			for _, channel := range socket.channels {
+				h.join(channel, socket)
+			}
+
+		case socket := <-h.unregister:
+			h.drop(socket)
+
+		case s := <-h.subscription:
+			h.subscribe(s)
+
+		case p := <-h.broadcast:
+			h.handle(p)
+
+		case envelope := <-h.notify:
+			h.send(envelope, nil)
+
+		case a := <-h.answers:
+			h.deliver(a)
+		}
+	}
+}
+
+func (h *Hub) join(channel string, socket *Socket) {
+	if h.channels[channel] == nil {
+		h.channels[channel] = make(map[*Socket]bool)
+	}
+	h.channels[channel][socket] = true
+}
+
+func (h *Hub) leave(channel string, socket *Socket) {
+	delete(h.channels[channel], socket)
+	if len(h.channels[channel]) == 0 {
+		delete(h.channels, channel)
+	}
+}
+
+// drop removes the socket from the hub and closes its send channel which in turn closes the
+// connection.  Dropping a socket more than once is a no-op.
+func (h *Hub) drop(socket *Socket) {
+	if _, ok := h.sockets[socket.user][socket]; !ok {
+		return
+	}
+
+	delete(h.sockets[socket.user], socket)
+	if len(h.sockets[socket.user]) == 0 {
+		delete(h.sockets, socket.user)
+	}
+
+	for channel, sockets := range h.channels {
+		if sockets[socket] {
+			h.leave(channel, socket)
+		}
+	}
+	close(socket.send)
+	close(socket.posts)
+}
+
+func (h *Hub) subscribe(s *subscription) {
+	if !s.subscribe && len(s.users) == 0 {
+		delete(h.channels, s.channel)
+		return
+	}
+
+	for _, user := range s.users {
+		for socket := range h.sockets[user] {
+			if s.subscribe {
+				h.join(s.channel, socket)
+			} else {
+				h.leave(s.channel, socket)
+			}
+		}
+	}
+}
+
+// handle acts on a frame from a socket.  Frames that target a channel the socket isn't
+// subscribed to are answered with an error frame, the rest are passed back to the socket to be
+// handled by post.  The database is only used off the hub loop so a slow query doesn't hold up
+// every socket, while the frames of a socket are still handled in the order they were sent.
+func (h *Hub) handle(p *post) {
+	var (
+		socket   = p.socket
+		envelope = p.envelope
+	)
+
+	if _, ok := h.sockets[socket.user][socket]; !ok {
+		return
+	}
+
+	if p.err != nil {
+		h.fail(p, protocol.CodeInvalidFrame, p.err.Error())
+		return
+	}
+
+	switch envelope.Type {
+
+	case protocol.TypeSend, protocol.TypeTyping:
+		if !h.channels[envelope.Channel][socket] {
+			h.fail(p, protocol.CodeForbidden, "not a member of the channel")
+			return
+		}
+
+	case protocol.TypeJoin, protocol.TypeLeave:
+		h.fail(p, protocol.CodeInvalidFrame, "subscriptions follow channel membership")
+		return
+
+	case protocol.TypeAck:
+		return
+
+	default:
+		h.fail(p, protocol.CodeInvalidFrame, string(envelope.Type)+" frames can't be sent by clients")
+		return
+	}
+
+	select {
+	case socket.posts <- p:
+	default:
+		h.fail(p, protocol.CodeInternal, "too many frames waiting to be handled")
+	}
+}
+
+// post handles a send or typing frame the hub accepted.  It's called by the socket rather than the
+// hub loop, what it results in is sent to the loop as an answer.  Frames whose role in the channel
+// doesn't let them post are answered with an error frame.
+func (h *Hub) post(p *post) {
+	var (
+		socket   = p.socket
+		envelope = p.envelope
+	)
+
+	role, err := h.database.Authorize(envelope.Channel, socket.user, structs.ActionPost)
+	if err == ErrNotPermitted {
+		h.refuse(p, protocol.CodeForbidden, fmt.Sprintf("a %s of the channel can't post", role))
+		return
+	} else if err != nil {
+		log.Printf("hub: failed to authorize %s: %s", socket.user, err)
+		h.refuse(p, protocol.CodeInternal, "could not check membership")
+		return
+	}
+
+	if envelope.Type == protocol.TypeTyping {
+		typing := &protocol.Typing{}
+		envelope.Unmarshal(typing)
+		typing.Author = socket.user
+
+		if e, err := protocol.New(protocol.TypeTyping, envelope.Channel, typing); err == nil {
+			h.answers <- &answer{socket: socket, frames: []*protocol.Envelope{e}}
+		}
+		return
+	}
+
+	send := &protocol.Send{}
+	envelope.Unmarshal(send)
+
+	var (
+		message = &MessageInfo{
+			Channel: envelope.Channel,
+			Owner:   socket.user,
+			Body:    send.Text,
+			Parent:  send.Parent,
+		}
+		thread *structs.Thread
+	)
+	if len(send.Attachments) > 0 {
+		if err := h.database.Attachable(message, send.Attachments); err == ErrInvalidAttachment {
+			h.refuse(p, protocol.CodeInvalidFrame, err.Error())
+			return
+		} else if err != nil {
+			log.Printf("hub: failed to check attachments: %s", err)
+			h.refuse(p, protocol.CodeInternal, "could not store the message")
+			return
+		}
+	}
+
+	if message.Parent == "" {
+		err = h.database.CreateMessage(message)
+	} else {
+		thread, err = h.database.CreateReply(message)
+	}
+	if err == ErrParentNotFound {
+		h.refuse(p, protocol.CodeInvalidFrame, err.Error())
+		return
+	} else if err != nil {
+		log.Printf("hub: failed to log message: %s", err)
+		h.refuse(p, protocol.CodeInternal, "could not store the message")
+		return
+	}
+
+	// you've read what you wrote
+	if _, err := h.database.MarkRead(message, socket.user); err != nil {
+		log.Printf("hub: failed to mark %s read: %s", message.ID, err)
+	}
+
+	a := &answer{socket: socket, echo: true}
+	if e, err := protocol.New(protocol.TypeMessage, message.Channel, message); err == nil {
+		a.frames = append(a.frames, e)
+	}
+	if thread != nil {
+		if e, err := protocol.New(protocol.TypeThread, message.Channel, thread); err == nil {
+			a.frames = append(a.frames, e)
+		}
+	}
+	if ack, err := envelope.Reply(protocol.TypeAck, &protocol.Ack{Message: message.ID}); err == nil {
+		a.reply = ack
+	}
+	h.answers <- a
+}
+
+// deliver sends what a frame handled off the loop resulted in.  The socket may have been dropped
+// since, it's then just not replied to.
+func (h *Hub) deliver(a *answer) {
+	var ignore *Socket
+	if !a.echo {
+		ignore = a.socket
+	}
+	for _, envelope := range a.frames {
+		h.send(envelope, ignore)
+	}
+
+	if _, ok := h.sockets[a.socket.user][a.socket]; ok && a.reply != nil {
+		h.reply(a.socket, a.reply)
+	}
+}
+
+// fail answers the frame with an error frame
+func (h *Hub) fail(p *post, code, message string) {
+	if envelope, err := failure(p, code, message); err == nil {
+		h.reply(p.socket, envelope)
+	}
+}
+
+// refuse answers the frame with an error frame from off the hub loop
+func (h *Hub) refuse(p *post, code, message string) {
+	if envelope, err := failure(p, code, message); err == nil {
+		h.answers <- &answer{socket: p.socket, reply: envelope}
+	}
+}
+
+// failure is the error frame answering the frame
+func failure(p *post, code, message string) (*protocol.Envelope, error) {
+	if p.envelope != nil {
+		return p.envelope.Reply(protocol.TypeError, protocol.NewError(code, message))
+	}
+	return protocol.New(protocol.TypeError, "", protocol.NewError(code, message))
+}
+
+// reply sends the envelope to a single socket dropping the socket if it can't keep up
+func (h *Hub) reply(socket *Socket, envelope *protocol.Envelope) {
+	select {
+	case socket.send <- envelope:
+	default:
+		h.drop(socket)
+	}
+}
+
+// send delivers the envelope to every socket in the envelope's channel except ignore
+func (h *Hub) send(envelope *protocol.Envelope, ignore *Socket) {
+	for socket := range h.channels[envelope.Channel] {
+		if socket != ignore {
+			h.reply(socket, envelope)
+		}
+	}
+}
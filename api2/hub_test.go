@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/gomega"
+	"github.com/sir-wiggles/chat/api/backplane"
+	"github.com/sir-wiggles/chat/api/protocol"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+func TestHubFanOut(t *testing.T) {
+	var (
+		g        = NewGomegaWithT(t)
+		general  = UUIDRecal("general")
+		private  = UUIDRecal("private")
+		alice    = UUIDRecal("alice")
+		bob      = UUIDRecal("bob")
+		channels = map[string][]string{
+			alice: {general, private},
+			bob:   {general},
+		}
+		db = &MockCassandra{
+			AuthorizeFn: func(cid, uid string, action structs.Action) (structs.Role, error) {
+				return structs.RoleMember, nil
+			},
+			ListUserChannelsFn: func(i *UserInfo) error {
+				i.Channels = convertChannels(channels[i.ID])
+				return nil
+			},
+			CreateMessageFn: func(i *MessageInfo) error {
+				id := gocql.TimeUUID()
+				i.ID, i.Created = id.String(), id.Time()
+				return nil
+			},
+			MarkReadFn: func(i *MessageInfo, user string) (bool, error) {
+				return true, nil
+			},
+			CreateReplyFn: func(i *MessageInfo) (*structs.Thread, error) {
+				id := gocql.TimeUUID()
+				i.ID, i.Created = id.String(), id.Time()
+				return &structs.Thread{Parent: i.Parent, Replies: 1, LastReply: i.Created}, nil
+			},
+		}
+		hub     = NewHub(db, nil)
+		chatter = &Chatter{database: db, hub: hub}
+		handler = chatter.Register(mux.NewRouter())
+	)
+
+	handler.Use(JSONMiddleWare, testAuth.Middleware)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	dial := func(user string) *websocket.Conn {
+		url := fmt.Sprintf("ws%s/test/ws?token=%s", strings.TrimPrefix(server.URL, "http"), testToken(t, user))
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		g.Expect(err).ShouldNot(HaveOccurred())
+		return conn
+	}
+
+	aliceConn, bobConn := dial(alice), dial(bob)
+	defer aliceConn.Close()
+	defer bobConn.Close()
+
+	post := func(conn *websocket.Conn, channel, text string, parent ...string) {
+		send := &protocol.Send{Text: text}
+		if len(parent) > 0 {
+			send.Parent = parent[0]
+		}
+		envelope, err := protocol.New(protocol.TypeSend, channel, send)
+		g.Expect(err).ShouldNot(HaveOccurred())
+		data, err := protocol.Encode(envelope)
+		g.Expect(err).ShouldNot(HaveOccurred())
+		g.Expect(conn.WriteMessage(websocket.TextMessage, data)).Should(Succeed())
+	}
+
+	// next reads frames until one that isn't an ack arrives
+	next := func(conn *websocket.Conn, timeout time.Duration) (*protocol.Envelope, error) {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return nil, err
+			}
+			envelope, err := protocol.Decode(data)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			if envelope.Type != protocol.TypeAck {
+				return envelope, nil
+			}
+		}
+	}
+
+	// bob isn't a member of the private channel so the post is refused and only the post to
+	// general reaches alice
+	post(bobConn, private, "let me in")
+	post(bobConn, general, "hi all")
+
+	envelope, err := next(bobConn, time.Second)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(envelope.Type).Should(Equal(protocol.TypeError))
+
+	message := &MessageInfo{}
+	envelope, err = next(aliceConn, time.Second)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(envelope.Type).Should(Equal(protocol.TypeMessage))
+	g.Expect(envelope.Unmarshal(message)).Should(Succeed())
+	g.Expect(message.Channel).Should(Equal(general))
+	g.Expect(message.Owner).Should(Equal(bob))
+	g.Expect(message.Body).Should(Equal("hi all"))
+
+	// alice's post to the private channel must not reach bob, the next thing bob sees is his own
+	// post echoed back from general
+	post(aliceConn, private, "secret")
+
+	envelope, err = next(bobConn, time.Second)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(envelope.Unmarshal(message)).Should(Succeed())
+	g.Expect(message.Body).Should(Equal("hi all"))
+
+	envelope, err = next(aliceConn, time.Second)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(envelope.Unmarshal(message)).Should(Succeed())
+	g.Expect(message.Body).Should(Equal("secret"))
+
+	// a reply reaches the channel followed by the summary of its thread
+	post(aliceConn, general, "welcome bob", message.ID)
+
+	envelope, err = next(bobConn, time.Second)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(envelope.Type).Should(Equal(protocol.TypeMessage))
+	g.Expect(envelope.Unmarshal(message)).Should(Succeed())
+	g.Expect(message.Body).Should(Equal("welcome bob"))
+	g.Expect(message.Parent).ShouldNot(BeEmpty())
+
+	thread := &structs.Thread{}
+	envelope, err = next(bobConn, time.Second)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(envelope.Type).Should(Equal(protocol.TypeThread))
+	g.Expect(envelope.Unmarshal(thread)).Should(Succeed())
+	g.Expect(thread.Parent).Should(Equal(message.Parent))
+	g.Expect(thread.Replies).Should(Equal(1))
+
+	_, err = next(bobConn, 100*time.Millisecond)
+	g.Expect(err).Should(HaveOccurred())
+}
+
+func TestHubNotify(t *testing.T) {
+	var (
+		g       = NewGomegaWithT(t)
+		general = UUIDRecal("general")
+		alice   = UUIDRecal("alice")
+		db      = &MockCassandra{
+			AuthorizeFn: func(cid, uid string, action structs.Action) (structs.Role, error) {
+				return structs.RoleMember, nil
+			},
+			ListUserChannelsFn: func(i *UserInfo) error {
+				i.Channels = convertChannels([]string{general})
+				return nil
+			},
+			CreateMessageFn: func(i *MessageInfo) error {
+				id := gocql.TimeUUID()
+				i.ID, i.Created = id.String(), id.Time()
+				return nil
+			},
+			MarkReadFn: func(i *MessageInfo, user string) (bool, error) {
+				return true, nil
+			},
+		}
+		bp        = backplane.NewMemory()
+		published = make(chan []byte, 1)
+		hub       = NewHub(db, bp)
+		chatter   = &Chatter{database: db, hub: hub}
+		handler   = chatter.Register(mux.NewRouter())
+	)
+	defer bp.Close()
+
+	_, err := bp.Subscribe(general, func(channel string, data []byte) {
+		published <- data
+	})
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	handler.Use(JSONMiddleWare, testAuth.Middleware)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	url := fmt.Sprintf("ws%s/test/ws?token=%s", strings.TrimPrefix(server.URL, "http"), testToken(t, alice))
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	defer conn.Close()
+
+	// next reads frames until one of the type arrives
+	next := func(t protocol.Type) *protocol.Envelope {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			_, data, err := conn.ReadMessage()
+			g.Expect(err).ShouldNot(HaveOccurred())
+			envelope, err := protocol.Decode(data)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			if envelope.Type == t {
+				return envelope
+			}
+		}
+	}
+
+	// the post coming back means the socket is subscribed to general
+	envelope, err := protocol.New(protocol.TypeSend, general, &protocol.Send{Text: "hi"})
+	g.Expect(err).ShouldNot(HaveOccurred())
+	data, err := protocol.Encode(envelope)
+	g.Expect(err).ShouldNot(HaveOccurred())
+	g.Expect(conn.WriteMessage(websocket.TextMessage, data)).Should(Succeed())
+
+	message := &MessageInfo{}
+	g.Expect(next(protocol.TypeMessage).Unmarshal(message)).Should(Succeed())
+
+	editedAt := time.Now().UTC()
+	message.Body, message.EditedAt = "hello", &editedAt
+	hub.Notify(protocol.TypeEdited, message)
+
+	edited := &MessageInfo{}
+	g.Expect(next(protocol.TypeEdited).Unmarshal(edited)).Should(Succeed())
+	g.Expect(edited.ID).Should(Equal(message.ID))
+	g.Expect(edited.Body).Should(Equal("hello"))
+	g.Expect(edited.EditedAt).ShouldNot(BeNil())
+
+	// the clients of the api service get the message in its own form
+	var d struct {
+		Envelope *protocol.Envelope `json:"envelope"`
+	}
+	select {
+	case data = <-published:
+	case <-time.After(time.Second):
+		t.Fatal("nothing was published to the backplane")
+	}
+	g.Expect(json.Unmarshal(data, &d)).Should(Succeed())
+	g.Expect(d.Envelope.Type).Should(Equal(protocol.TypeEdited))
+
+	sent := &structs.Message{}
+	g.Expect(d.Envelope.Unmarshal(sent)).Should(Succeed())
+	g.Expect(sent.ID).Should(Equal(message.ID))
+	g.Expect(sent.Author.ID).Should(Equal(alice))
+	g.Expect(sent.Text).Should(Equal([]string{"hello"}))
+
+	// reactions are sent in the same form to both
+	hub.NotifyReactions(general, &structs.Reactions{
+		Message:   message.ID,
+		Reactions: []*structs.Reaction{{Emoji: "👍", Count: 1, Users: []string{alice}}},
+	})
+
+	reactions := &structs.Reactions{}
+	g.Expect(next(protocol.TypeReaction).Unmarshal(reactions)).Should(Succeed())
+	g.Expect(reactions.Message).Should(Equal(message.ID))
+	g.Expect(reactions.Reactions[0].Users).Should(Equal([]string{alice}))
+
+	select {
+	case data = <-published:
+	case <-time.After(time.Second):
+		t.Fatal("nothing was published to the backplane")
+	}
+	g.Expect(json.Unmarshal(data, &d)).Should(Succeed())
+	g.Expect(d.Envelope.Type).Should(Equal(protocol.TypeReaction))
+}
+
+func TestHubUnsubscribe(t *testing.T) {
+	var (
+		g         = NewGomegaWithT(t)
+		general   = UUIDRecal("general")
+		bob       = UUIDRecal("bob")
+		bp        = backplane.NewMemory()
+		published = make(chan []byte, 1)
+		hub       = NewHub(&MockCassandra{}, bp)
+	)
+	defer bp.Close()
+
+	_, err := bp.Subscribe(membershipChannel, func(channel string, data []byte) {
+		published <- data
+	})
+	g.Expect(err).ShouldNot(HaveOccurred())
+
+	// the api service is told who was removed so it stops sending them the channel
+	hub.Unsubscribe(general, bob)
+
+	var data []byte
+	select {
+	case data = <-published:
+	case <-time.After(time.Second):
+		t.Fatal("nothing was published to the backplane")
+	}
+
+	var r struct {
+		Channel string   `json:"channel"`
+		Users   []string `json:"users"`
+	}
+	g.Expect(json.Unmarshal(data, &r)).Should(Succeed())
+	g.Expect(r.Channel).Should(Equal(general))
+	g.Expect(r.Users).Should(Equal([]string{bob}))
+}
+
+func TestHubSlowWrite(t *testing.T) {
+	var (
+		g       = NewGomegaWithT(t)
+		general = UUIDRecal("general")
+		alice   = UUIDRecal("alice")
+		bob     = UUIDRecal("bob")
+		storing = make(chan struct{})
+		release = make(chan struct{})
+		db      = &MockCassandra{
+			AuthorizeFn: func(cid, uid string, action structs.Action) (structs.Role, error) {
+				return structs.RoleMember, nil
+			},
+			ListUserChannelsFn: func(i *UserInfo) error {
+				i.Channels = convertChannels([]string{general})
+				return nil
+			},
+			CreateMessageFn: func(i *MessageInfo) error {
+				close(storing)
+				<-release
+				id := gocql.TimeUUID()
+				i.ID, i.Created = id.String(), id.Time()
+				return nil
+			},
+			MarkReadFn: func(i *MessageInfo, user string) (bool, error) {
+				return true, nil
+			},
+		}
+		hub     = NewHub(db, nil)
+		chatter = &Chatter{database: db, hub: hub}
+		handler = chatter.Register(mux.NewRouter())
+	)
+
+	handler.Use(JSONMiddleWare, testAuth.Middleware)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	dial := func(user string) *websocket.Conn {
+		url := fmt.Sprintf("ws%s/test/ws?token=%s", strings.TrimPrefix(server.URL, "http"), testToken(t, user))
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		g.Expect(err).ShouldNot(HaveOccurred())
+		return conn
+	}
+
+	post := func(conn *websocket.Conn, t protocol.Type, payload interface{}) {
+		envelope, err := protocol.New(t, general, payload)
+		g.Expect(err).ShouldNot(HaveOccurred())
+		data, err := protocol.Encode(envelope)
+		g.Expect(err).ShouldNot(HaveOccurred())
+		g.Expect(conn.WriteMessage(websocket.TextMessage, data)).Should(Succeed())
+	}
+
+	next := func(conn *websocket.Conn) *protocol.Envelope {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := conn.ReadMessage()
+		g.Expect(err).ShouldNot(HaveOccurred())
+		envelope, err := protocol.Decode(data)
+		g.Expect(err).ShouldNot(HaveOccurred())
+		return envelope
+	}
+
+	aliceConn, bobConn := dial(alice), dial(bob)
+	defer aliceConn.Close()
+	defer bobConn.Close()
+
+	// bob's typing reaches alice while her message is still being stored
+	post(aliceConn, protocol.TypeSend, &protocol.Send{Text: "slow"})
+	<-storing
+	post(bobConn, protocol.TypeTyping, &protocol.Typing{Active: true})
+	g.Expect(next(aliceConn).Type).Should(Equal(protocol.TypeTyping))
+
+	close(release)
+	message := &MessageInfo{}
+	envelope := next(bobConn)
+	g.Expect(envelope.Type).Should(Equal(protocol.TypeMessage))
+	g.Expect(envelope.Unmarshal(message)).Should(Succeed())
+	g.Expect(message.Body).Should(Equal("slow"))
+}
+
+func TestCheckOrigin(t *testing.T) {
+	defer func(origins []string) { corsAllowedOrigins = origins }(corsAllowedOrigins)
+	corsAllowedOrigins = []string{"https://chat.example.com"}
+
+	var tt = []struct {
+		name    string
+		origin  string
+		allowed bool
+	}{
+		{name: "allows requests without an origin", allowed: true},
+		{name: "allows the same host", origin: "http://api.example.com:5050", allowed: true},
+		{name: "allows the cors origins", origin: "https://chat.example.com", allowed: true},
+		{name: "refuses other sites", origin: "https://evil.example.com"},
+		{name: "refuses another scheme of a cors origin", origin: "http://chat.example.com"},
+	}
+
+	for _, tt := range tt {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			r := httptest.NewRequest("GET", "http://api.example.com:5050/api/test/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			g.Expect(checkOrigin(r)).Should(Equal(tt.allowed))
+		})
+	}
+}
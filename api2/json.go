@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 
 	"gopkg.in/go-playground/validator.v9"
@@ -21,6 +24,15 @@ func (w *ResponseWriter) Write(p []byte) (int, error) {
 	return w.buf.Write(p)
 }
 
+// Hijack lets the wrapped http.ResponseWriter be taken over, e.g. when upgrading to a websocket
+func (w *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+	return hijacker.Hijack()
+}
+
 // JSON takes a struct and encodes it to JSON.  If the value is an error, then the error will
 // be returned as an object with error as the key and value as the .Error() of the error.
 //
@@ -35,9 +47,6 @@ func (w *ResponseWriter) Write(p []byte) (int, error) {
 func (w *ResponseWriter) JSON(v interface{}, status ...int) error {
 
 	var code = http.StatusOK
-	if len(status) > 1 {
-		code = status[0]
-	}
 
 	log.Printf("%T", v)
 
@@ -66,6 +75,10 @@ func (w *ResponseWriter) JSON(v interface{}, status ...int) error {
 
 	}
 
+	if len(status) > 0 {
+		code = status[0]
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 
@@ -77,12 +90,22 @@ func (w *ResponseWriter) JSON(v interface{}, status ...int) error {
 	return nil
 }
 
+// maxRequestSize is the largest request body in bytes read, enough for the largest attachment
+func maxRequestSize() int64 {
+	return maxAttachmentSize + uploadOverhead
+}
+
 // JSONMiddleWare wraps response writer allowing the ability to respond with a struct as JSON.
 // Example:
 //    err := w.(*ResponseWriter).JSON(struct)
 func JSONMiddleWare(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		body, err := ioutil.ReadAll(r.Body)
+		// one byte over the limit is read to know the body is too large
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize()+1))
+		if err == nil && int64(len(body)) > maxRequestSize() {
+			http.Error(w, "body is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		if err != nil {
 			log.Printf("Error reading body: %v", err)
 			http.Error(w, "can't read body", http.StatusBadRequest)
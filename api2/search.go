@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sir-wiggles/chat/api/search"
+)
+
+// ErrInvalidTime is returned when the "after" or "before" query params of a search aren't times
+var ErrInvalidTime = errors.New(`"after" and "before" must be RFC 3339 times`)
+
+// Search finds messages in the channels of the authenticated user
+type Search struct {
+	Handler  http.HandlerFunc
+	database DatabaseController
+}
+
+// Register initializes the given router with search related routes returning the sub router
+func (c *Search) Register(router *mux.Router) *mux.Router {
+	/*
+	 *GET    /search?q=Q&author=A&channel=C&after=T&before=T&limit=N
+	 *                               -- Search the messages of the authenticated user's channels
+	 */
+	sub := router.NewRoute().PathPrefix("/search").Subrouter()
+	sub.Path("/").Handler(c.setHandler(c.Messages)).Methods("GET")
+
+	return sub
+}
+
+func (c *Search) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.Handler(w, r)
+}
+
+func (c Search) setHandler(h http.HandlerFunc) http.Handler {
+	n := c
+	n.Handler = h
+	return &n
+}
+
+// Messages searches the messages of every channel and conversation the authenticated user is a
+// member of for the words of the "q" query param, best match first.  "author" and "channel" only
+// find the messages of that user or in that channel and "after" and "before" limit when they were
+// sent.  Matched words are marked in the snippet of each message found.
+func (c *Search) Messages(w http.ResponseWriter, r *http.Request) {
+	var (
+		rw    = w.(*ResponseWriter)
+		query = r.URL.Query()
+		page  = &SearchPage{
+			Query:   query.Get("q"),
+			Author:  query.Get("author"),
+			Channel: query.Get("channel"),
+			Limit:   search.DefaultLimit,
+		}
+		ok bool
+	)
+
+	if page.User, ok = actingUser(r, ""); !ok {
+		rw.JSON(ErrForbidden, http.StatusForbidden)
+		return
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > search.MaxLimit {
+			rw.JSON(ErrInvalidLimit, http.StatusBadRequest)
+			return
+		}
+		page.Limit = n
+	}
+
+	for param, field := range map[string]**time.Time{"after": &page.After, "before": &page.Before} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			rw.JSON(ErrInvalidTime, http.StatusBadRequest)
+			return
+		}
+		*field = &t
+	}
+
+	switch err := c.database.SearchMessages(page); err {
+	case nil:
+		rw.JSON(page)
+	case ErrInvalidQuery, ErrInvalidRange, ErrInvalidLimit:
+		rw.JSON(err, http.StatusBadRequest)
+	case ErrNotPermitted:
+		rw.JSON(err, http.StatusForbidden)
+	default:
+		rw.JSON(err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/onsi/gomega"
+	"github.com/sir-wiggles/chat/api/search"
+	"github.com/sir-wiggles/chat/api/structs"
+)
+
+var ttSearch = []struct {
+	name  string
+	query url.Values
+	hits  []string
+	code  int
+}{
+	{
+		name:  "searches every channel of the user",
+		query: url.Values{"q": {"deploy"}},
+		hits:  []string{"general-3", "random-1", "general-1"},
+		code:  http.StatusOK,
+	},
+	{
+		name:  "searches a channel",
+		query: url.Values{"q": {"deploy"}, "channel": {UUIDRecal("general")}},
+		hits:  []string{"general-3", "general-1"},
+		code:  http.StatusOK,
+	},
+	{
+		name:  "searches the messages of an author",
+		query: url.Values{"q": {"deploy"}, "author": {UUIDRecal("bob")}},
+		hits:  []string{"random-1"},
+		code:  http.StatusOK,
+	},
+	{
+		name: "searches a date range",
+		query: url.Values{
+			"q":      {"deploy"},
+			"after":  {"3000-01-01T00:01:00Z"},
+			"before": {"3000-01-01T00:03:00Z"},
+		},
+		hits: []string{"random-1"},
+		code: http.StatusOK,
+	},
+	{
+		name:  "limits the hits",
+		query: url.Values{"q": {"deploy"}, "limit": {"1"}},
+		hits:  []string{"general-3"},
+		code:  http.StatusOK,
+	},
+	{
+		name:  "fails to search a channel the user isn't in",
+		query: url.Values{"q": {"deploy"}, "channel": {UUIDRecal("secret")}},
+		code:  http.StatusForbidden,
+	},
+	{
+		name:  "fails without words",
+		query: url.Values{"q": {"  "}},
+		code:  http.StatusBadRequest,
+	},
+	{
+		name:  "fails with too many hits",
+		query: url.Values{"q": {"deploy"}, "limit": {"101"}},
+		code:  http.StatusBadRequest,
+	},
+	{
+		name:  "fails with a bad date",
+		query: url.Values{"q": {"deploy"}, "after": {"yesterday"}},
+		code:  http.StatusBadRequest,
+	},
+	{
+		name: "fails with a backwards date range",
+		query: url.Values{
+			"q":      {"deploy"},
+			"after":  {"3000-01-01T00:03:00Z"},
+			"before": {"3000-01-01T00:01:00Z"},
+		},
+		code: http.StatusBadRequest,
+	},
+}
+
+func TestSearch(t *testing.T) {
+	var (
+		index  = search.NewMemory()
+		start  = time.Date(3000, time.January, 1, 0, 0, 0, 0, time.UTC)
+		alice  = &structs.User{ID: UUIDRecal("alice")}
+		bob    = &structs.User{ID: UUIDRecal("bob")}
+		joined = []*ChannelInfo{{ID: UUIDRecal("general")}, {ID: UUIDRecal("random")}}
+	)
+
+	for i, m := range []*structs.Message{
+		{ID: "general-1", Channel: UUIDRecal("general"), Author: alice, Text: []string{"deploy?"}},
+		{ID: "general-2", Channel: UUIDRecal("general"), Author: bob, Text: []string{"lunch"}},
+		{ID: "random-1", Channel: UUIDRecal("random"), Author: bob, Text: []string{"deploy <now>"}},
+		{ID: "general-3", Channel: UUIDRecal("general"), Author: alice, Text: []string{"deploy deploy"}},
+		{ID: "secret-1", Channel: UUIDRecal("secret"), Author: bob, Text: []string{"deploy"}},
+	} {
+		m.Time = start.Add(time.Duration(i) * time.Minute)
+		index.Index(m)
+	}
+
+	for _, tt := range ttSearch {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				g  = NewGomegaWithT(t)
+				db = &MockCassandra{
+					SearchMessagesFn: func(p *SearchPage) error {
+						g.Expect(p.User).Should(Equal(UUIDRecal("alice")))
+
+						query, err := p.query(joined)
+						if err != nil {
+							return err
+						}
+						hits, err := index.Search(query)
+						switch err {
+						case search.ErrEmptyQuery:
+							return ErrInvalidQuery
+						case search.ErrInvalidRange:
+							return ErrInvalidRange
+						}
+						p.Hits = hits
+						return err
+					},
+				}
+				finder  = &Search{database: db}
+				handler = finder.Register(mux.NewRouter())
+			)
+
+			handler.Use(JSONMiddleWare, testAuth.Middleware)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/search/?%s", server.URL, tt.query.Encode()), nil)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+testToken(t, UUIDRecal("alice")))
+
+			rsp, err := http.DefaultClient.Do(req)
+			g.Expect(err).ShouldNot(HaveOccurred())
+			g.Expect(rsp.StatusCode).Should(Equal(tt.code))
+
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var page SearchPage
+			g.Expect(json.NewDecoder(rsp.Body).Decode(&page)).Should(Succeed())
+			g.Expect(page.Query).Should(Equal(tt.query.Get("q")))
+
+			found := make([]string, 0, len(page.Hits))
+			for _, hit := range page.Hits {
+				found = append(found, hit.Message)
+				if hit.Message == "random-1" {
+					g.Expect(hit.Snippet).Should(Equal("<mark>deploy</mark> &lt;now&gt;"))
+				}
+			}
+			g.Expect(found).Should(Equal(tt.hits))
+		})
+	}
+}
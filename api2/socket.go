@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+
+	"github.com/gorilla/websocket"
+	"github.com/sir-wiggles/chat/api/protocol"
+)
+
+// Socket is created for every websocket connection to chatter
+type Socket struct {
+	user     string
+	channels []string
+	hub      *Hub
+	conn     *websocket.Conn
+	send     chan *protocol.Envelope
+
+	// posts are the frames the hub accepted from the socket waiting to be handled
+	posts chan *post
+}
+
+// NewSocket returns a socket for the user that will be subscribed to the given channels once
+// registered with the hub
+func NewSocket(hub *Hub, conn *websocket.Conn, user string, channels []string) *Socket {
+	return &Socket{
+		user:     user,
+		channels: channels,
+		hub:      hub,
+		conn:     conn,
+		send:     make(chan *protocol.Envelope, socketSendBufferSize),
+		posts:    make(chan *post, socketPostBufferSize),
+	}
+}
+
+// Start registers the socket with the hub and starts the read, write and post loops
+func (s *Socket) Start() {
+	s.hub.register <- s
+
+	go s.read()
+	go s.write()
+	go s.post()
+}
+
+func (s *Socket) read() {
+	defer func() {
+		s.hub.unregister <- s
+		s.conn.Close()
+	}()
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("socket: read error for %s: %s", s.user, err)
+			}
+			return
+		}
+
+		envelope, err := protocol.Decode(data)
+		s.hub.broadcast <- &post{socket: s, envelope: envelope, err: err}
+	}
+}
+
+// post handles the frames the hub accepted one at a time until the hub drops the socket
+func (s *Socket) post() {
+	for p := range s.posts {
+		s.hub.post(p)
+	}
+}
+
+func (s *Socket) write() {
+	defer s.conn.Close()
+
+	for envelope := range s.send {
+		data, err := protocol.Encode(envelope)
+		if err != nil {
+			log.Printf("socket: encoding %s frame for %s: %s", envelope.Type, s.user, err)
+			continue
+		}
+
+		if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			log.Printf("socket: write error for %s: %s", s.user, err)
+			return
+		}
+	}
+	s.conn.WriteMessage(websocket.CloseMessage, []byte{})
+}
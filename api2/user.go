@@ -11,11 +11,12 @@ import (
 type User struct {
 	Handler  http.HandlerFunc
 	database DatabaseController
+	hub      *Hub
 }
 
 // Register initializes the given router with user related routes returning the sub router
 // created to be used with other register methods
-func (c *User) Register(router *mux.Router) {
+func (c *User) Register(router *mux.Router) *mux.Router {
 	/*
 	 *DELETE /user/{user_id}/{channel_id}  -- Delete a channel
 	 *GET    /user/{user_id}/channels      -- Get all channels for the user
@@ -25,6 +26,7 @@ func (c *User) Register(router *mux.Router) {
 	sub.Path(fmt.Sprintf(`/{cid:%s}`, UUIDPattern)).Handler(c.setHandler(c.DeleteChannel))
 	sub.Path("/channels").Handler(c.setHandler(c.ListChannels))
 
+	return sub
 }
 
 func (c User) setHandler(h http.HandlerFunc) http.Handler {
@@ -37,8 +39,15 @@ func (c *User) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c.Handler(w, r)
 }
 
+// actingUser is the authenticated user, who must be the user in the route as well as any owner the
+// payload names
+func (c *User) actingUser(r *http.Request, claimed string) (string, bool) {
+	uid, ok := actingUser(r, claimed)
+	return uid, ok && mux.Vars(r)["uid"] == uid
+}
+
 type deleteChannelPayload struct {
-	Owner    string   `json:"owner" validate:"required,uuid"`
+	Owner    string   `json:"owner" validate:"omitempty,uuid"`
 	Channels []string `json:"channels" validate:"required,dive,uuid"`
 }
 
@@ -52,11 +61,16 @@ func (c *User) DeleteChannel(w http.ResponseWriter, r *http.Request) {
 		rw.JSON(err)
 		return
 	}
+	owner, ok := c.actingUser(r, payload.Owner)
+	if !ok {
+		rw.JSON(ErrForbidden, http.StatusForbidden)
+		return
+	}
 
 	var channels = convertChannels(payload.Channels)
 
 	var info = &ChannelInfo{
-		Owner:    payload.Owner,
+		Owner:    owner,
 		Channels: channels,
 	}
 
@@ -64,11 +78,16 @@ func (c *User) DeleteChannel(w http.ResponseWriter, r *http.Request) {
 		rw.JSON(err)
 		return
 	}
+	// only the channels the owner owned were deleted
+	for _, channel := range info.Channels {
+		c.hub.Unsubscribe(channel.ID)
+	}
+
 	rw.JSON("OK")
 }
 
 type listChannelPayload struct {
-	Owner string `json:"owner" validate:"required,uuid"`
+	Owner string `json:"owner" validate:"omitempty,uuid"`
 }
 
 // ListChannels will get all the channels for a user
@@ -81,9 +100,14 @@ func (c *User) ListChannels(w http.ResponseWriter, r *http.Request) {
 		rw.JSON(err)
 		return
 	}
+	owner, ok := c.actingUser(r, payload.Owner)
+	if !ok {
+		rw.JSON(ErrForbidden, http.StatusForbidden)
+		return
+	}
 
 	var info = &ChannelInfo{
-		Owner: payload.Owner,
+		Owner: owner,
 	}
 
 	if err := c.database.ListChannels(info); err != nil {
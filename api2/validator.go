@@ -29,7 +29,7 @@ func ValidateBody(payload interface{}, body io.Reader) error {
 
 	err := json.NewDecoder(body).Decode(payload)
 	// request.Body is empty then we'll get an EOF, we'll let the validator handle this case
-	if err.Error() == "EOF" {
+	if err == io.EOF {
 	} else if err != nil {
 		return err
 	}
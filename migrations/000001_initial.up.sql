@@ -5,7 +5,7 @@ CREATE TABLE users (
     gid     NUMERIC NOT NULL,
     name    TEXT    NOT NULL,
     email   TEXT    NOT NULL,
-    picture TEXT
+    picture TEXT,
     uuid    UUID
 );
 
@@ -0,0 +1,25 @@
+BEGIN;
+
+-- Refresh tokens are rotated on every use.  Each token belongs to the family of the sign in that
+-- started the chain so that a rotated token being used again revokes every token in the family.
+CREATE TABLE refresh_tokens (
+    id         UUID        PRIMARY KEY,
+    family     UUID        NOT NULL,
+    user_id    UUID        NOT NULL,
+    token_hash BYTEA       NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    rotated_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX ON refresh_tokens (family);
+CREATE INDEX ON refresh_tokens (user_id);
+
+-- Access tokens revoked before they expire, keyed by their jti claim
+CREATE TABLE revoked_tokens (
+    jti        UUID        PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+COMMIT;
@@ -0,0 +1,12 @@
+BEGIN;
+
+DELETE FROM users WHERE gid IS NULL;
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_local_password;
+ALTER TABLE users DROP COLUMN IF EXISTS password_hash;
+ALTER TABLE users DROP COLUMN IF EXISTS username;
+
+ALTER TABLE users ALTER COLUMN email SET NOT NULL;
+ALTER TABLE users ALTER COLUMN gid SET NOT NULL;
+
+COMMIT;
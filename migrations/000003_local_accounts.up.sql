@@ -0,0 +1,13 @@
+BEGIN;
+
+-- Local accounts sign in with a username and a bcrypt hashed password instead of google so they
+-- have no google id and may have no email.
+ALTER TABLE users ALTER COLUMN gid DROP NOT NULL;
+ALTER TABLE users ALTER COLUMN email DROP NOT NULL;
+
+ALTER TABLE users ADD COLUMN username TEXT UNIQUE;
+ALTER TABLE users ADD COLUMN password_hash TEXT;
+
+ALTER TABLE users ADD CONSTRAINT users_local_password CHECK (username IS NULL OR password_hash IS NOT NULL);
+
+COMMIT;
@@ -0,0 +1,19 @@
+BEGIN;
+
+-- Full-text index of the messages stored in cassandra.  The api services keep it in step as
+-- messages are sent, edited and deleted, searches are limited to channels by the caller.
+CREATE TABLE message_search (
+    channel    TEXT        NOT NULL,
+    message    UUID        NOT NULL,
+    parent     TEXT        NOT NULL DEFAULT '',
+    author     TEXT        NOT NULL,
+    body       TEXT        NOT NULL,
+    document   TSVECTOR    NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (channel, message)
+);
+
+CREATE INDEX ON message_search USING GIN (document);
+CREATE INDEX ON message_search (channel, created_at);
+
+COMMIT;
@@ -0,0 +1,19 @@
+// frames of the socket protocol (api/protocol)
+const VERSION = 1;
+
+let lastID = 0;
+
+// envelope wraps the payload in a frame for the channel.  The id lets the acks and errors the
+// server answers with be matched to the frame.
+function envelope(type, channel, payload) {
+    lastID++;
+    return {
+        v: VERSION,
+        type: type,
+        channel: channel,
+        id: `web-${lastID}`,
+        payload: payload
+    };
+}
+
+export { VERSION, envelope };
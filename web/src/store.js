@@ -9,6 +9,38 @@ const systemMessages = {
     system: true
 };
 
+// frames of the socket protocol (api/protocol) that carry a message as their payload
+const messageFrames = {
+    initialize: true,
+    system: true,
+    message: true
+};
+
+// addMessage appends the message to the list grouping it with the last message if they're both
+// system messages or have the same author
+function addMessage(state, message) {
+    if (state.messages.length === 0) {
+        state.messages.push(message);
+        return;
+    }
+
+    let lastMessage = state.messages[state.messages.length - 1];
+
+    // if both the current message and the previous message are system related messages
+    // then group them together
+    if (systemMessages[message.type] && systemMessages[lastMessage.type]) {
+        lastMessage.text.push(message.text);
+        return;
+    }
+
+    if (lastMessage.author.id === message.author.id) {
+        lastMessage.text.push(message.text);
+        return;
+    }
+
+    state.messages.push(message);
+}
+
 export default new Vuex.Store({
     strict: true,
     state: {
@@ -21,6 +53,8 @@ export default new Vuex.Store({
             onclose: null
         },
         messages: [],
+        // send frames waiting to be acked keyed by their id
+        pending: {},
         author: {
             uuid: "",
             name: "",
@@ -44,39 +78,45 @@ export default new Vuex.Store({
         SOCKET_ONOPEN: function(state) {
             state.socket.open = true;
         },
-        SOCKET_ONMESSAGE: function(state, message) {
-            // initialize messages give us the client information (id and name); however, we
-            // don't want the id to persist in this case because if the second message is from
-            // the author it will then be grouped with the system message with the last if
-            // statement in this block
-            if (message.type === "initialize") {
-                state.author = Object.assign({}, message.author);
-                message.author.id = "";
+        SOCKET_SENT: function(state, frame) {
+            state.pending = Object.assign({}, state.pending, {
+                [frame.id]: frame
+            });
+        },
+        SOCKET_ONMESSAGE: function(state, frame) {
+            if (frame.type === "ack" || frame.type === "error") {
+                let pending = Object.assign({}, state.pending);
+                delete pending[frame.id];
+                state.pending = pending;
             }
 
-            if (state.messages.length === 0) {
-                state.messages.push(message);
+            // errors are shown like system messages so it's clear what wasn't sent
+            if (frame.type === "error") {
+                state.socket.error = frame.payload;
+                addMessage(state, {
+                    type: "system",
+                    author: { id: "", name: "", avatar: "" },
+                    text: [frame.payload.message],
+                    time: frame.time
+                });
                 return;
             }
 
-            let lastMessage = state.messages[state.messages.length - 1];
-
-            // if both the current message and the previous message are system related messages
-            // then group them together
-            if (
-                systemMessages[message.type] &&
-                systemMessages[lastMessage.type]
-            ) {
-                lastMessage.text.push(message.text);
+            if (!messageFrames[frame.type]) {
                 return;
             }
+            let message = Object.assign({ type: frame.type }, frame.payload);
 
-            if (lastMessage.author.id === message.author.id) {
-                lastMessage.text.push(message.text);
-                return;
+            // initialize messages give us the client information (id and name); however, we
+            // don't want the id to persist in this case because if the second message is from
+            // the author it will then be grouped with the system message with the last if
+            // statement in this block
+            if (message.type === "initialize") {
+                state.author = Object.assign({}, message.author);
+                message.author.id = "";
             }
 
-            state.messages.push(message);
+            addMessage(state, message);
         },
         SOCKET_ONERROR: function(state, error) {
             state.socket.onerror = error;